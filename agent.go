@@ -74,3 +74,9 @@ const (
 	EffortHigh   Effort = "high"
 	EffortMax    Effort = "max"
 )
+
+// Input formats accepted by the Claude Code CLI.
+const (
+	InputFormatStreamJSON = "stream-json"
+	InputFormatText       = "text"
+)
@@ -0,0 +1,62 @@
+package claude
+
+import "strings"
+
+// AttributeToAgent groups msgs by the agent that produced them, keeping their
+// order. The main agent's messages are under "". A subagent's messages are
+// under its chain of parent tool-use IDs, outermost first and joined by "/":
+// "toolu_A" for a subagent started by tool call toolu_A, and "toolu_A/toolu_B"
+// for one started by tool call toolu_B inside that subagent.
+//
+// Chains are resolved from the tool_use blocks in msgs, so a subagent whose
+// spawning tool call is not among msgs is keyed by its own parent ID alone.
+func AttributeToAgent(msgs []Message) map[string][]Message {
+	// spawnedBy maps a tool_use ID to the parent ID of the message that made
+	// the call, "" for the main agent.
+	spawnedBy := make(map[string]string)
+	for _, msg := range msgs {
+		if am, ok := msg.(*AssistantMessage); ok {
+			for _, block := range am.Content {
+				if tu, ok := block.(*ToolUseBlock); ok && tu.ID != "" {
+					spawnedBy[tu.ID] = am.ParentToolUseID
+				}
+			}
+		}
+	}
+
+	groups := make(map[string][]Message)
+	for _, msg := range msgs {
+		key := agentChain(parentToolUseID(msg), spawnedBy)
+		groups[key] = append(groups[key], msg)
+	}
+	return groups
+}
+
+// agentChain returns the "/"-joined chain of parent tool-use IDs ending at
+// parent.
+func agentChain(parent string, spawnedBy map[string]string) string {
+	var chain []string
+	seen := make(map[string]bool)
+	for id := parent; id != "" && !seen[id]; id = spawnedBy[id] {
+		seen[id] = true
+		chain = append(chain, id)
+	}
+	for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+		chain[i], chain[j] = chain[j], chain[i]
+	}
+	return strings.Join(chain, "/")
+}
+
+// parentToolUseID returns the parent tool-use ID of msg, "" for messages of
+// the main agent and types that carry none.
+func parentToolUseID(msg Message) string {
+	switch m := msg.(type) {
+	case *UserMessage:
+		return m.ParentToolUseID
+	case *AssistantMessage:
+		return m.ParentToolUseID
+	case *StreamEvent:
+		return m.ParentToolUseID
+	}
+	return ""
+}
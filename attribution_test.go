@@ -0,0 +1,64 @@
+package claude
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAttributeToAgent(t *testing.T) {
+	taskCall := func(parent, id string) *AssistantMessage {
+		return &AssistantMessage{
+			ParentToolUseID: parent,
+			Content:         []ContentBlock{&ToolUseBlock{ID: id, Name: "Task"}},
+		}
+	}
+	text := func(parent, s string) *AssistantMessage {
+		return &AssistantMessage{ParentToolUseID: parent, Content: []ContentBlock{&TextBlock{Text: s}}}
+	}
+
+	mainCall := taskCall("", "toolu_A")
+	subText := text("toolu_A", "researching")
+	nestedCall := taskCall("toolu_A", "toolu_B")
+	nestedText := text("toolu_B", "deep dive")
+	nestedResult := &UserMessage{ParentToolUseID: "toolu_B", Content: "tool output"}
+	siblingText := text("toolu_C", "sibling")
+	orphanText := text("toolu_X", "spawner not seen")
+	result := &ResultMessage{Subtype: ResultSubtypeSuccess}
+
+	msgs := []Message{mainCall, subText, nestedCall, nestedText, nestedResult, taskCall("", "toolu_C"), siblingText, orphanText, result}
+	got := AttributeToAgent(msgs)
+
+	want := map[string][]Message{
+		"":                {mainCall, msgs[5], result},
+		"toolu_A":         {subText, nestedCall},
+		"toolu_A/toolu_B": {nestedText, nestedResult},
+		"toolu_C":         {siblingText},
+		"toolu_X":         {orphanText},
+	}
+	if !reflect.DeepEqual(got, want) {
+		for key := range want {
+			if !reflect.DeepEqual(got[key], want[key]) {
+				t.Errorf("group %q = %v, want %v", key, got[key], want[key])
+			}
+		}
+		t.Errorf("groups %v, want keys of %v", keysOf(got), keysOf(want))
+	}
+}
+
+func TestAttributeToAgentCycle(t *testing.T) {
+	// Malformed input where two calls claim each other as parent must not loop.
+	a := &AssistantMessage{ParentToolUseID: "toolu_B", Content: []ContentBlock{&ToolUseBlock{ID: "toolu_A"}}}
+	b := &AssistantMessage{ParentToolUseID: "toolu_A", Content: []ContentBlock{&ToolUseBlock{ID: "toolu_B"}}}
+	got := AttributeToAgent([]Message{a, b})
+	if len(got) != 2 {
+		t.Errorf("expected two groups, got %v", keysOf(got))
+	}
+}
+
+func keysOf(groups map[string][]Message) []string {
+	keys := make([]string, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	return keys
+}
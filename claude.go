@@ -25,14 +25,15 @@ package claude
 import (
 	"context"
 	"encoding/json"
-	"fmt"
 	"os"
 )
 
 // Version is the SDK version.
 const Version = "0.1.0"
 
-// MinimumClaudeCodeVersion is the minimum required Claude Code version.
+// MinimumClaudeCodeVersion is the minimum required Claude Code version. When
+// the CLI reports an older one during initialize, Connect and Query fail
+// unless WithSkipVersionCheck is set.
 const MinimumClaudeCodeVersion = "2.0.0"
 
 // Query performs a one-shot query to Claude Code and returns channels for
@@ -41,12 +42,22 @@ const MinimumClaudeCodeVersion = "2.0.0"
 // The messages channel yields Message values as they arrive. The error channel
 // yields at most one error after all messages have been sent. Always drain the
 // messages channel before reading the error channel.
+//
+// With WithCanUseTool, hooks or SDK MCP servers, stdin stays open until the
+// first result so the callbacks can be answered; the call is otherwise the
+// same one-shot exchange.
 func Query(ctx context.Context, prompt string, opts ...Option) (<-chan Message, <-chan error) {
 	return runQuery(ctx, &prompt, nil, opts...)
 }
 
 // QueryStream performs a query with streaming input messages.
 // This matches Python SDK's AsyncIterable prompt mode.
+//
+// An input message may carry the InputOverrideModel ("_model") and
+// InputOverridePermissionMode ("_permission_mode") keys; they are stripped and
+// sent as set_model/set_permission_mode control requests before the message.
+// A message with an invalid override, or with InputOverrideCwd, is not sent:
+// the stream ends and the error is delivered on the error channel.
 func QueryStream(ctx context.Context, input <-chan map[string]any, opts ...Option) (<-chan Message, <-chan error) {
 	return runQuery(ctx, nil, input, opts...)
 }
@@ -62,32 +73,42 @@ func runQuery(ctx context.Context, prompt *string, input <-chan map[string]any,
 		options := applyOptions(opts)
 		os.Setenv("CLAUDE_CODE_ENTRYPOINT", "sdk-go")
 
-		// Configure permission settings
-		if options.CanUseTool != nil {
-			if prompt != nil {
-				errChan <- &SDKError{Message: "can_use_tool callback requires streaming input; use QueryStream instead of Query"}
-				return
-			}
-			if options.PermissionPromptToolName != "" {
-				errChan <- &SDKError{Message: "can_use_tool callback cannot be used with permission_prompt_tool_name"}
+		if err := validateInputFormat(options); err != nil {
+			errChan <- err
+			return
+		}
+		if err := validateAddDirs(options); err != nil {
+			errChan <- err
+			return
+		}
+		if err := validateResumeSession(options); err != nil {
+			errChan <- err
+			return
+		}
+		textInput := options.InputFormat == InputFormatText
+		if textInput && prompt == nil {
+			errChan <- &SDKError{Message: "text input format requires a string prompt; use Query instead of QueryStream"}
+			return
+		}
+		if prompt != nil {
+			if err := checkInputTokens(options, *prompt); err != nil {
+				errChan <- err
 				return
 			}
-			options.PermissionPromptToolName = "stdio"
 		}
 
-		t := newSubprocessTransport(options)
-		if err := t.Connect(ctx); err != nil {
+		// Configure permission settings
+		if options.CanUseTool != nil && textInput {
+			errChan <- &SDKError{Message: "can_use_tool callback requires the stream-json input format"}
+			return
+		}
+		if err := configurePermissionPromptTool(options); err != nil {
 			errChan <- err
 			return
 		}
+		expandSDKToolAllowlist(options)
 
-		// Extract SDK MCP servers
-		sdkMcpServers := make(map[string]*McpServer)
-		for name, config := range options.McpServers {
-			if sdkCfg, ok := config.(*McpSdkServerConfig); ok {
-				sdkMcpServers[name] = sdkCfg.Instance
-			}
-		}
+		sdkMcpServers := sdkMcpServerInstances(options.McpServers)
 
 		// Convert agents
 		var agentsMap map[string]map[string]any
@@ -108,39 +129,61 @@ func runQuery(ctx context.Context, prompt *string, input <-chan map[string]any,
 			}
 		}
 
-		q := newQueryHandler(t, queryOptions{
-			CanUseTool:        options.CanUseTool,
-			Hooks:             convertHooks(options.Hooks),
-			SdkMcpServers:     sdkMcpServers,
-			InitializeTimeout: 60,
-			Agents:            agentsMap,
-		})
-		started := false
-		defer func() {
-			if started {
-				q.close()
+		var t Transport
+		var q *queryHandler
+		err := retryConnect(ctx, options, nil, func() error {
+			var err error
+			t, err = connectTransport(ctx, options, true)
+			if err != nil {
+				return err
 			}
-		}()
-
-		if err := q.start(ctx); err != nil {
-			errChan <- err
-			return
-		}
-		started = true
-
-		if _, err := q.initialize(ctx); err != nil {
+			q = newQueryHandler(t, queryOptions{
+				CanUseTool:        options.CanUseTool,
+				Hooks:             convertHooks(options.Hooks),
+				SdkMcpServers:     sdkMcpServers,
+				InitializeTimeout: resolveInitializeTimeout(options),
+				Agents:            agentsMap,
+				RequireVersion:    options.RequireCLIVersion,
+				SkipVersionCheck:  options.SkipVersionCheck,
+				CallbackTimeout:   options.GlobalTimeout,
+				MaxCallbacks:      options.MaxConcurrentCallbacks,
+				Logger:            options.Logger,
+			})
+			if err := q.start(ctx); err != nil {
+				_ = t.Close()
+				return err
+			}
+			// Plain text input has no control protocol and so no handshake.
+			if !textInput {
+				if _, err := q.initialize(ctx); err != nil {
+					q.close()
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
 			errChan <- err
 			return
 		}
+		defer q.close()
 
-		if prompt != nil {
-			userMsg := map[string]any{
-				"type":               "user",
-				"session_id":         "",
-				"message":            map[string]any{"role": "user", "content": *prompt},
-				"parent_tool_use_id": nil,
+		if textInput {
+			// Send the prompt and close stdin.
+			if err := t.Write(*prompt + "\n"); err != nil {
+				errChan <- err
+				return
 			}
-			data, _ := json.Marshal(userMsg)
+			_ = t.EndInput()
+		} else if prompt != nil && q.needsOpenInput() {
+			// Callbacks answer over stdin, so stream the prompt as a single
+			// message and keep stdin open until the first result.
+			single := make(chan map[string]any, 1)
+			single <- promptMessage(*prompt)
+			close(single)
+			go q.streamInput(ctx, single)
+		} else if prompt != nil {
+			data, _ := json.Marshal(promptMessage(*prompt))
 			if err := t.Write(string(data) + "\n"); err != nil {
 				errChan <- err
 				return
@@ -150,20 +193,34 @@ func runQuery(ctx context.Context, prompt *string, input <-chan map[string]any,
 			go q.streamInput(ctx, input)
 		}
 
+		var dedupe *Deduplicator
+		if options.DedupeOnResume {
+			dedupe = NewDeduplicator()
+		}
+
 		// Read and forward messages
-		hadError := false
+		hadError, sawResult := false, false
 		for rawMsg := range q.receiveMessages() {
-			if msgType, _ := rawMsg["type"].(string); msgType == "error" {
-				errText, _ := rawMsg["error"].(string)
-				if errText == "" {
-					errText = "unknown transport error"
+			msg, err := parseMessage(rawMsg)
+			if err != nil {
+				if q.tolerateParseError(options.MaxParseErrors, err) {
+					continue
 				}
-				errChan <- fmt.Errorf("%s", errText)
+				errChan <- err
 				hadError = true
 				break
 			}
-			msg, err := parseMessage(rawMsg)
-			if err != nil {
+			if options.StrictJSONDecoding {
+				warnUnknownFields(loggerOr(options.Logger), rawMsg)
+			}
+			if dedupe != nil && dedupe.Seen(msg) {
+				continue
+			}
+			if _, ok := msg.(*ResultMessage); ok {
+				sawResult = true
+			}
+			notifyToolUseObserver(options, msg)
+			if err := q.modelPin.check(options, msg); err != nil {
 				errChan <- err
 				hadError = true
 				break
@@ -179,6 +236,8 @@ func runQuery(ctx context.Context, prompt *string, input <-chan map[string]any,
 		if !hadError {
 			if transportErr := q.err(); transportErr != nil {
 				errChan <- transportErr
+			} else if !sawResult {
+				errChan <- newIncompleteResponseError()
 			}
 		}
 	}()
@@ -186,6 +245,16 @@ func runQuery(ctx context.Context, prompt *string, input <-chan map[string]any,
 	return msgChan, errChan
 }
 
+// promptMessage wraps a string prompt in a user input message.
+func promptMessage(prompt string) map[string]any {
+	return map[string]any{
+		"type":               "user",
+		"session_id":         "",
+		"message":            map[string]any{"role": "user", "content": prompt},
+		"parent_tool_use_id": nil,
+	}
+}
+
 // convertHooks converts public hook types to the internal format.
 func convertHooks(hooks map[HookEvent][]HookMatcher) map[string][]hookMatcherConfig {
 	if len(hooks) == 0 {
@@ -3,9 +3,14 @@ package claude
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"os"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // ClaudeClient provides bidirectional, interactive conversations with Claude Code.
@@ -18,48 +23,102 @@ import (
 type ClaudeClient struct {
 	options *AgentOptions
 
-	transport *subprocessTransport
+	transport Transport
 	query     *queryHandler
 
-	mu     sync.Mutex
-	closed bool
+	mu         sync.Mutex
+	closed     bool
+	connecting bool // a Connect is running the handshake with mu released
+
+	abortConnect context.CancelFunc // wakes a Connect sleeping between retries
+
+	transportUsed bool // the WithTransport transport has been handed to a connection
+
+	outputMu         sync.Mutex
+	structuredOutput any
+
+	connectedAt   time.Time   // start of the MaxSessionDuration budget
+	deadlineTimer *time.Timer // interrupts at the session deadline when enabled
+
+	dedupe *Deduplicator // set by WithDedupeOnResume
+	guard  *contentGuard // set by WithContentGuard
+
+	stats sessionStats
+	state clientState
+
+	turns      sessionTurns // in-flight turns, for the busy-session check
+	nextStream atomic.Int64 // identifies QueryStream calls to sessionTurns
 }
 
 // NewClient creates a new ClaudeClient with the given options.
 func NewClient(opts ...Option) *ClaudeClient {
-	return &ClaudeClient{
+	c := &ClaudeClient{
 		options: applyOptions(opts),
 	}
+	if c.options.DedupeOnResume {
+		c.dedupe = NewDeduplicator()
+	}
+	c.guard = newContentGuard(c.options)
+	return c
 }
 
-// Connect establishes the connection to Claude Code.
+// Connect establishes the connection to Claude Code, then runs the
+// WithAfterConnect hook if one is set.
 func (c *ClaudeClient) Connect(ctx context.Context) error {
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	err := c.connectLocked(ctx)
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
 
-	os.Setenv("CLAUDE_CODE_ENTRYPOINT", "sdk-go-client")
+	// The hook runs unlocked so it can call methods on the client.
+	if c.options.AfterConnect != nil {
+		if err := c.options.AfterConnect(ctx, c); err != nil {
+			c.mu.Lock()
+			c.disconnectLocked()
+			c.mu.Unlock()
+			return &SDKError{Message: "after-connect hook failed", Cause: err}
+		}
+	}
+	return nil
+}
 
-	// Configure permission settings
-	configuredOptions := *c.options
-	if configuredOptions.CanUseTool != nil {
-		if configuredOptions.PermissionPromptToolName != "" {
-			return &SDKError{Message: "can_use_tool callback cannot be used with permission_prompt_tool_name"}
+func (c *ClaudeClient) connectLocked(ctx context.Context) error {
+	if c.connecting {
+		return &SDKError{Message: "Connect is already in progress"}
+	}
+	c.connecting = true
+	defer func() { c.connecting = false }()
+
+	if c.options.Transport != nil {
+		if c.transportUsed {
+			return ErrTransportReused
 		}
-		configuredOptions.PermissionPromptToolName = "stdio"
+		c.transportUsed = true
 	}
 
-	c.transport = newSubprocessTransport(&configuredOptions)
-	if err := c.transport.Connect(ctx); err != nil {
+	os.Setenv("CLAUDE_CODE_ENTRYPOINT", "sdk-go-client")
+
+	if c.options.InputFormat != "" && c.options.InputFormat != InputFormatStreamJSON {
+		return &SDKError{Message: "ClaudeClient requires the stream-json input format"}
+	}
+
+	if err := validateAddDirs(c.options); err != nil {
+		return err
+	}
+	if err := validateResumeSession(c.options); err != nil {
 		return err
 	}
 
-	// Extract SDK MCP servers
-	sdkMcpServers := make(map[string]*McpServer)
-	for name, config := range configuredOptions.McpServers {
-		if sdkCfg, ok := config.(*McpSdkServerConfig); ok {
-			sdkMcpServers[name] = sdkCfg.Instance
-		}
+	// Configure permission settings
+	configuredOptions := *c.options
+	if err := configurePermissionPromptTool(&configuredOptions); err != nil {
+		return err
 	}
+	expandSDKToolAllowlist(&configuredOptions)
+
+	sdkMcpServers := sdkMcpServerInstances(configuredOptions.McpServers)
 
 	// Convert agents
 	var agentsMap map[string]map[string]any
@@ -80,33 +139,113 @@ func (c *ClaudeClient) Connect(ctx context.Context) error {
 		}
 	}
 
-	c.query = newQueryHandler(c.transport, queryOptions{
-		CanUseTool:        configuredOptions.CanUseTool,
-		Hooks:             convertHooks(configuredOptions.Hooks),
-		SdkMcpServers:     sdkMcpServers,
-		InitializeTimeout: resolveInitializeTimeout(),
-		Agents:            agentsMap,
-	})
-
-	// The connect context is only for handshake/initialize timeout.
-	// Reader lifecycle is managed by client.Close().
-	if err := c.query.start(context.Background()); err != nil {
-		_ = c.transport.Close()
-		c.transport = nil
-		c.query = nil
+	// The backoff between attempts runs unlocked as well, and Close ends it.
+	waitCtx, abort := context.WithCancel(ctx)
+	c.abortConnect = abort
+	defer func() {
+		abort()
+		c.abortConnect = nil
+	}()
+	wait := func(d time.Duration) error {
+		c.mu.Unlock()
+		err := sleepContext(waitCtx, d)
+		c.mu.Lock()
+		if c.closed {
+			return &CLIConnectionError{SDKError: SDKError{Message: "client was closed during connect"}}
+		}
 		return err
 	}
 
-	if _, err := c.query.initialize(ctx); err != nil {
-		c.query.close()
-		c.query = nil
-		c.transport = nil
+	err := retryConnect(ctx, &configuredOptions, wait, func() error {
+		transport, err := connectTransport(ctx, &configuredOptions, false)
+		if err != nil {
+			return err
+		}
+		c.transport = transport
+		c.emitSessionEvent(SessionEventConnected, "", "")
+
+		q := newQueryHandler(transport, queryOptions{
+			CanUseTool:        c.recordPermissionUpdates(configuredOptions.CanUseTool),
+			Hooks:             convertHooks(configuredOptions.Hooks),
+			SdkMcpServers:     sdkMcpServers,
+			InitializeTimeout: resolveInitializeTimeout(&configuredOptions),
+			Agents:            agentsMap,
+			RequireVersion:    configuredOptions.RequireCLIVersion,
+			SkipVersionCheck:  configuredOptions.SkipVersionCheck,
+			CallbackTimeout:   configuredOptions.GlobalTimeout,
+			MaxCallbacks:      configuredOptions.MaxConcurrentCallbacks,
+			Logger:            configuredOptions.Logger,
+		})
+
+		// The connect context is only for handshake/initialize timeout.
+		// Reader lifecycle is managed by client.Close().
+		if err := q.start(context.Background()); err != nil {
+			_ = transport.Close()
+			c.transport = nil
+			return err
+		}
+		c.query = q
+
+		// The handshake runs unlocked so that WaitReady, ServerInfo and Close
+		// can reach the published handler meanwhile.
+		c.mu.Unlock()
+		_, err = q.initialize(ctx)
+		c.mu.Lock()
+		if c.query != q {
+			q.close()
+			return &CLIConnectionError{SDKError: SDKError{Message: "client was closed during connect"}}
+		}
+		if err != nil {
+			q.close()
+			c.query = nil
+			c.transport = nil
+			return err
+		}
+		return nil
+	})
+	if err != nil {
 		return err
 	}
+	c.emitSessionEvent(SessionEventInitialized, "", "")
+
+	c.connectedAt = time.Now()
+	if c.options.MaxSessionDuration > 0 && c.options.InterruptAtMaxSessionDuration {
+		c.deadlineTimer = time.AfterFunc(c.options.MaxSessionDuration, func() {
+			_ = c.Interrupt(context.Background())
+		})
+	}
 
 	return nil
 }
 
+// disconnectLocked tears down a connection made by connectLocked, leaving the
+// client free to Connect again.
+func (c *ClaudeClient) disconnectLocked() {
+	if c.deadlineTimer != nil {
+		c.deadlineTimer.Stop()
+		c.deadlineTimer = nil
+	}
+	if c.query != nil {
+		c.query.close()
+	}
+	c.query = nil
+	c.transport = nil
+	c.turns.reset()
+}
+
+// WaitReady blocks until the CLI has completed the initialize handshake.
+// Connect already waits for the handshake; WaitReady is useful when another
+// goroutine is connecting the client.
+func (c *ClaudeClient) WaitReady(ctx context.Context) error {
+	c.mu.Lock()
+	query := c.query
+	c.mu.Unlock()
+	if query == nil {
+		return &CLIConnectionError{SDKError: SDKError{Message: "Not connected. Call Connect() first."}}
+	}
+	return query.waitReady(ctx)
+}
+
 // Query sends a new message in the conversation.
 func (c *ClaudeClient) Query(ctx context.Context, prompt string) error {
 	return c.QueryWithSession(ctx, prompt, "default")
@@ -114,40 +253,225 @@ func (c *ClaudeClient) Query(ctx context.Context, prompt string) error {
 
 // QueryWithSession sends a new string prompt with explicit session ID.
 func (c *ClaudeClient) QueryWithSession(ctx context.Context, prompt string, sessionID string) error {
-	c.mu.Lock()
-	if err := c.ensureConnectedLocked(); err != nil {
-		c.mu.Unlock()
+	return c.Send(ctx, InputMessage{Content: prompt, SessionID: sessionID})
+}
+
+// QueryBlocks sends a user message made of content blocks, such as text
+// alongside screenshots. Only *TextBlock and *ImageBlock are accepted.
+func (c *ClaudeClient) QueryBlocks(ctx context.Context, blocks []ContentBlock, sessionID string) error {
+	return c.Send(ctx, InputMessage{Content: blocks, SessionID: sessionID})
+}
+
+// InputMessage is a user message for ClaudeClient.Send.
+type InputMessage struct {
+	// Content is a string or a []ContentBlock of text and image blocks.
+	Content any
+	// SessionID defaults to "default".
+	SessionID string
+	// ParentToolUseID, when set, sends the message within that tool use,
+	// such as a subagent's Task call, rather than as a new turn.
+	ParentToolUseID string
+}
+
+// Send sends a single user message, the typed counterpart of a message on
+// the QueryStream channel.
+func (c *ClaudeClient) Send(ctx context.Context, msg InputMessage) error {
+	sessionID := msg.SessionID
+	if sessionID == "" {
+		sessionID = "default"
+	}
+	var content any
+	switch v := msg.Content.(type) {
+	case string:
+		if err := checkInputTokens(c.options, v); err != nil {
+			return err
+		}
+		content = v
+	case []ContentBlock:
+		blocks, err := userContent(v)
+		if err != nil {
+			return err
+		}
+		var text strings.Builder
+		for _, block := range v {
+			if tb, ok := block.(*TextBlock); ok {
+				text.WriteString(tb.Text)
+			}
+		}
+		if err := checkInputTokens(c.options, text.String()); err != nil {
+			return err
+		}
+		content = blocks
+	default:
+		return &SDKError{Message: fmt.Sprintf("input content must be a string or []ContentBlock, got %T", msg.Content)}
+	}
+
+	message := map[string]any{
+		"type":               "user",
+		"message":            map[string]any{"role": "user", "content": content},
+		"parent_tool_use_id": nil,
+		"session_id":         sessionID,
+	}
+	if msg.ParentToolUseID != "" {
+		message["parent_tool_use_id"] = msg.ParentToolUseID
+	} else if err := c.beginTurn(sessionID, 0); err != nil {
 		return err
 	}
-	transport := c.transport
-	c.mu.Unlock()
+	if err := c.writeMessage(message); err != nil {
+		if msg.ParentToolUseID == "" {
+			c.turns.release(sessionID, 0)
+		}
+		return err
+	}
+	c.emitSessionEvent(SessionEventQuery, sessionID, "")
+	return nil
+}
+
+// userContent converts input blocks to the content array of a user message.
+func userContent(blocks []ContentBlock) ([]map[string]any, error) {
+	if len(blocks) == 0 {
+		return nil, &SDKError{Message: "user message has no content blocks"}
+	}
+	content := make([]map[string]any, 0, len(blocks))
+	for _, block := range blocks {
+		switch b := block.(type) {
+		case *TextBlock:
+			content = append(content, map[string]any{"type": "text", "text": b.Text})
+		case *ImageBlock:
+			if !slices.Contains(SupportedImageMediaTypes, b.MediaType) {
+				return nil, &SDKError{Message: fmt.Sprintf("unsupported image media type %q; use one of %s", b.MediaType, strings.Join(SupportedImageMediaTypes, ", "))}
+			}
+			if b.Data == "" {
+				return nil, &SDKError{Message: "image block has no data"}
+			}
+			content = append(content, map[string]any{
+				"type": "image",
+				"source": map[string]any{
+					"type":       "base64",
+					"media_type": b.MediaType,
+					"data":       b.Data,
+				},
+			})
+		case nil:
+			return nil, &SDKError{Message: "user message has a nil content block"}
+		default:
+			return nil, &SDKError{Message: fmt.Sprintf("%s blocks cannot be sent as user input", block.contentBlockType())}
+		}
+	}
+	return content, nil
+}
+
+// SendSystemReminder injects out-of-band guidance into a session.
+//
+// The CLI has no dedicated input type for this, so the text is sent as a
+// meta user message wrapped in <system-reminder> tags, the same shape Claude
+// Code uses for its own reminders. The model reads it as context rather than
+// as something the user said, but it is still delivered on the user turn and
+// starts a new response like any other input.
+func (c *ClaudeClient) SendSystemReminder(ctx context.Context, sessionID string, text string) error {
 	if sessionID == "" {
 		sessionID = "default"
 	}
 
+	message := map[string]any{
+		"type": "user",
+		"message": map[string]any{
+			"role": "user",
+			"content": []map[string]any{
+				{"type": "text", "text": "<system-reminder>\n" + text + "\n</system-reminder>"},
+			},
+		},
+		"isMeta":             true,
+		"parent_tool_use_id": nil,
+		"session_id":         sessionID,
+	}
+	if err := c.beginTurn(sessionID, 0); err != nil {
+		return err
+	}
+	if err := c.writeMessage(message); err != nil {
+		c.turns.release(sessionID, 0)
+		return err
+	}
+	return nil
+}
+
+// SendToolResult answers a tool_use the model made for a tool implemented by
+// the caller rather than by an MCP server. content is a string, a
+// []ContentBlock of text and image blocks, or any other value the API takes as
+// tool_result content; isError marks the call as failed.
+func (c *ClaudeClient) SendToolResult(ctx context.Context, toolUseID string, content any, isError bool, sessionID string) error {
+	if toolUseID == "" {
+		return &SDKError{Message: "tool result has no tool_use ID"}
+	}
+	if sessionID == "" {
+		sessionID = "default"
+	}
+	if blocks, ok := content.([]ContentBlock); ok {
+		converted, err := userContent(blocks)
+		if err != nil {
+			return err
+		}
+		content = converted
+	}
+
+	result := map[string]any{
+		"type":        "tool_result",
+		"tool_use_id": toolUseID,
+		"content":     content,
+	}
+	if isError {
+		result["is_error"] = true
+	}
 	message := map[string]any{
 		"type":               "user",
-		"message":            map[string]any{"role": "user", "content": prompt},
+		"message":            map[string]any{"role": "user", "content": []map[string]any{result}},
 		"parent_tool_use_id": nil,
 		"session_id":         sessionID,
 	}
+	return c.writeMessage(message)
+}
+
+// writeMessage marshals a single input message and writes it to the CLI.
+func (c *ClaudeClient) writeMessage(message map[string]any) error {
+	c.mu.Lock()
+	if err := c.ensureConnectedLocked(); err != nil {
+		c.mu.Unlock()
+		return err
+	}
+	if err := c.checkSessionDurationLocked(); err != nil {
+		c.mu.Unlock()
+		return err
+	}
+	transport := c.transport
+	c.mu.Unlock()
+
 	data, _ := json.Marshal(message)
 	return transport.Write(string(data) + "\n")
 }
 
 // QueryStream sends streaming messages with optional default session ID.
-// Existing session_id on each message is preserved.
+// Existing session_id on each message is preserved. The InputOverrideModel and
+// InputOverridePermissionMode keys are applied before the message is sent.
+//
+// A user message for a session that has a turn in flight from another sender
+// is reported as described in WithStrictSessions.
 func (c *ClaudeClient) QueryStream(ctx context.Context, messages <-chan map[string]any, defaultSessionID string) error {
 	c.mu.Lock()
 	if err := c.ensureConnectedLocked(); err != nil {
 		c.mu.Unlock()
 		return err
 	}
+	if err := c.checkSessionDurationLocked(); err != nil {
+		c.mu.Unlock()
+		return err
+	}
 	transport := c.transport
+	query := c.query
 	c.mu.Unlock()
 	if defaultSessionID == "" {
 		defaultSessionID = "default"
 	}
+	stream := c.nextStream.Add(1)
 
 	for {
 		select {
@@ -160,13 +484,26 @@ func (c *ClaudeClient) QueryStream(ctx context.Context, messages <-chan map[stri
 			if msg == nil {
 				continue
 			}
+			if err := query.applyInputOverrides(ctx, msg); err != nil {
+				return err
+			}
 			if _, exists := msg["session_id"]; !exists {
 				msg["session_id"] = defaultSessionID
 			}
+			sessionID, _ := msg["session_id"].(string)
+			if msg["type"] == "user" {
+				if err := c.beginTurn(sessionID, stream); err != nil {
+					return err
+				}
+			}
 			data, _ := json.Marshal(msg)
 			if err := transport.Write(string(data) + "\n"); err != nil {
+				if msg["type"] == "user" {
+					c.turns.release(sessionID, stream)
+				}
 				return err
 			}
+			c.emitSessionEvent(SessionEventQuery, sessionID, "")
 		}
 	}
 }
@@ -178,30 +515,30 @@ func (c *ClaudeClient) ReceiveMessages(ctx context.Context) <-chan Message {
 }
 
 // ReceiveMessagesWithErrors returns messages and a terminal error channel.
+// A transport or stream failure is sent on the error channel and ends the
+// stream; it never appears among the messages.
 func (c *ClaudeClient) ReceiveMessagesWithErrors(ctx context.Context) (<-chan Message, <-chan error) {
+	c.mu.Lock()
+	query := c.query
+	c.mu.Unlock()
 	msgChan := make(chan Message, 100)
 	errChan := make(chan error, 1)
 	go func() {
 		defer close(msgChan)
 		defer close(errChan)
-		if c.query == nil {
+		if query == nil {
 			errChan <- &CLIConnectionError{SDKError: SDKError{Message: "Not connected. Call Connect() first."}}
 			return
 		}
-		for rawMsg := range c.query.receiveMessages() {
-			if rawType, _ := rawMsg["type"].(string); rawType == "error" {
-				errText, _ := rawMsg["error"].(string)
-				if errText == "" {
-					errText = "unknown stream error"
-				}
-				errChan <- &SDKError{Message: errText}
-				return
-			}
-			msg, err := parseMessage(rawMsg)
+		for rawMsg := range query.receiveMessages() {
+			msg, err := c.decodeMessage(query, rawMsg)
 			if err != nil {
 				errChan <- err
 				return
 			}
+			if msg == nil {
+				continue
+			}
 			select {
 			case msgChan <- msg:
 			case <-ctx.Done():
@@ -209,7 +546,7 @@ func (c *ClaudeClient) ReceiveMessagesWithErrors(ctx context.Context) (<-chan Me
 				return
 			}
 		}
-		if err := c.query.err(); err != nil {
+		if err := query.err(); err != nil {
 			errChan <- err
 		}
 	}()
@@ -224,48 +561,182 @@ func (c *ClaudeClient) ReceiveResponse(ctx context.Context) <-chan Message {
 }
 
 // ReceiveResponseWithErrors receives until ResultMessage and returns terminal error channel.
+// If the stream ends before a ResultMessage, an *IncompleteResponseError is sent.
 func (c *ClaudeClient) ReceiveResponseWithErrors(ctx context.Context) (<-chan Message, <-chan error) {
+	return c.ReceiveUntil(ctx, nil)
+}
+
+// ReceiveResponseTimeout is ReceiveResponseWithErrors bounded to timeout: if
+// no ResultMessage arrives in time, the messages received so far are still
+// delivered and a *ResponseTimeoutError is sent. Only the receive stops; call
+// Interrupt to stop the turn itself.
+func (c *ClaudeClient) ReceiveResponseTimeout(ctx context.Context, timeout time.Duration) (<-chan Message, <-chan error) {
+	return c.receiveUntil(ctx, nil, timeout)
+}
+
+// ReceiveUntil receives messages until stop returns true or a ResultMessage
+// arrives. The message that ends the receive IS included in the yielded messages.
+func (c *ClaudeClient) ReceiveUntil(ctx context.Context, stop func(Message) bool) (<-chan Message, <-chan error) {
+	return c.receiveUntil(ctx, stop, 0)
+}
+
+// receiveUntil implements ReceiveUntil, giving up after timeout when it is
+// positive.
+func (c *ClaudeClient) receiveUntil(ctx context.Context, stop func(Message) bool, timeout time.Duration) (<-chan Message, <-chan error) {
+	c.mu.Lock()
+	query := c.query
+	c.mu.Unlock()
 	msgChan := make(chan Message, 100)
 	errChan := make(chan error, 1)
 	go func() {
 		defer close(msgChan)
 		defer close(errChan)
-		if c.query == nil {
+		if query == nil {
 			errChan <- &CLIConnectionError{SDKError: SDKError{Message: "Not connected. Call Connect() first."}}
 			return
 		}
-		for rawMsg := range c.query.receiveMessages() {
-			if rawType, _ := rawMsg["type"].(string); rawType == "error" {
-				errText, _ := rawMsg["error"].(string)
-				if errText == "" {
-					errText = "unknown stream error"
-				}
-				errChan <- &SDKError{Message: errText}
+		var deadline <-chan time.Time
+		if timeout > 0 {
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			deadline = timer.C
+		}
+		timedOut := func() error {
+			return &ResponseTimeoutError{
+				SDKError: SDKError{Message: fmt.Sprintf("no result message within %s", timeout)},
+				Timeout:  timeout,
+			}
+		}
+		for {
+			var rawMsg map[string]any
+			var ok bool
+			select {
+			case rawMsg, ok = <-query.receiveMessages():
+			case <-ctx.Done():
+				errChan <- ctx.Err()
 				return
+			case <-deadline:
+				errChan <- timedOut()
+				return
+			}
+			if !ok {
+				break
 			}
-			msg, err := parseMessage(rawMsg)
+			msg, err := c.decodeMessage(query, rawMsg)
 			if err != nil {
 				errChan <- err
 				return
 			}
+			if msg == nil {
+				continue
+			}
 			select {
 			case msgChan <- msg:
 			case <-ctx.Done():
 				errChan <- ctx.Err()
 				return
+			case <-deadline:
+				errChan <- timedOut()
+				return
 			}
 			if _, ok := msg.(*ResultMessage); ok {
 				return
 			}
+			if stop != nil && stop(msg) {
+				return
+			}
 		}
-		if err := c.query.err(); err != nil {
+		if err := query.err(); err != nil {
 			errChan <- err
+			return
 		}
+		errChan <- newIncompleteResponseError()
 	}()
 	return msgChan, errChan
 }
 
+// FinalStructuredOutput returns the structured output merged from every
+// ResultMessage received so far, as a copy the caller may keep or modify. It
+// requires WithResultAccumulator and returns nil otherwise.
+//
+// Fragments are merged in arrival order: maps are merged key by key
+// (recursively), arrays are appended, and any other value replaces the
+// previous one.
+func (c *ClaudeClient) FinalStructuredOutput() any {
+	c.outputMu.Lock()
+	defer c.outputMu.Unlock()
+	return copyStructuredOutput(c.structuredOutput)
+}
+
+// decodeMessage parses a raw message from query and updates
+// client-side state. It returns a nil Message for a skipped parse error or
+// duplicate, and an error that ends the receive.
+func (c *ClaudeClient) decodeMessage(query *queryHandler, rawMsg map[string]any) (Message, error) {
+	msg, err := parseMessage(rawMsg)
+	if err != nil {
+		if query.tolerateParseError(c.options.MaxParseErrors, err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if c.options.StrictJSONDecoding {
+		warnUnknownFields(loggerOr(c.options.Logger), rawMsg)
+	}
+	if c.dedupe != nil && c.dedupe.Seen(msg) {
+		return nil, nil
+	}
+	if err := c.observeMessage(query, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// observeMessage updates client-side state from a message received through
+// query, which may be nil. A non-nil error ends the receive.
+func (c *ClaudeClient) observeMessage(query *queryHandler, msg Message) error {
+	notifyToolUseObserver(c.options, msg)
+	c.state.observe(msg)
+	if query != nil {
+		if err := query.modelPin.check(c.options, msg); err != nil {
+			return err
+		}
+	}
+	if err := c.guardContent(msg); err != nil {
+		return err
+	}
+	if rm, ok := msg.(*ResultMessage); ok {
+		c.turns.finish(rm.SessionID)
+		c.stats.add(rm)
+		c.emitSessionEvent(SessionEventResult, rm.SessionID, rm.Subtype)
+	}
+	if rm, ok := msg.(*ResultMessage); ok && c.options.ResultAccumulator && rm.StructuredOutput != nil {
+		c.outputMu.Lock()
+		c.structuredOutput = mergeStructuredOutput(c.structuredOutput, rm.StructuredOutput)
+		c.outputMu.Unlock()
+	}
+	return nil
+}
+
+// notifyToolUseObserver passes each tool_use block in msg to the configured
+// ToolUseObserver.
+func notifyToolUseObserver(o *AgentOptions, msg Message) {
+	am, ok := msg.(*AssistantMessage)
+	if !ok || o.ToolUseObserver == nil {
+		return
+	}
+	for _, block := range am.Content {
+		if tu, ok := block.(*ToolUseBlock); ok {
+			o.ToolUseObserver(tu, am.SessionID)
+		}
+	}
+}
+
 // Interrupt sends an interrupt signal.
+//
+// The CLI stops the current turn, emits its ResultMessage and keeps the session
+// open; the client stays connected. The interrupted turn's remaining messages,
+// including that ResultMessage, are still delivered to the receiver. Use
+// InterruptAndContinue to discard them, or Stop to end the session.
 func (c *ClaudeClient) Interrupt(ctx context.Context) error {
 	c.mu.Lock()
 	if err := c.ensureConnectedLocked(); err != nil {
@@ -274,7 +745,98 @@ func (c *ClaudeClient) Interrupt(ctx context.Context) error {
 	}
 	query := c.query
 	c.mu.Unlock()
-	return query.interrupt(ctx)
+	if err := query.interrupt(ctx); err != nil {
+		return err
+	}
+	c.emitSessionEvent(SessionEventInterrupt, "", "")
+	return nil
+}
+
+// InterruptAndContinue interrupts the current turn and discards its remaining
+// messages up to and including its ResultMessage, leaving the client connected
+// and ready for the next Query. When no turn is in flight it returns once the
+// interrupt is sent. It must not run while another goroutine is receiving
+// messages, as both would compete for the same stream.
+func (c *ClaudeClient) InterruptAndContinue(ctx context.Context) error {
+	if err := c.Interrupt(ctx); err != nil {
+		return err
+	}
+	if c.turns.pendingCount() == 0 {
+		return nil
+	}
+	msgChan, errChan := c.ReceiveResponseWithErrors(ctx)
+	for range msgChan {
+	}
+	return <-errChan
+}
+
+// Stop interrupts the current turn and closes the client, ending the session.
+// The interrupt is best effort; the client is closed even if it fails.
+func (c *ClaudeClient) Stop(ctx context.Context) error {
+	_ = c.Interrupt(ctx)
+	return c.Close()
+}
+
+// ChannelMetrics reports how full the client's internal queues are, for tuning
+// buffer sizes and spotting slow consumers. High-water marks cover the whole
+// connection.
+type ChannelMetrics struct {
+	MessageQueueDepth         int // messages buffered for the receiver
+	MessageQueueHighWater     int
+	MessageQueueCapacity      int
+	PendingControlRequests    int // control requests awaiting a response
+	PendingControlRequestsMax int
+}
+
+// ServerInfo describes the Claude Code CLI as reported by the initialize
+// handshake.
+type ServerInfo struct {
+	Version      string         // "" when the CLI did not report it
+	Capabilities map[string]any // nil when the CLI did not report them
+	Data         map[string]any // the raw initialize response
+}
+
+// ServerInfo returns the CLI's initialize response, waiting for the handshake
+// if another goroutine is still connecting the client.
+func (c *ClaudeClient) ServerInfo(ctx context.Context) (*ServerInfo, error) {
+	c.mu.Lock()
+	query := c.query
+	c.mu.Unlock()
+	if query == nil {
+		return nil, &CLIConnectionError{SDKError: SDKError{Message: "Not connected. Call Connect() first."}}
+	}
+	if err := query.waitReady(ctx); err != nil {
+		return nil, err
+	}
+	info := &ServerInfo{Data: query.initResult}
+	info.Version, _ = query.initResult["version"].(string)
+	info.Capabilities, _ = query.initResult["capabilities"].(map[string]any)
+	return info, nil
+}
+
+// CLIVersion returns the Claude Code version reported during initialize. It
+// returns "" when the client is not connected or the CLI did not report its
+// version; use WithRequireCLIVersion to fail Connect in that case.
+func (c *ClaudeClient) CLIVersion() string {
+	c.mu.Lock()
+	query := c.query
+	c.mu.Unlock()
+	if query == nil {
+		return ""
+	}
+	return query.cliVersion()
+}
+
+// Metrics returns a snapshot of the client's queue depths. It returns the
+// zero value when the client is not connected.
+func (c *ClaudeClient) Metrics() ChannelMetrics {
+	c.mu.Lock()
+	query := c.query
+	c.mu.Unlock()
+	if query == nil {
+		return ChannelMetrics{}
+	}
+	return query.metrics()
 }
 
 // SetPermissionMode changes the permission mode during conversation.
@@ -286,7 +848,12 @@ func (c *ClaudeClient) SetPermissionMode(ctx context.Context, mode PermissionMod
 	}
 	query := c.query
 	c.mu.Unlock()
-	return query.setPermissionMode(ctx, string(mode))
+	if err := query.setPermissionMode(ctx, string(mode)); err != nil {
+		return err
+	}
+	c.state.update(func(s *ClientState) { s.PermissionMode = mode })
+	c.emitSessionEvent(SessionEventPermissionModeChange, "", string(mode))
+	return nil
 }
 
 // SetModel changes the AI model during conversation.
@@ -303,10 +870,17 @@ func (c *ClaudeClient) SetModelOptional(ctx context.Context, model *string) erro
 	}
 	query := c.query
 	c.mu.Unlock()
-	if model == nil {
-		return query.setModelOptional(ctx, nil)
+	var value any
+	detail := ""
+	if model != nil {
+		value, detail = *model, *model
+	}
+	if err := query.setModelOptional(ctx, value); err != nil {
+		return err
 	}
-	return query.setModelOptional(ctx, *model)
+	c.state.update(func(s *ClientState) { s.Model = detail })
+	c.emitSessionEvent(SessionEventModelChange, "", detail)
+	return nil
 }
 
 // RewindFiles rewinds tracked files to a specific user message state.
@@ -321,8 +895,8 @@ func (c *ClaudeClient) RewindFiles(ctx context.Context, userMessageID string) er
 	return query.rewindFiles(ctx, userMessageID)
 }
 
-// GetMCPStatus gets current MCP server connection status.
-func (c *ClaudeClient) GetMCPStatus(ctx context.Context) (map[string]any, error) {
+// GetMCPStatus gets the connection status of each MCP server.
+func (c *ClaudeClient) GetMCPStatus(ctx context.Context) (*MCPStatus, error) {
 	c.mu.Lock()
 	if err := c.ensureConnectedLocked(); err != nil {
 		c.mu.Unlock()
@@ -342,7 +916,14 @@ func (c *ClaudeClient) Close() error {
 		return nil
 	}
 	c.closed = true
+	if c.abortConnect != nil {
+		c.abortConnect()
+	}
+	if c.deadlineTimer != nil {
+		c.deadlineTimer.Stop()
+	}
 
+	connected := c.query != nil || c.transport != nil
 	if c.query != nil {
 		c.query.close()
 		c.query = nil
@@ -350,9 +931,35 @@ func (c *ClaudeClient) Close() error {
 		_ = c.transport.Close()
 	}
 	c.transport = nil
+	if connected {
+		c.emitSessionEvent(SessionEventClosed, "", "")
+	}
 	return nil
 }
 
+// checkSessionDurationLocked rejects new input once MaxSessionDuration has
+// elapsed since Connect.
+func (c *ClaudeClient) checkSessionDurationLocked() error {
+	limit := c.options.MaxSessionDuration
+	if limit <= 0 || c.connectedAt.IsZero() {
+		return nil
+	}
+	if elapsed := time.Since(c.connectedAt); elapsed > limit {
+		return &SessionDurationExceededError{
+			SDKError: SDKError{Message: fmt.Sprintf("session has run for %s, over its %s limit", elapsed.Round(time.Millisecond), limit)},
+			Limit:    limit,
+		}
+	}
+	return nil
+}
+
+// healthy reports whether the client is connected and still usable.
+func (c *ClaudeClient) healthy() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.closed && c.ensureConnectedLocked() == nil && c.checkSessionDurationLocked() == nil
+}
+
 func (c *ClaudeClient) ensureConnectedLocked() error {
 	if c.query == nil || c.transport == nil {
 		return &CLIConnectionError{SDKError: SDKError{Message: "Not connected. Call Connect() first."}}
@@ -376,10 +983,17 @@ func (c *ClaudeClient) ensureConnectedLocked() error {
 	if !c.transport.IsReady() {
 		return &CLIConnectionError{SDKError: SDKError{Message: "Connection is no longer active"}}
 	}
+	if !c.query.isReady() {
+		return &CLIConnectionError{SDKError: SDKError{Message: "Connection is not ready: initialize handshake has not completed"}}
+	}
 	return nil
 }
 
-func resolveInitializeTimeout() float64 {
+// resolveInitializeTimeout returns the initialize timeout in seconds.
+func resolveInitializeTimeout(options *AgentOptions) float64 {
+	if options.InitializeTimeout > 0 {
+		return options.InitializeTimeout.Seconds()
+	}
 	const minTimeoutSeconds = 60.0
 	raw := os.Getenv("CLAUDE_CODE_STREAM_CLOSE_TIMEOUT")
 	if raw == "" {
@@ -395,3 +1009,45 @@ func resolveInitializeTimeout() float64 {
 	}
 	return timeoutSeconds
 }
+
+// copyStructuredOutput returns a deep copy of the maps and arrays in v, so a
+// caller's copy is unaffected by later merges.
+func copyStructuredOutput(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, e := range v {
+			out[k] = copyStructuredOutput(e)
+		}
+		return out
+	case []any:
+		out := make([]any, len(v))
+		for i, e := range v {
+			out[i] = copyStructuredOutput(e)
+		}
+		return out
+	default:
+		return v
+	}
+}
+
+// mergeStructuredOutput merges src into dst: maps merge recursively, arrays
+// append, and other values are replaced.
+func mergeStructuredOutput(dst, src any) any {
+	switch s := src.(type) {
+	case map[string]any:
+		d, ok := dst.(map[string]any)
+		if !ok {
+			d = make(map[string]any, len(s))
+		}
+		for k, v := range s {
+			d[k] = mergeStructuredOutput(d[k], v)
+		}
+		return d
+	case []any:
+		d, _ := dst.([]any)
+		return append(d, s...)
+	default:
+		return src
+	}
+}
@@ -1,10 +1,13 @@
 package claude
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -24,6 +27,8 @@ func testableClient(t *testing.T, opts queryOptions) (*ClaudeClient, *mockTransp
 	if err := client.query.start(ctx); err != nil {
 		t.Fatalf("failed to start query handler: %v", err)
 	}
+	// Simulate a completed initialize handshake.
+	client.query.markReady()
 
 	return client, mt
 }
@@ -104,6 +109,36 @@ func TestClientDoubleClose(t *testing.T) {
 	}
 }
 
+func TestClientCloseDuringReceiveResponse(t *testing.T) {
+	client, mt := testableClient(t, queryOptions{})
+
+	msgs, errs := client.ReceiveResponseWithErrors(context.Background())
+	mt.msgChan <- map[string]any{
+		"type": "assistant",
+		"message": map[string]any{
+			"role":    "assistant",
+			"model":   "claude-sonnet-4-5",
+			"content": []any{map[string]any{"type": "text", "text": "working"}},
+		},
+	}
+	<-msgs
+
+	go func() { _ = client.Close() }()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range msgs {
+		}
+		<-errs
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("receive did not end after Close")
+	}
+}
+
 func TestClientReceiveResponse(t *testing.T) {
 	client, mt := testableClient(t, queryOptions{})
 	defer client.Close()
@@ -315,3 +350,1093 @@ func TestClientQueryWithSessionIncludesTransportExitError(t *testing.T) {
 		t.Fatalf("expected wrapped transport error, got: %v", err)
 	}
 }
+
+func TestClientReceiveUntilStopsAtToolUse(t *testing.T) {
+	client, mt := testableClient(t, queryOptions{})
+	defer client.Close()
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		mt.msgChan <- map[string]any{
+			"type": "assistant",
+			"message": map[string]any{
+				"model":   "claude-sonnet-4-5",
+				"content": []any{map[string]any{"type": "text", "text": "Let me check."}},
+			},
+		}
+		mt.msgChan <- map[string]any{
+			"type": "assistant",
+			"message": map[string]any{
+				"model": "claude-sonnet-4-5",
+				"content": []any{
+					map[string]any{"type": "tool_use", "id": "tu-1", "name": "Bash", "input": map[string]any{"command": "ls"}},
+				},
+			},
+		}
+		// Should not be received because ReceiveUntil stops at the tool use
+		mt.msgChan <- map[string]any{
+			"type": "assistant",
+			"message": map[string]any{
+				"model":   "claude-sonnet-4-5",
+				"content": []any{map[string]any{"type": "text", "text": "done"}},
+			},
+		}
+	}()
+
+	hasToolUse := func(msg Message) bool {
+		am, ok := msg.(*AssistantMessage)
+		if !ok {
+			return false
+		}
+		for _, block := range am.Content {
+			if _, ok := block.(*ToolUseBlock); ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	msgs, errs := client.ReceiveUntil(context.Background(), hasToolUse)
+	var messages []Message
+	for msg := range msgs {
+		messages = append(messages, msg)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 messages (text + tool use), got %d", len(messages))
+	}
+	if !hasToolUse(messages[1]) {
+		t.Errorf("expected last message to carry a ToolUseBlock, got %+v", messages[1])
+	}
+}
+
+func TestClientWritesBeforeReadyFailDeterministically(t *testing.T) {
+	mt := newMockTransport()
+	client := &ClaudeClient{options: &AgentOptions{}}
+	client.query = newQueryHandler(mt, queryOptions{})
+	client.transport = &subprocessTransport{ready: true}
+	_ = client.query.start(context.Background())
+	defer client.Close()
+
+	err := client.QueryWithSession(context.Background(), "hello", "sess-1")
+	if err == nil {
+		t.Fatal("expected not ready error before initialize completes")
+	}
+	var connErr *CLIConnectionError
+	if !errors.As(err, &connErr) {
+		t.Fatalf("expected CLIConnectionError, got %T", err)
+	}
+	if !strings.Contains(err.Error(), "not ready") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if written := mt.getWritten(); len(written) != 0 {
+		t.Fatalf("expected nothing written before readiness, got %v", written)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := client.WaitReady(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected WaitReady to time out, got %v", err)
+	}
+
+	client.query.markReady()
+	if err := client.WaitReady(context.Background()); err != nil {
+		t.Fatalf("expected WaitReady to succeed after handshake, got %v", err)
+	}
+}
+
+func TestClientWaitReadyDuringConnect(t *testing.T) {
+	handshakeStarted := func(mt *mockTransport) {
+		for len(mt.getWritten()) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	within := func(t *testing.T, what string, ch <-chan error) error {
+		t.Helper()
+		select {
+		case err := <-ch:
+			return err
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s blocked while the handshake was pending", what)
+			return nil
+		}
+	}
+
+	t.Run("handshake completes", func(t *testing.T) {
+		mt := newMockTransport()
+		client := NewClient(WithTransport(mt), WithCLIPath("/nonexistent/claude"), WithSkipVersionCheck())
+		defer client.Close()
+		connected := make(chan error, 1)
+		go func() { connected <- client.Connect(context.Background()) }()
+		handshakeStarted(mt)
+
+		ready := make(chan error, 1)
+		go func() { ready <- client.WaitReady(context.Background()) }()
+		info := make(chan error, 1)
+		go func() {
+			_, err := client.ServerInfo(context.Background())
+			info <- err
+		}()
+		respondToInitialize(mt, map[string]any{"version": "2.1.0"})
+
+		if err := within(t, "Connect", connected); err != nil {
+			t.Fatalf("Connect failed: %v", err)
+		}
+		if err := within(t, "WaitReady", ready); err != nil {
+			t.Errorf("WaitReady failed: %v", err)
+		}
+		if err := within(t, "ServerInfo", info); err != nil {
+			t.Errorf("ServerInfo failed: %v", err)
+		}
+	})
+
+	t.Run("closed during handshake", func(t *testing.T) {
+		mt := newMockTransport()
+		client := NewClient(WithTransport(mt), WithCLIPath("/nonexistent/claude"), WithSkipVersionCheck())
+		connected := make(chan error, 1)
+		go func() { connected <- client.Connect(context.Background()) }()
+		handshakeStarted(mt)
+
+		ready := make(chan error, 1)
+		go func() { ready <- client.WaitReady(context.Background()) }()
+		closed := make(chan error, 1)
+		go func() { closed <- client.Close() }()
+
+		if err := within(t, "Close", closed); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+		if err := within(t, "Connect", connected); err == nil {
+			t.Error("expected Connect to fail after Close")
+		}
+		if err := within(t, "WaitReady", ready); err == nil {
+			t.Error("expected WaitReady to fail after Close")
+		}
+	})
+}
+
+func TestClientServerInfo(t *testing.T) {
+	mt := newMockTransport()
+	client := &ClaudeClient{options: &AgentOptions{}}
+	client.query = newQueryHandler(mt, queryOptions{})
+	client.transport = &subprocessTransport{ready: true}
+	_ = client.query.start(context.Background())
+	defer client.Close()
+
+	go respondToInitialize(mt, map[string]any{
+		"version":      "2.1.3",
+		"capabilities": map[string]any{"interrupt": true},
+		"commands":     []any{},
+	})
+	if _, err := client.query.initialize(context.Background()); err != nil {
+		t.Fatalf("initialize failed: %v", err)
+	}
+
+	info, err := client.ServerInfo(context.Background())
+	if err != nil {
+		t.Fatalf("ServerInfo failed: %v", err)
+	}
+	if info.Version != "2.1.3" {
+		t.Errorf("expected version 2.1.3, got %q", info.Version)
+	}
+	if info.Capabilities["interrupt"] != true {
+		t.Errorf("expected interrupt capability, got %v", info.Capabilities)
+	}
+	if _, ok := info.Data["commands"]; !ok {
+		t.Errorf("expected raw response in Data, got %v", info.Data)
+	}
+}
+
+func TestClientServerInfoNotConnected(t *testing.T) {
+	_, err := NewClient().ServerInfo(context.Background())
+	var connErr *CLIConnectionError
+	if !errors.As(err, &connErr) {
+		t.Fatalf("expected CLIConnectionError, got %v", err)
+	}
+}
+
+func TestClientMaxSessionDuration(t *testing.T) {
+	tests := []struct {
+		name    string
+		elapsed time.Duration
+		wantErr bool
+	}{
+		{name: "within budget", elapsed: time.Second},
+		{name: "over budget", elapsed: time.Hour, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, stdin := writableClient(t)
+			defer client.Close()
+			client.options = applyOptions([]Option{WithMaxSessionDuration(time.Minute)})
+			client.connectedAt = time.Now().Add(-tt.elapsed)
+
+			queryErr := client.Query(context.Background(), "hello")
+			messages := make(chan map[string]any, 1)
+			messages <- map[string]any{"type": "user", "message": map[string]any{"role": "user", "content": "hi"}}
+			close(messages)
+			streamErr := client.QueryStream(context.Background(), messages, "")
+
+			for name, err := range map[string]error{"Query": queryErr, "QueryStream": streamErr} {
+				var exceeded *SessionDurationExceededError
+				if tt.wantErr {
+					if !errors.As(err, &exceeded) || exceeded.Limit != time.Minute {
+						t.Errorf("%s: expected SessionDurationExceededError, got %v", name, err)
+					}
+				} else if err != nil {
+					t.Errorf("%s: unexpected error: %v", name, err)
+				}
+			}
+			if tt.wantErr && stdin.Len() != 0 {
+				t.Errorf("expected nothing written after the budget, got %q", stdin.String())
+			}
+			if client.healthy() == tt.wantErr {
+				t.Errorf("expected healthy=%v", !tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestClientInterruptAtMaxSessionDuration(t *testing.T) {
+	cli := writeFakeCLI(t, fakeCLIScript)
+	interrupted := make(chan struct{})
+	var once sync.Once
+	client := NewClient(
+		WithCLIPath(cli),
+		WithMaxSessionDuration(20*time.Millisecond),
+		WithInterruptAtMaxSessionDuration(),
+		WithSessionEventLog(func(e SessionEvent) {
+			if e.Type == SessionEventInterrupt {
+				once.Do(func() { close(interrupted) })
+			}
+		}),
+	)
+	if err := client.Connect(context.Background()); err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+	defer client.Close()
+
+	select {
+	case <-interrupted:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected an interrupt at the session deadline")
+	}
+}
+
+func TestClientAfterConnect(t *testing.T) {
+	cli := writeFakeCLI(t, fakeCLIScript)
+	ran := false
+	client := NewClient(
+		WithCLIPath(cli),
+		WithAfterConnect(func(ctx context.Context, c *ClaudeClient) error {
+			ran = true
+			return c.SetPermissionMode(ctx, PermissionAcceptEdits)
+		}),
+	)
+	if err := client.Connect(context.Background()); err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+	defer client.Close()
+	if !ran {
+		t.Error("expected the after-connect hook to run")
+	}
+	if err := client.Query(context.Background(), "hello"); err != nil {
+		t.Errorf("expected client to stay connected, got %v", err)
+	}
+}
+
+func TestClientAfterConnectErrorAbortsConnect(t *testing.T) {
+	cli := writeFakeCLI(t, fakeCLIScript)
+	hookErr := errors.New("warm-up failed")
+	client := NewClient(
+		WithCLIPath(cli),
+		WithAfterConnect(func(ctx context.Context, c *ClaudeClient) error { return hookErr }),
+	)
+	err := client.Connect(context.Background())
+	if !errors.Is(err, hookErr) {
+		t.Fatalf("expected hook error from Connect, got %v", err)
+	}
+	var connErr *CLIConnectionError
+	if err := client.Query(context.Background(), "hello"); !errors.As(err, &connErr) {
+		t.Errorf("expected client to be disconnected, got %v", err)
+	}
+	_ = client.Close()
+}
+
+func TestClientWaitReadyNotConnected(t *testing.T) {
+	client := NewClient()
+	if err := client.WaitReady(context.Background()); err == nil {
+		t.Fatal("expected error when not connected")
+	}
+}
+
+// stdinBuffer captures bytes written to a subprocessTransport's stdin.
+type stdinBuffer struct {
+	bytes.Buffer
+}
+
+func (b *stdinBuffer) Close() error { return nil }
+
+// writableClient returns a ready client whose writes are captured in the returned buffer.
+func writableClient(t *testing.T) (*ClaudeClient, *stdinBuffer) {
+	t.Helper()
+	client, _ := testableClient(t, queryOptions{})
+	stdin := &stdinBuffer{}
+	client.transport = &subprocessTransport{ready: true, stdin: stdin}
+	return client, stdin
+}
+
+func TestClientSendSystemReminder(t *testing.T) {
+	client, stdin := writableClient(t)
+	defer client.Close()
+
+	if err := client.SendSystemReminder(context.Background(), "sess-1", "Prefer concise answers."); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var msg map[string]any
+	if err := json.Unmarshal(stdin.Bytes(), &msg); err != nil {
+		t.Fatalf("invalid JSON written: %v (%q)", err, stdin.String())
+	}
+	if msg["type"] != "user" {
+		t.Errorf("expected type 'user', got %v", msg["type"])
+	}
+	if msg["isMeta"] != true {
+		t.Errorf("expected isMeta=true, got %v", msg["isMeta"])
+	}
+	if msg["session_id"] != "sess-1" {
+		t.Errorf("expected session_id 'sess-1', got %v", msg["session_id"])
+	}
+	inner, _ := msg["message"].(map[string]any)
+	content, _ := inner["content"].([]any)
+	if len(content) != 1 {
+		t.Fatalf("expected 1 content block, got %v", inner["content"])
+	}
+	block, _ := content[0].(map[string]any)
+	want := "<system-reminder>\nPrefer concise answers.\n</system-reminder>"
+	if block["type"] != "text" || block["text"] != want {
+		t.Errorf("unexpected content block: %v", block)
+	}
+}
+
+func TestClientQueryBlocks(t *testing.T) {
+	client, stdin := writableClient(t)
+	defer client.Close()
+
+	blocks := []ContentBlock{
+		&TextBlock{Text: "What is wrong in this screenshot?"},
+		&ImageBlock{MediaType: "image/png", Data: "iVBORw0KGgo="},
+	}
+	if err := client.QueryBlocks(context.Background(), blocks, "sess-1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var got map[string]any
+	if err := json.Unmarshal(stdin.Bytes(), &got); err != nil {
+		t.Fatalf("invalid JSON written: %v (%q)", err, stdin.String())
+	}
+	var want map[string]any
+	_ = json.Unmarshal([]byte(`{
+		"type": "user",
+		"session_id": "sess-1",
+		"parent_tool_use_id": null,
+		"message": {
+			"role": "user",
+			"content": [
+				{"type": "text", "text": "What is wrong in this screenshot?"},
+				{"type": "image", "source": {"type": "base64", "media_type": "image/png", "data": "iVBORw0KGgo="}}
+			]
+		}
+	}`), &want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected message:\n got %v\nwant %v", got, want)
+	}
+}
+
+func TestClientQueryBlocksRejectsInvalidBlocks(t *testing.T) {
+	tests := []struct {
+		name    string
+		blocks  []ContentBlock
+		wantErr string
+	}{
+		{"empty", nil, "no content blocks"},
+		{"unsupported media type", []ContentBlock{&ImageBlock{MediaType: "image/bmp", Data: "Qk0="}}, `unsupported image media type "image/bmp"`},
+		{"missing data", []ContentBlock{&ImageBlock{MediaType: "image/jpeg"}}, "no data"},
+		{"output block", []ContentBlock{&ToolUseBlock{ID: "t1", Name: "Read"}}, "tool_use blocks cannot be sent"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, stdin := writableClient(t)
+			defer client.Close()
+
+			err := client.QueryBlocks(context.Background(), tt.blocks, "")
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+			if stdin.Len() != 0 {
+				t.Errorf("expected nothing written, got %q", stdin.String())
+			}
+		})
+	}
+}
+
+func TestClientSend(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  InputMessage
+		want string
+	}{
+		{
+			name: "string content",
+			msg:  InputMessage{Content: "hello", SessionID: "sess-1"},
+			want: `{"message":{"content":"hello","role":"user"},"parent_tool_use_id":null,"session_id":"sess-1","type":"user"}`,
+		},
+		{
+			name: "block content",
+			msg:  InputMessage{Content: []ContentBlock{&TextBlock{Text: "what is this?"}, &ImageBlock{MediaType: "image/png", Data: "iVBORw0KGgo="}}},
+			want: `{"message":{"content":[{"text":"what is this?","type":"text"},{"source":{"data":"iVBORw0KGgo=","media_type":"image/png","type":"base64"},"type":"image"}],"role":"user"},"parent_tool_use_id":null,"session_id":"default","type":"user"}`,
+		},
+		{
+			name: "within a tool use",
+			msg:  InputMessage{Content: "continue", SessionID: "sess-1", ParentToolUseID: "toolu_9"},
+			want: `{"message":{"content":"continue","role":"user"},"parent_tool_use_id":"toolu_9","session_id":"sess-1","type":"user"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, stdin := writableClient(t)
+			defer client.Close()
+
+			if err := client.Send(context.Background(), tt.msg); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := strings.TrimSpace(stdin.String()); got != tt.want {
+				t.Errorf("envelope = %s\nwant       %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientSendRejectsInvalidContent(t *testing.T) {
+	for _, content := range []any{nil, 42, []string{"hi"}} {
+		client, stdin := writableClient(t)
+		err := client.Send(context.Background(), InputMessage{Content: content})
+		if err == nil || !strings.Contains(err.Error(), "must be a string or []ContentBlock") {
+			t.Errorf("content %#v: expected an invalid content error, got %v", content, err)
+		}
+		if stdin.Len() != 0 {
+			t.Errorf("content %#v: expected nothing written, got %q", content, stdin.String())
+		}
+		client.Close()
+	}
+}
+
+func TestClientSendToolResult(t *testing.T) {
+	tests := []struct {
+		name    string
+		content any
+		isError bool
+		want    string
+	}{
+		{
+			name:    "text",
+			content: "42",
+			want:    `{"message":{"content":[{"content":"42","tool_use_id":"toolu_1","type":"tool_result"}],"role":"user"},"parent_tool_use_id":null,"session_id":"sess-1","type":"user"}`,
+		},
+		{
+			name:    "error",
+			content: "lookup failed",
+			isError: true,
+			want:    `{"message":{"content":[{"content":"lookup failed","is_error":true,"tool_use_id":"toolu_1","type":"tool_result"}],"role":"user"},"parent_tool_use_id":null,"session_id":"sess-1","type":"user"}`,
+		},
+		{
+			name:    "blocks",
+			content: []ContentBlock{&TextBlock{Text: "chart"}, &ImageBlock{MediaType: "image/png", Data: "iVBORw0KGgo="}},
+			want:    `{"message":{"content":[{"content":[{"text":"chart","type":"text"},{"source":{"data":"iVBORw0KGgo=","media_type":"image/png","type":"base64"},"type":"image"}],"tool_use_id":"toolu_1","type":"tool_result"}],"role":"user"},"parent_tool_use_id":null,"session_id":"sess-1","type":"user"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, stdin := writableClient(t)
+			defer client.Close()
+
+			if err := client.SendToolResult(context.Background(), "toolu_1", tt.content, tt.isError, "sess-1"); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := strings.TrimSpace(stdin.String()); got != tt.want {
+				t.Errorf("envelope = %s\nwant       %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientSendToolResultRequiresID(t *testing.T) {
+	client, stdin := writableClient(t)
+	defer client.Close()
+
+	err := client.SendToolResult(context.Background(), "", "42", false, "")
+	if err == nil || !strings.Contains(err.Error(), "no tool_use ID") {
+		t.Errorf("expected a missing ID error, got %v", err)
+	}
+	if stdin.Len() != 0 {
+		t.Errorf("expected nothing written, got %q", stdin.String())
+	}
+}
+
+func TestClientFinalStructuredOutputMergesFragments(t *testing.T) {
+	client, mt := testableClient(t, queryOptions{})
+	defer client.Close()
+	client.options.ResultAccumulator = true
+
+	result := func(output any) map[string]any {
+		return map[string]any{
+			"type":              "result",
+			"subtype":           "success",
+			"is_error":          false,
+			"duration_ms":       float64(100),
+			"duration_api_ms":   float64(90),
+			"num_turns":         float64(1),
+			"session_id":        "sess-1",
+			"structured_output": output,
+		}
+	}
+	mt.msgChan <- result(map[string]any{
+		"summary": "first",
+		"items":   []any{"a"},
+		"meta":    map[string]any{"page": float64(1)},
+	})
+	mt.msgChan <- result(map[string]any{
+		"summary": "second",
+		"items":   []any{"b", "c"},
+		"meta":    map[string]any{"done": true},
+	})
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		for range client.ReceiveResponse(ctx) {
+		}
+	}
+
+	merged, ok := client.FinalStructuredOutput().(map[string]any)
+	if !ok {
+		t.Fatalf("expected merged map, got %T", client.FinalStructuredOutput())
+	}
+	if merged["summary"] != "second" {
+		t.Errorf("expected scalar to be replaced, got %v", merged["summary"])
+	}
+	items, _ := merged["items"].([]any)
+	if len(items) != 3 || items[0] != "a" || items[2] != "c" {
+		t.Errorf("expected arrays to be appended, got %v", merged["items"])
+	}
+	meta, _ := merged["meta"].(map[string]any)
+	if meta["page"] != float64(1) || meta["done"] != true {
+		t.Errorf("expected nested maps to be merged, got %v", merged["meta"])
+	}
+
+	// The returned value is a copy: later fragments do not change it.
+	_ = client.observeMessage(client.query, &ResultMessage{StructuredOutput: map[string]any{
+		"items": []any{"d"},
+		"meta":  map[string]any{"page": float64(2)},
+	}})
+	if len(merged["items"].([]any)) != 3 || meta["page"] != float64(1) {
+		t.Errorf("expected the earlier result to be unchanged, got %v", merged)
+	}
+	if again := client.FinalStructuredOutput().(map[string]any); len(again["items"].([]any)) != 4 {
+		t.Errorf("expected the new fragment to be merged, got %v", again)
+	}
+}
+
+func TestClientFinalStructuredOutputDisabled(t *testing.T) {
+	client := NewClient()
+	client.observeMessage(client.query, &ResultMessage{StructuredOutput: map[string]any{"a": 1}})
+	if out := client.FinalStructuredOutput(); out != nil {
+		t.Errorf("expected nil without WithResultAccumulator, got %v", out)
+	}
+}
+
+func TestClientQueryStreamOverrides(t *testing.T) {
+	client, stdin := writableClient(t)
+	defer client.Close()
+	mt := client.query.transport.(*mockTransport)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go ackControlRequests(mt, stop)
+
+	messages := make(chan map[string]any, 1)
+	messages <- map[string]any{
+		"type":             "user",
+		"message":          map[string]any{"role": "user", "content": "hi"},
+		InputOverrideModel: "claude-haiku-4-5",
+	}
+	close(messages)
+	if err := client.QueryStream(context.Background(), messages, "default"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	written := mt.getWritten()
+	if len(written) != 1 || !strings.Contains(written[0], `"set_model"`) {
+		t.Fatalf("expected set_model control request, got %v", written)
+	}
+	var msg map[string]any
+	if err := json.Unmarshal(stdin.Bytes(), &msg); err != nil {
+		t.Fatalf("invalid JSON written: %v", err)
+	}
+	if _, ok := msg[InputOverrideModel]; ok {
+		t.Error("expected override key to be stripped from the user message")
+	}
+	if msg["session_id"] != "default" {
+		t.Errorf("expected default session_id, got %v", msg["session_id"])
+	}
+}
+
+func TestClientReceiveResponseIncomplete(t *testing.T) {
+	client, mt := testableClient(t, queryOptions{})
+	defer client.Close()
+
+	mt.msgChan <- map[string]any{
+		"type": "assistant",
+		"message": map[string]any{
+			"model":   "claude-sonnet-4-5",
+			"content": []any{map[string]any{"type": "text", "text": "partial"}},
+		},
+	}
+	close(mt.msgChan)
+
+	msgChan, errChan := client.ReceiveResponseWithErrors(context.Background())
+	var count int
+	for range msgChan {
+		count++
+	}
+	if count != 1 {
+		t.Errorf("expected 1 message, got %d", count)
+	}
+	var incomplete *IncompleteResponseError
+	if err := <-errChan; !errors.As(err, &incomplete) {
+		t.Fatalf("expected IncompleteResponseError, got %v", err)
+	}
+}
+
+func TestClientMetrics(t *testing.T) {
+	if (NewClient().Metrics() != ChannelMetrics{}) {
+		t.Error("expected zero metrics before Connect")
+	}
+
+	client, mt := testableClient(t, queryOptions{})
+	defer client.Close()
+
+	for i := 0; i < 5; i++ {
+		mt.msgChan <- map[string]any{"type": "assistant", "n": i}
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for client.Metrics().MessageQueueDepth < 5 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	m := client.Metrics()
+	if m.MessageQueueDepth != 5 || m.MessageQueueHighWater != 5 {
+		t.Errorf("expected depth and high-water 5, got %+v", m)
+	}
+	if m.MessageQueueCapacity != 100 {
+		t.Errorf("expected capacity 100, got %d", m.MessageQueueCapacity)
+	}
+
+	<-client.query.receiveMessages()
+	<-client.query.receiveMessages()
+	if m := client.Metrics(); m.MessageQueueDepth != 3 || m.MessageQueueHighWater != 5 {
+		t.Errorf("expected depth 3 with high-water 5 after draining two, got %+v", m)
+	}
+
+	go func() {
+		_, _ = client.query.sendControlRequest(context.Background(), map[string]any{"subtype": "interrupt"}, 5)
+	}()
+	for client.Metrics().PendingControlRequests < 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if m := client.Metrics(); m.PendingControlRequests != 1 || m.PendingControlRequestsMax != 1 {
+		t.Errorf("expected one pending control request, got %+v", m)
+	}
+}
+
+func TestClientInterruptAndContinue(t *testing.T) {
+	client, stdin := writableClient(t)
+	defer client.Close()
+	mt := client.query.transport.(*mockTransport)
+	if err := client.Query(context.Background(), "first"); err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+
+	// Answer the interrupt, then finish the interrupted turn.
+	go func() {
+		for {
+			written := mt.getWritten()
+			if len(written) > 0 {
+				var req map[string]any
+				_ = json.Unmarshal([]byte(written[0]), &req)
+				mt.msgChan <- map[string]any{
+					"type":     "control_response",
+					"response": map[string]any{"subtype": "success", "request_id": req["request_id"]},
+				}
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		mt.msgChan <- map[string]any{
+			"type":    "assistant",
+			"message": map[string]any{"model": "claude-sonnet-4-5", "content": []any{map[string]any{"type": "text", "text": "stale"}}},
+		}
+		mt.msgChan <- map[string]any{
+			"type": "result", "subtype": ResultSubtypeErrorDuringExecution, "duration_ms": 1.0, "duration_api_ms": 1.0,
+			"is_error": true, "num_turns": 1.0, "session_id": "default",
+		}
+	}()
+
+	if err := client.InterruptAndContinue(context.Background()); err != nil {
+		t.Fatalf("InterruptAndContinue failed: %v", err)
+	}
+	if !client.healthy() {
+		t.Fatal("expected client to stay connected")
+	}
+	if err := client.Query(context.Background(), "next"); err != nil {
+		t.Fatalf("Query after InterruptAndContinue failed: %v", err)
+	}
+	if !strings.Contains(stdin.String(), `"next"`) {
+		t.Errorf("expected next prompt to be written, got %q", stdin.String())
+	}
+
+	mt.msgChan <- map[string]any{
+		"type": "result", "subtype": ResultSubtypeSuccess, "duration_ms": 1.0, "duration_api_ms": 1.0,
+		"is_error": false, "num_turns": 1.0, "session_id": "default", "result": "fresh",
+	}
+	msgChan, errChan := client.ReceiveResponseWithErrors(context.Background())
+	var got []Message
+	for msg := range msgChan {
+		got = append(got, msg)
+	}
+	if err := <-errChan; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("expected only the next turn's result, got %d messages", len(got))
+	}
+	if rm, ok := got[0].(*ResultMessage); !ok || rm.Result != "fresh" {
+		t.Errorf("expected fresh result, got %#v", got[0])
+	}
+}
+
+func TestClientInterruptAndContinueWithoutTurn(t *testing.T) {
+	client, _ := writableClient(t)
+	defer client.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	go ackControlRequests(client.query.transport.(*mockTransport), stop)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := client.InterruptAndContinue(ctx); err != nil {
+		t.Fatalf("expected InterruptAndContinue to return with no turn in flight, got %v", err)
+	}
+}
+
+func TestClientStopClosesSession(t *testing.T) {
+	client, _ := testableClient(t, queryOptions{})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := client.Stop(ctx); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+	if err := client.Query(context.Background(), "next"); err == nil {
+		t.Error("expected Query to fail after Stop")
+	}
+}
+
+func TestClientToolUseObserver(t *testing.T) {
+	client, mt := testableClient(t, queryOptions{})
+	defer client.Close()
+
+	type observed struct{ id, name, session string }
+	var got []observed
+	client.options = applyOptions([]Option{WithToolUseObserver(func(block *ToolUseBlock, sessionID string) {
+		got = append(got, observed{block.ID, block.Name, sessionID})
+	})})
+
+	mt.msgChan <- map[string]any{
+		"type":       "assistant",
+		"session_id": "sess-1",
+		"message": map[string]any{
+			"model": "claude-sonnet-4-5",
+			"content": []any{
+				map[string]any{"type": "text", "text": "Checking."},
+				map[string]any{"type": "tool_use", "id": "tu-1", "name": "Read", "input": map[string]any{"file_path": "a.go"}},
+				map[string]any{"type": "tool_use", "id": "tu-2", "name": "Bash", "input": map[string]any{"command": "ls"}},
+			},
+		},
+	}
+	mt.msgChan <- map[string]any{
+		"type": "result", "subtype": ResultSubtypeSuccess, "duration_ms": 1.0, "duration_api_ms": 1.0,
+		"is_error": false, "num_turns": 1.0, "session_id": "sess-1",
+	}
+
+	msgChan, errChan := client.ReceiveResponseWithErrors(context.Background())
+	for range msgChan {
+	}
+	if err := <-errChan; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []observed{{"tu-1", "Read", "sess-1"}, {"tu-2", "Bash", "sess-1"}}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d observations, got %v", len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("observation %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestClientModelChangeHandler(t *testing.T) {
+	client, mt := testableClient(t, queryOptions{})
+	defer client.Close()
+
+	var from, to string
+	client.options = applyOptions([]Option{
+		WithModel("claude-opus-4-1"),
+		WithModelChangeHandler(func(f, t string) { from, to = f, t }),
+	})
+
+	mt.msgChan <- map[string]any{
+		"type": "assistant",
+		"message": map[string]any{
+			"model":   "claude-sonnet-4-5-20250929",
+			"content": []any{map[string]any{"type": "text", "text": "hi"}},
+		},
+	}
+	mt.msgChan <- map[string]any{
+		"type": "result", "subtype": ResultSubtypeSuccess, "duration_ms": 1.0, "duration_api_ms": 1.0,
+		"is_error": false, "num_turns": 1.0, "session_id": "sess-1",
+	}
+
+	msgChan, errChan := client.ReceiveResponseWithErrors(context.Background())
+	count := 0
+	for range msgChan {
+		count++
+	}
+	if err := <-errChan; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("expected both messages delivered, got %d", count)
+	}
+	if from != "claude-opus-4-1" || to != "claude-sonnet-4-5-20250929" {
+		t.Errorf("expected change opus -> sonnet, got %q -> %q", from, to)
+	}
+}
+
+func TestClientStrictModelPinning(t *testing.T) {
+	client, mt := testableClient(t, queryOptions{})
+	defer client.Close()
+	client.options = applyOptions([]Option{WithModel("claude-opus-4-1"), WithStrictModelPinning()})
+
+	mt.msgChan <- map[string]any{
+		"type": "assistant",
+		"message": map[string]any{
+			"model":   "claude-sonnet-4-5-20250929",
+			"content": []any{map[string]any{"type": "text", "text": "hi"}},
+		},
+	}
+
+	msgChan, errChan := client.ReceiveResponseWithErrors(context.Background())
+	for msg := range msgChan {
+		t.Errorf("expected mismatched message to be withheld, got %T", msg)
+	}
+	var mismatch *ModelMismatchError
+	if err := <-errChan; !errors.As(err, &mismatch) {
+		t.Fatalf("expected ModelMismatchError, got %v", err)
+	}
+	if mismatch.Requested != "claude-opus-4-1" || mismatch.Actual != "claude-sonnet-4-5-20250929" {
+		t.Errorf("unexpected mismatch: %+v", mismatch)
+	}
+}
+
+func TestClientSetModelUpdatesModelPin(t *testing.T) {
+	client, _ := writableClient(t)
+	defer client.Close()
+	mt := client.query.transport.(*mockTransport)
+	client.options = applyOptions([]Option{WithModel("claude-opus-4-1"), WithStrictModelPinning()})
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go ackControlRequests(mt, stop)
+
+	if err := client.SetModel(context.Background(), "haiku"); err != nil {
+		t.Fatalf("SetModel failed: %v", err)
+	}
+	mt.msgChan <- map[string]any{
+		"type": "assistant",
+		"message": map[string]any{
+			"model":   "claude-haiku-4-5-20251001",
+			"content": []any{map[string]any{"type": "text", "text": "hi"}},
+		},
+	}
+	mt.msgChan <- map[string]any{
+		"type": "result", "subtype": ResultSubtypeSuccess, "duration_ms": 1.0, "duration_api_ms": 1.0,
+		"is_error": false, "num_turns": 1.0, "session_id": "sess-1",
+	}
+
+	msgChan, errChan := client.ReceiveResponseWithErrors(context.Background())
+	for range msgChan {
+	}
+	if err := <-errChan; err != nil {
+		t.Fatalf("unexpected error after SetModel: %v", err)
+	}
+}
+
+func TestClientReceiveResponseTimeout(t *testing.T) {
+	client, mt := testableClient(t, queryOptions{})
+	defer client.Close()
+	result := map[string]any{
+		"type": "result", "subtype": ResultSubtypeSuccess, "duration_ms": 1.0, "duration_api_ms": 1.0,
+		"is_error": false, "num_turns": 1.0, "session_id": "sess-1",
+	}
+
+	mt.msgChan <- assistantWithUUID("a", "working")
+	msgChan, errChan := client.ReceiveResponseTimeout(context.Background(), 50*time.Millisecond)
+	var got []Message
+	for msg := range msgChan {
+		got = append(got, msg)
+	}
+	var timeoutErr *ResponseTimeoutError
+	if err := <-errChan; !errors.As(err, &timeoutErr) || timeoutErr.Timeout != 50*time.Millisecond {
+		t.Fatalf("expected a ResponseTimeoutError, got %v", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("expected the partial assistant message, got %d messages", len(got))
+	}
+	if _, ok := got[0].(*AssistantMessage); !ok {
+		t.Errorf("expected AssistantMessage, got %T", got[0])
+	}
+
+	// The slow result is left for the next receive.
+	mt.msgChan <- result
+	msgChan, errChan = client.ReceiveResponseTimeout(context.Background(), time.Second)
+	got = nil
+	for msg := range msgChan {
+		got = append(got, msg)
+	}
+	if err := <-errChan; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("expected only the result message, got %d messages", len(got))
+	}
+	if _, ok := got[0].(*ResultMessage); !ok {
+		t.Errorf("expected ResultMessage, got %T", got[0])
+	}
+}
+
+func TestClientMaxParseErrors(t *testing.T) {
+	logger := &recordingLogger{}
+
+	tests := []struct {
+		name      string
+		malformed int
+		wantErr   bool
+	}{
+		{name: "under limit", malformed: 2},
+		{name: "at limit", malformed: 3},
+		{name: "over limit", malformed: 4, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, mt := testableClient(t, queryOptions{Logger: logger})
+			defer client.Close()
+			client.options = applyOptions([]Option{WithMaxParseErrors(3)})
+
+			for i := 0; i < tt.malformed; i++ {
+				mt.msgChan <- map[string]any{"type": "user", "message": "not an object"}
+			}
+			mt.msgChan <- map[string]any{
+				"type": "result", "subtype": ResultSubtypeSuccess, "duration_ms": 1.0, "duration_api_ms": 1.0,
+				"is_error": false, "num_turns": 1.0, "session_id": "sess-1",
+			}
+
+			msgChan, errChan := client.ReceiveResponseWithErrors(context.Background())
+			var got []Message
+			for msg := range msgChan {
+				got = append(got, msg)
+			}
+			err := <-errChan
+			var parseErr *MessageParseError
+			if tt.wantErr {
+				if !errors.As(err, &parseErr) {
+					t.Fatalf("expected MessageParseError, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(got) != 1 {
+				t.Fatalf("expected only the result message, got %d messages", len(got))
+			}
+			if _, ok := got[0].(*ResultMessage); !ok {
+				t.Errorf("expected ResultMessage, got %T", got[0])
+			}
+		})
+	}
+	if logs := strings.Join(logger.get(), "\n"); !strings.Contains(logs, "warn: Skipping unparseable message") {
+		t.Errorf("expected skipped messages to be logged, got %q", logs)
+	}
+}
+
+func TestClientParseErrorFailsByDefault(t *testing.T) {
+	client, mt := testableClient(t, queryOptions{})
+	defer client.Close()
+
+	mt.msgChan <- map[string]any{"type": "user", "message": "not an object"}
+
+	msgChan, errChan := client.ReceiveResponseWithErrors(context.Background())
+	for range msgChan {
+	}
+	var parseErr *MessageParseError
+	if err := <-errChan; !errors.As(err, &parseErr) {
+		t.Fatalf("expected MessageParseError, got %v", err)
+	}
+}
+
+func TestClientQueryStreamRejectsCwdOverride(t *testing.T) {
+	client, stdin := writableClient(t)
+	defer client.Close()
+
+	messages := make(chan map[string]any, 1)
+	messages <- map[string]any{
+		"type":           "user",
+		"message":        map[string]any{"role": "user", "content": "hi"},
+		InputOverrideCwd: "/tmp/other",
+	}
+	close(messages)
+	err := client.QueryStream(context.Background(), messages, "sess-2")
+	if !errors.Is(err, ErrPerSessionCwdUnsupported) {
+		t.Fatalf("expected ErrPerSessionCwdUnsupported, got %v", err)
+	}
+	if stdin.Len() != 0 {
+		t.Errorf("expected nothing to be written, got %q", stdin.String())
+	}
+}
+
+func TestClientReceivePropagatesOriginalError(t *testing.T) {
+	client, mt := testableClient(t, queryOptions{})
+	defer client.Close()
+
+	mt.errChan <- &ProcessExitedError{SDKError: SDKError{Message: "CLI process has exited"}}
+
+	msgChan, errChan := client.ReceiveMessagesWithErrors(context.Background())
+	for range msgChan {
+	}
+	var exited *ProcessExitedError
+	if err := <-errChan; !errors.As(err, &exited) {
+		t.Fatalf("expected the transport's ProcessExitedError, got %T (%v)", err, err)
+	}
+}
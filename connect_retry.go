@@ -0,0 +1,94 @@
+package claude
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+)
+
+// errControlRequestTimeout is wrapped by the error of a control request that
+// got no response in time.
+var errControlRequestTimeout = errors.New("control request timeout")
+
+// maxConnectRetryDelay caps the backoff between connect attempts.
+const maxConnectRetryDelay = 30 * time.Second
+
+// spawnError marks the error from starting the CLI process, so that
+// isTransientStartupError can tell it from the other connection errors.
+type spawnError struct{ err error }
+
+func (e *spawnError) Error() string { return e.err.Error() }
+func (e *spawnError) Unwrap() error { return e.err }
+
+// retryConnect runs connect, which starts the CLI and completes the initialize
+// handshake, until it succeeds, fails with an error other than a transient
+// startup failure, or has made the WithConnectRetry number of attempts. A
+// WithTransport transport cannot be restarted and gets a single attempt.
+//
+// wait sleeps between attempts and returns an error to stop retrying; nil
+// waits for the delay or until ctx is done.
+func retryConnect(ctx context.Context, options *AgentOptions, wait func(time.Duration) error, connect func() error) error {
+	attempts := options.ConnectRetryAttempts
+	if attempts < 1 || options.Transport != nil {
+		attempts = 1
+	}
+	for attempt := 1; ; attempt++ {
+		err := connect()
+		if err == nil || attempt >= attempts || !isTransientStartupError(err) {
+			return err
+		}
+		delay := connectRetryDelay(options.ConnectRetryBaseDelay, attempt)
+		loggerOr(options.Logger).Warnf("Connect attempt %d of %d failed, retrying in %s: %v", attempt, attempts, delay, err)
+		if wait == nil {
+			err = sleepContext(ctx, delay)
+		} else {
+			err = wait(delay)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// sleepContext waits for d, returning early with ctx's error if ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// connectRetryDelay returns the wait after the given failed attempt: base
+// doubled per attempt, capped at maxConnectRetryDelay, with the upper half
+// randomized so clients started together do not retry in lockstep.
+func connectRetryDelay(base time.Duration, attempt int) time.Duration {
+	if base <= 0 {
+		return 0
+	}
+	delay := base
+	for i := 1; i < attempt && delay < maxConnectRetryDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, maxConnectRetryDelay)
+	half := delay / 2
+	return half + rand.N(delay-half+1)
+}
+
+// isTransientStartupError reports whether err may go away by starting the CLI
+// again: the binary was not found, the process could not be spawned, or the
+// initialize handshake timed out. A process that exits on its own is not
+// retried, since a CLI rejecting its arguments fails the same way every time.
+// Validation, version and permission errors are not transient either, and
+// neither is a CLI path environment variable naming a missing file.
+func isTransientStartupError(err error) bool {
+	var notFound *CLINotFoundError
+	var spawn *spawnError
+	return errors.Is(err, errControlRequestTimeout) ||
+		(errors.As(err, &notFound) && notFound.EnvVar == "") ||
+		errors.As(err, &spawn)
+}
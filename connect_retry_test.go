@@ -0,0 +1,216 @@
+package claude
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// flakyCLI returns a fake CLI that hangs without answering initialize on its
+// first failures runs and then behaves like fakeCLIScript, and the file
+// counting its runs. Pair it with a short WithInitializeTimeout.
+func flakyCLI(t *testing.T, failures int) (cli, countFile string) {
+	countFile = filepath.Join(t.TempDir(), "count")
+	cli = writeFakeCLI(t, fmt.Sprintf(`#!/bin/sh
+n=$(cat "%s" 2>/dev/null || echo 0)
+n=$((n+1))
+echo $n > "%s"
+if [ $n -le %d ]; then
+  exec sleep 30
+fi
+`, countFile, countFile, failures)+strings.TrimPrefix(fakeCLIScript, "#!/bin/sh\n"))
+	return cli, countFile
+}
+
+func runCount(t *testing.T, countFile string) string {
+	t.Helper()
+	data, err := os.ReadFile(countFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func TestClientConnectRetry(t *testing.T) {
+	cli, countFile := flakyCLI(t, 2)
+	client := NewClient(WithCLIPath(cli), WithConnectRetry(3, time.Millisecond), WithInitializeTimeout(200*time.Millisecond))
+	if err := client.Connect(context.Background()); err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+	defer client.Close()
+	if got := runCount(t, countFile); got != "3" {
+		t.Errorf("expected 3 CLI starts, got %s", got)
+	}
+}
+
+func TestClientConnectRetryExhausted(t *testing.T) {
+	cli, countFile := flakyCLI(t, 5)
+	client := NewClient(WithCLIPath(cli), WithConnectRetry(2, time.Millisecond), WithInitializeTimeout(200*time.Millisecond))
+	err := client.Connect(context.Background())
+	if err == nil {
+		client.Close()
+		t.Fatal("expected connect to fail")
+	}
+	if !isTransientStartupError(err) {
+		t.Errorf("expected the last startup error, got %v", err)
+	}
+	if got := runCount(t, countFile); got != "2" {
+		t.Errorf("expected 2 CLI starts, got %s", got)
+	}
+}
+
+func TestClientConnectRetrySkipsExitedCLI(t *testing.T) {
+	countFile := filepath.Join(t.TempDir(), "count")
+	cli := writeFakeCLI(t, fmt.Sprintf(`#!/bin/sh
+n=$(cat "%s" 2>/dev/null || echo 0)
+echo $((n+1)) > "%s"
+echo "error: unknown option '--bogus'" >&2
+exit 1
+`, countFile, countFile))
+	client := NewClient(WithCLIPath(cli), WithConnectRetry(3, time.Millisecond))
+	if err := client.Connect(context.Background()); err == nil {
+		client.Close()
+		t.Fatal("expected connect to fail")
+	}
+	if got := runCount(t, countFile); got != "1" {
+		t.Errorf("expected 1 CLI start, got %s", got)
+	}
+}
+
+func TestClientCloseAbortsConnectRetry(t *testing.T) {
+	cli, countFile := flakyCLI(t, 5)
+	client := NewClient(WithCLIPath(cli), WithConnectRetry(3, time.Hour), WithInitializeTimeout(50*time.Millisecond))
+	done := make(chan error, 1)
+	go func() { done <- client.Connect(context.Background()) }()
+
+	// Let the first attempt time out so that Connect sleeps in its backoff.
+	time.Sleep(300 * time.Millisecond)
+	closed := make(chan struct{})
+	go func() {
+		client.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close blocked behind the connect backoff")
+	}
+	select {
+	case err := <-done:
+		var connErr *CLIConnectionError
+		if !errors.As(err, &connErr) || !strings.Contains(err.Error(), "closed during connect") {
+			t.Errorf("expected a closed-during-connect error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Connect kept retrying after Close")
+	}
+	if got := runCount(t, countFile); got != "1" {
+		t.Errorf("expected 1 CLI start, got %s", got)
+	}
+}
+
+func TestClientConnectRetrySkipsMissingCLIOverride(t *testing.T) {
+	t.Setenv("CLAUDE_CODE_CLI", filepath.Join(t.TempDir(), "claude"))
+	client := NewClient(WithConnectRetry(3, time.Hour))
+	err := client.Connect(context.Background())
+	var notFound *CLINotFoundError
+	if !errors.As(err, &notFound) || notFound.EnvVar != "CLAUDE_CODE_CLI" {
+		client.Close()
+		t.Fatalf("expected a CLINotFoundError for CLAUDE_CODE_CLI, got %v", err)
+	}
+}
+
+func TestQueryConnectRetry(t *testing.T) {
+	cli, countFile := flakyCLI(t, 1)
+	msgs, errs := Query(context.Background(), "hi", WithCLIPath(cli), WithConnectRetry(2, time.Millisecond), WithInitializeTimeout(200*time.Millisecond))
+	var result *ResultMessage
+	for msg := range msgs {
+		if rm, ok := msg.(*ResultMessage); ok {
+			result = rm
+		}
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	if result == nil {
+		t.Fatal("expected a result message")
+	}
+	if got := runCount(t, countFile); got != "2" {
+		t.Errorf("expected 2 CLI starts, got %s", got)
+	}
+}
+
+func TestRetryConnect(t *testing.T) {
+	notFound := &CLINotFoundError{CLIConnectionError: CLIConnectionError{SDKError: SDKError{Message: "not found"}}}
+	tests := []struct {
+		name      string
+		errs      []error
+		attempts  int
+		transport Transport
+		wantCalls int
+		wantErr   error
+	}{
+		{name: "succeeds after transient failures", errs: []error{notFound, notFound, nil}, attempts: 3, wantCalls: 3},
+		{name: "missing CLI path override is not retried", errs: []error{&CLINotFoundError{CLIPath: "/opt/missing/claude", EnvVar: "CLAUDE_CODE_CLI"}}, attempts: 3, wantCalls: 1},
+		{name: "validation error is not retried", errs: []error{&SDKError{Message: "bad option"}}, attempts: 3, wantCalls: 1},
+		{name: "version error is not retried", errs: []error{&CLIConnectionError{SDKError: SDKError{Message: "too old"}}}, attempts: 3, wantCalls: 1},
+		{name: "initialize timeout is retried", errs: []error{fmt.Errorf("%w: initialize", errControlRequestTimeout), nil}, attempts: 2, wantCalls: 2},
+		{name: "spawn failure is retried", errs: []error{&CLIConnectionError{SDKError: SDKError{Message: "Failed to start Claude Code", Cause: &spawnError{errors.New("text file busy")}}}, nil}, attempts: 2, wantCalls: 2},
+		{name: "exited process is not retried", errs: []error{NewProcessError("exited", 1, "unknown option")}, attempts: 2, wantCalls: 1},
+		{name: "process gone during handshake is not retried", errs: []error{&CLIConnectionError{SDKError: SDKError{Message: "write failed", Cause: &ProcessExitedError{}}}}, attempts: 2, wantCalls: 1},
+		{name: "custom transport gets one attempt", errs: []error{notFound}, attempts: 3, transport: newMemoryTransport(), wantCalls: 1},
+		{name: "retries disabled", errs: []error{notFound}, wantCalls: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			options := applyOptions([]Option{WithConnectRetry(tt.attempts, time.Millisecond), WithTransport(tt.transport)})
+			err := retryConnect(context.Background(), options, nil, func() error {
+				err := tt.errs[calls]
+				calls++
+				return err
+			})
+			if calls != tt.wantCalls {
+				t.Errorf("expected %d attempts, got %d", tt.wantCalls, calls)
+			}
+			if want := tt.errs[calls-1]; err != want {
+				t.Errorf("expected error %v, got %v", want, err)
+			}
+		})
+	}
+}
+
+func TestRetryConnectContextCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	options := applyOptions([]Option{WithConnectRetry(5, time.Hour)})
+	err := retryConnect(ctx, options, nil, func() error {
+		calls++
+		cancel()
+		return fmt.Errorf("%w: initialize", errControlRequestTimeout)
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("expected 1 attempt, got %d", calls)
+	}
+}
+
+func TestConnectRetryDelay(t *testing.T) {
+	for attempt, want := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 3: 400 * time.Millisecond, 20: maxConnectRetryDelay} {
+		for range 20 {
+			if got := connectRetryDelay(100*time.Millisecond, attempt); got < want/2 || got > want {
+				t.Errorf("attempt %d: delay %s outside [%s, %s]", attempt, got, want/2, want)
+			}
+		}
+	}
+	if got := connectRetryDelay(0, 3); got != 0 {
+		t.Errorf("expected no delay without a base, got %s", got)
+	}
+}
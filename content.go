@@ -1,5 +1,7 @@
 package claude
 
+import "strings"
+
 // ContentBlock is a sealed interface representing content within messages.
 // Use type switch to handle specific content types.
 type ContentBlock interface {
@@ -32,9 +34,65 @@ func (b *ToolUseBlock) contentBlockType() string { return "tool_use" }
 
 // ToolResultBlock represents a tool result content block.
 type ToolResultBlock struct {
-	ToolUseID string `json:"tool_use_id"`
-	Content   any    `json:"content,omitempty"` // string | []map[string]any | nil
-	IsError   *bool  `json:"is_error,omitempty"`
+	ToolUseID string       `json:"tool_use_id"`
+	Content   any          `json:"content,omitempty"` // string | []any | nil, as sent by the CLI
+	Items     []MCPContent `json:"-"`                 // text and image items of list-form Content
+	IsError   *bool        `json:"is_error,omitempty"`
 }
 
 func (b *ToolResultBlock) contentBlockType() string { return "tool_result" }
+
+// TextContent returns the text of the result: the string form as is, or the
+// text items of the list form joined by newlines.
+func (b *ToolResultBlock) TextContent() string {
+	if text, ok := b.Content.(string); ok {
+		return text
+	}
+	var parts []string
+	for _, item := range b.Items {
+		if item.Type == "text" {
+			parts = append(parts, item.Text)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// ServerToolUseBlock represents a call to a tool that runs on the API side,
+// such as web search.
+type ServerToolUseBlock struct {
+	ID    string         `json:"id"`
+	Name  string         `json:"name"`
+	Input map[string]any `json:"input"`
+}
+
+func (b *ServerToolUseBlock) contentBlockType() string { return "server_tool_use" }
+
+// WebSearchResult is a single page returned by the web search server tool.
+type WebSearchResult struct {
+	URL              string `json:"url"`
+	Title            string `json:"title"`
+	PageAge          string `json:"page_age,omitempty"`
+	EncryptedContent string `json:"encrypted_content,omitempty"`
+}
+
+// WebSearchResultBlock represents the results of a web search server tool
+// call. ErrorCode is set instead of Results when the search failed.
+type WebSearchResultBlock struct {
+	ToolUseID string            `json:"tool_use_id"`
+	Results   []WebSearchResult `json:"results,omitempty"`
+	ErrorCode string            `json:"error_code,omitempty"`
+}
+
+func (b *WebSearchResultBlock) contentBlockType() string { return "web_search_tool_result" }
+
+// ImageBlock represents a base64-encoded image. It can be sent as user input
+// with ClaudeClient.QueryBlocks.
+type ImageBlock struct {
+	MediaType string `json:"media_type"` // one of SupportedImageMediaTypes
+	Data      string `json:"data"`       // base64-encoded image bytes
+}
+
+func (b *ImageBlock) contentBlockType() string { return "image" }
+
+// SupportedImageMediaTypes lists the image formats accepted in an ImageBlock.
+var SupportedImageMediaTypes = []string{"image/jpeg", "image/png", "image/gif", "image/webp"}
@@ -0,0 +1,111 @@
+package claude
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// GuardAction is what a content guard does when assistant text matches.
+type GuardAction int
+
+const (
+	// GuardActionInterrupt interrupts the turn. The receive continues and
+	// delivers the rest of the turn, ending with its ResultMessage.
+	GuardActionInterrupt GuardAction = iota
+	// GuardActionError interrupts the turn and ends the receive with a
+	// *ContentGuardError instead of the matching message.
+	GuardActionError
+)
+
+// contentGuard scans the assistant text of a turn for a pattern and trips at
+// most once per turn.
+type contentGuard struct {
+	pattern *regexp.Regexp
+	action  GuardAction
+
+	mu      sync.Mutex
+	block   strings.Builder // text streamed so far in the current content block
+	tripped bool
+}
+
+func newContentGuard(o *AgentOptions) *contentGuard {
+	if o.ContentGuardPattern == nil {
+		return nil
+	}
+	return &contentGuard{pattern: o.ContentGuardPattern, action: o.ContentGuardAction}
+}
+
+// check inspects top-level text deltas and assistant text blocks and returns
+// the matched text when the guard trips. Deltas are matched against the whole
+// block streamed so far, so a match split across deltas is found.
+func (g *contentGuard) check(msg Message) (string, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	switch m := msg.(type) {
+	case *StreamEvent:
+		if m.ParentToolUseID != "" {
+			return "", false
+		}
+		switch m.Event["type"] {
+		case "content_block_start":
+			g.block.Reset()
+		case "content_block_delta":
+			delta, _ := m.Event["delta"].(map[string]any)
+			if text, ok := delta["text"].(string); ok && delta["type"] == "text_delta" {
+				g.block.WriteString(text)
+				return g.match(g.block.String())
+			}
+		}
+	case *AssistantMessage:
+		for _, block := range m.Content {
+			if tb, ok := block.(*TextBlock); ok {
+				if match, ok := g.match(tb.Text); ok {
+					return match, true
+				}
+			}
+		}
+	case *ResultMessage:
+		g.block.Reset()
+		g.tripped = false
+	}
+	return "", false
+}
+
+func (g *contentGuard) match(text string) (string, bool) {
+	if g.tripped {
+		return "", false
+	}
+	loc := g.pattern.FindStringIndex(text)
+	if loc == nil {
+		return "", false
+	}
+	g.tripped = true
+	return text[loc[0]:loc[1]], true
+}
+
+// guardContent runs the content guard on msg. It interrupts the turn in the
+// background, as the control response is read by the same loop that feeds
+// the receiver.
+func (c *ClaudeClient) guardContent(msg Message) error {
+	if c.guard == nil {
+		return nil
+	}
+	match, ok := c.guard.check(msg)
+	if !ok {
+		return nil
+	}
+	go func() {
+		if err := c.Interrupt(context.Background()); err != nil {
+			loggerOr(c.options.Logger).Warnf("Content guard failed to interrupt the turn: %v", err)
+		}
+	}()
+	if c.guard.action == GuardActionError {
+		return &ContentGuardError{
+			SDKError: SDKError{Message: "assistant output matched the content guard"},
+			Match:    match,
+		}
+	}
+	return nil
+}
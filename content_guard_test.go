@@ -0,0 +1,167 @@
+package claude
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func textDelta(text, parentToolUseID string) *StreamEvent {
+	return &StreamEvent{
+		UUID:            "e",
+		SessionID:       "s",
+		ParentToolUseID: parentToolUseID,
+		Event: map[string]any{
+			"type":  "content_block_delta",
+			"index": float64(0),
+			"delta": map[string]any{"type": "text_delta", "text": text},
+		},
+	}
+}
+
+func TestContentGuardCheck(t *testing.T) {
+	blockStart := &StreamEvent{Event: map[string]any{"type": "content_block_start"}}
+	tests := []struct {
+		name      string
+		msgs      []Message
+		wantTrips []string // matched text of each trip, in order
+	}{
+		{
+			name:      "match split across deltas",
+			msgs:      []Message{blockStart, textDelta("the pass", ""), textDelta("word is", "")},
+			wantTrips: []string{"password"},
+		},
+		{
+			name:      "new block resets the buffer",
+			msgs:      []Message{blockStart, textDelta("pass", ""), blockStart, textDelta("word", "")},
+			wantTrips: nil,
+		},
+		{
+			name:      "subagent text ignored",
+			msgs:      []Message{textDelta("password", "tool-1")},
+			wantTrips: nil,
+		},
+		{
+			name:      "complete assistant message",
+			msgs:      []Message{&AssistantMessage{Content: []ContentBlock{&TextBlock{Text: "my password"}}}},
+			wantTrips: []string{"password"},
+		},
+		{
+			name: "once per turn, again after the result",
+			msgs: []Message{
+				textDelta("password", ""),
+				&AssistantMessage{Content: []ContentBlock{&TextBlock{Text: "password"}}},
+				&ResultMessage{Subtype: ResultSubtypeSuccess},
+				&AssistantMessage{Content: []ContentBlock{&TextBlock{Text: "password"}}},
+			},
+			wantTrips: []string{"password", "password"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newContentGuard(&AgentOptions{ContentGuardPattern: regexp.MustCompile(`pass\s*word`)})
+			var trips []string
+			for _, msg := range tt.msgs {
+				if match, ok := g.check(msg); ok {
+					trips = append(trips, match)
+				}
+			}
+			if len(trips) != len(tt.wantTrips) {
+				t.Fatalf("trips = %q, want %q", trips, tt.wantTrips)
+			}
+			for i := range trips {
+				if trips[i] != tt.wantTrips[i] {
+					t.Errorf("trip %d = %q, want %q", i, trips[i], tt.wantTrips[i])
+				}
+			}
+		})
+	}
+}
+
+func TestClientContentGuard(t *testing.T) {
+	tests := []struct {
+		name       string
+		action     GuardAction
+		wantErr    bool
+		wantResult bool
+	}{
+		{"interrupt", GuardActionInterrupt, false, true},
+		{"error", GuardActionError, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, _ := writableClient(t)
+			defer client.Close()
+			client.options = applyOptions([]Option{WithContentGuard(regexp.MustCompile(`secret`), tt.action)})
+			client.guard = newContentGuard(client.options)
+			mt := client.query.transport.(*mockTransport)
+			stop := make(chan struct{})
+			defer close(stop)
+			go ackControlRequests(mt, stop)
+
+			for _, text := range []string{"the sec", "ret is"} {
+				mt.msgChan <- map[string]any{
+					"type":       "stream_event",
+					"uuid":       "e",
+					"session_id": "s",
+					"event": map[string]any{
+						"type":  "content_block_delta",
+						"delta": map[string]any{"type": "text_delta", "text": text},
+					},
+				}
+			}
+			mt.msgChan <- map[string]any{
+				"type": "result", "subtype": "error_during_execution", "is_error": false,
+				"duration_ms": float64(1), "duration_api_ms": float64(1), "num_turns": float64(1), "session_id": "s",
+			}
+
+			var gotErr error
+			gotResult := false
+			for msg, err := range client.Messages2(context.Background()) {
+				if err != nil {
+					gotErr = err
+					break
+				}
+				if _, ok := msg.(*ResultMessage); ok {
+					gotResult = true
+					break
+				}
+			}
+
+			var guardErr *ContentGuardError
+			if tt.wantErr != errors.As(gotErr, &guardErr) {
+				t.Errorf("expected ContentGuardError=%v, got %v", tt.wantErr, gotErr)
+			}
+			if guardErr != nil && guardErr.Match != "secret" {
+				t.Errorf("Match = %q, want %q", guardErr.Match, "secret")
+			}
+			if gotResult != tt.wantResult {
+				t.Errorf("expected result delivered=%v", tt.wantResult)
+			}
+
+			deadline := time.Now().Add(2 * time.Second)
+			for !wroteInterrupt(mt) {
+				if time.Now().After(deadline) {
+					t.Fatalf("expected an interrupt control request, wrote %q", mt.getWritten())
+				}
+				time.Sleep(time.Millisecond)
+			}
+		})
+	}
+}
+
+func wroteInterrupt(mt *mockTransport) bool {
+	for _, line := range mt.getWritten() {
+		var req struct {
+			Type    string         `json:"type"`
+			Request map[string]any `json:"request"`
+		}
+		if json.Unmarshal([]byte(line), &req) == nil && req.Type == "control_request" && req.Request["subtype"] == "interrupt" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+package claude
+
+import (
+	"context"
+	"sync"
+)
+
+// MessageUUID returns the CLI-assigned UUID of msg, or "" when the message
+// type carries none or the CLI did not send one.
+func MessageUUID(msg Message) string {
+	switch m := msg.(type) {
+	case *UserMessage:
+		return m.UUID
+	case *AssistantMessage:
+		return m.UUID
+	case *ResultMessage:
+		return m.UUID
+	case *StreamEvent:
+		return m.UUID
+	case *SystemMessage:
+		uuid, _ := m.Data["uuid"].(string)
+		return uuid
+	}
+	return ""
+}
+
+// dedupeCapacity bounds the UUIDs a Deduplicator remembers. A replay repeats
+// recent history, so forgetting the oldest UUIDs keeps a long-lived client's
+// memory flat without letting replayed messages through.
+const dedupeCapacity = 10000
+
+// Deduplicator drops messages whose UUID has already been seen, such as the
+// history the CLI replays when a session is resumed. It remembers the most
+// recent 10000 UUIDs. Messages without a UUID and stream events, which are
+// not replayed, always pass. It is safe for concurrent use.
+type Deduplicator struct {
+	mu    sync.Mutex
+	seen  map[string]struct{}
+	order []string // the UUIDs in seen as a ring, oldest at next once full
+	next  int
+}
+
+// NewDeduplicator returns a Deduplicator that treats the given UUIDs as
+// already seen, e.g. the messages an app persisted before a restart.
+func NewDeduplicator(seen ...string) *Deduplicator {
+	d := &Deduplicator{seen: make(map[string]struct{}, len(seen))}
+	d.Mark(seen...)
+	return d
+}
+
+// Mark records UUIDs as seen.
+func (d *Deduplicator) Mark(uuids ...string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, uuid := range uuids {
+		if uuid != "" {
+			d.recordLocked(uuid)
+		}
+	}
+}
+
+// recordLocked adds uuid to seen, forgetting the oldest UUID when full.
+func (d *Deduplicator) recordLocked(uuid string) {
+	if _, ok := d.seen[uuid]; ok {
+		return
+	}
+	if len(d.order) < dedupeCapacity {
+		d.order = append(d.order, uuid)
+	} else {
+		delete(d.seen, d.order[d.next])
+		d.order[d.next] = uuid
+		d.next = (d.next + 1) % dedupeCapacity
+	}
+	d.seen[uuid] = struct{}{}
+}
+
+// Seen reports whether msg is a duplicate, and records its UUID otherwise.
+func (d *Deduplicator) Seen(msg Message) bool {
+	if _, ok := msg.(*StreamEvent); ok {
+		return false
+	}
+	uuid := MessageUUID(msg)
+	if uuid == "" {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.seen[uuid]; ok {
+		return true
+	}
+	d.recordLocked(uuid)
+	return false
+}
+
+// Filter forwards the messages from in that have not been seen. The returned
+// channel is closed when in is closed or ctx is done.
+func (d *Deduplicator) Filter(ctx context.Context, in <-chan Message) <-chan Message {
+	out := make(chan Message, 100)
+	go func() {
+		defer close(out)
+		for msg := range in {
+			if d.Seen(msg) {
+				continue
+			}
+			select {
+			case out <- msg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
@@ -0,0 +1,150 @@
+package claude
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func assistantWithUUID(uuid, text string) map[string]any {
+	raw := map[string]any{
+		"type": "assistant",
+		"message": map[string]any{
+			"model":   "claude-sonnet-4-5",
+			"content": []any{map[string]any{"type": "text", "text": text}},
+		},
+	}
+	if uuid != "" {
+		raw["uuid"] = uuid
+	}
+	return raw
+}
+
+func TestMessageUUID(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  map[string]any
+		want string
+	}{
+		{"user", map[string]any{"type": "user", "uuid": "u-1", "message": map[string]any{"content": "hi"}}, "u-1"},
+		{"assistant", assistantWithUUID("a-1", "hi"), "a-1"},
+		{"result", map[string]any{
+			"type": "result", "subtype": "success", "duration_ms": 1.0, "duration_api_ms": 1.0,
+			"is_error": false, "num_turns": 1.0, "session_id": "s", "uuid": "r-1",
+		}, "r-1"},
+		{"system", map[string]any{"type": "system", "subtype": "init", "uuid": "s-1"}, "s-1"},
+		{"missing", assistantWithUUID("", "hi"), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := parseMessage(tt.raw)
+			if err != nil {
+				t.Fatalf("parseMessage: %v", err)
+			}
+			if got := MessageUUID(msg); got != tt.want {
+				t.Errorf("MessageUUID = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeduplicator(t *testing.T) {
+	d := NewDeduplicator("seeded")
+	tests := []struct {
+		name string
+		msg  Message
+		dup  bool
+	}{
+		{"first", &AssistantMessage{UUID: "a"}, false},
+		{"repeat", &AssistantMessage{UUID: "a"}, true},
+		{"same uuid other type", &UserMessage{UUID: "a"}, true},
+		{"seeded", &UserMessage{UUID: "seeded"}, true},
+		{"no uuid", &AssistantMessage{}, false},
+		{"no uuid again", &AssistantMessage{}, false},
+		{"stream event", &StreamEvent{UUID: "e"}, false},
+		{"stream event again", &StreamEvent{UUID: "e"}, false},
+	}
+	for _, tt := range tests {
+		if got := d.Seen(tt.msg); got != tt.dup {
+			t.Errorf("%s: Seen = %v, want %v", tt.name, got, tt.dup)
+		}
+	}
+}
+
+func TestDeduplicatorForgetsOldest(t *testing.T) {
+	d := NewDeduplicator()
+	for i := range dedupeCapacity + 1 {
+		if d.Seen(&AssistantMessage{UUID: fmt.Sprintf("a-%d", i)}) {
+			t.Fatalf("a-%d: unexpected duplicate", i)
+		}
+	}
+	if len(d.seen) != dedupeCapacity {
+		t.Errorf("expected %d remembered UUIDs, got %d", dedupeCapacity, len(d.seen))
+	}
+	if !d.Seen(&AssistantMessage{UUID: fmt.Sprintf("a-%d", dedupeCapacity)}) {
+		t.Error("expected the newest UUID to be remembered")
+	}
+	if d.Seen(&AssistantMessage{UUID: "a-0"}) {
+		t.Error("expected the oldest UUID to be forgotten")
+	}
+}
+
+func TestDeduplicatorFilter(t *testing.T) {
+	in := make(chan Message, 4)
+	in <- &AssistantMessage{UUID: "a", Model: "first"}
+	in <- &AssistantMessage{UUID: "a", Model: "replayed"}
+	in <- &AssistantMessage{UUID: "b"}
+	in <- &AssistantMessage{UUID: "b"}
+	close(in)
+
+	var got []Message
+	for msg := range NewDeduplicator().Filter(context.Background(), in) {
+		got = append(got, msg)
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(got))
+	}
+	if am := got[0].(*AssistantMessage); am.Model != "first" {
+		t.Errorf("expected the first copy to pass, got %q", am.Model)
+	}
+}
+
+func TestNewClientDedupeOnResume(t *testing.T) {
+	if NewClient().dedupe != nil {
+		t.Error("expected no deduplicator by default")
+	}
+	if NewClient(WithDedupeOnResume()).dedupe == nil {
+		t.Error("expected WithDedupeOnResume to set a deduplicator")
+	}
+}
+
+func TestClientDedupeOnResume(t *testing.T) {
+	client, mt := testableClient(t, queryOptions{})
+	defer client.Close()
+	client.dedupe = NewDeduplicator()
+
+	mt.msgChan <- assistantWithUUID("a", "one")
+	mt.msgChan <- assistantWithUUID("a", "one replayed")
+	mt.msgChan <- assistantWithUUID("b", "two")
+	mt.msgChan <- assistantWithUUID("", "untracked")
+	mt.msgChan <- assistantWithUUID("b", "two replayed")
+	close(mt.msgChan)
+
+	var texts []string
+	for msg, err := range client.Messages2(context.Background()) {
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		am := msg.(*AssistantMessage)
+		texts = append(texts, am.Content[0].(*TextBlock).Text)
+	}
+	want := []string{"one", "two", "untracked"}
+	if len(texts) != len(want) {
+		t.Fatalf("got %v, want %v", texts, want)
+	}
+	for i := range want {
+		if texts[i] != want[i] {
+			t.Errorf("message %d = %q, want %q", i, texts[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package claude
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Environment variables read by OptionsFromEnv.
+const (
+	EnvModel          = "CLAUDE_MODEL"           // WithModel
+	EnvFallbackModel  = "CLAUDE_FALLBACK_MODEL"  // WithFallbackModel
+	EnvPermissionMode = "CLAUDE_PERMISSION_MODE" // WithPermissionMode: default, acceptEdits, plan or bypassPermissions
+	EnvMaxTurns       = "CLAUDE_MAX_TURNS"       // WithMaxTurns: a positive integer
+	EnvMaxBudgetUSD   = "CLAUDE_MAX_BUDGET_USD"  // WithMaxBudgetUSD: a positive number
+	EnvCwd            = "CLAUDE_CWD"             // WithCwd
+)
+
+// OptionsFromEnv returns the options set by the Env* variables, skipping
+// unset and empty ones. Put explicit options after them so they win:
+//
+//	envOpts, err := claude.OptionsFromEnv()
+//	if err != nil {
+//		return err
+//	}
+//	client := claude.NewClient(append(envOpts, claude.WithMaxTurns(5))...)
+//
+// A malformed value fails the whole call with an error naming every bad
+// variable, rather than running with part of the intended configuration.
+//
+// CLAUDE_CODE_CLI and CLAUDE_CLI_PATH are not read here: the CLI search
+// already honours them whenever WithCLIPath is not set.
+func OptionsFromEnv() ([]Option, error) {
+	var opts []Option
+	var problems []string
+	for _, name := range []string{EnvModel, EnvFallbackModel, EnvPermissionMode, EnvMaxTurns, EnvMaxBudgetUSD, EnvCwd} {
+		value := strings.TrimSpace(os.Getenv(name))
+		if value == "" {
+			continue
+		}
+		switch name {
+		case EnvModel:
+			opts = append(opts, WithModel(value))
+		case EnvFallbackModel:
+			opts = append(opts, WithFallbackModel(value))
+		case EnvPermissionMode:
+			mode := PermissionMode(value)
+			switch mode {
+			case PermissionDefault, PermissionAcceptEdits, PermissionPlan, PermissionBypassPermissions:
+				opts = append(opts, WithPermissionMode(mode))
+			default:
+				problems = append(problems, fmt.Sprintf("%s=%q is not a permission mode", name, value))
+			}
+		case EnvMaxTurns:
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				problems = append(problems, fmt.Sprintf("%s=%q is not a positive integer", name, value))
+				continue
+			}
+			opts = append(opts, WithMaxTurns(n))
+		case EnvMaxBudgetUSD:
+			budget, err := strconv.ParseFloat(value, 64)
+			if err != nil || !(budget > 0) {
+				problems = append(problems, fmt.Sprintf("%s=%q is not a positive number", name, value))
+				continue
+			}
+			opts = append(opts, WithMaxBudgetUSD(budget))
+		case EnvCwd:
+			opts = append(opts, WithCwd(value))
+		}
+	}
+	if len(problems) > 0 {
+		return nil, &SDKError{Message: "invalid environment: " + strings.Join(problems, "; ")}
+	}
+	return opts, nil
+}
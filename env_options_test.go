@@ -0,0 +1,70 @@
+package claude
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOptionsFromEnv(t *testing.T) {
+	t.Setenv(EnvModel, "claude-sonnet-4-5")
+	t.Setenv(EnvFallbackModel, "claude-haiku-4-5")
+	t.Setenv(EnvPermissionMode, "acceptEdits")
+	t.Setenv(EnvMaxTurns, " 7 ")
+	t.Setenv(EnvMaxBudgetUSD, "2.5")
+	t.Setenv(EnvCwd, "/tmp/work")
+	t.Setenv("CLAUDE_CLI_PATH", "/opt/claude/bin/claude")
+
+	envOpts, err := OptionsFromEnv()
+	if err != nil {
+		t.Fatalf("OptionsFromEnv: %v", err)
+	}
+	opts := applyOptions(append(envOpts, WithMaxTurns(3)))
+
+	if opts.Model != "claude-sonnet-4-5" {
+		t.Errorf("Model = %q", opts.Model)
+	}
+	if opts.FallbackModel != "claude-haiku-4-5" {
+		t.Errorf("FallbackModel = %q", opts.FallbackModel)
+	}
+	if opts.PermissionMode != PermissionAcceptEdits {
+		t.Errorf("PermissionMode = %q", opts.PermissionMode)
+	}
+	if opts.MaxTurns != 3 {
+		t.Errorf("MaxTurns = %d, want the explicit 3", opts.MaxTurns)
+	}
+	if opts.MaxBudgetUSD == nil || *opts.MaxBudgetUSD != 2.5 {
+		t.Errorf("MaxBudgetUSD = %v", opts.MaxBudgetUSD)
+	}
+	if opts.Cwd != "/tmp/work" {
+		t.Errorf("Cwd = %q", opts.Cwd)
+	}
+	if opts.CLIPath != "" {
+		t.Errorf("CLIPath = %q, want the CLI path left to the CLI search", opts.CLIPath)
+	}
+}
+
+func TestOptionsFromEnvMalformed(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{EnvPermissionMode, "yolo"},
+		{EnvMaxTurns, "ten"},
+		{EnvMaxTurns, "0"},
+		{EnvMaxBudgetUSD, "-1"},
+		{EnvMaxBudgetUSD, "NaN"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+"="+tt.value, func(t *testing.T) {
+			t.Setenv(EnvModel, "claude-sonnet-4-5")
+			t.Setenv(tt.name, tt.value)
+			opts, err := OptionsFromEnv()
+			if err == nil {
+				t.Fatalf("expected error, got %d options", len(opts))
+			}
+			if !strings.Contains(err.Error(), tt.name) {
+				t.Errorf("error %q does not name %s", err, tt.name)
+			}
+		})
+	}
+}
@@ -1,6 +1,10 @@
 package claude
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"time"
+)
 
 // SDKError is the base error type for all Claude SDK errors.
 type SDKError struct {
@@ -28,6 +32,7 @@ type CLIConnectionError struct {
 type CLINotFoundError struct {
 	CLIConnectionError
 	CLIPath string
+	EnvVar  string // the variable that set CLIPath; "" when the CLI was searched for
 }
 
 // ProcessError is raised when the CLI process fails.
@@ -52,6 +57,20 @@ func NewProcessError(message string, exitCode int, stderr string) *ProcessError
 	}
 }
 
+// ProcessExitedError is raised when the CLI process is gone, e.g. a write hit
+// a broken pipe. It is returned as the Cause of a CLIConnectionError, so
+// callers can branch on it with errors.As to trigger a reconnect.
+type ProcessExitedError struct {
+	SDKError
+}
+
+// AuthenticationRequiredError is raised when the CLI prints a login or API key
+// prompt to stdout instead of starting the JSON stream.
+type AuthenticationRequiredError struct {
+	SDKError
+	Prompt string // the stdout line that matched
+}
+
 // CLIJSONDecodeError is raised when unable to decode JSON from CLI output.
 type CLIJSONDecodeError struct {
 	SDKError
@@ -63,3 +82,71 @@ type MessageParseError struct {
 	SDKError
 	Data map[string]any
 }
+
+// ErrPerSessionCwdUnsupported is returned when an input message sets
+// InputOverrideCwd. The CLI runs every session of a connection in the
+// process working directory.
+var ErrPerSessionCwdUnsupported = errors.New("per-session cwd is not supported by the CLI; use a separate client with WithCwd")
+
+// ErrTransportReused is returned when a second connection would use a
+// WithTransport transport, which the SDK closed with the first one.
+var ErrTransportReused = errors.New("the WithTransport transport was closed with an earlier connection; pass a fresh Transport")
+
+// SessionNotFoundError is raised when resuming a session that does not exist.
+type SessionNotFoundError struct {
+	SDKError
+	SessionID string
+}
+
+// ModelMismatchError is raised under WithStrictModelPinning when a response
+// comes from a model other than the requested one.
+type ModelMismatchError struct {
+	SDKError
+	Requested string
+	Actual    string
+}
+
+// SessionDurationExceededError is raised when a ClaudeClient is sent new
+// input after its WithMaxSessionDuration budget has run out.
+type SessionDurationExceededError struct {
+	SDKError
+	Limit time.Duration
+}
+
+// ContentGuardError is raised when assistant output matches a WithContentGuard
+// pattern with GuardActionError.
+type ContentGuardError struct {
+	SDKError
+	Match string // the matched text
+}
+
+// IncompleteResponseError is raised when the message stream ends before a
+// ResultMessage arrives, e.g. when the CLI exits cleanly after an interrupt.
+type IncompleteResponseError struct {
+	SDKError
+}
+
+func newIncompleteResponseError() *IncompleteResponseError {
+	return &IncompleteResponseError{SDKError: SDKError{Message: "message stream ended before a result message was received"}}
+}
+
+// ResponseTimeoutError is raised by ClaudeClient.ReceiveResponseTimeout when
+// no ResultMessage arrives in time.
+type ResponseTimeoutError struct {
+	SDKError
+	Timeout time.Duration
+}
+
+// SessionBusyError is raised under WithStrictSessions when input is sent for a
+// session that has a turn in flight from another sender.
+type SessionBusyError struct {
+	SDKError
+	SessionID string
+}
+
+// InputTooLongError is raised when a prompt exceeds WithMaxInputTokens.
+type InputTooLongError struct {
+	SDKError
+	EstimatedTokens int
+	MaxTokens       int
+}
@@ -1,7 +1,10 @@
 package claude
 
 import (
+	"context"
 	"errors"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -107,3 +110,25 @@ func TestErrorHierarchyIs(t *testing.T) {
 		t.Error("ProcessError should chain to its cause via errors.Is")
 	}
 }
+
+func TestQueryIncompleteResponse(t *testing.T) {
+	cli := filepath.Join(t.TempDir(), "claude")
+	script := "#!/bin/sh\ncat >/dev/null\n" +
+		`echo '{"type":"assistant","message":{"model":"claude-sonnet-4-5","content":[{"type":"text","text":"partial"}]}}'` + "\n"
+	if err := os.WriteFile(cli, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	msgChan, errChan := Query(context.Background(), "hi", WithCLIPath(cli), WithInputFormat(InputFormatText))
+	var count int
+	for range msgChan {
+		count++
+	}
+	if count != 1 {
+		t.Errorf("expected 1 message, got %d", count)
+	}
+	var incomplete *IncompleteResponseError
+	if err := <-errChan; !errors.As(err, &incomplete) {
+		t.Fatalf("expected IncompleteResponseError, got %v", err)
+	}
+}
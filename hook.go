@@ -1,6 +1,9 @@
 package claude
 
-import "context"
+import (
+	"context"
+	"time"
+)
 
 // HookEvent represents the type of hook event.
 type HookEvent string
@@ -18,8 +21,9 @@ const (
 	HookPermissionRequest  HookEvent = "PermissionRequest"
 )
 
-// HookInput represents input data for hook callbacks.
-// Use HookEventName field to determine the specific type.
+// HookInput represents input data for hook callbacks as sent by the CLI, with
+// the fields of every event. Typed returns a view with only the fields of
+// HookEventName's event.
 type HookInput struct {
 	// Common fields
 	SessionID      string `json:"session_id"`
@@ -85,9 +89,13 @@ type HookSpecificOutput struct {
 
 // HookJSONOutput represents the output from a hook callback.
 type HookJSONOutput struct {
-	// Async mode
-	Async        *bool `json:"async,omitempty"`
-	AsyncTimeout *int  `json:"asyncTimeout,omitempty"`
+	// Async mode: the hook is acknowledged at once and AsyncWork, when set,
+	// runs in the background for up to AsyncTimeout milliseconds. Its output
+	// is sent as a second response to the same hook request. See
+	// NewAsyncHookOutput.
+	Async        *bool                                              `json:"async,omitempty"`
+	AsyncTimeout *int                                               `json:"asyncTimeout,omitempty"`
+	AsyncWork    func(ctx context.Context) (*HookJSONOutput, error) `json:"-"`
 
 	// Sync mode - common control fields
 	Continue       *bool  `json:"continue,omitempty"`
@@ -105,7 +113,10 @@ type HookJSONOutput struct {
 
 // HookContext provides context information for hook callbacks.
 type HookContext struct {
-	Signal any // Future: abort signal support
+	// Signal is cancelled when the CLI withdraws the hook request or when the
+	// matcher's Timeout, or WithGlobalTimeout without one, expires. Hooks doing
+	// slow I/O should stop when it is done; their output is then discarded.
+	Signal context.Context
 }
 
 // HookCallback is the signature for hook callback functions.
@@ -117,8 +128,48 @@ type HookCallback func(
 ) (*HookJSONOutput, error)
 
 // HookMatcher defines a hook matcher configuration.
+//
+// Matcher is a regular expression that must match the whole tool name, e.g.
+// "Bash", "Write|Edit" or "mcp__.*"; "" and "*" match every tool. The SDK
+// checks it as well as the CLI, so Hooks never see other tools' calls.
+// Events without a tool, such as Notification, are not filtered.
 type HookMatcher struct {
 	Matcher string // Tool name pattern (e.g., "Bash", "Write|Edit")
 	Hooks   []HookCallback
 	Timeout *float64 // Timeout in seconds
 }
+
+// NewAsyncHookOutput returns a hook output that acknowledges the hook at once
+// and runs work in the background, cancelling its context after timeout (no
+// limit when zero). The output work returns, or its error, is sent when it
+// finishes.
+func NewAsyncHookOutput(timeout time.Duration, work func(ctx context.Context) (*HookJSONOutput, error)) *HookJSONOutput {
+	async := true
+	output := &HookJSONOutput{Async: &async, AsyncWork: work}
+	if timeout > 0 {
+		ms := max(1, int(timeout.Milliseconds()))
+		output.AsyncTimeout = &ms
+	}
+	return output
+}
+
+// NewStopHookContinue returns a Stop/SubagentStop hook output that prevents
+// the agent from stopping and feeds reason back to Claude as the instruction
+// for how to continue.
+//
+// When a Stop hook has already blocked once, the CLI sets StopHookActive on the
+// next Stop input. Callbacks should check it and return nil (allowing the stop)
+// when it is true, otherwise the agent can loop forever:
+//
+//	func(ctx context.Context, input claude.HookInput, _ string, _ claude.HookContext) (*claude.HookJSONOutput, error) {
+//	    if input.StopHookActive {
+//	        return nil, nil
+//	    }
+//	    return claude.NewStopHookContinue("Run the tests before finishing."), nil
+//	}
+func NewStopHookContinue(reason string) *HookJSONOutput {
+	return &HookJSONOutput{
+		Decision: "block",
+		Reason:   reason,
+	}
+}
@@ -0,0 +1,165 @@
+package claude
+
+// TypedHookInput is a sealed interface over the per-event views of a
+// HookInput. Get one with HookInput.Typed and use a type switch:
+//
+//	switch in := input.Typed().(type) {
+//	case *PreToolUseInput:
+//		log.Printf("about to run %s", in.ToolName)
+//	case *NotificationInput:
+//		log.Printf("notification: %s", in.Message)
+//	}
+type TypedHookInput interface {
+	hookEvent() HookEvent
+}
+
+// HookInputBase holds the fields common to every hook event.
+type HookInputBase struct {
+	SessionID      string
+	TranscriptPath string
+	Cwd            string
+	PermissionMode string
+}
+
+// PreToolUseInput is the input of a PreToolUse hook.
+type PreToolUseInput struct {
+	HookInputBase
+	ToolName  string
+	ToolInput map[string]any
+	ToolUseID string
+}
+
+// PostToolUseInput is the input of a PostToolUse hook.
+type PostToolUseInput struct {
+	HookInputBase
+	ToolName     string
+	ToolInput    map[string]any
+	ToolUseID    string
+	ToolResponse any
+}
+
+// PostToolUseFailureInput is the input of a PostToolUseFailure hook.
+type PostToolUseFailureInput struct {
+	HookInputBase
+	ToolName    string
+	ToolInput   map[string]any
+	ToolUseID   string
+	Error       string
+	IsInterrupt bool
+}
+
+// UserPromptSubmitInput is the input of a UserPromptSubmit hook.
+type UserPromptSubmitInput struct {
+	HookInputBase
+	Prompt string
+}
+
+// StopInput is the input of a Stop hook.
+type StopInput struct {
+	HookInputBase
+	StopHookActive bool
+}
+
+// SubagentStopInput is the input of a SubagentStop hook.
+type SubagentStopInput struct {
+	HookInputBase
+	StopHookActive      bool
+	AgentID             string
+	AgentTranscriptPath string
+	AgentType           string
+}
+
+// SubagentStartInput is the input of a SubagentStart hook.
+type SubagentStartInput struct {
+	HookInputBase
+	AgentID   string
+	AgentType string
+}
+
+// PreCompactInput is the input of a PreCompact hook.
+type PreCompactInput struct {
+	HookInputBase
+	Trigger            string // "manual" or "auto"
+	CustomInstructions string
+}
+
+// NotificationInput is the input of a Notification hook.
+type NotificationInput struct {
+	HookInputBase
+	Message          string
+	Title            string
+	NotificationType string
+}
+
+// PermissionRequestInput is the input of a PermissionRequest hook.
+type PermissionRequestInput struct {
+	HookInputBase
+	ToolName              string
+	ToolInput             map[string]any
+	PermissionSuggestions []PermissionUpdate
+}
+
+func (*PreToolUseInput) hookEvent() HookEvent         { return HookPreToolUse }
+func (*PostToolUseInput) hookEvent() HookEvent        { return HookPostToolUse }
+func (*PostToolUseFailureInput) hookEvent() HookEvent { return HookPostToolUseFailure }
+func (*UserPromptSubmitInput) hookEvent() HookEvent   { return HookUserPromptSubmit }
+func (*StopInput) hookEvent() HookEvent               { return HookStop }
+func (*SubagentStopInput) hookEvent() HookEvent       { return HookSubagentStop }
+func (*SubagentStartInput) hookEvent() HookEvent      { return HookSubagentStart }
+func (*PreCompactInput) hookEvent() HookEvent         { return HookPreCompact }
+func (*NotificationInput) hookEvent() HookEvent       { return HookNotification }
+func (*PermissionRequestInput) hookEvent() HookEvent  { return HookPermissionRequest }
+
+// Typed returns the view of h for its HookEventName, holding only the fields
+// that event carries. It returns nil for an event the SDK does not know; h
+// itself stays available for those.
+func (h HookInput) Typed() TypedHookInput {
+	base := HookInputBase{
+		SessionID:      h.SessionID,
+		TranscriptPath: h.TranscriptPath,
+		Cwd:            h.Cwd,
+		PermissionMode: h.PermissionMode,
+	}
+	switch HookEvent(h.HookEventName) {
+	case HookPreToolUse:
+		return &PreToolUseInput{HookInputBase: base, ToolName: h.ToolName, ToolInput: h.ToolInput, ToolUseID: h.ToolUseID}
+	case HookPostToolUse:
+		return &PostToolUseInput{HookInputBase: base, ToolName: h.ToolName, ToolInput: h.ToolInput, ToolUseID: h.ToolUseID, ToolResponse: h.ToolResponse}
+	case HookPostToolUseFailure:
+		return &PostToolUseFailureInput{
+			HookInputBase: base,
+			ToolName:      h.ToolName,
+			ToolInput:     h.ToolInput,
+			ToolUseID:     h.ToolUseID,
+			Error:         h.ErrorMsg,
+			IsInterrupt:   h.IsInterrupt != nil && *h.IsInterrupt,
+		}
+	case HookUserPromptSubmit:
+		return &UserPromptSubmitInput{HookInputBase: base, Prompt: h.Prompt}
+	case HookStop:
+		return &StopInput{HookInputBase: base, StopHookActive: h.StopHookActive}
+	case HookSubagentStop:
+		return &SubagentStopInput{
+			HookInputBase:       base,
+			StopHookActive:      h.StopHookActive,
+			AgentID:             h.AgentID,
+			AgentTranscriptPath: h.AgentTranscriptPath,
+			AgentType:           h.AgentType,
+		}
+	case HookSubagentStart:
+		return &SubagentStartInput{HookInputBase: base, AgentID: h.AgentID, AgentType: h.AgentType}
+	case HookPreCompact:
+		return &PreCompactInput{HookInputBase: base, Trigger: h.Trigger, CustomInstructions: h.CustomInstructions}
+	case HookNotification:
+		return &NotificationInput{HookInputBase: base, Message: h.NotificationMessage, Title: h.Title, NotificationType: h.NotificationType}
+	case HookPermissionRequest:
+		var suggestions []PermissionUpdate
+		for _, raw := range h.PermissionSuggestions {
+			if m, ok := raw.(map[string]any); ok {
+				suggestions = append(suggestions, parsePermissionUpdate(m))
+			}
+		}
+		return &PermissionRequestInput{HookInputBase: base, ToolName: h.ToolName, ToolInput: h.ToolInput, PermissionSuggestions: suggestions}
+	}
+	return nil
+}
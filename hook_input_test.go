@@ -0,0 +1,91 @@
+package claude
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHookInputTyped(t *testing.T) {
+	base := HookInputBase{SessionID: "sess-1", TranscriptPath: "/tmp/t.jsonl", Cwd: "/work", PermissionMode: "default"}
+	common := map[string]any{
+		"session_id":      "sess-1",
+		"transcript_path": "/tmp/t.jsonl",
+		"cwd":             "/work",
+		"permission_mode": "default",
+	}
+	with := func(fields map[string]any) map[string]any {
+		m := map[string]any{}
+		for k, v := range common {
+			m[k] = v
+		}
+		for k, v := range fields {
+			m[k] = v
+		}
+		return m
+	}
+
+	tests := []struct {
+		name string
+		raw  map[string]any
+		want TypedHookInput
+	}{
+		{
+			name: "PreToolUse",
+			raw: with(map[string]any{
+				"hook_event_name": "PreToolUse",
+				"tool_name":       "Bash",
+				"tool_input":      map[string]any{"command": "ls"},
+				"tool_use_id":     "toolu_1",
+			}),
+			want: &PreToolUseInput{HookInputBase: base, ToolName: "Bash", ToolInput: map[string]any{"command": "ls"}, ToolUseID: "toolu_1"},
+		},
+		{
+			name: "Notification",
+			raw: with(map[string]any{
+				"hook_event_name":   "Notification",
+				"message":           "Claude needs your permission",
+				"title":             "Permission",
+				"notification_type": "permission_prompt",
+			}),
+			want: &NotificationInput{HookInputBase: base, Message: "Claude needs your permission", Title: "Permission", NotificationType: "permission_prompt"},
+		},
+		{
+			name: "PostToolUseFailure",
+			raw: with(map[string]any{
+				"hook_event_name": "PostToolUseFailure",
+				"tool_name":       "Bash",
+				"error":           "exit 1",
+				"is_interrupt":    true,
+			}),
+			want: &PostToolUseFailureInput{HookInputBase: base, ToolName: "Bash", Error: "exit 1", IsInterrupt: true},
+		},
+		{
+			name: "PermissionRequest",
+			raw: with(map[string]any{
+				"hook_event_name": "PermissionRequest",
+				"tool_name":       "Write",
+				"permission_suggestions": []any{
+					map[string]any{"type": "setMode", "mode": "acceptEdits", "destination": "session"},
+				},
+			}),
+			want: &PermissionRequestInput{
+				HookInputBase:         base,
+				ToolName:              "Write",
+				PermissionSuggestions: []PermissionUpdate{{Type: PermissionUpdateSetMode, Mode: PermissionAcceptEdits, Destination: PermissionDestSession}},
+			},
+		},
+		{
+			name: "unknown event",
+			raw:  with(map[string]any{"hook_event_name": "FutureEvent"}),
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseHookInput(tt.raw).Typed()
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Typed() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
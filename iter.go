@@ -0,0 +1,82 @@
+package claude
+
+import (
+	"context"
+	"iter"
+)
+
+// Query2 is Query as a range-over-func iterator:
+//
+//	for msg, err := range claude.Query2(ctx, prompt, opts...) {
+//		if err != nil {
+//			return err
+//		}
+//		...
+//	}
+//
+// A failure is yielded last as (nil, err). Breaking out of the loop cancels
+// the query and returns once the CLI subprocess has been cleaned up.
+func Query2(ctx context.Context, prompt string, opts ...Option) iter.Seq2[Message, error] {
+	return func(yield func(Message, error) bool) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		msgs, errs := Query(ctx, prompt, opts...)
+		yieldMessages(msgs, errs, cancel, yield)
+	}
+}
+
+// Messages2 is ReceiveMessagesWithErrors as a range-over-func iterator. A
+// failure, including cancellation of ctx, is yielded last as (nil, err).
+// Messages are read from the CLI only as the loop asks for them, so breaking
+// out leaves the client connected with any later messages still queued.
+func (c *ClaudeClient) Messages2(ctx context.Context) iter.Seq2[Message, error] {
+	return func(yield func(Message, error) bool) {
+		c.mu.Lock()
+		query := c.query
+		c.mu.Unlock()
+		if query == nil {
+			yield(nil, &CLIConnectionError{SDKError: SDKError{Message: "Not connected. Call Connect() first."}})
+			return
+		}
+		raw := query.receiveMessages()
+		for {
+			select {
+			case <-ctx.Done():
+				yield(nil, ctx.Err())
+				return
+			case rawMsg, ok := <-raw:
+				if !ok {
+					if err := query.err(); err != nil {
+						yield(nil, err)
+					}
+					return
+				}
+				msg, err := c.decodeMessage(query, rawMsg)
+				if err != nil {
+					yield(nil, err)
+					return
+				}
+				if msg != nil && !yield(msg, nil) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// yieldMessages feeds msgs and then the terminal error from errs to yield.
+// When yield asks to stop, it cancels the producer and drains msgs so the
+// producer has finished by the time it returns.
+func yieldMessages(msgs <-chan Message, errs <-chan error, cancel context.CancelFunc, yield func(Message, error) bool) {
+	for msg := range msgs {
+		if !yield(msg, nil) {
+			cancel()
+			for range msgs {
+			}
+			return
+		}
+	}
+	if err := <-errs; err != nil {
+		yield(nil, err)
+	}
+}
@@ -0,0 +1,124 @@
+package claude
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestQuery2BreakCleansUpSubprocess(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	cli := writeFakeCLI(t, `#!/bin/sh
+echo $$ > "`+pidFile+`"
+read -r line
+for i in 1 2 3; do
+  echo '{"type":"assistant","message":{"model":"claude-sonnet-4-5","content":[{"type":"text","text":"chunk"}]}}'
+done
+exec sleep 30
+`)
+
+	received := 0
+	for msg, err := range Query2(context.Background(), "hi", WithCLIPath(cli), WithInputFormat(InputFormatText)) {
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, ok := msg.(*AssistantMessage); !ok {
+			t.Fatalf("expected AssistantMessage, got %T", msg)
+		}
+		received++
+		break
+	}
+	if received != 1 {
+		t.Fatalf("expected to stop after 1 message, got %d", received)
+	}
+
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatalf("reading pid file: %v", err)
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	proc, err := os.FindProcess(pid)
+	if err == nil && proc.Signal(syscall.Signal(0)) == nil {
+		t.Errorf("expected CLI process %d to have exited after break", pid)
+	}
+}
+
+func TestQuery2YieldsTerminalError(t *testing.T) {
+	var results []error
+	for msg, err := range Query2(context.Background(), "hi", WithInputFormat("yaml")) {
+		if msg != nil {
+			t.Errorf("expected no messages, got %T", msg)
+		}
+		results = append(results, err)
+	}
+	if len(results) != 1 || results[0] == nil {
+		t.Fatalf("expected a single terminal error, got %v", results)
+	}
+}
+
+func TestClientMessages2(t *testing.T) {
+	client, mt := testableClient(t, queryOptions{})
+	defer client.Close()
+
+	for i := 0; i < 3; i++ {
+		mt.msgChan <- map[string]any{
+			"type": "assistant",
+			"message": map[string]any{
+				"model":   "claude-sonnet-4-5",
+				"content": []any{map[string]any{"type": "text", "text": "chunk"}},
+			},
+		}
+	}
+
+	seen := 0
+	for _, err := range client.Messages2(context.Background()) {
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		seen++
+		if seen == 2 {
+			break
+		}
+	}
+	if seen != 2 {
+		t.Fatalf("expected to stop after 2 messages, got %d", seen)
+	}
+
+	// The client stays connected and the remaining message is still queued.
+	close(mt.msgChan)
+	var rest []Message
+	var terminal error
+	for msg, err := range client.Messages2(context.Background()) {
+		if err != nil {
+			terminal = err
+			continue
+		}
+		rest = append(rest, msg)
+	}
+	if len(rest) != 1 {
+		t.Errorf("expected the unread message after break, got %d", len(rest))
+	}
+	if terminal != nil {
+		t.Errorf("unexpected terminal error: %v", terminal)
+	}
+}
+
+func TestClientMessages2Cancelled(t *testing.T) {
+	client, _ := testableClient(t, queryOptions{})
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var terminal error
+	for _, err := range client.Messages2(ctx) {
+		terminal = err
+	}
+	if !errors.Is(terminal, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", terminal)
+	}
+}
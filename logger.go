@@ -0,0 +1,33 @@
+package claude
+
+// Logger receives the SDK's internal diagnostics: waits while closing the
+// input stream, connect retries, and errors that have no caller to return to.
+// Set one with WithLogger; without it nothing is logged. An adapter for
+// log/slog is a few lines:
+//
+//	type slogLogger struct{ l *slog.Logger }
+//
+//	func (s slogLogger) Debugf(format string, args ...any) { s.l.Debug(fmt.Sprintf(format, args...)) }
+//	func (s slogLogger) Warnf(format string, args ...any)  { s.l.Warn(fmt.Sprintf(format, args...)) }
+//
+// Methods may be called from several goroutines at once.
+type Logger interface {
+	// Debugf logs routine progress, such as waiting for a result.
+	Debugf(format string, args ...any)
+	// Warnf logs a problem the SDK worked around or could not report.
+	Warnf(format string, args ...any)
+}
+
+// nopLogger discards everything.
+type nopLogger struct{}
+
+func (nopLogger) Debugf(string, ...any) {}
+func (nopLogger) Warnf(string, ...any)  {}
+
+// loggerOr returns l, or a no-op Logger when l is nil.
+func loggerOr(l Logger) Logger {
+	if l == nil {
+		return nopLogger{}
+	}
+	return l
+}
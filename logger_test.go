@@ -0,0 +1,60 @@
+package claude
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordingLogger keeps every formatted line, prefixed with its level.
+type recordingLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *recordingLogger) Debugf(format string, args ...any) {
+	l.add("debug: " + fmt.Sprintf(format, args...))
+}
+func (l *recordingLogger) Warnf(format string, args ...any) {
+	l.add("warn: " + fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) add(line string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, line)
+}
+
+func (l *recordingLogger) get() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.lines...)
+}
+
+func TestLoggerStreamCloseWait(t *testing.T) {
+	logger := &recordingLogger{}
+	opts := applyOptions([]Option{WithLogger(logger)})
+	handler := newQueryHandler(newMockTransport(), queryOptions{
+		Hooks:  map[string][]hookMatcherConfig{"Stop": {{Hooks: []HookCallback{nil}}}},
+		Logger: opts.Logger,
+	})
+	handler.streamCloseTimeout = 0.01
+
+	input := make(chan map[string]any)
+	close(input)
+	handler.streamInput(context.Background(), input)
+
+	lines := logger.get()
+	if len(lines) != 1 || !strings.HasPrefix(lines[0], "debug: Waiting for first result before closing stdin") {
+		t.Errorf("expected one stream-close debug line, got %q", lines)
+	}
+}
+
+func TestLoggerDefaultsToNop(t *testing.T) {
+	handler := newQueryHandler(newMockTransport(), queryOptions{})
+	if _, ok := handler.logger.(nopLogger); !ok {
+		t.Errorf("expected a no-op logger by default, got %T", handler.logger)
+	}
+}
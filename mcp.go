@@ -1,6 +1,15 @@
 package claude
 
-import "context"
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
 // McpStdioServerConfig represents an MCP stdio server configuration.
 type McpStdioServerConfig struct {
@@ -44,12 +53,30 @@ type McpServerConfig interface {
 	mcpServerConfigType() string
 }
 
-// MCPContent represents content in an MCP tool result.
+// MCPContent represents content in an MCP tool result: Text for "text",
+// base64 Data and MimeType for "image" and "audio", and Resource for an
+// embedded "resource".
 type MCPContent struct {
-	Type     string `json:"type"`
-	Text     string `json:"text,omitempty"`
-	Data     string `json:"data,omitempty"`
-	MimeType string `json:"mimeType,omitempty"`
+	Type     string              `json:"type"`
+	Text     string              `json:"text,omitempty"`
+	Data     string              `json:"data,omitempty"`
+	MimeType string              `json:"mimeType,omitempty"`
+	Resource *MCPResourceContent `json:"resource,omitempty"`
+}
+
+// TextContent returns text content.
+func TextContent(text string) MCPContent {
+	return MCPContent{Type: "text", Text: text}
+}
+
+// ImageContent returns image content from base64-encoded data.
+func ImageContent(data, mimeType string) MCPContent {
+	return MCPContent{Type: "image", Data: data, MimeType: mimeType}
+}
+
+// AudioContent returns audio content from base64-encoded data.
+func AudioContent(data, mimeType string) MCPContent {
+	return MCPContent{Type: "audio", Data: data, MimeType: mimeType}
 }
 
 // MCPToolResult represents the result from an MCP tool execution.
@@ -89,24 +116,205 @@ func NewMCPTool(name, description string, inputSchema map[string]any, handler MC
 	}
 }
 
+func (t *SdkMcpTool) isIdempotent() bool {
+	return t.Annotations != nil && t.Annotations.IdempotentHint != nil && *t.Annotations.IdempotentHint
+}
+
 // McpServer represents an in-process MCP server that handles tool calls.
 type McpServer struct {
 	Name    string
 	Version string
 	Tools   []*SdkMcpTool
 	toolMap map[string]*SdkMcpTool
+
+	mu           sync.RWMutex // guards Tools and toolMap against Reset
+	initialTools []*SdkMcpTool
+
+	contentRedactor  func(MCPContent) MCPContent
+	inputTransformer func(toolName string, args map[string]any) map[string]any
+	resultCache      *toolResultCache
+	resultFormatter  func(toolName string, result MCPToolResult) MCPToolResult
+	protocolVersion  string
+	descriptions     map[string]string
+	callSlots        chan struct{} // bounds concurrent handler calls when non-nil
+	imagePassthrough *imagePassthrough
+	negotiated       atomic.Value // protocol version from the last initialize
+	recorder         *toolCallRecorder
+	resources        []*MCPResource
+	prompts          []*MCPPrompt
+	logger           Logger
+}
+
+// McpServerOption is a functional option for configuring an McpServer.
+type McpServerOption func(*McpServer)
+
+// WithContentRedactor sets a function applied to each content item of a tool
+// result before it is returned to the CLI. Items redacted to empty text are dropped.
+func WithContentRedactor(fn func(MCPContent) MCPContent) McpServerOption {
+	return func(s *McpServer) { s.contentRedactor = fn }
+}
+
+// WithInputTransformer sets a function applied to tool arguments before the
+// tool handler runs, e.g. to coerce string-typed numbers in one place.
+func WithInputTransformer(fn func(toolName string, args map[string]any) map[string]any) McpServerOption {
+	return func(s *McpServer) { s.inputTransformer = fn }
+}
+
+// WithToolResultCache caches results of tools annotated with IdempotentHint,
+// keyed by tool name and arguments. At most maxEntries results are kept (oldest
+// evicted first; zero means unbounded) and entries expire after ttl (zero
+// means never). Error results are not cached.
+func WithToolResultCache(maxEntries int, ttl time.Duration) McpServerOption {
+	return func(s *McpServer) { s.resultCache = newToolResultCache(maxEntries, ttl) }
+}
+
+// WithToolResultFormatter sets a function applied to every successful tool
+// result before content redaction, so output formatting can be shared across
+// tools instead of repeated in each handler. JSONResultFormatter is a ready-made
+// formatter for JSON output.
+func WithToolResultFormatter(fn func(toolName string, result MCPToolResult) MCPToolResult) McpServerOption {
+	return func(s *McpServer) { s.resultFormatter = fn }
+}
+
+// JSONResultFormatter pretty-prints text content holding a JSON object or
+// array with two-space indentation. Numbers keep their original spelling and
+// other content is returned unchanged.
+func JSONResultFormatter(toolName string, result MCPToolResult) MCPToolResult {
+	formatted := make([]MCPContent, len(result.Content))
+	for i, item := range result.Content {
+		formatted[i] = item
+		if item.Type != "text" {
+			continue
+		}
+		trimmed := strings.TrimSpace(item.Text)
+		if !strings.HasPrefix(trimmed, "{") && !strings.HasPrefix(trimmed, "[") {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := json.Indent(&buf, []byte(trimmed), "", "  "); err == nil {
+			formatted[i].Text = buf.String()
+		}
+	}
+	result.Content = formatted
+	return result
+}
+
+// WithMaxConcurrentCalls caps how many tool handlers of this server run at
+// once, e.g. for servers backed by a single database connection. Further calls
+// wait for a free slot or for their context to end. n <= 0 means no limit.
+func WithMaxConcurrentCalls(n int) McpServerOption {
+	return func(s *McpServer) {
+		if n > 0 {
+			s.callSlots = make(chan struct{}, n)
+		} else {
+			s.callSlots = nil
+		}
+	}
+}
+
+// WithToolResultImagePassthrough writes image results of at least minBytes
+// (decoded) to files in dir (os.TempDir when empty) and returns them as MCP
+// resource_link content instead of inline base64, keeping large images out of
+// the control protocol. Links are only used once the CLI has negotiated
+// protocol version 2025-06-18 or later; otherwise, and whenever a file cannot
+// be written, images stay inline.
+//
+// The tradeoff: a linked image is not shown to the model directly, it has to
+// open the file (e.g. with the Read tool, which must be allowed to access
+// dir). Files are not removed by the SDK.
+func WithToolResultImagePassthrough(dir string, minBytes int) McpServerOption {
+	return func(s *McpServer) { s.imagePassthrough = &imagePassthrough{dir: dir, minBytes: minBytes} }
+}
+
+// WithToolDescriptions overrides the descriptions reported in tools/list for
+// the named tools, e.g. per locale, without touching the tool definitions.
+// Tools not in the map keep their own Description.
+func WithToolDescriptions(descriptions map[string]string) McpServerOption {
+	return func(s *McpServer) { s.descriptions = descriptions }
+}
+
+// WithMCPLogger routes the server's internal diagnostics, such as failed
+// WithToolCallRecorder writes, to l instead of discarding them.
+func WithMCPLogger(l Logger) McpServerOption {
+	return func(s *McpServer) { s.logger = l }
+}
+
+// WithMCPProtocolVersion pins the MCP protocol version reported in the
+// initialize response instead of negotiating it with the CLI.
+func WithMCPProtocolVersion(version string) McpServerOption {
+	return func(s *McpServer) { s.protocolVersion = version }
+}
+
+// DefaultMCPProtocolVersion is reported when the CLI requests no protocol
+// version, or one the SDK server does not support.
+const DefaultMCPProtocolVersion = "2024-11-05"
+
+// supportedMCPProtocolVersions lists the versions the SDK server can echo back.
+var supportedMCPProtocolVersions = map[string]bool{
+	"2024-11-05": true,
+	"2025-03-26": true,
+	"2025-06-18": true,
+}
+
+// negotiateProtocolVersion picks the protocol version for an initialize
+// request that asked for requested.
+func (s *McpServer) negotiateProtocolVersion(requested string) string {
+	if s.protocolVersion != "" {
+		return s.protocolVersion
+	}
+	if supportedMCPProtocolVersions[requested] {
+		return requested
+	}
+	return DefaultMCPProtocolVersion
+}
+
+// Reset returns the server to its state at creation so it can be reused for
+// another session: cached tool results and the negotiated protocol version are
+// cleared, and Tools is restored to the tools the server was created with.
+// It is safe to call while requests are being handled.
+func (s *McpServer) Reset() {
+	if s.resultCache != nil {
+		s.resultCache.clear()
+	}
+	s.negotiated.Store("")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.restoreTools()
+}
+
+// restoreTools sets Tools and toolMap to the initial tool set. The caller must
+// hold mu or have exclusive access to the server.
+func (s *McpServer) restoreTools() {
+	s.Tools = append([]*SdkMcpTool(nil), s.initialTools...)
+	s.toolMap = make(map[string]*SdkMcpTool, len(s.Tools))
+	for _, t := range s.Tools {
+		s.toolMap[t.Name] = t
+	}
 }
 
 // HandleInitialize handles the MCP initialize request.
 func (s *McpServer) HandleInitialize(id any) map[string]any {
+	return s.handleInitialize(id, "")
+}
+
+func (s *McpServer) handleInitialize(id any, requestedVersion string) map[string]any {
+	version := s.negotiateProtocolVersion(requestedVersion)
+	s.negotiated.Store(version)
+	capabilities := map[string]any{
+		"tools": map[string]any{},
+	}
+	if len(s.resources) > 0 {
+		capabilities["resources"] = map[string]any{}
+	}
+	if len(s.prompts) > 0 {
+		capabilities["prompts"] = map[string]any{}
+	}
 	return map[string]any{
 		"jsonrpc": "2.0",
 		"id":      id,
 		"result": map[string]any{
-			"protocolVersion": "2024-11-05",
-			"capabilities": map[string]any{
-				"tools": map[string]any{},
-			},
+			"protocolVersion": version,
+			"capabilities":    capabilities,
 			"serverInfo": map[string]any{
 				"name":    s.Name,
 				"version": s.Version,
@@ -117,15 +325,21 @@ func (s *McpServer) HandleInitialize(id any) map[string]any {
 
 // HandleListTools handles the MCP tools/list request.
 func (s *McpServer) HandleListTools(id any) map[string]any {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	tools := make([]map[string]any, 0, len(s.Tools))
 	for _, t := range s.Tools {
 		schema := t.InputSchema
 		if schema == nil {
 			schema = map[string]any{"type": "object", "properties": map[string]any{}}
 		}
+		description := t.Description
+		if override, ok := s.descriptions[t.Name]; ok {
+			description = override
+		}
 		toolData := map[string]any{
 			"name":        t.Name,
-			"description": t.Description,
+			"description": description,
 			"inputSchema": schema,
 		}
 		if t.Annotations != nil {
@@ -142,7 +356,9 @@ func (s *McpServer) HandleListTools(id any) map[string]any {
 
 // HandleCallTool handles the MCP tools/call request.
 func (s *McpServer) HandleCallTool(ctx context.Context, id any, name string, arguments map[string]any) map[string]any {
+	s.mu.RLock()
 	tool, ok := s.toolMap[name]
+	s.mu.RUnlock()
 	if !ok {
 		return map[string]any{
 			"jsonrpc": "2.0",
@@ -154,28 +370,93 @@ func (s *McpServer) HandleCallTool(ctx context.Context, id any, name string, arg
 		}
 	}
 
-	result, err := tool.Handler(ctx, arguments)
-	if err != nil {
-		return map[string]any{
-			"jsonrpc": "2.0",
-			"id":      id,
-			"error": map[string]any{
-				"code":    -32603,
-				"message": err.Error(),
-			},
+	if s.inputTransformer != nil {
+		arguments = s.inputTransformer(name, arguments)
+		if arguments == nil {
+			arguments = map[string]any{}
 		}
 	}
 
+	var cacheKey string
+	cacheable := s.resultCache != nil && tool.isIdempotent()
+	if cacheable {
+		cacheKey, cacheable = toolResultCacheKey(name, arguments)
+	}
+
+	result, cached := MCPToolResult{}, false
+	if cacheable {
+		result, cached = s.resultCache.get(cacheKey)
+	}
+	if !cached {
+		if s.callSlots != nil {
+			select {
+			case s.callSlots <- struct{}{}:
+				defer func() { <-s.callSlots }()
+			case <-ctx.Done():
+				return map[string]any{
+					"jsonrpc": "2.0",
+					"id":      id,
+					"error": map[string]any{
+						"code":    -32603,
+						"message": ctx.Err().Error(),
+					},
+				}
+			}
+		}
+		var err error
+		result, err = tool.Handler(ctx, arguments)
+		if err != nil {
+			if s.recorder != nil {
+				s.recorder.record(loggerOr(s.logger), ToolCallRecord{Tool: name, Input: arguments, Error: err.Error()})
+			}
+			code := -32603
+			var invalid *invalidParamsError
+			if errors.As(err, &invalid) {
+				code = -32602
+			}
+			return map[string]any{
+				"jsonrpc": "2.0",
+				"id":      id,
+				"error": map[string]any{
+					"code":    code,
+					"message": err.Error(),
+				},
+			}
+		}
+		if cacheable && !result.IsError {
+			s.resultCache.put(cacheKey, result)
+		}
+	}
+
+	if s.recorder != nil {
+		s.recorder.record(loggerOr(s.logger), ToolCallRecord{Tool: name, Input: arguments, Output: &result})
+	}
+
+	if s.resultFormatter != nil && !result.IsError {
+		result = s.resultFormatter(name, result)
+	}
+
+	linkImages := false
+	if s.imagePassthrough != nil {
+		version, _ := s.negotiated.Load().(string)
+		linkImages = version >= resourceLinkProtocolVersion
+	}
+
 	content := make([]map[string]any, 0, len(result.Content))
 	for _, item := range result.Content {
-		c := map[string]any{"type": item.Type}
-		if item.Type == "text" {
-			c["text"] = item.Text
-		} else if item.Type == "image" {
-			c["data"] = item.Data
-			c["mimeType"] = item.MimeType
+		if s.contentRedactor != nil {
+			item = s.contentRedactor(item)
+			if item.Type == "" || (item.Type == "text" && item.Text == "") {
+				continue
+			}
 		}
-		content = append(content, c)
+		if item.Type == "image" && linkImages {
+			if link, ok := s.imagePassthrough.reference(item); ok {
+				content = append(content, link)
+				continue
+			}
+		}
+		content = append(content, mcpContentMap(item))
 	}
 
 	responseData := map[string]any{"content": content}
@@ -190,6 +471,37 @@ func (s *McpServer) HandleCallTool(ctx context.Context, id any, name string, arg
 	}
 }
 
+// mcpContentMap serializes one item of a tools/call result. Types the SDK does
+// not know keep every field that is set.
+func mcpContentMap(item MCPContent) map[string]any {
+	c := map[string]any{"type": item.Type}
+	switch item.Type {
+	case "text":
+		c["text"] = item.Text
+	case "image", "audio":
+		c["data"] = item.Data
+		c["mimeType"] = item.MimeType
+	case "resource":
+		if item.Resource != nil {
+			c["resource"] = item.Resource
+		}
+	default:
+		if item.Text != "" {
+			c["text"] = item.Text
+		}
+		if item.Data != "" {
+			c["data"] = item.Data
+		}
+		if item.MimeType != "" {
+			c["mimeType"] = item.MimeType
+		}
+		if item.Resource != nil {
+			c["resource"] = item.Resource
+		}
+	}
+	return c
+}
+
 // HandleRequest dispatches an MCP JSONRPC request to the appropriate handler.
 func (s *McpServer) HandleRequest(ctx context.Context, message map[string]any) map[string]any {
 	method, _ := message["method"].(string)
@@ -201,7 +513,8 @@ func (s *McpServer) HandleRequest(ctx context.Context, message map[string]any) m
 
 	switch method {
 	case "initialize":
-		return s.HandleInitialize(id)
+		requested, _ := params["protocolVersion"].(string)
+		return s.handleInitialize(id, requested)
 	case "tools/list":
 		return s.HandleListTools(id)
 	case "tools/call":
@@ -211,6 +524,17 @@ func (s *McpServer) HandleRequest(ctx context.Context, message map[string]any) m
 			args = map[string]any{}
 		}
 		return s.HandleCallTool(ctx, id, name, args)
+	case "resources/list":
+		return s.HandleListResources(id)
+	case "resources/read":
+		uri, _ := params["uri"].(string)
+		return s.HandleReadResource(ctx, id, uri)
+	case "prompts/list":
+		return s.HandleListPrompts(id)
+	case "prompts/get":
+		name, _ := params["name"].(string)
+		args, _ := params["arguments"].(map[string]any)
+		return s.HandleGetPrompt(ctx, id, name, promptArguments(args))
 	case "notifications/initialized":
 		return map[string]any{"jsonrpc": "2.0", "result": map[string]any{}}
 	default:
@@ -225,16 +549,52 @@ func (s *McpServer) HandleRequest(ctx context.Context, message map[string]any) m
 	}
 }
 
+// sdkMcpServerInstances returns the in-process servers among configs. The
+// instances are returned by reference, never copied, so state that tool
+// handlers share across servers stays shared.
+func sdkMcpServerInstances(configs map[string]McpServerConfig) map[string]*McpServer {
+	servers := make(map[string]*McpServer)
+	for name, config := range configs {
+		if sdkCfg, ok := config.(*McpSdkServerConfig); ok {
+			servers[name] = sdkCfg.Instance
+		}
+	}
+	return servers
+}
+
 // CreateSdkMcpServer creates an in-process MCP server configuration.
+//
+// Tool handlers run concurrently, both within one server and across servers.
+// To share state between servers (a session store, a cache, an app struct),
+// close every handler over the same value and guard it as you would for any
+// concurrent access, e.g. with a sync.Map or a mutex:
+//
+//	store := &sync.Map{}
+//	writer := CreateSdkMcpServer("writer", "1.0.0", NewMCPTool("put", "...", nil,
+//		func(ctx context.Context, args map[string]any) (MCPToolResult, error) {
+//			store.Store(args["key"], args["value"])
+//			...
+//		}))
+//	reader := CreateSdkMcpServer("reader", "1.0.0", NewMCPTool("get", "...", nil,
+//		func(ctx context.Context, args map[string]any) (MCPToolResult, error) {
+//			v, _ := store.Load(args["key"])
+//			...
+//		}))
 func CreateSdkMcpServer(name string, version string, tools ...*SdkMcpTool) *McpSdkServerConfig {
+	return CreateSdkMcpServerWithOptions(name, version, tools)
+}
+
+// CreateSdkMcpServerWithOptions creates an in-process MCP server configuration
+// with server-level options applied.
+func CreateSdkMcpServerWithOptions(name string, version string, tools []*SdkMcpTool, opts ...McpServerOption) *McpSdkServerConfig {
 	server := &McpServer{
-		Name:    name,
-		Version: version,
-		Tools:   tools,
-		toolMap: make(map[string]*SdkMcpTool, len(tools)),
+		Name:         name,
+		Version:      version,
+		initialTools: append([]*SdkMcpTool(nil), tools...),
 	}
-	for _, t := range tools {
-		server.toolMap[t.Name] = t
+	server.restoreTools()
+	for _, opt := range opts {
+		opt(server)
 	}
 	return &McpSdkServerConfig{
 		Type:     "sdk",
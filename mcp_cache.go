@@ -0,0 +1,80 @@
+package claude
+
+import (
+	"encoding/json"
+	"slices"
+	"sync"
+	"time"
+)
+
+// toolResultCache stores results of idempotent SDK MCP tools, bounded by
+// entry count (oldest evicted first) and TTL.
+type toolResultCache struct {
+	maxEntries int
+	ttl        time.Duration
+
+	mu      sync.Mutex
+	entries map[string]toolResultCacheEntry
+	order   []string
+}
+
+type toolResultCacheEntry struct {
+	result   MCPToolResult
+	storedAt time.Time
+}
+
+func newToolResultCache(maxEntries int, ttl time.Duration) *toolResultCache {
+	return &toolResultCache{
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		entries:    make(map[string]toolResultCacheEntry),
+	}
+}
+
+// toolResultCacheKey returns a key for a tool call. encoding/json sorts map
+// keys, so equal arguments always produce the same key.
+func toolResultCacheKey(toolName string, args map[string]any) (string, bool) {
+	data, err := json.Marshal(args)
+	if err != nil {
+		return "", false
+	}
+	return toolName + "\x00" + string(data), true
+}
+
+func (c *toolResultCache) get(key string) (MCPToolResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return MCPToolResult{}, false
+	}
+	if c.ttl > 0 && time.Since(entry.storedAt) > c.ttl {
+		delete(c.entries, key)
+		if i := slices.Index(c.order, key); i >= 0 {
+			c.order = slices.Delete(c.order, i, i+1)
+		}
+		return MCPToolResult{}, false
+	}
+	return entry.result, true
+}
+
+func (c *toolResultCache) put(key string, result MCPToolResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exists := c.entries[key]; !exists {
+		c.order = append(c.order, key)
+	}
+	c.entries[key] = toolResultCacheEntry{result: result, storedAt: time.Now()}
+	for c.maxEntries > 0 && len(c.entries) > c.maxEntries && len(c.order) > 0 {
+		oldest := c.order[0]
+		c.order = c.order[1:]
+		delete(c.entries, oldest)
+	}
+}
+
+func (c *toolResultCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]toolResultCacheEntry)
+	c.order = nil
+}
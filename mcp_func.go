@@ -0,0 +1,239 @@
+package claude
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+var (
+	contextType    = reflect.TypeFor[context.Context]()
+	errorType      = reflect.TypeFor[error]()
+	toolResultType = reflect.TypeFor[MCPToolResult]()
+	timeType       = reflect.TypeFor[time.Time]()
+	rawMessageType = reflect.TypeFor[json.RawMessage]()
+	stringType     = reflect.TypeFor[string]()
+)
+
+// ToolFromFunc creates a tool from a typed Go function, deriving InputSchema
+// from its argument struct and decoding the call's arguments into it with
+// encoding/json. fn has one of the forms
+//
+//	func(Args) (R, error)
+//	func(context.Context, Args) (R, error)
+//
+// where Args is a struct or pointer to struct and R is string (returned as
+// text content) or MCPToolResult.
+//
+// Properties are named by json tags and described by a description tag.
+// Fields are required unless they are pointers or tagged omitempty or omitzero:
+//
+//	type WeatherArgs struct {
+//		City  string `json:"city" description:"City name"`
+//		Units string `json:"units,omitempty" description:"metric or imperial"`
+//	}
+//
+// Strings, booleans, numbers, slices, string-keyed maps, time.Time and nested
+// structs are supported.
+func ToolFromFunc(name, description string, fn any) (*SdkMcpTool, error) {
+	v := reflect.ValueOf(fn)
+	if v.Kind() != reflect.Func || v.IsNil() {
+		return nil, fmt.Errorf("tool %s: fn must be a non-nil function, got %T", name, fn)
+	}
+	ft := v.Type()
+	withContext := ft.NumIn() == 2 && ft.In(0) == contextType
+	if ft.NumIn() != 1 && !withContext {
+		return nil, fmt.Errorf("tool %s: fn must take (Args) or (context.Context, Args), got %s", name, ft)
+	}
+	argsType := ft.In(ft.NumIn() - 1)
+	structType := argsType
+	if structType.Kind() == reflect.Pointer {
+		structType = structType.Elem()
+	}
+	if structType.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("tool %s: arguments must be a struct or pointer to struct, got %s", name, argsType)
+	}
+	if ft.NumOut() != 2 || ft.Out(1) != errorType || (ft.Out(0) != stringType && ft.Out(0) != toolResultType) {
+		return nil, fmt.Errorf("tool %s: fn must return (string, error) or (MCPToolResult, error), got %s", name, ft)
+	}
+
+	schema, err := jsonSchemaFor(structType, nil)
+	if err != nil {
+		return nil, fmt.Errorf("tool %s: %w", name, err)
+	}
+
+	handler := func(ctx context.Context, args map[string]any) (MCPToolResult, error) {
+		data, err := json.Marshal(args)
+		if err != nil {
+			return MCPToolResult{}, err
+		}
+		ptr := reflect.New(structType)
+		if err := json.Unmarshal(data, ptr.Interface()); err != nil {
+			return MCPToolResult{}, &invalidParamsError{tool: name, err: err}
+		}
+		in := []reflect.Value{ptr}
+		if argsType.Kind() != reflect.Pointer {
+			in[0] = ptr.Elem()
+		}
+		if withContext {
+			in = append([]reflect.Value{reflect.ValueOf(ctx)}, in...)
+		}
+		out := v.Call(in)
+		if err, _ := out[1].Interface().(error); err != nil {
+			return MCPToolResult{}, err
+		}
+		if text, ok := out[0].Interface().(string); ok {
+			return MCPToolResult{Content: []MCPContent{{Type: "text", Text: text}}}, nil
+		}
+		return out[0].Interface().(MCPToolResult), nil
+	}
+	return NewMCPTool(name, description, schema, handler), nil
+}
+
+// NewTypedMCPTool creates a tool whose handler receives the call's arguments
+// decoded into T with encoding/json. InputSchema is derived from T as
+// described for ToolFromFunc; when T does not describe a JSON object, such as
+// a scalar or an unsupported type, it accepts any object. Arguments that do
+// not decode into T are answered with a JSON-RPC invalid params error without
+// calling handler.
+func NewTypedMCPTool[T any](name, description string, handler func(context.Context, T) (MCPToolResult, error)) *SdkMcpTool {
+	schema, err := jsonSchemaFor(reflect.TypeFor[T](), nil)
+	if err != nil || schema["type"] != "object" {
+		schema = map[string]any{"type": "object"}
+	}
+	return NewMCPTool(name, description, schema, func(ctx context.Context, args map[string]any) (MCPToolResult, error) {
+		data, err := json.Marshal(args)
+		if err != nil {
+			return MCPToolResult{}, err
+		}
+		var typed T
+		if err := json.Unmarshal(data, &typed); err != nil {
+			return MCPToolResult{}, &invalidParamsError{tool: name, err: err}
+		}
+		return handler(ctx, typed)
+	})
+}
+
+// invalidParamsError reports tool arguments that do not decode into the
+// tool's argument type. HandleCallTool answers it with code -32602.
+type invalidParamsError struct {
+	tool string
+	err  error
+}
+
+func (e *invalidParamsError) Error() string {
+	return fmt.Sprintf("invalid arguments for tool %s: %v", e.tool, e.err)
+}
+
+func (e *invalidParamsError) Unwrap() error { return e.err }
+
+// jsonSchemaFor returns the JSON schema of values of t as encoded by
+// encoding/json. visiting holds the structs being expanded, to reject
+// recursive types.
+func jsonSchemaFor(t reflect.Type, visiting []reflect.Type) (map[string]any, error) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}, nil
+	case t == rawMessageType:
+		return map[string]any{}, nil
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]any{"type": "string"}, nil
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}, nil
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}, nil
+	case reflect.Interface:
+		return map[string]any{}, nil
+	case reflect.Slice, reflect.Array:
+		if t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "contentEncoding": "base64"}, nil
+		}
+		items, err := jsonSchemaFor(t.Elem(), visiting)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]any{"type": "array", "items": items}, nil
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("unsupported map key type %s", t.Key())
+		}
+		values, err := jsonSchemaFor(t.Elem(), visiting)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]any{"type": "object", "additionalProperties": values}, nil
+	case reflect.Struct:
+		for _, v := range visiting {
+			if v == t {
+				return nil, fmt.Errorf("recursive type %s", t)
+			}
+		}
+		properties := map[string]any{}
+		required := []string{}
+		if err := addStructProperties(t, append(visiting[:len(visiting):len(visiting)], t), properties, &required); err != nil {
+			return nil, err
+		}
+		schema := map[string]any{"type": "object", "properties": properties}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		return schema, nil
+	default:
+		return nil, fmt.Errorf("unsupported type %s", t)
+	}
+}
+
+// addStructProperties adds the JSON properties of the fields of t, flattening
+// embedded structs without a json name as encoding/json does.
+func addStructProperties(t reflect.Type, visiting []reflect.Type, properties map[string]any, required *[]string) error {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Pointer {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				if err := addStructProperties(embedded, visiting, properties, required); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		schema, err := jsonSchemaFor(field.Type, visiting)
+		if err != nil {
+			return fmt.Errorf("field %s: %w", field.Name, err)
+		}
+		if desc := field.Tag.Get("description"); desc != "" {
+			schema["description"] = desc
+		}
+		properties[name] = schema
+		optional := strings.Contains(","+opts+",", ",omitempty,") || strings.Contains(","+opts+",", ",omitzero,")
+		if !optional && field.Type.Kind() != reflect.Pointer {
+			*required = append(*required, name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package claude
+
+import (
+	"encoding/base64"
+	"mime"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// resourceLinkProtocolVersion is the first MCP protocol version with
+// resource_link content in tool results.
+const resourceLinkProtocolVersion = "2025-06-18"
+
+// imagePassthrough writes large image results to files and returns them as
+// resource links instead of inline base64.
+type imagePassthrough struct {
+	dir      string
+	minBytes int
+}
+
+// reference writes the image to a file and returns a resource_link content
+// item for it. It reports false when the image should stay inline: it is
+// smaller than minBytes, its data is not valid base64, or the file cannot be
+// written.
+func (p *imagePassthrough) reference(item MCPContent) (map[string]any, bool) {
+	data, err := base64.StdEncoding.DecodeString(item.Data)
+	if err != nil || len(data) < p.minBytes {
+		return nil, false
+	}
+	ext := ""
+	if exts, _ := mime.ExtensionsByType(item.MimeType); len(exts) > 0 {
+		ext = exts[0]
+	}
+	f, err := os.CreateTemp(p.dir, "mcp-image-*"+ext)
+	if err != nil {
+		return nil, false
+	}
+	_, writeErr := f.Write(data)
+	closeErr := f.Close()
+	if writeErr != nil || closeErr != nil {
+		_ = os.Remove(f.Name())
+		return nil, false
+	}
+	path, err := filepath.Abs(f.Name())
+	if err != nil {
+		path = f.Name()
+	}
+	return map[string]any{
+		"type":     "resource_link",
+		"uri":      fileURI(path),
+		"name":     filepath.Base(path),
+		"mimeType": item.MimeType,
+	}, true
+}
+
+// fileURI returns the file:// URI of an absolute path.
+func fileURI(path string) string {
+	path = filepath.ToSlash(path)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path // Windows drive paths
+	}
+	return (&url.URL{Scheme: "file", Path: path}).String()
+}
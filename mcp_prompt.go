@@ -0,0 +1,135 @@
+package claude
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// MCPPrompt is a prompt template served by an SDK MCP server.
+type MCPPrompt struct {
+	Name        string
+	Description string
+	Arguments   []MCPPromptArgument
+	Get         MCPPromptHandler
+}
+
+// MCPPromptArgument describes an argument of an MCPPrompt.
+type MCPPromptArgument struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Required    bool   `json:"required,omitempty"`
+}
+
+// MCPPromptHandler renders a prompt from its arguments. Required arguments
+// are checked before it is called.
+type MCPPromptHandler func(ctx context.Context, args map[string]string) ([]MCPPromptMessage, error)
+
+// MCPPromptMessage is one message of a rendered prompt.
+type MCPPromptMessage struct {
+	Role    string     `json:"role"` // "user" or "assistant"
+	Content MCPContent `json:"content"`
+}
+
+// WithMCPPrompts registers prompts served through prompts/list and
+// prompts/get. The server advertises the prompts capability when at least one
+// is registered.
+func WithMCPPrompts(prompts ...*MCPPrompt) McpServerOption {
+	return func(s *McpServer) {
+		s.prompts = append(s.prompts, prompts...)
+	}
+}
+
+// HandleListPrompts handles the MCP prompts/list request.
+func (s *McpServer) HandleListPrompts(id any) map[string]any {
+	prompts := make([]map[string]any, 0, len(s.prompts))
+	for _, p := range s.prompts {
+		entry := map[string]any{"name": p.Name}
+		if p.Description != "" {
+			entry["description"] = p.Description
+		}
+		if len(p.Arguments) > 0 {
+			entry["arguments"] = p.Arguments
+		}
+		prompts = append(prompts, entry)
+	}
+	return map[string]any{
+		"jsonrpc": "2.0",
+		"id":      id,
+		"result":  map[string]any{"prompts": prompts},
+	}
+}
+
+// HandleGetPrompt handles the MCP prompts/get request.
+func (s *McpServer) HandleGetPrompt(ctx context.Context, id any, name string, args map[string]string) map[string]any {
+	invalidParams := func(message string) map[string]any {
+		return map[string]any{
+			"jsonrpc": "2.0",
+			"id":      id,
+			"error": map[string]any{
+				"code":    -32602,
+				"message": message,
+			},
+		}
+	}
+
+	var prompt *MCPPrompt
+	for _, p := range s.prompts {
+		if p.Name == name {
+			prompt = p
+			break
+		}
+	}
+	if prompt == nil || prompt.Get == nil {
+		return invalidParams(fmt.Sprintf("Prompt '%s' not found", name))
+	}
+	var missing []string
+	for _, arg := range prompt.Arguments {
+		if _, ok := args[arg.Name]; arg.Required && !ok {
+			missing = append(missing, arg.Name)
+		}
+	}
+	if len(missing) > 0 {
+		return invalidParams(fmt.Sprintf("Missing required arguments for prompt '%s': %s", name, strings.Join(missing, ", ")))
+	}
+	if args == nil {
+		args = map[string]string{}
+	}
+
+	messages, err := prompt.Get(ctx, args)
+	if err != nil {
+		return map[string]any{
+			"jsonrpc": "2.0",
+			"id":      id,
+			"error": map[string]any{
+				"code":    -32603,
+				"message": err.Error(),
+			},
+		}
+	}
+	if messages == nil {
+		messages = []MCPPromptMessage{}
+	}
+	result := map[string]any{"messages": messages}
+	if prompt.Description != "" {
+		result["description"] = prompt.Description
+	}
+	return map[string]any{
+		"jsonrpc": "2.0",
+		"id":      id,
+		"result":  result,
+	}
+}
+
+// promptArguments reads prompts/get arguments, which MCP defines as strings.
+func promptArguments(raw map[string]any) map[string]string {
+	args := make(map[string]string, len(raw))
+	for name, value := range raw {
+		if s, ok := value.(string); ok {
+			args[name] = s
+		} else {
+			args[name] = fmt.Sprint(value)
+		}
+	}
+	return args
+}
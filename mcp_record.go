@@ -0,0 +1,109 @@
+package claude
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// ToolCallRecord is one line written by WithToolCallRecorder: the arguments a
+// tool was called with and the result or error its handler returned.
+type ToolCallRecord struct {
+	Tool   string         `json:"tool"`
+	Input  map[string]any `json:"input"`
+	Output *MCPToolResult `json:"output,omitempty"`
+	Error  string         `json:"error,omitempty"`
+}
+
+// WithToolCallRecorder writes every tool call handled by the server to w as a
+// JSONL ToolCallRecord, for golden-file tests replayed with ReplayHandler.
+// Inputs are recorded after WithInputTransformer and outputs before
+// formatting and redaction. Cached results are recorded like handler calls.
+func WithToolCallRecorder(w io.Writer) McpServerOption {
+	return func(s *McpServer) { s.recorder = &toolCallRecorder{w: w} }
+}
+
+// toolCallRecorder serializes records from concurrent handlers.
+type toolCallRecorder struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (r *toolCallRecorder) record(logger Logger, rec ToolCallRecord) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		logger.Warnf("Failed to record call to tool %s: %v", rec.Tool, err)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := r.w.Write(append(data, '\n')); err != nil {
+		logger.Warnf("Failed to record call to tool %s: %v", rec.Tool, err)
+	}
+}
+
+// ReplayHandler returns a handler for toolName that serves the results
+// recorded for it in the WithToolCallRecorder file at path. A call is matched
+// to the records with the same arguments and gets them in recorded order; once
+// they are used up, the last one repeats. A call with unrecorded arguments
+// fails, so drift in the agent's behavior shows up as a tool error.
+func ReplayHandler(path, toolName string) (MCPToolHandler, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	recorded := make(map[string][]ToolCallRecord)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var rec ToolCallRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		if rec.Tool != toolName {
+			continue
+		}
+		key, ok := toolResultCacheKey(rec.Tool, rec.Input)
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: arguments cannot be encoded", path, line)
+		}
+		recorded[key] = append(recorded[key], rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var mu sync.Mutex
+	served := make(map[string]int)
+	return func(ctx context.Context, args map[string]any) (MCPToolResult, error) {
+		key, _ := toolResultCacheKey(toolName, args)
+		mu.Lock()
+		records := recorded[key]
+		if len(records) == 0 {
+			mu.Unlock()
+			return MCPToolResult{}, fmt.Errorf("no recorded call to tool %s with these arguments", toolName)
+		}
+		i := min(served[key], len(records)-1)
+		served[key]++
+		mu.Unlock()
+
+		rec := records[i]
+		if rec.Error != "" {
+			return MCPToolResult{}, errors.New(rec.Error)
+		}
+		if rec.Output == nil {
+			return MCPToolResult{}, nil
+		}
+		return *rec.Output, nil
+	}, nil
+}
@@ -0,0 +1,110 @@
+package claude
+
+import (
+	"context"
+	"fmt"
+)
+
+// MCPResource is a read-only resource served by an SDK MCP server.
+type MCPResource struct {
+	URI         string
+	Name        string
+	Description string
+	MimeType    string
+	Read        MCPResourceHandler
+}
+
+// MCPResourceHandler returns the contents of the resource at uri.
+type MCPResourceHandler func(ctx context.Context, uri string) ([]MCPResourceContent, error)
+
+// MCPResourceContent is one item of a resources/read result: Text for text
+// resources, or base64-encoded Blob for binary ones. An empty URI or MimeType
+// is filled in from the resource.
+type MCPResourceContent struct {
+	URI      string `json:"uri"`
+	MimeType string `json:"mimeType,omitempty"`
+	Text     string `json:"text,omitempty"`
+	Blob     string `json:"blob,omitempty"`
+}
+
+// WithMCPResources registers resources served through resources/list and
+// resources/read. The server advertises the resources capability when at
+// least one is registered.
+func WithMCPResources(resources ...*MCPResource) McpServerOption {
+	return func(s *McpServer) {
+		s.resources = append(s.resources, resources...)
+	}
+}
+
+// mcpResourceNotFound is the JSON-RPC error code MCP uses for an unknown URI.
+const mcpResourceNotFound = -32002
+
+// HandleListResources handles the MCP resources/list request.
+func (s *McpServer) HandleListResources(id any) map[string]any {
+	resources := make([]map[string]any, 0, len(s.resources))
+	for _, r := range s.resources {
+		entry := map[string]any{"uri": r.URI, "name": r.Name}
+		if r.Description != "" {
+			entry["description"] = r.Description
+		}
+		if r.MimeType != "" {
+			entry["mimeType"] = r.MimeType
+		}
+		resources = append(resources, entry)
+	}
+	return map[string]any{
+		"jsonrpc": "2.0",
+		"id":      id,
+		"result":  map[string]any{"resources": resources},
+	}
+}
+
+// HandleReadResource handles the MCP resources/read request.
+func (s *McpServer) HandleReadResource(ctx context.Context, id any, uri string) map[string]any {
+	var resource *MCPResource
+	for _, r := range s.resources {
+		if r.URI == uri {
+			resource = r
+			break
+		}
+	}
+	if resource == nil || resource.Read == nil {
+		return map[string]any{
+			"jsonrpc": "2.0",
+			"id":      id,
+			"error": map[string]any{
+				"code":    mcpResourceNotFound,
+				"message": fmt.Sprintf("Resource '%s' not found", uri),
+				"data":    map[string]any{"uri": uri},
+			},
+		}
+	}
+
+	contents, err := resource.Read(ctx, uri)
+	if err != nil {
+		return map[string]any{
+			"jsonrpc": "2.0",
+			"id":      id,
+			"error": map[string]any{
+				"code":    -32603,
+				"message": err.Error(),
+			},
+		}
+	}
+	for i := range contents {
+		if contents[i].URI == "" {
+			contents[i].URI = uri
+		}
+		if contents[i].MimeType == "" {
+			contents[i].MimeType = resource.MimeType
+		}
+	}
+	if contents == nil {
+		contents = []MCPResourceContent{}
+	}
+	return map[string]any{
+		"jsonrpc": "2.0",
+		"id":      id,
+		"result":  map[string]any{"contents": contents},
+	}
+}
@@ -0,0 +1,53 @@
+package claude
+
+// MCPServerState is the connection state of an MCP server as reported by the
+// CLI.
+type MCPServerState string
+
+const (
+	MCPServerConnected MCPServerState = "connected"
+	MCPServerFailed    MCPServerState = "failed"
+	MCPServerNeedsAuth MCPServerState = "needs-auth"
+	MCPServerPending   MCPServerState = "pending"
+)
+
+// MCPStatus is the result of ClaudeClient.GetMCPStatus.
+type MCPStatus struct {
+	Servers []MCPServerStatus
+	Raw     map[string]any // the control response as received
+}
+
+// MCPServerStatus is the status of one MCP server.
+type MCPServerStatus struct {
+	Name      string
+	Status    MCPServerState
+	ToolCount int    // tools the server offers, 0 unless connected
+	Error     string // why the server failed to connect, for MCPServerFailed
+}
+
+// parseMCPStatus reads an mcp_status control response. Servers missing a
+// name are skipped; unknown states are kept as reported.
+func parseMCPStatus(raw map[string]any) *MCPStatus {
+	status := &MCPStatus{Raw: raw}
+	servers, _ := raw["mcpServers"].([]any)
+	for _, item := range servers {
+		m, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		name, _ := m["name"].(string)
+		if name == "" {
+			continue
+		}
+		state, _ := m["status"].(string)
+		errMsg, _ := m["error"].(string)
+		tools, _ := m["tools"].([]any)
+		status.Servers = append(status.Servers, MCPServerStatus{
+			Name:      name,
+			Status:    MCPServerState(state),
+			ToolCount: len(tools),
+			Error:     errMsg,
+		})
+	}
+	return status
+}
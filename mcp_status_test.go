@@ -0,0 +1,44 @@
+package claude
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestQueryHandlerMCPStatus(t *testing.T) {
+	mt := newMockTransport()
+	handler := newQueryHandler(mt, queryOptions{})
+	_ = handler.start(context.Background())
+	defer handler.close()
+
+	go respondToInitialize(mt, map[string]any{
+		"mcpServers": []any{
+			map[string]any{
+				"name":       "calc",
+				"status":     "connected",
+				"serverInfo": map[string]any{"name": "calc", "version": "1.0.0"},
+				"tools":      []any{map[string]any{"name": "add"}, map[string]any{"name": "sqrt"}},
+			},
+			map[string]any{"name": "github", "status": "failed", "error": "spawn gh-mcp ENOENT"},
+			map[string]any{"name": "linear", "status": "needs-auth"},
+			map[string]any{"status": "connected"},
+		},
+	})
+	status, err := handler.getMcpStatus(context.Background())
+	if err != nil {
+		t.Fatalf("getMcpStatus failed: %v", err)
+	}
+
+	want := []MCPServerStatus{
+		{Name: "calc", Status: MCPServerConnected, ToolCount: 2},
+		{Name: "github", Status: MCPServerFailed, Error: "spawn gh-mcp ENOENT"},
+		{Name: "linear", Status: MCPServerNeedsAuth},
+	}
+	if !reflect.DeepEqual(status.Servers, want) {
+		t.Errorf("Servers = %+v, want %+v", status.Servers, want)
+	}
+	if _, ok := status.Raw["mcpServers"]; !ok {
+		t.Errorf("expected Raw to keep the response, got %v", status.Raw)
+	}
+}
@@ -1,8 +1,21 @@
 package claude
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestCreateSdkMcpServer(t *testing.T) {
@@ -125,3 +138,945 @@ func TestMcpServerHandleRequest(t *testing.T) {
 		t.Error("expected error for unknown method")
 	}
 }
+
+func TestMcpServerContentRedactor(t *testing.T) {
+	tool := NewMCPTool("whoami", "Show credentials", nil,
+		func(ctx context.Context, args map[string]any) (MCPToolResult, error) {
+			return MCPToolResult{
+				Content: []MCPContent{
+					{Type: "text", Text: "token=sk-abc123 user=alice"},
+					{Type: "text", Text: "DROP"},
+				},
+			}, nil
+		},
+	)
+	tokenPattern := regexp.MustCompile(`sk-[a-z0-9]+`)
+	server := CreateSdkMcpServerWithOptions("secrets", "1.0.0", []*SdkMcpTool{tool},
+		WithContentRedactor(func(c MCPContent) MCPContent {
+			if c.Text == "DROP" {
+				c.Text = ""
+			}
+			c.Text = tokenPattern.ReplaceAllString(c.Text, "[REDACTED]")
+			return c
+		}),
+	)
+
+	resp := server.Instance.HandleCallTool(context.Background(), "call-1", "whoami", map[string]any{})
+	result, _ := resp["result"].(map[string]any)
+	content, _ := result["content"].([]map[string]any)
+	if len(content) != 1 {
+		t.Fatalf("expected 1 content item after redaction, got %d", len(content))
+	}
+	if text, _ := content[0]["text"].(string); text != "token=[REDACTED] user=alice" {
+		t.Errorf("unexpected redacted text: %q", text)
+	}
+}
+
+func TestMcpServerInputTransformer(t *testing.T) {
+	var seen []string
+	addTool := NewMCPTool("add", "Add two numbers", nil,
+		func(ctx context.Context, args map[string]any) (MCPToolResult, error) {
+			seen = append(seen, "handler")
+			a, ok := args["a"].(float64)
+			if !ok {
+				return MCPToolResult{}, fmt.Errorf("a is %T, not float64", args["a"])
+			}
+			b, _ := args["b"].(float64)
+			return MCPToolResult{
+				Content: []MCPContent{{Type: "text", Text: strconv.FormatFloat(a+b, 'f', -1, 64)}},
+			}, nil
+		},
+	)
+	server := CreateSdkMcpServerWithOptions("calc", "1.0.0", []*SdkMcpTool{addTool},
+		WithInputTransformer(func(toolName string, args map[string]any) map[string]any {
+			seen = append(seen, "transformer:"+toolName)
+			for k, v := range args {
+				if str, ok := v.(string); ok {
+					if f, err := strconv.ParseFloat(str, 64); err == nil {
+						args[k] = f
+					}
+				}
+			}
+			return args
+		}),
+	)
+
+	resp := server.Instance.HandleCallTool(context.Background(), "call-1", "add", map[string]any{"a": "2", "b": float64(3)})
+	if resp["error"] != nil {
+		t.Fatalf("unexpected error: %v", resp["error"])
+	}
+	result, _ := resp["result"].(map[string]any)
+	content, _ := result["content"].([]map[string]any)
+	if len(content) != 1 || content[0]["text"] != "5" {
+		t.Errorf("unexpected content: %v", content)
+	}
+	if len(seen) != 2 || seen[0] != "transformer:add" || seen[1] != "handler" {
+		t.Errorf("expected transformer to run before handler, got %v", seen)
+	}
+}
+
+func TestMcpServerToolResultCache(t *testing.T) {
+	idempotent := true
+	var lookups, writes int
+	lookup := NewMCPTool("lookup", "Look up a value", nil,
+		func(ctx context.Context, args map[string]any) (MCPToolResult, error) {
+			lookups++
+			return MCPToolResult{Content: []MCPContent{{Type: "text", Text: fmt.Sprintf("value-%v", args["key"])}}}, nil
+		},
+	)
+	lookup.Annotations = &MCPToolAnnotations{IdempotentHint: &idempotent}
+	write := NewMCPTool("write", "Write a value", nil,
+		func(ctx context.Context, args map[string]any) (MCPToolResult, error) {
+			writes++
+			return MCPToolResult{Content: []MCPContent{{Type: "text", Text: "ok"}}}, nil
+		},
+	)
+	server := CreateSdkMcpServerWithOptions("kv", "1.0.0", []*SdkMcpTool{lookup, write},
+		WithToolResultCache(10, time.Minute),
+	)
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		resp := server.Instance.HandleCallTool(ctx, i, "lookup", map[string]any{"key": "a", "opts": map[string]any{"x": 1, "y": 2}})
+		result, _ := resp["result"].(map[string]any)
+		content, _ := result["content"].([]map[string]any)
+		if len(content) != 1 || content[0]["text"] != "value-a" {
+			t.Fatalf("unexpected cached content: %v", content)
+		}
+		server.Instance.HandleCallTool(ctx, i, "write", map[string]any{"key": "a"})
+	}
+	if lookups != 1 {
+		t.Errorf("expected idempotent handler to run once, ran %d times", lookups)
+	}
+	if writes != 3 {
+		t.Errorf("expected non-idempotent handler to run every time, ran %d times", writes)
+	}
+
+	server.Instance.HandleCallTool(ctx, 4, "lookup", map[string]any{"key": "b"})
+	if lookups != 2 {
+		t.Errorf("expected different args to miss the cache, handler ran %d times", lookups)
+	}
+}
+
+func TestToolResultCacheBounds(t *testing.T) {
+	cache := newToolResultCache(2, 0)
+	cache.put("a", MCPToolResult{})
+	cache.put("b", MCPToolResult{})
+	cache.put("c", MCPToolResult{})
+	if _, ok := cache.get("a"); ok {
+		t.Error("expected oldest entry to be evicted")
+	}
+	if _, ok := cache.get("c"); !ok {
+		t.Error("expected newest entry to be cached")
+	}
+
+	expiring := newToolResultCache(0, time.Millisecond)
+	expiring.put("a", MCPToolResult{})
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := expiring.get("a"); ok {
+		t.Error("expected entry to expire after ttl")
+	}
+	if len(expiring.entries) != 0 || len(expiring.order) != 0 {
+		t.Errorf("expected the expired entry to be removed, got %d entries and %d keys", len(expiring.entries), len(expiring.order))
+	}
+}
+
+func TestMcpServerToolResultFormatter(t *testing.T) {
+	stats := NewMCPTool("stats", "Summarize values", nil,
+		func(ctx context.Context, args map[string]any) (MCPToolResult, error) {
+			return MCPToolResult{Content: []MCPContent{
+				{Type: "text", Text: `{"count":3,"mean":2.50,"values":[1,2.5,4]}`},
+				{Type: "text", Text: "done"},
+			}}, nil
+		},
+	)
+	server := CreateSdkMcpServerWithOptions("stats", "1.0.0", []*SdkMcpTool{stats},
+		WithToolResultFormatter(JSONResultFormatter),
+	)
+
+	resp := server.Instance.HandleCallTool(context.Background(), "call-1", "stats", map[string]any{})
+	result, _ := resp["result"].(map[string]any)
+	content, _ := result["content"].([]map[string]any)
+	if len(content) != 2 {
+		t.Fatalf("expected 2 content items, got %d", len(content))
+	}
+	want := "{\n  \"count\": 3,\n  \"mean\": 2.50,\n  \"values\": [\n    1,\n    2.5,\n    4\n  ]\n}"
+	if text, _ := content[0]["text"].(string); text != want {
+		t.Errorf("unexpected formatted JSON:\n%s", text)
+	}
+	if text, _ := content[1]["text"].(string); text != "done" {
+		t.Errorf("expected plain text unchanged, got %q", text)
+	}
+}
+
+func TestSdkMcpServersShareState(t *testing.T) {
+	store := &sync.Map{}
+	put := NewMCPTool("put", "Store a value", nil,
+		func(ctx context.Context, args map[string]any) (MCPToolResult, error) {
+			store.Store(args["key"], args["value"])
+			return MCPToolResult{Content: []MCPContent{{Type: "text", Text: "ok"}}}, nil
+		},
+	)
+	get := NewMCPTool("get", "Load a value", nil,
+		func(ctx context.Context, args map[string]any) (MCPToolResult, error) {
+			v, _ := store.Load(args["key"])
+			text, _ := v.(string)
+			return MCPToolResult{Content: []MCPContent{{Type: "text", Text: text}}}, nil
+		},
+	)
+	writerCfg := CreateSdkMcpServer("writer", "1.0.0", put)
+	readerCfg := CreateSdkMcpServer("reader", "1.0.0", get)
+
+	opts := applyOptions([]Option{WithMcpServers(map[string]McpServerConfig{
+		"writer": writerCfg,
+		"reader": readerCfg,
+	})})
+	servers := sdkMcpServerInstances(opts.McpServers)
+	if servers["writer"] != writerCfg.Instance || servers["reader"] != readerCfg.Instance {
+		t.Fatal("expected server instances to be passed by reference")
+	}
+
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		key := strconv.Itoa(i)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			servers["writer"].HandleCallTool(ctx, key, "put", map[string]any{"key": key, "value": "v" + key})
+		}()
+		go func() {
+			defer wg.Done()
+			servers["reader"].HandleCallTool(ctx, key, "get", map[string]any{"key": key})
+		}()
+	}
+	wg.Wait()
+
+	resp := servers["reader"].HandleCallTool(ctx, "final", "get", map[string]any{"key": "7"})
+	result, _ := resp["result"].(map[string]any)
+	content, _ := result["content"].([]map[string]any)
+	if len(content) != 1 || content[0]["text"] != "v7" {
+		t.Errorf("expected reader to see writer's value, got %v", content)
+	}
+}
+
+func TestMcpServerProtocolVersionNegotiation(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      []McpServerOption
+		requested any
+		want      string
+	}{
+		{name: "echoes supported version", requested: "2025-06-18", want: "2025-06-18"},
+		{name: "falls back for unknown version", requested: "1999-01-01", want: DefaultMCPProtocolVersion},
+		{name: "falls back when absent", requested: nil, want: DefaultMCPProtocolVersion},
+		{name: "pinned version wins", opts: []McpServerOption{WithMCPProtocolVersion("2025-03-26")}, requested: "2025-06-18", want: "2025-03-26"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := CreateSdkMcpServerWithOptions("test", "1.0.0", nil, tt.opts...)
+			params := map[string]any{}
+			if tt.requested != nil {
+				params["protocolVersion"] = tt.requested
+			}
+			resp := server.Instance.HandleRequest(context.Background(), map[string]any{
+				"method": "initialize",
+				"id":     "1",
+				"params": params,
+			})
+			result, _ := resp["result"].(map[string]any)
+			if got := result["protocolVersion"]; got != tt.want {
+				t.Errorf("expected protocol version %q, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestMcpServerToolDescriptions(t *testing.T) {
+	greet := NewMCPTool("greet", "Greet someone", nil,
+		func(ctx context.Context, args map[string]any) (MCPToolResult, error) {
+			return MCPToolResult{Content: []MCPContent{{Type: "text", Text: "Hello!"}}}, nil
+		},
+	)
+	farewell := NewMCPTool("farewell", "Say goodbye", nil,
+		func(ctx context.Context, args map[string]any) (MCPToolResult, error) {
+			return MCPToolResult{Content: []MCPContent{{Type: "text", Text: "Bye!"}}}, nil
+		},
+	)
+	server := CreateSdkMcpServerWithOptions("greeter", "1.0.0", []*SdkMcpTool{greet, farewell},
+		WithToolDescriptions(map[string]string{"greet": "Saluer quelqu'un"}),
+	)
+
+	resp := server.Instance.HandleListTools("list-1")
+	result, _ := resp["result"].(map[string]any)
+	tools, _ := result["tools"].([]map[string]any)
+	descriptions := map[any]any{}
+	for _, tool := range tools {
+		descriptions[tool["name"]] = tool["description"]
+	}
+	if descriptions["greet"] != "Saluer quelqu'un" {
+		t.Errorf("expected overridden description, got %v", descriptions["greet"])
+	}
+	if descriptions["farewell"] != "Say goodbye" {
+		t.Errorf("expected original description, got %v", descriptions["farewell"])
+	}
+	if greet.Description != "Greet someone" {
+		t.Errorf("expected tool definition to be unchanged, got %q", greet.Description)
+	}
+
+	call := server.Instance.HandleCallTool(context.Background(), "call-1", "greet", map[string]any{})
+	callResult, _ := call["result"].(map[string]any)
+	content, _ := callResult["content"].([]map[string]any)
+	if len(content) != 1 || content[0]["text"] != "Hello!" {
+		t.Errorf("expected handler to be unchanged, got %v", content)
+	}
+}
+
+func TestMcpServerMaxConcurrentCalls(t *testing.T) {
+	const limit = 2
+	var running, peak atomic.Int32
+	slow := NewMCPTool("query", "Query the database", nil,
+		func(ctx context.Context, args map[string]any) (MCPToolResult, error) {
+			n := running.Add(1)
+			defer running.Add(-1)
+			for {
+				p := peak.Load()
+				if n <= p || peak.CompareAndSwap(p, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			return MCPToolResult{Content: []MCPContent{{Type: "text", Text: "ok"}}}, nil
+		},
+	)
+	server := CreateSdkMcpServerWithOptions("db", "1.0.0", []*SdkMcpTool{slow}, WithMaxConcurrentCalls(limit))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp := server.Instance.HandleCallTool(context.Background(), i, "query", map[string]any{})
+			if resp["error"] != nil {
+				t.Errorf("unexpected error: %v", resp["error"])
+			}
+		}()
+	}
+	wg.Wait()
+	if p := peak.Load(); p > limit {
+		t.Errorf("expected at most %d concurrent handlers, saw %d", limit, p)
+	}
+
+	// A call waiting for a slot gives up when its context ends.
+	server.Instance.callSlots <- struct{}{}
+	server.Instance.callSlots <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if resp := server.Instance.HandleCallTool(ctx, "late", "query", map[string]any{}); resp["error"] == nil {
+		t.Error("expected an error when the context ends while waiting for a slot")
+	}
+}
+
+func TestMcpServerToolResultImagePassthrough(t *testing.T) {
+	image := bytes.Repeat([]byte{0x89, 'P', 'N', 'G'}, 64) // 256 bytes
+	encoded := base64.StdEncoding.EncodeToString(image)
+	screenshot := NewMCPTool("screenshot", "Capture the screen", nil,
+		func(ctx context.Context, args map[string]any) (MCPToolResult, error) {
+			return MCPToolResult{Content: []MCPContent{
+				{Type: "text", Text: "captured"},
+				{Type: "image", Data: encoded, MimeType: "image/png"},
+			}}, nil
+		},
+	)
+
+	tests := []struct {
+		name     string
+		protocol string
+		minBytes int
+		wantLink bool
+	}{
+		{name: "links large image", protocol: "2025-06-18", minBytes: 100, wantLink: true},
+		{name: "inline below threshold", protocol: "2025-06-18", minBytes: 1024},
+		{name: "inline on older protocol", protocol: "2025-03-26", minBytes: 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			server := CreateSdkMcpServerWithOptions("screen", "1.0.0", []*SdkMcpTool{screenshot},
+				WithToolResultImagePassthrough(dir, tt.minBytes))
+			server.Instance.HandleRequest(context.Background(), map[string]any{
+				"method": "initialize",
+				"id":     "1",
+				"params": map[string]any{"protocolVersion": tt.protocol},
+			})
+
+			resp := server.Instance.HandleCallTool(context.Background(), "call-1", "screenshot", map[string]any{})
+			result, _ := resp["result"].(map[string]any)
+			content, _ := result["content"].([]map[string]any)
+			if len(content) != 2 || content[0]["text"] != "captured" {
+				t.Fatalf("unexpected content: %v", content)
+			}
+			item := content[1]
+
+			if !tt.wantLink {
+				if item["type"] != "image" || item["data"] != encoded || item["mimeType"] != "image/png" {
+					t.Errorf("expected inline image, got %v", item)
+				}
+				if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+					t.Errorf("expected no files written, got %d", len(entries))
+				}
+				return
+			}
+
+			if item["type"] != "resource_link" || item["mimeType"] != "image/png" {
+				t.Fatalf("expected resource_link, got %v", item)
+			}
+			uri, _ := item["uri"].(string)
+			parsed, err := url.Parse(uri)
+			if err != nil || parsed.Scheme != "file" {
+				t.Fatalf("expected file URI, got %q", uri)
+			}
+			path := filepath.FromSlash(parsed.Path)
+			if filepath.Dir(path) != dir || filepath.Ext(path) != ".png" {
+				t.Errorf("expected .png file in %s, got %s", dir, path)
+			}
+			if item["name"] != filepath.Base(path) {
+				t.Errorf("expected name %q, got %v", filepath.Base(path), item["name"])
+			}
+			written, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("reading linked file: %v", err)
+			}
+			if !bytes.Equal(written, image) {
+				t.Error("linked file does not hold the decoded image")
+			}
+		})
+	}
+}
+
+func TestMcpServerImagePassthroughFallsBackOnWriteError(t *testing.T) {
+	image := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 64))
+	tool := NewMCPTool("img", "Image", nil,
+		func(ctx context.Context, args map[string]any) (MCPToolResult, error) {
+			return MCPToolResult{Content: []MCPContent{{Type: "image", Data: image, MimeType: "image/png"}}}, nil
+		},
+	)
+	missing := filepath.Join(t.TempDir(), "missing")
+	server := CreateSdkMcpServerWithOptions("img", "1.0.0", []*SdkMcpTool{tool},
+		WithToolResultImagePassthrough(missing, 1))
+	server.Instance.HandleRequest(context.Background(), map[string]any{
+		"method": "initialize",
+		"id":     "1",
+		"params": map[string]any{"protocolVersion": "2025-06-18"},
+	})
+
+	resp := server.Instance.HandleCallTool(context.Background(), "call-1", "img", map[string]any{})
+	result, _ := resp["result"].(map[string]any)
+	content, _ := result["content"].([]map[string]any)
+	if len(content) != 1 || content[0]["type"] != "image" || content[0]["data"] != image {
+		t.Errorf("expected inline fallback, got %v", content)
+	}
+}
+
+func TestMcpServerReset(t *testing.T) {
+	idempotent := true
+	var lookups atomic.Int32
+	lookup := NewMCPTool("lookup", "Look up a value", nil,
+		func(ctx context.Context, args map[string]any) (MCPToolResult, error) {
+			lookups.Add(1)
+			return MCPToolResult{Content: []MCPContent{{Type: "text", Text: "value"}}}, nil
+		},
+	)
+	lookup.Annotations = &MCPToolAnnotations{IdempotentHint: &idempotent}
+	image := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 64))
+	screenshot := NewMCPTool("screenshot", "Take a screenshot", nil,
+		func(ctx context.Context, args map[string]any) (MCPToolResult, error) {
+			return MCPToolResult{Content: []MCPContent{{Type: "image", Data: image, MimeType: "image/png"}}}, nil
+		},
+	)
+	server := CreateSdkMcpServerWithOptions("kv", "1.0.0", []*SdkMcpTool{lookup, screenshot},
+		WithToolResultCache(10, time.Minute),
+		WithToolResultImagePassthrough(t.TempDir(), 1),
+	).Instance
+
+	ctx := context.Background()
+	contentType := func(id any) any {
+		resp := server.HandleCallTool(ctx, id, "screenshot", map[string]any{})
+		result, _ := resp["result"].(map[string]any)
+		content, _ := result["content"].([]map[string]any)
+		if len(content) != 1 {
+			t.Fatalf("expected one content item, got %v", content)
+		}
+		return content[0]["type"]
+	}
+	server.HandleRequest(ctx, map[string]any{
+		"method": "initialize",
+		"id":     "init",
+		"params": map[string]any{"protocolVersion": "2025-06-18"},
+	})
+	if got := contentType("before"); got != "resource_link" {
+		t.Fatalf("expected a linked image after negotiating 2025-06-18, got %v", got)
+	}
+	args := map[string]any{"key": "a"}
+	server.HandleCallTool(ctx, 1, "lookup", args)
+	server.HandleCallTool(ctx, 2, "lookup", args)
+	if n := lookups.Load(); n != 1 {
+		t.Fatalf("expected cached result before Reset, handler ran %d times", n)
+	}
+
+	server.Reset()
+
+	server.HandleCallTool(ctx, 3, "lookup", args)
+	if n := lookups.Load(); n != 2 {
+		t.Errorf("expected Reset to clear the cache, handler ran %d times", n)
+	}
+	if got := contentType("after"); got != "image" {
+		t.Errorf("expected Reset to forget the negotiated version and inline the image, got %v", got)
+	}
+}
+
+func TestMcpServerResetConcurrent(t *testing.T) {
+	echo := NewMCPTool("echo", "Echo", nil,
+		func(ctx context.Context, args map[string]any) (MCPToolResult, error) {
+			return MCPToolResult{Content: []MCPContent{{Type: "text", Text: "ok"}}}, nil
+		},
+	)
+	server := CreateSdkMcpServerWithOptions("echo", "1.0.0", []*SdkMcpTool{echo},
+		WithToolResultCache(10, 0),
+	).Instance
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if i%2 == 0 {
+					server.Reset()
+					continue
+				}
+				resp := server.HandleCallTool(context.Background(), j, "echo", map[string]any{})
+				if _, ok := resp["result"]; !ok {
+					t.Errorf("unexpected response during Reset: %v", resp)
+					return
+				}
+				server.HandleListTools(j)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestMcpServerToolCallRecordAndReplay(t *testing.T) {
+	var calls atomic.Int32
+	weather := NewMCPTool("weather", "Current weather", nil,
+		func(ctx context.Context, args map[string]any) (MCPToolResult, error) {
+			n := calls.Add(1)
+			if args["city"] == "Atlantis" {
+				return MCPToolResult{}, fmt.Errorf("unknown city")
+			}
+			return MCPToolResult{Content: []MCPContent{{Type: "text", Text: fmt.Sprintf("%v: sunny (call %d)", args["city"], n)}}}, nil
+		},
+	)
+	var recording bytes.Buffer
+	live := CreateSdkMcpServerWithOptions("wx", "1.0.0", []*SdkMcpTool{weather},
+		WithToolCallRecorder(&recording),
+	).Instance
+
+	ctx := context.Background()
+	inputs := []map[string]any{{"city": "Paris"}, {"city": "Paris"}, {"city": "Oslo"}, {"city": "Atlantis"}}
+	var want []map[string]any
+	for i, args := range inputs {
+		want = append(want, live.HandleCallTool(ctx, i, "weather", args))
+	}
+	if lines := bytes.Count(recording.Bytes(), []byte("\n")); lines != len(inputs) {
+		t.Fatalf("expected %d recorded lines, got %d:\n%s", len(inputs), lines, recording.String())
+	}
+
+	path := filepath.Join(t.TempDir(), "weather.jsonl")
+	if err := os.WriteFile(path, recording.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	handler, err := ReplayHandler(path, "weather")
+	if err != nil {
+		t.Fatalf("ReplayHandler: %v", err)
+	}
+	replay := CreateSdkMcpServer("wx", "1.0.0", NewMCPTool("weather", "Current weather", nil, handler)).Instance
+
+	// Results come back in recorded order, then the last one per input repeats.
+	for i, args := range inputs {
+		got := replay.HandleCallTool(ctx, i, "weather", args)
+		if fmt.Sprint(got) != fmt.Sprint(want[i]) {
+			t.Errorf("call %d: replayed %v, recorded %v", i, got, want[i])
+		}
+	}
+	again := replay.HandleCallTool(ctx, 9, "weather", map[string]any{"city": "Oslo"})
+	if fmt.Sprint(again["result"]) != fmt.Sprint(want[2]["result"]) {
+		t.Errorf("expected the last Oslo result to repeat, got %v", again)
+	}
+	if calls.Load() != int32(len(inputs)) {
+		t.Errorf("replay must not call the live handler, calls = %d", calls.Load())
+	}
+
+	unknown := replay.HandleCallTool(ctx, 10, "weather", map[string]any{"city": "Rome"})
+	if _, ok := unknown["error"]; !ok {
+		t.Errorf("expected an error for unrecorded arguments, got %v", unknown)
+	}
+}
+
+func TestReplayHandlerErrors(t *testing.T) {
+	if _, err := ReplayHandler(filepath.Join(t.TempDir(), "missing.jsonl"), "weather"); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+	path := filepath.Join(t.TempDir(), "bad.jsonl")
+	if err := os.WriteFile(path, []byte("{\"tool\":\"weather\"}\nnot json\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReplayHandler(path, "weather"); err == nil || !strings.Contains(err.Error(), ":2:") {
+		t.Errorf("expected an error naming line 2, got %v", err)
+	}
+}
+
+type forecastArgs struct {
+	City     string                     `json:"city" description:"City name"`
+	Days     int                        `json:"days,omitempty"`
+	Units    *string                    `json:"units"`
+	Location struct{ Lat, Lon float64 } `json:"location"`
+	Tags     []string                   `json:"tags,omitempty"`
+	Extra    map[string]bool            `json:"extra,omitempty"`
+	internal string
+}
+
+func TestToolFromFunc(t *testing.T) {
+	tool, err := ToolFromFunc("forecast", "Weather forecast", func(args forecastArgs) (string, error) {
+		if args.City == "" {
+			return "", fmt.Errorf("city is required")
+		}
+		return fmt.Sprintf("%s for %d days at %.1f,%.1f", args.City, args.Days, args.Location.Lat, args.Location.Lon), nil
+	})
+	if err != nil {
+		t.Fatalf("ToolFromFunc: %v", err)
+	}
+
+	want := map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"city":  map[string]any{"type": "string", "description": "City name"},
+			"days":  map[string]any{"type": "integer"},
+			"units": map[string]any{"type": "string"},
+			"location": map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"Lat": map[string]any{"type": "number"},
+					"Lon": map[string]any{"type": "number"},
+				},
+				"required": []string{"Lat", "Lon"},
+			},
+			"tags":  map[string]any{"type": "array", "items": map[string]any{"type": "string"}},
+			"extra": map[string]any{"type": "object", "additionalProperties": map[string]any{"type": "boolean"}},
+		},
+		"required": []string{"city", "location"},
+	}
+	if !reflect.DeepEqual(tool.InputSchema, want) {
+		t.Errorf("InputSchema =\n%v\nwant\n%v", tool.InputSchema, want)
+	}
+
+	server := CreateSdkMcpServer("wx", "1.0.0", tool).Instance
+	resp := server.HandleRequest(context.Background(), map[string]any{
+		"jsonrpc": "2.0",
+		"id":      1,
+		"method":  "tools/call",
+		"params": map[string]any{
+			"name":      "forecast",
+			"arguments": map[string]any{"city": "Oslo", "days": float64(3), "location": map[string]any{"Lat": 59.9, "Lon": 10.7}},
+		},
+	})
+	result, _ := resp["result"].(map[string]any)
+	content, _ := result["content"].([]map[string]any)
+	if len(content) != 1 || content[0]["text"] != "Oslo for 3 days at 59.9,10.7" {
+		t.Errorf("unexpected response: %v", resp)
+	}
+
+	resp = server.HandleCallTool(context.Background(), 2, "forecast", map[string]any{"city": float64(1)})
+	if _, ok := resp["error"]; !ok {
+		t.Errorf("expected an error for mistyped arguments, got %v", resp)
+	}
+}
+
+func TestToolFromFuncWithContextAndResult(t *testing.T) {
+	type key struct{}
+	tool, err := ToolFromFunc("echo", "Echo", func(ctx context.Context, args *struct {
+		Text string `json:"text"`
+	}) (MCPToolResult, error) {
+		return MCPToolResult{Content: []MCPContent{{Type: "text", Text: fmt.Sprint(ctx.Value(key{}), ":", args.Text)}}}, nil
+	})
+	if err != nil {
+		t.Fatalf("ToolFromFunc: %v", err)
+	}
+	ctx := context.WithValue(context.Background(), key{}, "ctx")
+	result, err := tool.Handler(ctx, map[string]any{"text": "hi"})
+	if err != nil || len(result.Content) != 1 || result.Content[0].Text != "ctx:hi" {
+		t.Errorf("unexpected result %+v, err %v", result, err)
+	}
+}
+
+func TestToolFromFuncRejectsBadSignatures(t *testing.T) {
+	type node struct {
+		Next *node `json:"next"`
+	}
+	tests := []struct {
+		name string
+		fn   any
+	}{
+		{"not a function", "nope"},
+		{"no arguments", func() (string, error) { return "", nil }},
+		{"non-struct argument", func(s string) (string, error) { return s, nil }},
+		{"wrong result", func(struct{}) (int, error) { return 0, nil }},
+		{"missing error", func(struct{}) string { return "" }},
+		{"unsupported field", func(struct{ C chan int }) (string, error) { return "", nil }},
+		{"recursive type", func(node) (string, error) { return "", nil }},
+	}
+	for _, tt := range tests {
+		if _, err := ToolFromFunc("bad", "", tt.fn); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+}
+
+func TestNewTypedMCPTool(t *testing.T) {
+	type addArgs struct {
+		A     float64 `json:"a" description:"First operand"`
+		B     float64 `json:"b"`
+		Round *bool   `json:"round"`
+		Label string  `json:"label,omitempty"`
+	}
+	tool := NewTypedMCPTool("add", "Add two numbers", func(ctx context.Context, args addArgs) (MCPToolResult, error) {
+		sum := args.A + args.B
+		if args.Round != nil && *args.Round {
+			sum = float64(int(sum + 0.5))
+		}
+		return MCPToolResult{Content: []MCPContent{{Type: "text", Text: fmt.Sprintf("%s%g", args.Label, sum)}}}, nil
+	})
+
+	want := map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"a":     map[string]any{"type": "number", "description": "First operand"},
+			"b":     map[string]any{"type": "number"},
+			"round": map[string]any{"type": "boolean"},
+			"label": map[string]any{"type": "string"},
+		},
+		"required": []string{"a", "b"},
+	}
+	if !reflect.DeepEqual(tool.InputSchema, want) {
+		t.Errorf("InputSchema =\n%v\nwant\n%v", tool.InputSchema, want)
+	}
+
+	server := CreateSdkMcpServer("calc", "1.0.0", tool).Instance
+	tests := []struct {
+		name     string
+		args     map[string]any
+		wantText string
+		wantCode int
+	}{
+		{"required only", map[string]any{"a": 1.5, "b": 2.0}, "3.5", 0},
+		{"with optional", map[string]any{"a": 1.5, "b": 2.0, "round": true, "label": "sum="}, "sum=4", 0},
+		{"decoding failure", map[string]any{"a": "one", "b": 2.0}, "", -32602},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := server.HandleCallTool(context.Background(), 1, "add", tt.args)
+			if tt.wantCode != 0 {
+				errObj, _ := resp["error"].(map[string]any)
+				if errObj["code"] != tt.wantCode {
+					t.Errorf("expected error code %d, got %v", tt.wantCode, resp)
+				}
+				return
+			}
+			result, _ := resp["result"].(map[string]any)
+			content, _ := result["content"].([]map[string]any)
+			if len(content) != 1 || content[0]["text"] != tt.wantText {
+				t.Errorf("expected %q, got %v", tt.wantText, resp)
+			}
+		})
+	}
+}
+
+func TestNewTypedMCPToolNonStruct(t *testing.T) {
+	tool := NewTypedMCPTool("keys", "", func(ctx context.Context, args any) (MCPToolResult, error) {
+		return MCPToolResult{Content: []MCPContent{{Type: "text", Text: fmt.Sprint(len(args.(map[string]any)))}}}, nil
+	})
+	if !reflect.DeepEqual(tool.InputSchema, map[string]any{"type": "object"}) {
+		t.Errorf("expected a permissive object schema, got %v", tool.InputSchema)
+	}
+	result, err := tool.Handler(context.Background(), map[string]any{"x": 1.0, "y": 2.0})
+	if err != nil || result.Content[0].Text != "2" {
+		t.Errorf("unexpected result %+v, err %v", result, err)
+	}
+}
+
+func TestHandleCallToolContentTypes(t *testing.T) {
+	readme := &MCPResourceContent{URI: "docs://readme", MimeType: "text/markdown", Text: "# Project"}
+	tests := []struct {
+		name    string
+		content MCPContent
+		want    map[string]any
+	}{
+		{"text", TextContent("hello"), map[string]any{"type": "text", "text": "hello"}},
+		{"image", ImageContent("aW1n", "image/png"), map[string]any{"type": "image", "data": "aW1n", "mimeType": "image/png"}},
+		{"audio", AudioContent("YXVk", "audio/wav"), map[string]any{"type": "audio", "data": "YXVk", "mimeType": "audio/wav"}},
+		{"resource", MCPContent{Type: "resource", Resource: readme}, map[string]any{"type": "resource", "resource": readme}},
+		{"unknown", MCPContent{Type: "video", Data: "dmlk", MimeType: "video/mp4"}, map[string]any{"type": "video", "data": "dmlk", "mimeType": "video/mp4"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tool := NewMCPTool("get", "", map[string]any{"type": "object"}, func(ctx context.Context, args map[string]any) (MCPToolResult, error) {
+				return MCPToolResult{Content: []MCPContent{tt.content}}, nil
+			})
+			resp := CreateSdkMcpServer("content", "1.0.0", tool).Instance.HandleCallTool(context.Background(), 1, "get", map[string]any{})
+			result, _ := resp["result"].(map[string]any)
+			content, _ := result["content"].([]map[string]any)
+			if len(content) != 1 || !reflect.DeepEqual(content[0], tt.want) {
+				t.Errorf("content = %v, want %v", content, tt.want)
+			}
+		})
+	}
+}
+
+func TestMcpServerResources(t *testing.T) {
+	readme := &MCPResource{
+		URI:         "docs://readme",
+		Name:        "README",
+		Description: "Project overview",
+		MimeType:    "text/markdown",
+		Read: func(ctx context.Context, uri string) ([]MCPResourceContent, error) {
+			return []MCPResourceContent{{Text: "# Project"}}, nil
+		},
+	}
+	broken := &MCPResource{
+		URI:  "docs://broken",
+		Name: "Broken",
+		Read: func(ctx context.Context, uri string) ([]MCPResourceContent, error) {
+			return nil, fmt.Errorf("disk unavailable")
+		},
+	}
+	server := CreateSdkMcpServerWithOptions("docs", "1.0.0", nil, WithMCPResources(readme, broken)).Instance
+	ctx := context.Background()
+	request := func(id int, method string, params map[string]any) map[string]any {
+		return server.HandleRequest(ctx, map[string]any{"jsonrpc": "2.0", "id": id, "method": method, "params": params})
+	}
+
+	init := request(1, "initialize", nil)
+	caps := init["result"].(map[string]any)["capabilities"].(map[string]any)
+	if _, ok := caps["resources"]; !ok {
+		t.Errorf("expected the resources capability, got %v", caps)
+	}
+
+	list := request(2, "resources/list", nil)
+	want := []map[string]any{
+		{"uri": "docs://readme", "name": "README", "description": "Project overview", "mimeType": "text/markdown"},
+		{"uri": "docs://broken", "name": "Broken"},
+	}
+	if got := list["result"].(map[string]any)["resources"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("resources/list = %v, want %v", got, want)
+	}
+
+	read := request(3, "resources/read", map[string]any{"uri": "docs://readme"})
+	contents := read["result"].(map[string]any)["contents"]
+	wantContents := []MCPResourceContent{{URI: "docs://readme", MimeType: "text/markdown", Text: "# Project"}}
+	if !reflect.DeepEqual(contents, wantContents) {
+		t.Errorf("resources/read = %v, want %v", contents, wantContents)
+	}
+
+	tests := []struct {
+		uri      string
+		wantCode int
+	}{
+		{"docs://missing", -32002},
+		{"docs://broken", -32603},
+	}
+	for _, tt := range tests {
+		resp := request(4, "resources/read", map[string]any{"uri": tt.uri})
+		rpcErr, ok := resp["error"].(map[string]any)
+		if !ok || rpcErr["code"] != tt.wantCode {
+			t.Errorf("%s: expected error code %d, got %v", tt.uri, tt.wantCode, resp)
+		}
+	}
+}
+
+func TestMcpServerWithoutResources(t *testing.T) {
+	server := CreateSdkMcpServer("tools", "1.0.0").Instance
+	caps := server.HandleInitialize(1)["result"].(map[string]any)["capabilities"].(map[string]any)
+	if _, ok := caps["resources"]; ok {
+		t.Errorf("expected no resources capability without resources, got %v", caps)
+	}
+	list := server.HandleListResources(2)
+	if got := list["result"].(map[string]any)["resources"].([]map[string]any); len(got) != 0 {
+		t.Errorf("expected an empty list, got %v", got)
+	}
+}
+
+func TestMcpServerPrompts(t *testing.T) {
+	review := &MCPPrompt{
+		Name:        "code_review",
+		Description: "Review a change",
+		Arguments: []MCPPromptArgument{
+			{Name: "language", Description: "Programming language", Required: true},
+			{Name: "focus"},
+		},
+		Get: func(ctx context.Context, args map[string]string) ([]MCPPromptMessage, error) {
+			text := "Review this " + args["language"] + " change"
+			if focus := args["focus"]; focus != "" {
+				text += ", focusing on " + focus
+			}
+			return []MCPPromptMessage{{Role: "user", Content: MCPContent{Type: "text", Text: text}}}, nil
+		},
+	}
+	server := CreateSdkMcpServerWithOptions("prompts", "1.0.0", nil, WithMCPPrompts(review)).Instance
+	ctx := context.Background()
+	request := func(id int, method string, params map[string]any) map[string]any {
+		return server.HandleRequest(ctx, map[string]any{"jsonrpc": "2.0", "id": id, "method": method, "params": params})
+	}
+
+	caps := request(1, "initialize", nil)["result"].(map[string]any)["capabilities"].(map[string]any)
+	if _, ok := caps["prompts"]; !ok {
+		t.Errorf("expected the prompts capability, got %v", caps)
+	}
+
+	list := request(2, "prompts/list", nil)["result"].(map[string]any)["prompts"]
+	wantList := []map[string]any{{
+		"name":        "code_review",
+		"description": "Review a change",
+		"arguments":   review.Arguments,
+	}}
+	if !reflect.DeepEqual(list, wantList) {
+		t.Errorf("prompts/list = %v, want %v", list, wantList)
+	}
+
+	get := request(3, "prompts/get", map[string]any{
+		"name":      "code_review",
+		"arguments": map[string]any{"language": "Go", "focus": "error handling"},
+	})
+	result, _ := get["result"].(map[string]any)
+	wantMessages := []MCPPromptMessage{{Role: "user", Content: MCPContent{Type: "text", Text: "Review this Go change, focusing on error handling"}}}
+	if !reflect.DeepEqual(result["messages"], wantMessages) || result["description"] != "Review a change" {
+		t.Errorf("prompts/get = %v", get)
+	}
+
+	tests := []struct {
+		name    string
+		params  map[string]any
+		wantMsg string
+	}{
+		{"missing required argument", map[string]any{"name": "code_review", "arguments": map[string]any{"focus": "tests"}}, "Missing required arguments for prompt 'code_review': language"},
+		{"no arguments", map[string]any{"name": "code_review"}, "Missing required arguments for prompt 'code_review': language"},
+		{"unknown prompt", map[string]any{"name": "nope"}, "Prompt 'nope' not found"},
+	}
+	for _, tt := range tests {
+		resp := request(4, "prompts/get", tt.params)
+		rpcErr, ok := resp["error"].(map[string]any)
+		if !ok || rpcErr["code"] != -32602 || rpcErr["message"] != tt.wantMsg {
+			t.Errorf("%s: expected invalid params %q, got %v", tt.name, tt.wantMsg, resp)
+		}
+	}
+}
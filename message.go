@@ -1,5 +1,10 @@
 package claude
 
+import (
+	"encoding/json"
+	"time"
+)
+
 // Message is a sealed interface representing messages from Claude Code.
 // Use type switch to handle specific message types.
 type Message interface {
@@ -34,6 +39,16 @@ type AssistantMessage struct {
 	Model           string                `json:"model"`
 	ParentToolUseID string                `json:"parent_tool_use_id,omitempty"`
 	Error           AssistantMessageError `json:"error,omitempty"`
+	ErrorDetail     *ErrorDetail          `json:"error_detail,omitempty"`
+	SessionID       string                `json:"session_id,omitempty"`
+	UUID            string                `json:"uuid,omitempty"`
+}
+
+// ErrorDetail is the actionable part of an assistant error: the human-readable
+// message and, for rate limits, how long to wait before retrying.
+type ErrorDetail struct {
+	Message    string         `json:"message,omitempty"`
+	RetryAfter *time.Duration `json:"retry_after,omitempty"`
 }
 
 func (m *AssistantMessage) messageType() string { return "assistant" }
@@ -42,26 +57,110 @@ func (m *AssistantMessage) messageType() string { return "assistant" }
 type SystemMessage struct {
 	Subtype string         `json:"subtype"`
 	Data    map[string]any `json:"data"`
+	// Init holds the parsed fields of an init message; nil for other subtypes.
+	Init *SystemInitData `json:"init,omitempty"`
+}
+
+// SystemSubtypeInit is the subtype of the system message the CLI sends at the
+// start of a session.
+const SystemSubtypeInit = "init"
+
+// SystemInitData is the session setup reported by the init system message.
+type SystemInitData struct {
+	SessionID      string         `json:"session_id"`
+	Model          string         `json:"model,omitempty"`
+	Cwd            string         `json:"cwd,omitempty"`
+	PermissionMode PermissionMode `json:"permission_mode,omitempty"`
+	Tools          []string       `json:"tools,omitempty"`
+	MCPServers     []string       `json:"mcp_servers,omitempty"` // server names
 }
 
 func (m *SystemMessage) messageType() string { return "system" }
 
 // ResultMessage represents a result message with cost and usage information.
 type ResultMessage struct {
-	Subtype          string         `json:"subtype"`
-	DurationMS       int            `json:"duration_ms"`
-	DurationAPIMS    int            `json:"duration_api_ms"`
-	IsError          bool           `json:"is_error"`
-	NumTurns         int            `json:"num_turns"`
-	SessionID        string         `json:"session_id"`
-	TotalCostUSD     *float64       `json:"total_cost_usd,omitempty"`
-	Usage            map[string]any `json:"usage,omitempty"`
-	Result           string         `json:"result,omitempty"`
-	StructuredOutput any            `json:"structured_output,omitempty"`
+	Subtype           string             `json:"subtype"`
+	DurationMS        int                `json:"duration_ms"`
+	DurationAPIMS     int                `json:"duration_api_ms"`
+	IsError           bool               `json:"is_error"`
+	NumTurns          int                `json:"num_turns"`
+	SessionID         string             `json:"session_id"`
+	TotalCostUSD      *float64           `json:"total_cost_usd,omitempty"`
+	Usage             map[string]any     `json:"usage,omitempty"`
+	Result            string             `json:"result,omitempty"`
+	StructuredOutput  any                `json:"structured_output,omitempty"`
+	PermissionDenials []PermissionDenial `json:"permission_denials,omitempty"`
+	ModelUsage        map[string]Usage   `json:"modelUsage,omitempty"` // keyed by model name
+	UUID              string             `json:"uuid,omitempty"`
+}
+
+// Usage is a token and cost tally.
+type Usage struct {
+	InputTokens              int           `json:"input_tokens"`
+	OutputTokens             int           `json:"output_tokens"`
+	CacheCreationInputTokens int           `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int           `json:"cache_read_input_tokens"`
+	CostUSD                  float64       `json:"cost_usd,omitempty"`
+	ServerToolUse            ServerToolUse `json:"server_tool_use"`
+}
+
+// ServerToolUse counts requests to tools that run on the API side. Counts the
+// SDK does not know are only in the raw ResultMessage.Usage map.
+type ServerToolUse struct {
+	WebSearchRequests int `json:"web_search_requests,omitempty"`
+	WebFetchRequests  int `json:"web_fetch_requests,omitempty"`
+}
+
+// PermissionDenial records a tool call that was blocked during the run.
+type PermissionDenial struct {
+	ToolName  string         `json:"tool_name"`
+	ToolUseID string         `json:"tool_use_id,omitempty"`
+	ToolInput map[string]any `json:"tool_input,omitempty"`
+	Reason    string         `json:"reason,omitempty"`
 }
 
 func (m *ResultMessage) messageType() string { return "result" }
 
+// ParsedUsage returns Usage decoded into typed fields. Fields missing from the
+// payload are zero; the raw map stays available for fields the SDK does not
+// know yet.
+func (m *ResultMessage) ParsedUsage() Usage {
+	return parseUsage(m.Usage)
+}
+
+// Result message subtypes emitted by Claude Code.
+const (
+	ResultSubtypeSuccess              = "success"
+	ResultSubtypeErrorMaxTurns        = "error_max_turns"
+	ResultSubtypeErrorDuringExecution = "error_during_execution"
+)
+
+// PartialResult returns the last assistant text of a run that stopped at the
+// turn limit. It reports false for any other subtype or when no text was carried.
+func (m *ResultMessage) PartialResult() (string, bool) {
+	if m.Subtype != ResultSubtypeErrorMaxTurns || m.Result == "" {
+		return "", false
+	}
+	return m.Result, true
+}
+
+// DecodeStructuredOutput decodes StructuredOutput into v, a pointer, by way of
+// JSON. It fails when the result carries no structured output or its shape
+// does not match v.
+func (m *ResultMessage) DecodeStructuredOutput(v any) error {
+	if m.StructuredOutput == nil {
+		return &SDKError{Message: "result has no structured output"}
+	}
+	data, err := json.Marshal(m.StructuredOutput)
+	if err != nil {
+		return &SDKError{Message: "failed to encode structured output", Cause: err}
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return &SDKError{Message: "structured output does not match the target type", Cause: err}
+	}
+	return nil
+}
+
 // StreamEvent represents a stream event for partial message updates during streaming.
 type StreamEvent struct {
 	UUID            string         `json:"uuid"`
@@ -73,9 +172,23 @@ type StreamEvent struct {
 func (m *StreamEvent) messageType() string { return "stream_event" }
 
 // RateLimitEvent represents rate limit metadata events emitted by Claude CLI.
-// Keep the payload raw for forward compatibility with CLI changes.
+// The typed fields are nil or empty when the event does not carry them; Data
+// keeps the raw payload for forward compatibility with CLI changes.
 type RateLimitEvent struct {
-	Data map[string]any `json:"data"`
+	RetryAfterSeconds *float64       `json:"retry_after_seconds,omitempty"`
+	Remaining         *int           `json:"remaining,omitempty"`
+	ResetAt           *time.Time     `json:"reset_at,omitempty"`
+	LimitType         string         `json:"limit_type,omitempty"`
+	Data              map[string]any `json:"data"`
 }
 
 func (m *RateLimitEvent) messageType() string { return "rate_limit_event" }
+
+// CustomMessage is a message of a type registered with RegisterMessageParser.
+// Embed it in a struct to return a richer type from a custom parser.
+type CustomMessage struct {
+	Type string         `json:"type"`
+	Data map[string]any `json:"data"`
+}
+
+func (m *CustomMessage) messageType() string { return m.Type }
@@ -0,0 +1,95 @@
+package claude
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// modelPin tracks the requested model and reports assistant messages that
+// were answered by a different one, e.g. after a silent fallback.
+type modelPin struct {
+	mu          sync.Mutex
+	requested   string
+	initialized bool
+	reported    string // last mismatched model reported, so each change fires once
+}
+
+// set records a new requested model, as after SetModel.
+func (p *modelPin) set(model string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.requested = model
+	p.initialized = true
+	p.reported = ""
+}
+
+// check compares the model of a top-level assistant message with the requested
+// model. It calls ModelChangeHandler once per change and returns a
+// *ModelMismatchError when StrictModelPinning is set.
+func (p *modelPin) check(o *AgentOptions, msg Message) error {
+	am, ok := msg.(*AssistantMessage)
+	if !ok || am.Model == "" || am.ParentToolUseID != "" {
+		return nil
+	}
+	if o.ModelChangeHandler == nil && !o.StrictModelPinning {
+		return nil
+	}
+
+	p.mu.Lock()
+	if !p.initialized {
+		p.requested = o.Model
+		p.initialized = true
+	}
+	requested := p.requested
+	if requested == "" || modelMatches(requested, am.Model) || am.Model == p.reported {
+		p.mu.Unlock()
+		return nil
+	}
+	p.reported = am.Model
+	p.mu.Unlock()
+
+	if o.ModelChangeHandler != nil {
+		o.ModelChangeHandler(requested, am.Model)
+	}
+	if o.StrictModelPinning {
+		return &ModelMismatchError{
+			SDKError:  SDKError{Message: fmt.Sprintf("requested model %q but the response came from %q", requested, am.Model)},
+			Requested: requested,
+			Actual:    am.Model,
+		}
+	}
+	return nil
+}
+
+// modelMatches reports whether actual satisfies a request for requested. The
+// CLI accepts aliases ("sonnet") and undated IDs ("claude-sonnet-4-5") and
+// reports the resolved, dated ID: an ID matches only when what follows it is
+// a -YYYYMMDD date.
+func modelMatches(requested, actual string) bool {
+	requested, actual = strings.ToLower(requested), strings.ToLower(actual)
+	if requested == actual {
+		return true
+	}
+	if date, ok := strings.CutPrefix(actual, requested+"-"); ok {
+		return isModelDate(date)
+	}
+	switch requested {
+	case "sonnet", "opus", "haiku":
+		return strings.Contains(actual, requested)
+	}
+	return false
+}
+
+// isModelDate reports whether s is the 8-digit date of a model ID.
+func isModelDate(s string) bool {
+	if len(s) != 8 {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,73 @@
+package claude
+
+import "testing"
+
+func TestModelMatches(t *testing.T) {
+	tests := []struct {
+		requested string
+		actual    string
+		want      bool
+	}{
+		{"claude-sonnet-4-5", "claude-sonnet-4-5", true},
+		{"claude-sonnet-4-5", "claude-sonnet-4-5-20250929", true},
+		{"sonnet", "claude-sonnet-4-5-20250929", true},
+		{"Opus", "claude-opus-4-1-20250805", true},
+		{"claude-sonnet-4-5", "claude-haiku-4-5-20251001", false},
+		{"claude-sonnet-4", "claude-sonnet-4-5-20250929", false},
+		{"claude-sonnet-4", "claude-sonnet-4-20250514", true},
+		{"claude-sonnet-4-5", "claude-sonnet-4-5-2025", false},
+		{"sonnet", "claude-haiku-4-5", false},
+		{"claude-opus-4-1", "claude-opus-4", false},
+	}
+	for _, tt := range tests {
+		if got := modelMatches(tt.requested, tt.actual); got != tt.want {
+			t.Errorf("modelMatches(%q, %q) = %v, want %v", tt.requested, tt.actual, got, tt.want)
+		}
+	}
+}
+
+func TestModelPinFiresOncePerChange(t *testing.T) {
+	var changes [][2]string
+	options := applyOptions([]Option{
+		WithModel("claude-opus-4-1"),
+		WithModelChangeHandler(func(from, to string) { changes = append(changes, [2]string{from, to}) }),
+	})
+	var pin modelPin
+	for _, msg := range []Message{
+		&AssistantMessage{Model: "claude-opus-4-1-20250805"},
+		&AssistantMessage{Model: "claude-sonnet-4-5-20250929"},
+		&AssistantMessage{Model: "claude-sonnet-4-5-20250929"},
+		&AssistantMessage{Model: "claude-haiku-4-5", ParentToolUseID: "tu-1"},
+		&UserMessage{},
+	} {
+		if err := pin.check(options, msg); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if len(changes) != 1 || changes[0] != [2]string{"claude-opus-4-1", "claude-sonnet-4-5-20250929"} {
+		t.Fatalf("expected one change, got %v", changes)
+	}
+
+	pin.set("claude-sonnet-4-5")
+	if err := pin.check(options, &AssistantMessage{Model: "claude-sonnet-4-5-20250929"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(changes) != 1 {
+		t.Errorf("expected no change after pin update, got %v", changes)
+	}
+}
+
+func TestModelPinIgnoresUnpinnedModel(t *testing.T) {
+	fired := false
+	options := applyOptions([]Option{
+		WithStrictModelPinning(),
+		WithModelChangeHandler(func(from, to string) { fired = true }),
+	})
+	var pin modelPin
+	if err := pin.check(options, &AssistantMessage{Model: "claude-sonnet-4-5"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fired {
+		t.Error("handler should not fire when no model was requested")
+	}
+}
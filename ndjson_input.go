@@ -0,0 +1,98 @@
+package claude
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// QueryStreamReader runs QueryStream with input messages decoded from r, a
+// stream of newline-delimited JSON objects such as a recorded transcript of
+// user messages. Each object must be a user input message:
+//
+//	{"type":"user","message":{"role":"user","content":"..."}}
+//
+// Messages are streamed as they are read. A malformed or invalid message stops
+// the query and is reported on the error channel.
+func QueryStreamReader(ctx context.Context, r io.Reader, opts ...Option) (<-chan Message, <-chan error) {
+	ctx, cancel := context.WithCancel(ctx)
+	input := make(chan map[string]any)
+	readDone := make(chan struct{})
+	var readErr error
+	go func() {
+		defer close(readDone)
+		defer close(input)
+		if readErr = decodeInputMessages(ctx, r, input); readErr != nil {
+			cancel()
+		}
+	}()
+
+	msgs, errs := QueryStream(ctx, input, opts...)
+	msgChan := make(chan Message, 100)
+	errChan := make(chan error, 1)
+	go func() {
+		defer close(msgChan)
+		defer close(errChan)
+		for msg := range msgs {
+			select {
+			case msgChan <- msg:
+			case <-ctx.Done():
+			}
+		}
+		err := <-errs
+		// Stops the decoder if the query ended before the input did.
+		cancel()
+		<-readDone
+		if readErr != nil {
+			err = readErr
+		}
+		if err != nil {
+			errChan <- err
+		}
+	}()
+	return msgChan, errChan
+}
+
+// decodeInputMessages sends each valid input message from r to out.
+func decodeInputMessages(ctx context.Context, r io.Reader, out chan<- map[string]any) error {
+	dec := json.NewDecoder(r)
+	for n := 1; ; n++ {
+		var msg map[string]any
+		if err := dec.Decode(&msg); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return &SDKError{Message: fmt.Sprintf("invalid JSON in input message %d", n), Cause: err}
+		}
+		if err := validateInputMessage(msg); err != nil {
+			return &SDKError{Message: fmt.Sprintf("invalid input message %d", n), Cause: err}
+		}
+		select {
+		case out <- msg:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// validateInputMessage checks msg has the shape of a stream-json user message.
+func validateInputMessage(msg map[string]any) error {
+	if msg["type"] != "user" {
+		return fmt.Errorf("type must be \"user\", got %v", msg["type"])
+	}
+	inner, ok := msg["message"].(map[string]any)
+	if !ok {
+		return errors.New("missing \"message\" object")
+	}
+	if inner["role"] != "user" {
+		return fmt.Errorf("message.role must be \"user\", got %v", inner["role"])
+	}
+	switch inner["content"].(type) {
+	case string, []any:
+		return nil
+	default:
+		return errors.New("message.content must be a string or an array of content blocks")
+	}
+}
@@ -0,0 +1,62 @@
+package claude
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueryStreamReader(t *testing.T) {
+	cli := writeFakeCLI(t, fakeCLIScript)
+	transcript := `{"type":"user","message":{"role":"user","content":"first"}}
+{"type":"user","message":{"role":"user","content":[{"type":"text","text":"second"}]},"session_id":"sess-1"}
+`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msgChan, errChan := QueryStreamReader(ctx, strings.NewReader(transcript), WithCLIPath(cli))
+	var results int
+	for msg := range msgChan {
+		if _, ok := msg.(*ResultMessage); ok {
+			results++
+		}
+	}
+	if err := <-errChan; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if results != 2 {
+		t.Errorf("expected a result per input message, got %d", results)
+	}
+}
+
+func TestQueryStreamReaderRejectsInvalidMessage(t *testing.T) {
+	cli := writeFakeCLI(t, fakeCLIScript)
+	tests := []struct {
+		name       string
+		transcript string
+		wantErr    string
+	}{
+		{name: "malformed JSON", transcript: `{"type":"user",`, wantErr: "invalid JSON in input message 1"},
+		{name: "wrong type", transcript: `{"type":"assistant","message":{"role":"user","content":"x"}}`, wantErr: "invalid input message 1"},
+		{
+			name: "missing content",
+			transcript: `{"type":"user","message":{"role":"user","content":"ok"}}
+{"type":"user","message":{"role":"user"}}`,
+			wantErr: "invalid input message 2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			msgChan, errChan := QueryStreamReader(ctx, strings.NewReader(tt.transcript), WithCLIPath(cli))
+			for range msgChan {
+			}
+			err := <-errChan
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
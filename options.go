@@ -1,8 +1,15 @@
 package claude
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+	"unicode/utf8"
 )
 
 // AgentOptions holds all configuration options for Claude SDK queries and clients.
@@ -70,6 +77,9 @@ type AgentOptions struct {
 	// AddDirs specifies additional directories.
 	AddDirs []string
 
+	// StrictAddDirs rejects AddDirs entries that are not existing directories.
+	StrictAddDirs bool
+
 	// Env sets additional environment variables.
 	Env map[string]string
 
@@ -79,6 +89,10 @@ type AgentOptions struct {
 	// MaxBufferSize sets the maximum bytes when buffering CLI stdout.
 	MaxBufferSize int
 
+	// LargeInputWarning is the input message size in bytes above which a
+	// warning is logged. Zero uses a 1MB default; negative disables it.
+	LargeInputWarning int
+
 	// Stderr is a callback for stderr output from CLI.
 	Stderr func(string)
 
@@ -119,7 +133,9 @@ type AgentOptions struct {
 	// Thinking controls extended thinking behavior.
 	Thinking ThinkingConfig
 
-	// Effort sets the effort level for thinking depth.
+	// Effort sets the effort level for thinking depth. An explicit thinking
+	// budget (ThinkingConfigEnabled or MaxThinkingTokens) still caps thinking
+	// at EffortMax; adaptive thinking's default 32000-token cap does not.
 	Effort Effort
 
 	// OutputFormat for structured outputs (e.g., JSON schema).
@@ -127,6 +143,122 @@ type AgentOptions struct {
 
 	// EnableFileCheckpointing enables file checkpointing.
 	EnableFileCheckpointing bool
+
+	// InputFormat overrides the CLI input format. Defaults to stream-json.
+	InputFormat string
+
+	// ValidateResume checks that the Resume session exists before starting the CLI.
+	ValidateResume bool
+
+	// ResultAccumulator merges structured outputs across result messages
+	// received by a ClaudeClient.
+	ResultAccumulator bool
+
+	// MaxInputTokens rejects string prompts whose estimated token count exceeds
+	// it. Zero disables the check.
+	MaxInputTokens int
+
+	// TokenEstimator estimates the token count of a prompt for MaxInputTokens.
+	// Defaults to a rough four-characters-per-token heuristic.
+	TokenEstimator func(text string) int
+
+	// EndInputSentinel is written to stdin before it is closed at end of input.
+	EndInputSentinel map[string]any
+
+	// ToolUseObserver is called for every tool_use block in received
+	// assistant messages.
+	ToolUseObserver func(block *ToolUseBlock, sessionID string)
+
+	// AllowAllSDKTools adds every SDK MCP server tool to AllowedTools.
+	AllowAllSDKTools bool
+
+	// ProtocolDump is a file that every message exchanged with the CLI is
+	// appended to.
+	ProtocolDump string
+
+	// SessionEventLog receives ClaudeClient lifecycle events.
+	SessionEventLog func(SessionEvent)
+
+	// ModelChangeHandler is called when an assistant message reports a model
+	// other than the requested one.
+	ModelChangeHandler func(from, to string)
+
+	// StrictModelPinning fails the receive with a *ModelMismatchError when an
+	// assistant message reports a model other than the requested one.
+	StrictModelPinning bool
+
+	// MaxParseErrors is the number of unparseable messages skipped per
+	// connection before the receive fails. Zero fails on the first.
+	MaxParseErrors int
+
+	// RequireCLIVersion fails the initialize handshake when the CLI does not
+	// report its version.
+	RequireCLIVersion bool
+
+	// SkipVersionCheck accepts a CLI older than MinimumClaudeCodeVersion.
+	SkipVersionCheck bool
+
+	// MaxSessionDuration is the wall-clock budget of a ClaudeClient session,
+	// measured from Connect. Zero means no limit.
+	MaxSessionDuration time.Duration
+
+	// InterruptAtMaxSessionDuration interrupts the running turn when
+	// MaxSessionDuration runs out.
+	InterruptAtMaxSessionDuration bool
+
+	// AfterConnect runs at the end of ClaudeClient.Connect.
+	AfterConnect func(ctx context.Context, client *ClaudeClient) error
+
+	// ShutdownGrace is how long Close waits for the CLI to exit after asking
+	// it to terminate before killing it. Defaults to 2s.
+	ShutdownGrace time.Duration
+
+	// DedupeOnResume drops received messages whose UUID was already seen.
+	DedupeOnResume bool
+
+	// StrictJSONDecoding logs a warning for unknown top-level fields in
+	// messages the SDK decodes.
+	StrictJSONDecoding bool
+
+	// ContentGuardPattern is matched against assistant text by a ClaudeClient.
+	ContentGuardPattern *regexp.Regexp
+
+	// ContentGuardAction is what happens when ContentGuardPattern matches.
+	ContentGuardAction GuardAction
+
+	// Transport replaces the CLI subprocess.
+	Transport Transport
+
+	// GlobalTimeout bounds each permission, hook and SDK MCP callback.
+	GlobalTimeout time.Duration
+
+	// InitializeTimeout bounds the wait for the CLI's initialize response.
+	InitializeTimeout time.Duration
+
+	// ConnectRetryAttempts is the number of attempts to start the CLI.
+	ConnectRetryAttempts int
+
+	// ConnectRetryBaseDelay is the wait after the first failed attempt.
+	ConnectRetryBaseDelay time.Duration
+
+	// MaxConcurrentCallbacks caps the control requests handled at once.
+	MaxConcurrentCallbacks int
+
+	// Logger receives internal diagnostics. Nil discards them.
+	Logger Logger
+
+	// StrictSessions fails input for a session that has a turn in flight
+	// from another sender instead of logging a warning.
+	StrictSessions bool
+
+	// WriteTimeout bounds a single write to the CLI's stdin. Zero waits
+	// indefinitely.
+	WriteTimeout time.Duration
+
+	// CleanEnv starts the CLI with only the EnvAllowlist variables of the
+	// parent environment, plus the ones it needs to run, instead of all of them.
+	CleanEnv     bool
+	EnvAllowlist []string
 }
 
 // Option is a functional option for configuring AgentOptions.
@@ -205,6 +337,15 @@ func WithResume(sessionID string) Option {
 	return func(o *AgentOptions) { o.Resume = sessionID }
 }
 
+// WithResumeValidation makes Query and Connect fail early with a
+// SessionNotFoundError when the WithResume session has no transcript in the
+// local Claude Code session store, found through CLAUDE_CONFIG_DIR in WithEnv
+// or the environment. It is skipped with WithTransport, whose CLI may keep its
+// sessions elsewhere.
+func WithResumeValidation() Option {
+	return func(o *AgentOptions) { o.ValidateResume = true }
+}
+
 // WithMaxTurns sets the maximum number of turns.
 func WithMaxTurns(n int) Option {
 	return func(o *AgentOptions) { o.MaxTurns = n }
@@ -240,7 +381,9 @@ func WithCwd(cwd string) Option {
 	return func(o *AgentOptions) { o.Cwd = cwd }
 }
 
-// WithCLIPath sets the path to the Claude Code CLI.
+// WithCLIPath sets the path to the Claude Code CLI. Without it the
+// CLAUDE_CODE_CLI or CLAUDE_CLI_PATH environment variable is used, then PATH
+// and the usual install locations.
 func WithCLIPath(path string) Option {
 	return func(o *AgentOptions) { o.CLIPath = path }
 }
@@ -255,6 +398,12 @@ func WithAddDirs(dirs ...string) Option {
 	return func(o *AgentOptions) { o.AddDirs = dirs }
 }
 
+// WithStrictAddDirs makes Query and Connect fail before starting the CLI when
+// a WithAddDirs entry does not exist or is not a directory.
+func WithStrictAddDirs() Option {
+	return func(o *AgentOptions) { o.StrictAddDirs = true }
+}
+
 // WithEnv sets additional environment variables.
 func WithEnv(env map[string]string) Option {
 	return func(o *AgentOptions) { o.Env = env }
@@ -270,6 +419,14 @@ func WithMaxBufferSize(size int) Option {
 	return func(o *AgentOptions) { o.MaxBufferSize = size }
 }
 
+// WithLargeInputWarning sets the size in bytes above which a single input
+// message logs a warning. The CLI has no compressed input encoding, so very
+// large inputs (such as whole files in a tool_result) are sent as-is and are
+// better split into smaller messages. A negative size disables the warning.
+func WithLargeInputWarning(size int) Option {
+	return func(o *AgentOptions) { o.LargeInputWarning = size }
+}
+
 // WithStderr sets a callback for stderr output.
 func WithStderr(fn func(string)) Option {
 	return func(o *AgentOptions) { o.Stderr = fn }
@@ -345,11 +502,266 @@ func WithOutputFormat(format map[string]any) Option {
 	return func(o *AgentOptions) { o.OutputFormat = format }
 }
 
+// WithJSONSchema requests structured output matching schema, a JSON schema
+// given as any value that marshals to it: a map, a struct or json.RawMessage.
+// It is shorthand for WithOutputFormat with type "json_schema"; decode the
+// result with ResultMessage.DecodeStructuredOutput.
+func WithJSONSchema(schema any) Option {
+	return WithOutputFormat(map[string]any{"type": "json_schema", "schema": schema})
+}
+
 // WithEnableFileCheckpointing enables file checkpointing.
 func WithEnableFileCheckpointing() Option {
 	return func(o *AgentOptions) { o.EnableFileCheckpointing = true }
 }
 
+// WithInputFormat overrides the CLI input format ("stream-json" or "text").
+// The text format carries a single prompt and does not support the control
+// protocol, so it cannot be combined with callbacks, hooks or SDK MCP servers.
+func WithInputFormat(format string) Option {
+	return func(o *AgentOptions) { o.InputFormat = format }
+}
+
+// WithResultAccumulator makes ClaudeClient merge the structured_output of every
+// received ResultMessage; read the merged value with FinalStructuredOutput.
+func WithResultAccumulator() Option {
+	return func(o *AgentOptions) { o.ResultAccumulator = true }
+}
+
+// WithMaxInputTokens makes Query and ClaudeClient.Query reject prompts whose
+// estimated size exceeds maxTokens with an InputTooLongError, before anything
+// is sent to the CLI.
+func WithMaxInputTokens(maxTokens int) Option {
+	return func(o *AgentOptions) { o.MaxInputTokens = maxTokens }
+}
+
+// WithTokenEstimator replaces the heuristic used by WithMaxInputTokens, e.g.
+// with a real tokenizer.
+func WithTokenEstimator(fn func(text string) int) Option {
+	return func(o *AgentOptions) { o.TokenEstimator = fn }
+}
+
+// WithEndInputSentinel writes msg (e.g. {"type": "end"}) as a final input line
+// before stdin is closed, for CLI versions that expect an explicit end marker.
+// By default stdin is simply closed. The sentinel is not sent in text input
+// format.
+func WithEndInputSentinel(msg map[string]any) Option {
+	return func(o *AgentOptions) { o.EndInputSentinel = msg }
+}
+
+// WithToolUseObserver calls fn for every tool_use block in assistant messages
+// as they are received, e.g. for an audit trail. It only observes: fn cannot
+// block or alter the tool call, and it runs on the receive path, so it should
+// return quickly.
+func WithToolUseObserver(fn func(block *ToolUseBlock, sessionID string)) Option {
+	return func(o *AgentOptions) { o.ToolUseObserver = fn }
+}
+
+// WithAllowAllSDKTools allows every tool of every SDK MCP server passed to
+// WithMcpServers, as "mcp__<server>__<tool>", in addition to WithAllowedTools.
+// The list is expanded when the CLI is started.
+func WithAllowAllSDKTools() Option {
+	return func(o *AgentOptions) { o.AllowAllSDKTools = true }
+}
+
+// WithProtocolDump appends every message exchanged with the CLI, including
+// control requests and responses, to the file at path as JSONL records with a
+// timestamp, a direction ("outbound" to the CLI, "inbound" from it) and the
+// message type and subtype. Intended for bug reports; the dump contains
+// prompts and tool inputs verbatim.
+func WithProtocolDump(path string) Option {
+	return func(o *AgentOptions) { o.ProtocolDump = path }
+}
+
+// WithSessionEventLog calls fn at each ClaudeClient lifecycle transition:
+// connect, initialize, every query and result, interrupts, model and
+// permission mode changes, and close. fn runs synchronously, sometimes while
+// the client holds its lock, so it must return quickly and must not call
+// methods on the client.
+func WithSessionEventLog(fn func(SessionEvent)) Option {
+	return func(o *AgentOptions) { o.SessionEventLog = fn }
+}
+
+// WithModelChangeHandler calls fn when an assistant message reports a model
+// other than the one requested with WithModel or SetModel, such as after a
+// fallback. Aliases and undated IDs match their resolved model, subagent
+// messages are ignored, and fn fires once per change.
+func WithModelChangeHandler(fn func(from, to string)) Option {
+	return func(o *AgentOptions) { o.ModelChangeHandler = fn }
+}
+
+// WithStrictModelPinning makes the receive fail with a *ModelMismatchError
+// when an assistant message reports a model other than the requested one.
+func WithStrictModelPinning() Option {
+	return func(o *AgentOptions) { o.StrictModelPinning = true }
+}
+
+// WithMaxParseErrors skips and logs up to n messages that fail to parse, such
+// as a known message type with a malformed field, before the receive fails
+// with the next *MessageParseError. The count spans the whole connection, not
+// a single receive.
+func WithMaxParseErrors(n int) Option {
+	return func(o *AgentOptions) { o.MaxParseErrors = n }
+}
+
+// WithRequireCLIVersion makes Connect and Query fail with a
+// *CLIConnectionError when the initialize response has no version field.
+// By default a missing version is treated as unknown and ClaudeClient.CLIVersion
+// returns "".
+func WithRequireCLIVersion() Option {
+	return func(o *AgentOptions) { o.RequireCLIVersion = true }
+}
+
+// WithSkipVersionCheck connects even when the CLI reports a version older
+// than MinimumClaudeCodeVersion, or one that cannot be parsed. Older CLIs may
+// not support every control request the SDK sends.
+func WithSkipVersionCheck() Option {
+	return func(o *AgentOptions) { o.SkipVersionCheck = true }
+}
+
+// WithMaxSessionDuration caps the wall-clock time of a ClaudeClient session,
+// measured from Connect. Once it has passed, Query, QueryStream and
+// SendSystemReminder fail with a *SessionDurationExceededError; the turn in
+// progress keeps running unless WithInterruptAtMaxSessionDuration is also set.
+func WithMaxSessionDuration(d time.Duration) Option {
+	return func(o *AgentOptions) { o.MaxSessionDuration = d }
+}
+
+// WithInterruptAtMaxSessionDuration interrupts the running turn when the
+// WithMaxSessionDuration budget runs out, instead of letting it finish.
+func WithInterruptAtMaxSessionDuration() Option {
+	return func(o *AgentOptions) { o.InterruptAtMaxSessionDuration = true }
+}
+
+// WithShutdownGrace sets how long closing waits for the CLI to exit after
+// SIGTERM (os.Interrupt on Windows) before killing it, giving it time to flush
+// transcripts and remove checkpoint files. Zero keeps the 2s default.
+func WithShutdownGrace(d time.Duration) Option {
+	return func(o *AgentOptions) { o.ShutdownGrace = d }
+}
+
+// WithAfterConnect runs fn at the end of ClaudeClient.Connect, after the
+// initialize handshake, to bootstrap the session: set the permission mode,
+// add directories, warm MCP servers. fn may call methods on the client. If it
+// returns an error the connection is closed and Connect returns that error.
+func WithAfterConnect(fn func(ctx context.Context, client *ClaudeClient) error) Option {
+	return func(o *AgentOptions) { o.AfterConnect = fn }
+}
+
+// WithDedupeOnResume drops messages whose UUID has already been received, so
+// history the CLI replays on resume is not processed twice. A ClaudeClient
+// remembers UUIDs across reconnects; Query remembers them for one call. Use a
+// Deduplicator directly to seed it with UUIDs persisted elsewhere.
+func WithDedupeOnResume() Option {
+	return func(o *AgentOptions) { o.DedupeOnResume = true }
+}
+
+// WithStrictJSONDecoding logs a warning listing the top-level fields of
+// received user, assistant, result and stream_event messages that the SDK
+// does not know, to catch CLI schema changes early. Messages are still
+// decoded and delivered as usual.
+func WithStrictJSONDecoding() Option {
+	return func(o *AgentOptions) { o.StrictJSONDecoding = true }
+}
+
+// WithContentGuard makes a ClaudeClient interrupt the turn when assistant text
+// matches pattern, then continue or fail as action says. The guard trips at
+// most once per turn.
+//
+// Without WithIncludePartialMessages the guard only sees complete assistant
+// messages, so the matching text has been generated, and billed, by the time
+// the turn is interrupted. With partial messages it checks each text delta
+// and interrupts within one streaming chunk of the match, though the CLI may
+// still emit some text before the interrupt lands.
+func WithContentGuard(pattern *regexp.Regexp, action GuardAction) Option {
+	return func(o *AgentOptions) {
+		o.ContentGuardPattern = pattern
+		o.ContentGuardAction = action
+	}
+}
+
+// WithTransport makes NewClient and Query talk to Claude Code over t instead of
+// starting the CLI; CLIPath and the other process options are ignored. t must
+// be ready to use, and the SDK closes it when the client or query ends, so
+// each connection needs a fresh Transport: reconnecting the client, or a
+// ClientPool dialing a second client, fails with ErrTransportReused.
+func WithTransport(t Transport) Option {
+	return func(o *AgentOptions) { o.Transport = t }
+}
+
+// WithGlobalTimeout bounds every callback the CLI waits on: CanUseTool, hook
+// callbacks and SDK MCP server requests. A callback still running after d gets
+// its context cancelled and the CLI gets an error response, so a stuck
+// callback cannot stall the session. A HookMatcher Timeout overrides d for
+// that matcher's hooks. Zero means no limit.
+func WithGlobalTimeout(d time.Duration) Option {
+	return func(o *AgentOptions) { o.GlobalTimeout = d }
+}
+
+// WithInitializeTimeout sets how long Query and Connect wait for the CLI to
+// answer the initialize request. When unset, the timeout is read from
+// CLAUDE_CODE_STREAM_CLOSE_TIMEOUT (milliseconds, at least 60s) and otherwise
+// defaults to 60s.
+func WithInitializeTimeout(d time.Duration) Option {
+	return func(o *AgentOptions) { o.InitializeTimeout = d }
+}
+
+// WithConnectRetry makes Query and Connect start the CLI up to maxAttempts
+// times when it fails transiently: the binary is not found, the process cannot
+// be spawned, or the initialize handshake times out. The wait between attempts
+// starts at baseDelay and doubles each time, with jitter. Other errors, such as
+// invalid options, a CLI that exits during startup or an unsupported CLI
+// version, fail at once. A cancelled context or ClaudeClient.Close stops the
+// retries.
+func WithConnectRetry(maxAttempts int, baseDelay time.Duration) Option {
+	return func(o *AgentOptions) {
+		o.ConnectRetryAttempts = maxAttempts
+		o.ConnectRetryBaseDelay = baseDelay
+	}
+}
+
+// WithMaxConcurrentCallbacks caps how many CLI control requests, that is
+// permission checks, hook callbacks and SDK MCP server calls, are handled at
+// once. Further requests wait in a queue for a free slot, or until the CLI
+// withdraws them; time spent waiting counts against WithGlobalTimeout.
+// n <= 0 means no limit.
+func WithMaxConcurrentCallbacks(n int) Option {
+	return func(o *AgentOptions) { o.MaxConcurrentCallbacks = n }
+}
+
+// WithLogger routes the SDK's internal diagnostics to l instead of
+// discarding them.
+func WithLogger(l Logger) Option {
+	return func(o *AgentOptions) { o.Logger = l }
+}
+
+// WithStrictSessions makes ClaudeClient input for a session that already has
+// a turn in flight from another sender, such as a second concurrent
+// QueryStream, fail with a *SessionBusyError. Without it the input is sent
+// and a warning is logged.
+func WithStrictSessions() Option {
+	return func(o *AgentOptions) { o.StrictSessions = true }
+}
+
+// WithWriteTimeout fails a write to the CLI's stdin with a
+// *CLIConnectionError when the CLI has not read it within d. A partial write
+// leaves the input stream unusable, so the transport then refuses further
+// writes and closes stdin.
+func WithWriteTimeout(d time.Duration) Option {
+	return func(o *AgentOptions) { o.WriteTimeout = d }
+}
+
+// WithCleanEnv starts the CLI with only the named variables of the parent
+// environment instead of all of them. PATH and HOME (and on Windows
+// SYSTEMROOT and USERPROFILE) are always copied, since the CLI cannot run
+// without them; WithEnv variables and the SDK's own are set as usual.
+func WithCleanEnv(allowlist ...string) Option {
+	return func(o *AgentOptions) {
+		o.CleanEnv = true
+		o.EnvAllowlist = allowlist
+	}
+}
+
 // applyOptions creates AgentOptions from functional options.
 func applyOptions(opts []Option) *AgentOptions {
 	o := &AgentOptions{}
@@ -361,3 +773,113 @@ func applyOptions(opts []Option) *AgentOptions {
 	}
 	return o
 }
+
+// validateInputFormat checks the configured input format against known values.
+func validateInputFormat(o *AgentOptions) error {
+	switch o.InputFormat {
+	case "", InputFormatStreamJSON:
+		return nil
+	case InputFormatText:
+		if o.CanUseTool != nil || len(o.Hooks) > 0 {
+			return &SDKError{Message: "text input format does not support can_use_tool or hooks; use stream-json"}
+		}
+		for _, config := range o.McpServers {
+			if _, ok := config.(*McpSdkServerConfig); ok {
+				return &SDKError{Message: "text input format does not support SDK MCP servers; use stream-json"}
+			}
+		}
+		return nil
+	default:
+		return &SDKError{Message: fmt.Sprintf("unsupported input format: %q", o.InputFormat)}
+	}
+}
+
+// validateAddDirs checks AddDirs entries exist when StrictAddDirs is set. A
+// relative entry is resolved against Cwd, as the CLI resolves it.
+func validateAddDirs(o *AgentOptions) error {
+	if !o.StrictAddDirs {
+		return nil
+	}
+	for _, dir := range o.AddDirs {
+		path := dir
+		if !filepath.IsAbs(path) && o.Cwd != "" {
+			path = filepath.Join(o.Cwd, path)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return &SDKError{Message: fmt.Sprintf("add-dir %q is not accessible", dir), Cause: err}
+		}
+		if !info.IsDir() {
+			return &SDKError{Message: fmt.Sprintf("add-dir %q is not a directory", dir)}
+		}
+	}
+	return nil
+}
+
+// estimateTokens approximates a token count as one token per four characters.
+func estimateTokens(text string) int {
+	return (utf8.RuneCountInString(text) + 3) / 4
+}
+
+// checkInputTokens enforces MaxInputTokens for a string prompt.
+func checkInputTokens(o *AgentOptions, prompt string) error {
+	if o.MaxInputTokens <= 0 {
+		return nil
+	}
+	estimate := o.TokenEstimator
+	if estimate == nil {
+		estimate = estimateTokens
+	}
+	if tokens := estimate(prompt); tokens > o.MaxInputTokens {
+		return &InputTooLongError{
+			SDKError:        SDKError{Message: fmt.Sprintf("prompt is about %d tokens, over the limit of %d", tokens, o.MaxInputTokens)},
+			EstimatedTokens: tokens,
+			MaxTokens:       o.MaxInputTokens,
+		}
+	}
+	return nil
+}
+
+// expandSDKToolAllowlist appends SDK MCP server tools to AllowedTools when
+// AllowAllSDKTools is set. Servers are visited in name order so the resulting
+// flag is stable.
+func expandSDKToolAllowlist(o *AgentOptions) {
+	if !o.AllowAllSDKTools {
+		return
+	}
+	servers := sdkMcpServerInstances(o.McpServers)
+	names := make([]string, 0, len(servers))
+	for name := range servers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	allowed := append([]string(nil), o.AllowedTools...)
+	seen := make(map[string]bool, len(allowed))
+	for _, tool := range allowed {
+		seen[tool] = true
+	}
+	for _, name := range names {
+		for _, tool := range servers[name].Tools {
+			full := "mcp__" + name + "__" + tool.Name
+			if !seen[full] {
+				seen[full] = true
+				allowed = append(allowed, full)
+			}
+		}
+	}
+	o.AllowedTools = allowed
+}
+
+// configurePermissionPromptTool routes permission prompts over the control
+// protocol when a CanUseTool callback is set.
+func configurePermissionPromptTool(o *AgentOptions) error {
+	if o.CanUseTool == nil {
+		return nil
+	}
+	if o.PermissionPromptToolName != "" {
+		return &SDKError{Message: "can_use_tool callback cannot be used with permission_prompt_tool_name"}
+	}
+	o.PermissionPromptToolName = "stdio"
+	return nil
+}
@@ -2,7 +2,11 @@ package claude
 
 import (
 	"context"
+	"errors"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestApplyOptions(t *testing.T) {
@@ -254,6 +258,15 @@ func TestWithOutputFormat(t *testing.T) {
 	}
 }
 
+func TestWithJSONSchema(t *testing.T) {
+	schema := map[string]any{"type": "object", "properties": map[string]any{"city": map[string]any{"type": "string"}}}
+	opts := applyOptions([]Option{WithJSONSchema(schema)})
+	want := map[string]any{"type": "json_schema", "schema": schema}
+	if !reflect.DeepEqual(opts.OutputFormat, want) {
+		t.Errorf("OutputFormat = %v, want %v", opts.OutputFormat, want)
+	}
+}
+
 func TestWithEnableFileCheckpointing(t *testing.T) {
 	opts := applyOptions([]Option{WithEnableFileCheckpointing()})
 	if !opts.EnableFileCheckpointing {
@@ -327,3 +340,124 @@ func TestWithSystemPromptPreset(t *testing.T) {
 		t.Errorf("expected custom system prompt to be cleared, got %v", *opts.SystemPrompt)
 	}
 }
+
+func TestWithInputFormat(t *testing.T) {
+	opts := applyOptions([]Option{WithInputFormat(InputFormatText)})
+	if opts.InputFormat != InputFormatText {
+		t.Errorf("expected input format 'text', got %q", opts.InputFormat)
+	}
+}
+
+func TestValidateInputFormat(t *testing.T) {
+	canUseTool := func(ctx context.Context, toolName string, input map[string]any, permCtx ToolPermissionContext) (PermissionResult, error) {
+		return &PermissionResultAllow{}, nil
+	}
+	tests := []struct {
+		name    string
+		opts    []Option
+		wantErr bool
+	}{
+		{name: "default", opts: nil},
+		{name: "stream-json", opts: []Option{WithInputFormat(InputFormatStreamJSON)}},
+		{name: "text", opts: []Option{WithInputFormat(InputFormatText)}},
+		{name: "unknown", opts: []Option{WithInputFormat("xml")}, wantErr: true},
+		{name: "text with callback", opts: []Option{WithInputFormat(InputFormatText), WithCanUseTool(canUseTool)}, wantErr: true},
+		{
+			name: "text with sdk mcp",
+			opts: []Option{
+				WithInputFormat(InputFormatText),
+				WithMcpServers(map[string]McpServerConfig{"calc": CreateSdkMcpServer("calc", "1.0.0")}),
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateInputFormat(applyOptions(tt.opts))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateInputFormat() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWithResultAccumulator(t *testing.T) {
+	opts := applyOptions([]Option{WithResultAccumulator()})
+	if !opts.ResultAccumulator {
+		t.Error("expected ResultAccumulator=true")
+	}
+}
+
+func TestCheckInputTokens(t *testing.T) {
+	long := strings.Repeat("word ", 100) // 500 characters, ~125 tokens
+
+	tests := []struct {
+		name    string
+		opts    []Option
+		wantErr bool
+	}{
+		{name: "no limit", opts: nil},
+		{name: "under limit", opts: []Option{WithMaxInputTokens(200)}},
+		{name: "over limit", opts: []Option{WithMaxInputTokens(100)}, wantErr: true},
+		{
+			name: "custom estimator",
+			opts: []Option{WithMaxInputTokens(200), WithTokenEstimator(func(text string) int {
+				return len(strings.Fields(text)) * 3
+			})},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkInputTokens(applyOptions(tt.opts), long)
+			var tooLong *InputTooLongError
+			if got := errors.As(err, &tooLong); got != tt.wantErr {
+				t.Fatalf("expected InputTooLongError=%v, got %v", tt.wantErr, err)
+			}
+			if tooLong != nil && tooLong.EstimatedTokens <= tooLong.MaxTokens {
+				t.Errorf("unexpected token counts: %+v", tooLong)
+			}
+		})
+	}
+}
+
+func TestQueryRejectsPromptOverMaxInputTokens(t *testing.T) {
+	msgChan, errChan := Query(context.Background(), strings.Repeat("x", 1000),
+		WithMaxInputTokens(10), WithCLIPath("/nonexistent/claude"))
+	for range msgChan {
+	}
+	var tooLong *InputTooLongError
+	if err := <-errChan; !errors.As(err, &tooLong) {
+		t.Fatalf("expected InputTooLongError before starting the CLI, got %v", err)
+	}
+
+	client, _ := testableClient(t, queryOptions{})
+	defer client.Close()
+	client.options = applyOptions([]Option{WithMaxInputTokens(10)})
+	if err := client.Query(context.Background(), strings.Repeat("x", 1000)); !errors.As(err, &tooLong) {
+		t.Fatalf("expected InputTooLongError from ClaudeClient.Query, got %v", err)
+	}
+}
+
+func TestResolveInitializeTimeout(t *testing.T) {
+	tests := []struct {
+		name string
+		env  string
+		opts []Option
+		want float64
+	}{
+		{name: "default", want: 60},
+		{name: "option", opts: []Option{WithInitializeTimeout(5 * time.Second)}, want: 5},
+		{name: "env fallback", env: "120000", want: 120},
+		{name: "env below minimum", env: "1000", want: 60},
+		{name: "option wins over env", env: "120000", opts: []Option{WithInitializeTimeout(90 * time.Second)}, want: 90},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CLAUDE_CODE_STREAM_CLOSE_TIMEOUT", tt.env)
+			if got := resolveInitializeTimeout(applyOptions(tt.opts)); got != tt.want {
+				t.Errorf("resolveInitializeTimeout = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
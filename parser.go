@@ -1,6 +1,11 @@
 package claude
 
-import "fmt"
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
 
 // parseMessage converts a raw JSON map from CLI output into a typed Message.
 func parseMessage(data map[string]any) (Message, error) {
@@ -25,7 +30,12 @@ func parseMessage(data map[string]any) (Message, error) {
 		return parseStreamEvent(data)
 	case "rate_limit_event":
 		return parseRateLimitEvent(data)
+	case "error":
+		return nil, parseStreamError(data)
 	default:
+		if fn := lookupMessageParser(msgType); fn != nil {
+			return fn(data)
+		}
 		return nil, &MessageParseError{
 			SDKError: SDKError{Message: fmt.Sprintf("Unknown message type: %s", msgType)},
 			Data:     data,
@@ -33,6 +43,33 @@ func parseMessage(data map[string]any) (Message, error) {
 	}
 }
 
+var (
+	messageParsersMu sync.RWMutex
+	messageParsers   = map[string]func(map[string]any) (Message, error){}
+)
+
+// RegisterMessageParser installs fn as the parser for a message type the SDK
+// does not know, such as an experimental CLI message. Built-in types always
+// use the SDK's own parser. Passing a nil fn removes the registration.
+//
+// Message is sealed, so fn returns a *CustomMessage, or a pointer to a struct
+// that embeds CustomMessage.
+func RegisterMessageParser(msgType string, fn func(map[string]any) (Message, error)) {
+	messageParsersMu.Lock()
+	defer messageParsersMu.Unlock()
+	if fn == nil {
+		delete(messageParsers, msgType)
+		return
+	}
+	messageParsers[msgType] = fn
+}
+
+func lookupMessageParser(msgType string) func(map[string]any) (Message, error) {
+	messageParsersMu.RLock()
+	defer messageParsersMu.RUnlock()
+	return messageParsers[msgType]
+}
+
 func parseUserMessage(data map[string]any) (*UserMessage, error) {
 	msg, ok := data["message"].(map[string]any)
 	if !ok {
@@ -124,14 +161,57 @@ func parseAssistantMessage(data map[string]any) (*AssistantMessage, error) {
 	}
 
 	parentToolUseID, _ := data["parent_tool_use_id"].(string)
-	errorStr, _ := data["error"].(string)
+	sessionID, _ := data["session_id"].(string)
+	uuid, _ := data["uuid"].(string)
 
-	return &AssistantMessage{
+	am := &AssistantMessage{
 		Content:         blocks,
 		Model:           model,
 		ParentToolUseID: parentToolUseID,
-		Error:           AssistantMessageError(errorStr),
-	}, nil
+		SessionID:       sessionID,
+		UUID:            uuid,
+	}
+	parseAssistantError(data, am)
+	return am, nil
+}
+
+// parseAssistantError fills Error and ErrorDetail. The error is usually the
+// bare enum string, with the API error text as the message content; some CLI
+// versions send an object with "type", "message" and a retry hint instead.
+func parseAssistantError(data map[string]any, am *AssistantMessage) {
+	detailSrc := data
+	switch e := data["error"].(type) {
+	case string:
+		am.Error = AssistantMessageError(e)
+	case map[string]any:
+		kind, _ := e["type"].(string)
+		am.Error = AssistantMessageError(kind)
+		detailSrc = e
+	}
+	if am.Error == "" {
+		return
+	}
+
+	detail := &ErrorDetail{}
+	detail.Message, _ = detailSrc["message"].(string)
+	if detail.Message == "" {
+		for _, block := range am.Content {
+			if tb, ok := block.(*TextBlock); ok {
+				detail.Message = tb.Text
+				break
+			}
+		}
+	}
+	if secs, ok := detailSrc["retry_after"].(float64); ok {
+		d := time.Duration(secs * float64(time.Second))
+		detail.RetryAfter = &d
+	} else if ms, ok := detailSrc["retry_after_ms"].(float64); ok {
+		d := time.Duration(ms) * time.Millisecond
+		detail.RetryAfter = &d
+	}
+	if detail.Message != "" || detail.RetryAfter != nil {
+		am.ErrorDetail = detail
+	}
 }
 
 func parseSystemMessage(data map[string]any) (*SystemMessage, error) {
@@ -142,10 +222,43 @@ func parseSystemMessage(data map[string]any) (*SystemMessage, error) {
 			Data:     data,
 		}
 	}
-	return &SystemMessage{
+	sm := &SystemMessage{
 		Subtype: subtype,
 		Data:    data,
-	}, nil
+	}
+	if subtype == SystemSubtypeInit {
+		sm.Init = parseSystemInit(data)
+	}
+	return sm, nil
+}
+
+// parseSystemInit reads the fields of an init system message. MCP servers
+// are reported as objects with a name and status; only the names are kept.
+func parseSystemInit(data map[string]any) *SystemInitData {
+	init := &SystemInitData{}
+	init.SessionID, _ = data["session_id"].(string)
+	init.Model, _ = data["model"].(string)
+	init.Cwd, _ = data["cwd"].(string)
+	if mode, ok := data["permissionMode"].(string); ok {
+		init.PermissionMode = PermissionMode(mode)
+	}
+	if tools, ok := data["tools"].([]any); ok {
+		for _, tool := range tools {
+			if name, ok := tool.(string); ok {
+				init.Tools = append(init.Tools, name)
+			}
+		}
+	}
+	if servers, ok := data["mcp_servers"].([]any); ok {
+		for _, server := range servers {
+			if m, ok := server.(map[string]any); ok {
+				if name, ok := m["name"].(string); ok && name != "" {
+					init.MCPServers = append(init.MCPServers, name)
+				}
+			}
+		}
+	}
+	return init
 }
 
 func parseResultMessage(data map[string]any) (*ResultMessage, error) {
@@ -203,6 +316,7 @@ func parseResultMessage(data map[string]any) (*ResultMessage, error) {
 		NumTurns:      numTurns,
 		SessionID:     sessionID,
 	}
+	rm.UUID, _ = data["uuid"].(string)
 
 	if cost, ok := data["total_cost_usd"].(float64); ok {
 		rm.TotalCostUSD = &cost
@@ -214,10 +328,73 @@ func parseResultMessage(data map[string]any) (*ResultMessage, error) {
 		rm.Result = result
 	}
 	rm.StructuredOutput = data["structured_output"]
+	if denials, ok := data["permission_denials"].([]any); ok {
+		rm.PermissionDenials = parsePermissionDenials(denials)
+	}
+	if modelUsage, ok := data["modelUsage"].(map[string]any); ok {
+		rm.ModelUsage = make(map[string]Usage, len(modelUsage))
+		for model, raw := range modelUsage {
+			if m, ok := raw.(map[string]any); ok {
+				rm.ModelUsage[model] = parseUsage(m)
+			}
+		}
+	}
 
 	return rm, nil
 }
 
+func parsePermissionDenials(raw []any) []PermissionDenial {
+	denials := make([]PermissionDenial, 0, len(raw))
+	for _, item := range raw {
+		m, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		d := PermissionDenial{}
+		d.ToolName, _ = m["tool_name"].(string)
+		d.ToolUseID, _ = m["tool_use_id"].(string)
+		d.ToolInput, _ = m["tool_input"].(map[string]any)
+		d.Reason, _ = m["reason"].(string)
+		denials = append(denials, d)
+	}
+	return denials
+}
+
+// parseUsage reads a usage object. The CLI spells keys in snake_case for the
+// aggregate usage and in camelCase for modelUsage entries; both are accepted.
+func parseUsage(m map[string]any) Usage {
+	num := func(snake, camel string) any {
+		if v, ok := m[snake]; ok {
+			return v
+		}
+		return m[camel]
+	}
+	u := Usage{
+		InputTokens:              getIntFromAny(num("input_tokens", "inputTokens")),
+		OutputTokens:             getIntFromAny(num("output_tokens", "outputTokens")),
+		CacheCreationInputTokens: getIntFromAny(num("cache_creation_input_tokens", "cacheCreationInputTokens")),
+		CacheReadInputTokens:     getIntFromAny(num("cache_read_input_tokens", "cacheReadInputTokens")),
+	}
+	u.CostUSD, _ = num("cost_usd", "costUSD").(float64)
+	if stu, ok := num("server_tool_use", "serverToolUse").(map[string]any); ok {
+		count := func(snake, camel string) int {
+			if v, ok := stu[snake]; ok {
+				return getIntFromAny(v)
+			}
+			return getIntFromAny(stu[camel])
+		}
+		u.ServerToolUse = ServerToolUse{
+			WebSearchRequests: count("web_search_requests", "webSearchRequests"),
+			WebFetchRequests:  count("web_fetch_requests", "webFetchRequests"),
+		}
+	}
+	// modelUsage entries report web searches at the top level instead.
+	if u.ServerToolUse.WebSearchRequests == 0 {
+		u.ServerToolUse.WebSearchRequests = getIntFromAny(num("web_search_requests", "webSearchRequests"))
+	}
+	return u
+}
+
 func parseStreamEvent(data map[string]any) (*StreamEvent, error) {
 	uuid, _ := data["uuid"].(string)
 	sessionID, _ := data["session_id"].(string)
@@ -239,8 +416,62 @@ func parseStreamEvent(data map[string]any) (*StreamEvent, error) {
 	}, nil
 }
 
+// parseRateLimitEvent reads the typed fields from the top level of the event,
+// falling back to a nested rate_limit_info object with camelCase keys.
 func parseRateLimitEvent(data map[string]any) (*RateLimitEvent, error) {
-	return &RateLimitEvent{Data: data}, nil
+	info, _ := data["rate_limit_info"].(map[string]any)
+	field := func(snake, camel string) any {
+		if v, ok := data[snake]; ok {
+			return v
+		}
+		return info[camel]
+	}
+
+	event := &RateLimitEvent{Data: data}
+	if secs, ok := field("retry_after", "retryAfter").(float64); ok {
+		event.RetryAfterSeconds = &secs
+	}
+	if n, ok := field("remaining", "remaining").(float64); ok {
+		remaining := int(n)
+		event.Remaining = &remaining
+	}
+	event.ResetAt = parseTimestamp(field("reset_at", "resetsAt"))
+	event.LimitType, _ = field("limit_type", "rateLimitType").(string)
+	return event, nil
+}
+
+// parseTimestamp accepts a unix timestamp in seconds or an RFC 3339 string.
+func parseTimestamp(v any) *time.Time {
+	var t time.Time
+	switch v := v.(type) {
+	case float64:
+		sec, frac := math.Modf(v)
+		t = time.Unix(int64(sec), int64(frac*1e9))
+	case string:
+		parsed, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil
+		}
+		t = parsed
+	default:
+		return nil
+	}
+	return &t
+}
+
+// parseStreamError returns the error carried by the error pseudo-message that
+// the query handler pushes when the stream fails, so that it reaches the
+// receive methods' error channel like any other terminal error. The original
+// error travels under "cause" and is returned when present.
+func parseStreamError(data map[string]any) error {
+	if err, _ := data["cause"].(error); err != nil {
+		return err
+	}
+	text, _ := data["error"].(string)
+	if text == "" {
+		text = "unknown stream error"
+	}
+	return &SDKError{Message: text}
 }
 
 func parseContentBlock(block map[string]any) ContentBlock {
@@ -265,12 +496,85 @@ func parseContentBlock(block map[string]any) ContentBlock {
 		if ie, ok := block["is_error"].(bool); ok {
 			isError = &ie
 		}
-		return &ToolResultBlock{ToolUseID: toolUseID, Content: content, IsError: isError}
+		return &ToolResultBlock{ToolUseID: toolUseID, Content: content, Items: parseToolResultItems(content), IsError: isError}
+	case "server_tool_use":
+		id, _ := block["id"].(string)
+		name, _ := block["name"].(string)
+		input, _ := block["input"].(map[string]any)
+		return &ServerToolUseBlock{ID: id, Name: name, Input: input}
+	case "web_search_tool_result":
+		return parseWebSearchResultBlock(block)
+	case "image":
+		source, _ := block["source"].(map[string]any)
+		if sourceType, _ := source["type"].(string); sourceType != "base64" {
+			return nil
+		}
+		mediaType, _ := source["media_type"].(string)
+		data, _ := source["data"].(string)
+		return &ImageBlock{MediaType: mediaType, Data: data}
 	default:
 		return nil
 	}
 }
 
+// parseToolResultItems reads the text and image items of list-form tool
+// result content. Images come in the API form, with a base64 source, or the
+// MCP form, with data and mimeType. Other items are skipped.
+func parseToolResultItems(content any) []MCPContent {
+	list, ok := content.([]any)
+	if !ok {
+		return nil
+	}
+	items := make([]MCPContent, 0, len(list))
+	for _, raw := range list {
+		m, ok := raw.(map[string]any)
+		if !ok {
+			continue
+		}
+		switch m["type"] {
+		case "text":
+			text, _ := m["text"].(string)
+			items = append(items, MCPContent{Type: "text", Text: text})
+		case "image":
+			item := MCPContent{Type: "image"}
+			if source, ok := m["source"].(map[string]any); ok {
+				item.Data, _ = source["data"].(string)
+				item.MimeType, _ = source["media_type"].(string)
+			} else {
+				item.Data, _ = m["data"].(string)
+				item.MimeType, _ = m["mimeType"].(string)
+			}
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseWebSearchResultBlock reads a web_search_tool_result block, whose
+// content is either a list of results or a single error object.
+func parseWebSearchResultBlock(block map[string]any) *WebSearchResultBlock {
+	toolUseID, _ := block["tool_use_id"].(string)
+	result := &WebSearchResultBlock{ToolUseID: toolUseID}
+	switch content := block["content"].(type) {
+	case []any:
+		for _, item := range content {
+			m, ok := item.(map[string]any)
+			if !ok {
+				continue
+			}
+			var r WebSearchResult
+			r.URL, _ = m["url"].(string)
+			r.Title, _ = m["title"].(string)
+			r.PageAge, _ = m["page_age"].(string)
+			r.EncryptedContent, _ = m["encrypted_content"].(string)
+			result.Results = append(result.Results, r)
+		}
+	case map[string]any:
+		result.ErrorCode, _ = content["error_code"].(string)
+	}
+	return result
+}
+
 // getIntFromAny converts various numeric types to int.
 func getIntFromAny(v any) int {
 	switch n := v.(type) {
@@ -1,7 +1,12 @@
 package claude
 
 import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestParseUserMessageString(t *testing.T) {
@@ -135,20 +140,65 @@ func TestParseAssistantMessage(t *testing.T) {
 }
 
 func TestParseSystemMessage(t *testing.T) {
-	data := map[string]any{
-		"type":    "system",
-		"subtype": "init",
-	}
-	msg, err := parseMessage(data)
-	if err != nil {
-		t.Fatalf("unexpected error: %v", err)
-	}
-	sm, ok := msg.(*SystemMessage)
-	if !ok {
-		t.Fatalf("expected *SystemMessage, got %T", msg)
+	tests := []struct {
+		name     string
+		data     map[string]any
+		wantInit *SystemInitData
+	}{
+		{
+			name: "init",
+			data: map[string]any{
+				"type":           "system",
+				"subtype":        "init",
+				"session_id":     "sess-123",
+				"model":          "claude-sonnet-4-5",
+				"cwd":            "/work",
+				"permissionMode": "acceptEdits",
+				"tools":          []any{"Bash", "Read", "mcp__calc__add"},
+				"mcp_servers": []any{
+					map[string]any{"name": "calc", "status": "connected"},
+					map[string]any{"name": "github", "status": "failed"},
+				},
+			},
+			wantInit: &SystemInitData{
+				SessionID:      "sess-123",
+				Model:          "claude-sonnet-4-5",
+				Cwd:            "/work",
+				PermissionMode: PermissionAcceptEdits,
+				Tools:          []string{"Bash", "Read", "mcp__calc__add"},
+				MCPServers:     []string{"calc", "github"},
+			},
+		},
+		{
+			name:     "minimal init",
+			data:     map[string]any{"type": "system", "subtype": "init"},
+			wantInit: &SystemInitData{},
+		},
+		{
+			name: "other subtype",
+			data: map[string]any{"type": "system", "subtype": "compact_boundary", "session_id": "sess-123"},
+		},
 	}
-	if sm.Subtype != "init" {
-		t.Errorf("expected subtype 'init', got %s", sm.Subtype)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := parseMessage(tt.data)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			sm, ok := msg.(*SystemMessage)
+			if !ok {
+				t.Fatalf("expected *SystemMessage, got %T", msg)
+			}
+			if sm.Subtype != tt.data["subtype"] {
+				t.Errorf("expected subtype %v, got %s", tt.data["subtype"], sm.Subtype)
+			}
+			if !reflect.DeepEqual(sm.Data, tt.data) {
+				t.Errorf("expected Data to keep the raw message, got %v", sm.Data)
+			}
+			if !reflect.DeepEqual(sm.Init, tt.wantInit) {
+				t.Errorf("Init = %+v, want %+v", sm.Init, tt.wantInit)
+			}
+		})
 	}
 }
 
@@ -184,6 +234,134 @@ func TestParseResultMessage(t *testing.T) {
 	if rm.Result != "The answer is 4." {
 		t.Errorf("expected result 'The answer is 4.', got %s", rm.Result)
 	}
+	if rm.PermissionDenials != nil {
+		t.Errorf("expected no permission denials when the field is absent, got %v", rm.PermissionDenials)
+	}
+}
+
+func TestParseResultMessageMaxTurns(t *testing.T) {
+	data := map[string]any{
+		"type":            "result",
+		"subtype":         "error_max_turns",
+		"duration_ms":     float64(2000),
+		"duration_api_ms": float64(1800),
+		"is_error":        true,
+		"num_turns":       float64(5),
+		"session_id":      "sess-123",
+		"result":          "Partial analysis so far",
+	}
+	msg, err := parseMessage(data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rm, ok := msg.(*ResultMessage)
+	if !ok {
+		t.Fatalf("expected *ResultMessage, got %T", msg)
+	}
+	if !rm.IsError {
+		t.Error("expected is_error true")
+	}
+	partial, ok := rm.PartialResult()
+	if !ok || partial != "Partial analysis so far" {
+		t.Errorf("expected partial result, got %q (ok=%v)", partial, ok)
+	}
+
+	data["result"] = nil
+	msg, _ = parseMessage(data)
+	if _, ok := msg.(*ResultMessage).PartialResult(); ok {
+		t.Error("expected no partial result without result text")
+	}
+}
+
+func TestResultMessagePartialResultOtherSubtypes(t *testing.T) {
+	for _, subtype := range []string{ResultSubtypeSuccess, ResultSubtypeErrorDuringExecution} {
+		rm := &ResultMessage{Subtype: subtype, Result: "text"}
+		if _, ok := rm.PartialResult(); ok {
+			t.Errorf("expected no partial result for subtype %q", subtype)
+		}
+	}
+}
+
+func TestResultMessageDecodeStructuredOutput(t *testing.T) {
+	type answer struct {
+		City  string  `json:"city"`
+		Temps []int   `json:"temps"`
+		Notes *string `json:"notes"`
+	}
+	msg, err := parseMessage(map[string]any{
+		"type":              "result",
+		"subtype":           "success",
+		"duration_ms":       float64(1),
+		"duration_api_ms":   float64(1),
+		"is_error":          false,
+		"num_turns":         float64(1),
+		"session_id":        "sess-1",
+		"structured_output": map[string]any{"city": "Oslo", "temps": []any{float64(3), float64(5)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rm := msg.(*ResultMessage)
+
+	var got answer
+	if err := rm.DecodeStructuredOutput(&got); err != nil {
+		t.Fatalf("DecodeStructuredOutput: %v", err)
+	}
+	if got.City != "Oslo" || !reflect.DeepEqual(got.Temps, []int{3, 5}) || got.Notes != nil {
+		t.Errorf("unexpected decoded output %+v", got)
+	}
+
+	var mismatch struct {
+		City int `json:"city"`
+	}
+	if err := rm.DecodeStructuredOutput(&mismatch); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("expected a shape mismatch error, got %v", err)
+	}
+
+	empty := &ResultMessage{Subtype: ResultSubtypeSuccess}
+	if err := empty.DecodeStructuredOutput(&got); err == nil || !strings.Contains(err.Error(), "no structured output") {
+		t.Errorf("expected a missing output error, got %v", err)
+	}
+}
+
+func TestParseResultMessagePermissionDenials(t *testing.T) {
+	data := map[string]any{
+		"type":            "result",
+		"subtype":         "success",
+		"duration_ms":     float64(1000),
+		"duration_api_ms": float64(800),
+		"is_error":        false,
+		"num_turns":       float64(2),
+		"session_id":      "sess-123",
+		"permission_denials": []any{
+			map[string]any{
+				"tool_name":   "Bash",
+				"tool_use_id": "tu-1",
+				"tool_input":  map[string]any{"command": "rm -rf /"},
+				"reason":      "destructive command",
+			},
+			map[string]any{"tool_name": "Write"},
+			"malformed",
+		},
+	}
+	msg, err := parseMessage(data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rm := msg.(*ResultMessage)
+	if len(rm.PermissionDenials) != 2 {
+		t.Fatalf("expected 2 permission denials, got %d", len(rm.PermissionDenials))
+	}
+	first := rm.PermissionDenials[0]
+	if first.ToolName != "Bash" || first.ToolUseID != "tu-1" || first.Reason != "destructive command" {
+		t.Errorf("unexpected first denial: %+v", first)
+	}
+	if first.ToolInput["command"] != "rm -rf /" {
+		t.Errorf("unexpected tool input: %v", first.ToolInput)
+	}
+	if rm.PermissionDenials[1].ToolName != "Write" {
+		t.Errorf("unexpected second denial: %+v", rm.PermissionDenials[1])
+	}
 }
 
 func TestParseStreamEvent(t *testing.T) {
@@ -224,6 +402,72 @@ func TestParseRateLimitEvent(t *testing.T) {
 	}
 }
 
+func TestParseRateLimitEventTypedFields(t *testing.T) {
+	reset := time.Date(2026, 3, 1, 12, 30, 0, 0, time.UTC)
+	retry, remaining := 12.5, 3
+	tests := []struct {
+		name          string
+		data          map[string]any
+		wantRetry     *float64
+		wantRemaining *int
+		wantReset     *time.Time
+		wantType      string
+	}{
+		{
+			name: "unix timestamp",
+			data: map[string]any{
+				"retry_after": 12.5, "remaining": float64(3),
+				"reset_at": float64(reset.Unix()), "limit_type": "five_hour",
+			},
+			wantRetry: &retry, wantRemaining: &remaining, wantReset: &reset, wantType: "five_hour",
+		},
+		{
+			name:      "rfc3339 string",
+			data:      map[string]any{"reset_at": "2026-03-01T12:30:00Z", "limit_type": "weekly"},
+			wantReset: &reset, wantType: "weekly",
+		},
+		{
+			name: "nested rate_limit_info",
+			data: map[string]any{
+				"rate_limit_info": map[string]any{"resetsAt": float64(reset.Unix()), "rateLimitType": "five_hour"},
+			},
+			wantReset: &reset, wantType: "five_hour",
+		},
+		{
+			name: "missing fields",
+			data: map[string]any{"reset_at": "soon"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.data["type"] = "rate_limit_event"
+			msg, err := parseMessage(tt.data)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			rl := msg.(*RateLimitEvent)
+			if (rl.RetryAfterSeconds == nil) != (tt.wantRetry == nil) ||
+				(rl.RetryAfterSeconds != nil && *rl.RetryAfterSeconds != *tt.wantRetry) {
+				t.Errorf("RetryAfterSeconds = %v, want %v", rl.RetryAfterSeconds, tt.wantRetry)
+			}
+			if (rl.Remaining == nil) != (tt.wantRemaining == nil) ||
+				(rl.Remaining != nil && *rl.Remaining != *tt.wantRemaining) {
+				t.Errorf("Remaining = %v, want %v", rl.Remaining, tt.wantRemaining)
+			}
+			if (rl.ResetAt == nil) != (tt.wantReset == nil) ||
+				(rl.ResetAt != nil && !rl.ResetAt.Equal(*tt.wantReset)) {
+				t.Errorf("ResetAt = %v, want %v", rl.ResetAt, tt.wantReset)
+			}
+			if rl.LimitType != tt.wantType {
+				t.Errorf("LimitType = %q, want %q", rl.LimitType, tt.wantType)
+			}
+			if rl.Data["type"] != "rate_limit_event" {
+				t.Error("expected raw payload to be kept in Data")
+			}
+		})
+	}
+}
+
 func TestParseMissingType(t *testing.T) {
 	data := map[string]any{"foo": "bar"}
 	_, err := parseMessage(data)
@@ -239,3 +483,464 @@ func TestParseUnknownType(t *testing.T) {
 		t.Fatal("expected error for unknown type")
 	}
 }
+
+func TestParseResultMessageModelUsage(t *testing.T) {
+	data := map[string]any{
+		"type":            "result",
+		"subtype":         "success",
+		"duration_ms":     float64(1000),
+		"duration_api_ms": float64(800),
+		"is_error":        false,
+		"num_turns":       float64(3),
+		"session_id":      "sess-123",
+		"usage":           map[string]any{"input_tokens": float64(150), "output_tokens": float64(60)},
+		"modelUsage": map[string]any{
+			"claude-sonnet-4-5": map[string]any{
+				"inputTokens":              float64(100),
+				"outputTokens":             float64(50),
+				"cacheReadInputTokens":     float64(2000),
+				"cacheCreationInputTokens": float64(300),
+				"webSearchRequests":        float64(1),
+				"costUSD":                  0.0123,
+			},
+			"claude-haiku-4-5": map[string]any{
+				"inputTokens":  float64(50),
+				"outputTokens": float64(10),
+				"costUSD":      0.0004,
+			},
+		},
+	}
+	msg, err := parseMessage(data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rm := msg.(*ResultMessage)
+	if rm.Usage["input_tokens"] != float64(150) {
+		t.Errorf("expected aggregate usage to be preserved, got %v", rm.Usage)
+	}
+	if len(rm.ModelUsage) != 2 {
+		t.Fatalf("expected 2 model usage entries, got %d", len(rm.ModelUsage))
+	}
+	want := Usage{
+		InputTokens:              100,
+		OutputTokens:             50,
+		CacheCreationInputTokens: 300,
+		CacheReadInputTokens:     2000,
+		CostUSD:                  0.0123,
+		ServerToolUse:            ServerToolUse{WebSearchRequests: 1},
+	}
+	if got := rm.ModelUsage["claude-sonnet-4-5"]; got != want {
+		t.Errorf("unexpected sonnet usage: %+v", got)
+	}
+	if got := rm.ModelUsage["claude-haiku-4-5"]; got.InputTokens != 50 || got.OutputTokens != 10 || got.CacheReadInputTokens != 0 {
+		t.Errorf("unexpected haiku usage: %+v", got)
+	}
+	encoded, err := json.Marshal(rm)
+	if err != nil {
+		t.Fatalf("marshal failed: %v", err)
+	}
+	if !strings.Contains(string(encoded), `"modelUsage":{`) {
+		t.Errorf("expected model usage under the CLI's modelUsage key, got %s", encoded)
+	}
+}
+
+func TestResultMessageParsedUsage(t *testing.T) {
+	tests := []struct {
+		name  string
+		usage map[string]any
+		want  Usage
+	}{
+		{
+			name: "full payload",
+			usage: map[string]any{
+				"input_tokens":                float64(12),
+				"cache_creation_input_tokens": float64(4210),
+				"cache_read_input_tokens":     float64(18344),
+				"output_tokens":               float64(532),
+				"server_tool_use":             map[string]any{"web_search_requests": float64(2), "web_fetch_requests": float64(1)},
+				"service_tier":                "standard",
+				"cache_creation":              map[string]any{"ephemeral_1h_input_tokens": float64(0), "ephemeral_5m_input_tokens": float64(4210)},
+			},
+			want: Usage{
+				InputTokens:              12,
+				OutputTokens:             532,
+				CacheCreationInputTokens: 4210,
+				CacheReadInputTokens:     18344,
+				ServerToolUse:            ServerToolUse{WebSearchRequests: 2, WebFetchRequests: 1},
+			},
+		},
+		{
+			name:  "missing fields default to zero",
+			usage: map[string]any{"input_tokens": float64(7)},
+			want:  Usage{InputTokens: 7},
+		},
+		{
+			name: "no usage",
+			want: Usage{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := map[string]any{
+				"type":            "result",
+				"subtype":         "success",
+				"duration_ms":     float64(1000),
+				"duration_api_ms": float64(800),
+				"is_error":        false,
+				"num_turns":       float64(1),
+				"session_id":      "sess-123",
+			}
+			if tt.usage != nil {
+				data["usage"] = tt.usage
+			}
+			msg, err := parseMessage(data)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			rm := msg.(*ResultMessage)
+			if got := rm.ParsedUsage(); got != tt.want {
+				t.Errorf("ParsedUsage = %+v, want %+v", got, tt.want)
+			}
+			if tt.usage != nil && rm.Usage["service_tier"] != tt.usage["service_tier"] {
+				t.Errorf("expected the raw usage map to be kept, got %v", rm.Usage)
+			}
+		})
+	}
+}
+
+func TestParseStreamError(t *testing.T) {
+	cause := &ProcessExitedError{SDKError: SDKError{Message: "CLI process has exited"}}
+	tests := []struct {
+		name     string
+		data     map[string]any
+		wantText string
+		wantErr  error
+	}{
+		{
+			name:     "keeps original error",
+			data:     map[string]any{"type": "error", "error": cause.Error(), "cause": cause},
+			wantText: "CLI process has exited",
+			wantErr:  cause,
+		},
+		{
+			name:     "text only",
+			data:     map[string]any{"type": "error", "error": "boom"},
+			wantText: "boom",
+		},
+		{
+			name:     "empty",
+			data:     map[string]any{"type": "error"},
+			wantText: "unknown stream error",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := parseMessage(tt.data)
+			if msg != nil {
+				t.Errorf("expected no message, got %T", msg)
+			}
+			if err == nil || err.Error() != tt.wantText {
+				t.Fatalf("expected error %q, got %v", tt.wantText, err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("expected original error to be carried, got %v", err)
+			}
+		})
+	}
+}
+
+func TestParseAssistantMessageServerToolBlocks(t *testing.T) {
+	data := map[string]any{
+		"type": "assistant",
+		"message": map[string]any{
+			"model": "claude-sonnet-4-5",
+			"content": []any{
+				map[string]any{"type": "text", "text": "Let me search."},
+				map[string]any{
+					"type":  "server_tool_use",
+					"id":    "srvtoolu_1",
+					"name":  "web_search",
+					"input": map[string]any{"query": "go generics"},
+				},
+				map[string]any{
+					"type":        "web_search_tool_result",
+					"tool_use_id": "srvtoolu_1",
+					"content": []any{
+						map[string]any{
+							"type":              "web_search_result",
+							"url":               "https://go.dev/doc/tutorial/generics",
+							"title":             "Tutorial: Getting started with generics",
+							"page_age":          "March 15, 2022",
+							"encrypted_content": "abc",
+						},
+					},
+				},
+				map[string]any{
+					"type":        "web_search_tool_result",
+					"tool_use_id": "srvtoolu_2",
+					"content":     map[string]any{"type": "web_search_tool_result_error", "error_code": "max_uses_exceeded"},
+				},
+				map[string]any{"type": "future_block"},
+			},
+		},
+	}
+	msg, err := parseMessage(data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	am := msg.(*AssistantMessage)
+	if len(am.Content) != 4 {
+		t.Fatalf("expected 4 content blocks with the unknown one dropped, got %d", len(am.Content))
+	}
+
+	use, ok := am.Content[1].(*ServerToolUseBlock)
+	if !ok {
+		t.Fatalf("expected *ServerToolUseBlock, got %T", am.Content[1])
+	}
+	if use.ID != "srvtoolu_1" || use.Name != "web_search" || use.Input["query"] != "go generics" {
+		t.Errorf("unexpected server tool use: %+v", use)
+	}
+
+	results, ok := am.Content[2].(*WebSearchResultBlock)
+	if !ok {
+		t.Fatalf("expected *WebSearchResultBlock, got %T", am.Content[2])
+	}
+	want := WebSearchResult{
+		URL:              "https://go.dev/doc/tutorial/generics",
+		Title:            "Tutorial: Getting started with generics",
+		PageAge:          "March 15, 2022",
+		EncryptedContent: "abc",
+	}
+	if results.ToolUseID != "srvtoolu_1" || len(results.Results) != 1 || results.Results[0] != want {
+		t.Errorf("unexpected web search results: %+v", results)
+	}
+
+	failed := am.Content[3].(*WebSearchResultBlock)
+	if failed.ErrorCode != "max_uses_exceeded" || len(failed.Results) != 0 {
+		t.Errorf("unexpected web search error: %+v", failed)
+	}
+}
+
+func TestParseAssistantErrorDetail(t *testing.T) {
+	thirty := 30 * time.Second
+	fiveHundredMS := 500 * time.Millisecond
+	apiText := "API Error: Rate limit reached for requests"
+
+	tests := []struct {
+		name       string
+		data       map[string]any
+		wantError  AssistantMessageError
+		wantDetail *ErrorDetail
+	}{
+		{
+			name: "enum with retry hint",
+			data: map[string]any{
+				"error":       "rate_limit",
+				"retry_after": float64(30),
+			},
+			wantError:  AssistantErrorRateLimit,
+			wantDetail: &ErrorDetail{Message: apiText, RetryAfter: &thirty},
+		},
+		{
+			name: "error object",
+			data: map[string]any{
+				"error": map[string]any{
+					"type":           "rate_limit",
+					"message":        "Too many requests",
+					"retry_after_ms": float64(500),
+				},
+			},
+			wantError:  AssistantErrorRateLimit,
+			wantDetail: &ErrorDetail{Message: "Too many requests", RetryAfter: &fiveHundredMS},
+		},
+		{
+			name:       "billing error without hint",
+			data:       map[string]any{"error": "billing_error"},
+			wantError:  AssistantErrorBillingError,
+			wantDetail: &ErrorDetail{Message: apiText},
+		},
+		{name: "no error", data: map[string]any{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.data["type"] = "assistant"
+			tt.data["message"] = map[string]any{
+				"model":   "claude-sonnet-4-5",
+				"content": []any{map[string]any{"type": "text", "text": apiText}},
+			}
+			msg, err := parseMessage(tt.data)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			am := msg.(*AssistantMessage)
+			if am.Error != tt.wantError {
+				t.Errorf("expected error %q, got %q", tt.wantError, am.Error)
+			}
+			if tt.wantDetail == nil {
+				if am.ErrorDetail != nil {
+					t.Errorf("expected no detail, got %+v", am.ErrorDetail)
+				}
+				return
+			}
+			if am.ErrorDetail == nil {
+				t.Fatal("expected error detail")
+			}
+			if am.ErrorDetail.Message != tt.wantDetail.Message {
+				t.Errorf("expected message %q, got %q", tt.wantDetail.Message, am.ErrorDetail.Message)
+			}
+			got, want := am.ErrorDetail.RetryAfter, tt.wantDetail.RetryAfter
+			if (got == nil) != (want == nil) || (got != nil && *got != *want) {
+				t.Errorf("expected retry after %v, got %v", want, got)
+			}
+		})
+	}
+}
+
+// checkpointMessage is an app-defined message type built on CustomMessage.
+type checkpointMessage struct {
+	CustomMessage
+	Label string
+}
+
+func TestRegisterMessageParser(t *testing.T) {
+	RegisterMessageParser("checkpoint", func(data map[string]any) (Message, error) {
+		label, _ := data["label"].(string)
+		return &checkpointMessage{CustomMessage: CustomMessage{Type: "checkpoint", Data: data}, Label: label}, nil
+	})
+	RegisterMessageParser("experimental_raw", func(data map[string]any) (Message, error) {
+		return &CustomMessage{Type: "experimental_raw", Data: data}, nil
+	})
+	RegisterMessageParser("result", func(data map[string]any) (Message, error) {
+		t.Error("built-in types must not use registered parsers")
+		return nil, nil
+	})
+	t.Cleanup(func() {
+		RegisterMessageParser("checkpoint", nil)
+		RegisterMessageParser("experimental_raw", nil)
+		RegisterMessageParser("result", nil)
+	})
+
+	msg, err := parseMessage(map[string]any{"type": "checkpoint", "label": "before-refactor"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cp, ok := msg.(*checkpointMessage)
+	if !ok || cp.Label != "before-refactor" {
+		t.Fatalf("expected checkpoint message, got %#v", msg)
+	}
+
+	msg, err = parseMessage(map[string]any{"type": "experimental_raw", "n": float64(1)})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cm, ok := msg.(*CustomMessage); !ok || cm.Data["n"] != float64(1) {
+		t.Fatalf("expected custom message, got %#v", msg)
+	}
+
+	if _, err := parseMessage(map[string]any{
+		"type": "result", "subtype": "success", "duration_ms": float64(1), "duration_api_ms": float64(1),
+		"is_error": false, "num_turns": float64(1), "session_id": "s",
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	RegisterMessageParser("checkpoint", nil)
+	if _, err := parseMessage(map[string]any{"type": "checkpoint"}); err == nil {
+		t.Error("expected unknown type error after unregistering")
+	}
+}
+
+func TestParseUserMessageImageBlock(t *testing.T) {
+	msg, err := parseMessage(map[string]any{
+		"type": "user",
+		"message": map[string]any{
+			"content": []any{
+				map[string]any{
+					"type":   "image",
+					"source": map[string]any{"type": "base64", "media_type": "image/png", "data": "iVBORw0KGgo="},
+				},
+				map[string]any{
+					"type":   "image",
+					"source": map[string]any{"type": "url", "url": "https://example.com/a.png"},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	blocks := msg.(*UserMessage).Content.([]ContentBlock)
+	if len(blocks) != 1 {
+		t.Fatalf("expected only the base64 image to parse, got %d blocks", len(blocks))
+	}
+	img, ok := blocks[0].(*ImageBlock)
+	if !ok || img.MediaType != "image/png" || img.Data != "iVBORw0KGgo=" {
+		t.Errorf("unexpected image block: %#v", blocks[0])
+	}
+}
+
+func TestParseToolResultContent(t *testing.T) {
+	tests := []struct {
+		name      string
+		content   any
+		isError   any
+		wantItems []MCPContent
+		wantText  string
+	}{
+		{
+			name:     "string form",
+			content:  "total 8\nREADME.md",
+			wantText: "total 8\nREADME.md",
+		},
+		{
+			name: "list of text",
+			content: []any{
+				map[string]any{"type": "text", "text": "first"},
+				map[string]any{"type": "text", "text": "second"},
+			},
+			isError:   true,
+			wantItems: []MCPContent{{Type: "text", Text: "first"}, {Type: "text", Text: "second"}},
+			wantText:  "first\nsecond",
+		},
+		{
+			name: "mixed text and image",
+			content: []any{
+				map[string]any{"type": "text", "text": "screenshot:"},
+				map[string]any{"type": "image", "source": map[string]any{"type": "base64", "media_type": "image/png", "data": "iVBORw0KGgo="}},
+				map[string]any{"type": "image", "data": "R0lGOD", "mimeType": "image/gif"},
+				map[string]any{"type": "tool_reference", "tool_name": "Read"},
+			},
+			wantItems: []MCPContent{
+				{Type: "text", Text: "screenshot:"},
+				{Type: "image", Data: "iVBORw0KGgo=", MimeType: "image/png"},
+				{Type: "image", Data: "R0lGOD", MimeType: "image/gif"},
+			},
+			wantText: "screenshot:",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			block := map[string]any{"type": "tool_result", "tool_use_id": "tool-1", "content": tt.content}
+			if tt.isError != nil {
+				block["is_error"] = tt.isError
+			}
+			msg, err := parseMessage(map[string]any{
+				"type":    "user",
+				"message": map[string]any{"content": []any{block}},
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			tr := msg.(*UserMessage).Content.([]ContentBlock)[0].(*ToolResultBlock)
+			if !reflect.DeepEqual(tr.Items, tt.wantItems) && (len(tr.Items) != 0 || len(tt.wantItems) != 0) {
+				t.Errorf("Items = %+v, want %+v", tr.Items, tt.wantItems)
+			}
+			if got := tr.TextContent(); got != tt.wantText {
+				t.Errorf("TextContent = %q, want %q", got, tt.wantText)
+			}
+			if tt.isError != nil && (tr.IsError == nil || !*tr.IsError) {
+				t.Error("expected is_error to be preserved")
+			}
+		})
+	}
+}
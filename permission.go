@@ -96,7 +96,11 @@ func (p *PermissionUpdate) ToDict() map[string]any {
 
 // ToolPermissionContext provides context information for tool permission callbacks.
 type ToolPermissionContext struct {
-	Signal      any // Future: abort signal support
+	// Signal is cancelled when the CLI withdraws the permission request, for
+	// example after an interrupt, or when WithGlobalTimeout expires. Callbacks
+	// that wait, such as on a human, should stop when it is done; their result
+	// is then discarded.
+	Signal      context.Context
 	Suggestions []PermissionUpdate
 }
 
@@ -113,6 +117,20 @@ type PermissionResultAllow struct {
 
 func (r *PermissionResultAllow) permissionResultType() string { return "allow" }
 
+// AllowForSession allows the tool call and adds a session rule so the CLI does
+// not ask again for toolName until the session ends. ruleContent narrows the
+// rule, e.g. "npm test:*" for Bash; empty allows every use of the tool.
+func AllowForSession(toolName, ruleContent string) *PermissionResultAllow {
+	return &PermissionResultAllow{
+		UpdatedPermissions: []PermissionUpdate{{
+			Type:        PermissionUpdateAddRules,
+			Rules:       []PermissionRuleValue{{ToolName: toolName, RuleContent: ruleContent}},
+			Behavior:    PermissionBehaviorAllow,
+			Destination: PermissionDestSession,
+		}},
+	}
+}
+
 // PermissionResultDeny represents a deny permission result.
 type PermissionResultDeny struct {
 	Message   string `json:"message,omitempty"`
@@ -0,0 +1,182 @@
+package claude
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ClientPool keeps a bounded set of connected ClaudeClients warm so that
+// high-rate callers do not pay CLI startup and initialize on every request.
+//
+// A pooled client keeps its conversation state between uses; callers that need
+// isolation should address each request to its own session ID.
+type ClientPool struct {
+	idleTimeout time.Duration
+	dial        func(ctx context.Context) (*ClaudeClient, error)
+
+	slots chan struct{} // one token per client in use, bounds the pool size
+
+	mu     sync.Mutex
+	idle   []pooledClient
+	closed bool
+	stop   chan struct{}
+}
+
+type pooledClient struct {
+	client    *ClaudeClient
+	idleSince time.Time
+}
+
+// NewClientPool creates a pool of at most maxSize clients built from opts.
+// Clients idle for longer than idleTimeout are closed; zero disables expiry.
+func NewClientPool(maxSize int, idleTimeout time.Duration, opts ...Option) *ClientPool {
+	if maxSize <= 0 {
+		maxSize = 1
+	}
+	p := &ClientPool{
+		idleTimeout: idleTimeout,
+		slots:       make(chan struct{}, maxSize),
+		stop:        make(chan struct{}),
+	}
+	// A WithTransport transport serves a single client and is closed with it.
+	ownTransport := applyOptions(opts).Transport != nil
+	var dialed atomic.Bool
+	p.dial = func(ctx context.Context) (*ClaudeClient, error) {
+		if ownTransport && dialed.Swap(true) {
+			return nil, ErrTransportReused
+		}
+		client := NewClient(opts...)
+		if err := client.Connect(ctx); err != nil {
+			_ = client.Close()
+			return nil, err
+		}
+		return client, nil
+	}
+	if idleTimeout > 0 {
+		go p.evictLoop()
+	}
+	return p
+}
+
+// Acquire returns a connected client, reusing an idle one when possible and
+// blocking while the pool is at capacity. Call release exactly once when done;
+// a client whose connection has failed, or that still has a turn in flight
+// because the borrower did not receive through to its ResultMessage, is closed
+// instead of being reused.
+func (p *ClientPool) Acquire(ctx context.Context) (*ClaudeClient, func(), error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		<-p.slots
+		return nil, nil, &SDKError{Message: "client pool is closed"}
+	}
+	var client *ClaudeClient
+	var stale []*ClaudeClient
+	for len(p.idle) > 0 && client == nil {
+		last := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if p.expired(last) || !last.client.healthy() {
+			stale = append(stale, last.client)
+			continue
+		}
+		client = last.client
+	}
+	p.mu.Unlock()
+
+	for _, c := range stale {
+		_ = c.Close()
+	}
+
+	if client == nil {
+		var err error
+		client, err = p.dial(ctx)
+		if err != nil {
+			<-p.slots
+			return nil, nil, err
+		}
+	}
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() { p.release(client) })
+	}
+	return client, release, nil
+}
+
+// Close closes all idle clients. Clients still in use are closed when released.
+func (p *ClientPool) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	close(p.stop)
+	p.mu.Unlock()
+
+	for _, pc := range idle {
+		_ = pc.client.Close()
+	}
+	return nil
+}
+
+func (p *ClientPool) release(client *ClaudeClient) {
+	defer func() { <-p.slots }()
+
+	// Messages left from an unfinished turn would reach the next borrower.
+	reusable := client.healthy() && client.turns.pendingCount() == 0
+	p.mu.Lock()
+	if p.closed || !reusable {
+		p.mu.Unlock()
+		_ = client.Close()
+		return
+	}
+	p.idle = append(p.idle, pooledClient{client: client, idleSince: time.Now()})
+	p.mu.Unlock()
+}
+
+func (p *ClientPool) expired(pc pooledClient) bool {
+	return p.idleTimeout > 0 && time.Since(pc.idleSince) > p.idleTimeout
+}
+
+func (p *ClientPool) evictLoop() {
+	ticker := time.NewTicker(p.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.evictExpired()
+		}
+	}
+}
+
+func (p *ClientPool) evictExpired() {
+	p.mu.Lock()
+	var expired []*ClaudeClient
+	kept := p.idle[:0]
+	for _, pc := range p.idle {
+		if p.expired(pc) {
+			expired = append(expired, pc.client)
+		} else {
+			kept = append(kept, pc)
+		}
+	}
+	p.idle = kept
+	p.mu.Unlock()
+
+	for _, client := range expired {
+		_ = client.Close()
+	}
+}
@@ -0,0 +1,162 @@
+package claude
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestPool returns a pool whose dial creates healthy clients backed by mock transports.
+func newTestPool(t *testing.T, maxSize int, idleTimeout time.Duration) (*ClientPool, *atomic.Int32) {
+	t.Helper()
+	var dials atomic.Int32
+	pool := NewClientPool(maxSize, idleTimeout)
+	pool.dial = func(ctx context.Context) (*ClaudeClient, error) {
+		dials.Add(1)
+		client, _ := testableClient(t, queryOptions{})
+		client.transport = &subprocessTransport{ready: true}
+		return client, nil
+	}
+	t.Cleanup(func() { _ = pool.Close() })
+	return pool, &dials
+}
+
+func TestClientPoolReusesClients(t *testing.T) {
+	pool, dials := newTestPool(t, 2, 0)
+	ctx := context.Background()
+
+	first, release, err := pool.Acquire(ctx)
+	if err != nil {
+		t.Fatalf("acquire failed: %v", err)
+	}
+	release()
+
+	second, release, err := pool.Acquire(ctx)
+	if err != nil {
+		t.Fatalf("acquire failed: %v", err)
+	}
+	defer release()
+
+	if first != second {
+		t.Error("expected released client to be reused")
+	}
+	if n := dials.Load(); n != 1 {
+		t.Errorf("expected 1 dial, got %d", n)
+	}
+}
+
+func TestClientPoolBlocksAtMaxSize(t *testing.T) {
+	pool, _ := newTestPool(t, 1, 0)
+
+	_, release, err := pool.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("acquire failed: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, _, err := pool.Acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected acquire to block until deadline, got %v", err)
+	}
+
+	acquired := make(chan struct{})
+	go func() {
+		_, rel, err := pool.Acquire(context.Background())
+		if err == nil {
+			rel()
+		}
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("acquire should block while the pool is full")
+	case <-time.After(20 * time.Millisecond):
+	}
+	release()
+	select {
+	case <-acquired:
+	case <-time.After(2 * time.Second):
+		t.Fatal("acquire did not proceed after release")
+	}
+}
+
+func TestClientPoolDiscardsFailedClient(t *testing.T) {
+	pool, dials := newTestPool(t, 1, 0)
+	ctx := context.Background()
+
+	first, release, err := pool.Acquire(ctx)
+	if err != nil {
+		t.Fatalf("acquire failed: %v", err)
+	}
+	first.transport.(*subprocessTransport).exitErr = errors.New("process crashed")
+	release()
+
+	second, release, err := pool.Acquire(ctx)
+	if err != nil {
+		t.Fatalf("acquire failed: %v", err)
+	}
+	defer release()
+
+	if first == second {
+		t.Error("expected failed client to be discarded")
+	}
+	if !first.closed {
+		t.Error("expected failed client to be closed")
+	}
+	if n := dials.Load(); n != 2 {
+		t.Errorf("expected 2 dials, got %d", n)
+	}
+}
+
+func TestClientPoolDiscardsClientWithTurnInFlight(t *testing.T) {
+	pool, dials := newTestPool(t, 1, 0)
+	ctx := context.Background()
+
+	first, release, err := pool.Acquire(ctx)
+	if err != nil {
+		t.Fatalf("acquire failed: %v", err)
+	}
+	// The borrower sent a turn and released before its ResultMessage.
+	first.turns.claim("default", 0, false)
+	release()
+
+	second, release, err := pool.Acquire(ctx)
+	if err != nil {
+		t.Fatalf("acquire failed: %v", err)
+	}
+	defer release()
+
+	if first == second || !first.closed {
+		t.Error("expected the client with a turn in flight to be closed")
+	}
+	if n := dials.Load(); n != 2 {
+		t.Errorf("expected 2 dials, got %d", n)
+	}
+}
+
+func TestClientPoolEvictsIdleClients(t *testing.T) {
+	pool, dials := newTestPool(t, 1, 10*time.Millisecond)
+	ctx := context.Background()
+
+	first, release, err := pool.Acquire(ctx)
+	if err != nil {
+		t.Fatalf("acquire failed: %v", err)
+	}
+	release()
+	time.Sleep(50 * time.Millisecond)
+
+	second, release, err := pool.Acquire(ctx)
+	if err != nil {
+		t.Fatalf("acquire failed: %v", err)
+	}
+	defer release()
+
+	if first == second {
+		t.Error("expected idle client to be evicted")
+	}
+	if n := dials.Load(); n != 2 {
+		t.Errorf("expected 2 dials, got %d", n)
+	}
+}
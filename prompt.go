@@ -0,0 +1,37 @@
+package claude
+
+import (
+	"context"
+	"strings"
+	"text/template"
+)
+
+// RenderPrompt renders tmpl, a text/template, with data. Missing map keys are
+// reported as errors rather than rendered as "<no value>". Output is not
+// escaped: prompts are plain text, so values are inserted verbatim.
+func RenderPrompt(tmpl string, data any) (string, error) {
+	t, err := template.New("prompt").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", &SDKError{Message: "failed to parse prompt template", Cause: err}
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", &SDKError{Message: "failed to render prompt template", Cause: err}
+	}
+	return b.String(), nil
+}
+
+// QueryTemplate renders tmpl with data using RenderPrompt and runs Query with
+// the result. A rendering error is delivered on the error channel.
+func QueryTemplate(ctx context.Context, tmpl string, data any, opts ...Option) (<-chan Message, <-chan error) {
+	prompt, err := RenderPrompt(tmpl, data)
+	if err != nil {
+		msgChan := make(chan Message)
+		errChan := make(chan error, 1)
+		close(msgChan)
+		errChan <- err
+		close(errChan)
+		return msgChan, errChan
+	}
+	return Query(ctx, prompt, opts...)
+}
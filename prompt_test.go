@@ -0,0 +1,87 @@
+package claude
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestRenderPrompt(t *testing.T) {
+	tests := []struct {
+		name    string
+		tmpl    string
+		data    any
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "struct fields",
+			tmpl: "Review {{.File}} for {{.Focus}}.",
+			data: struct{ File, Focus string }{"main.go", "races"},
+			want: "Review main.go for races.",
+		},
+		{
+			name: "range over slice",
+			tmpl: "Files:{{range .}} {{.}}{{end}}",
+			data: []string{"a.go", "b.go"},
+			want: "Files: a.go b.go",
+		},
+		{
+			name: "values are not escaped",
+			tmpl: "{{.q}}",
+			data: map[string]any{"q": `<a href="x">&</a>`},
+			want: `<a href="x">&</a>`,
+		},
+		{name: "missing key", tmpl: "{{.missing}}", data: map[string]any{}, wantErr: true},
+		{name: "parse error", tmpl: "{{.File", data: nil, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := RenderPrompt(tt.tmpl, tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryTemplate(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("shell script test")
+	}
+	dir := t.TempDir()
+	promptFile := filepath.Join(dir, "prompt.txt")
+	cli := filepath.Join(dir, "claude")
+	script := "#!/bin/sh\ncat > " + promptFile + "\n" +
+		`echo '{"type":"result","subtype":"success","duration_ms":1,"duration_api_ms":1,"is_error":false,"num_turns":1,"session_id":"s"}'` + "\n"
+	if err := os.WriteFile(cli, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	msgChan, errChan := QueryTemplate(context.Background(), "Summarize {{.Topic}}", map[string]string{"Topic": "goroutines"},
+		WithCLIPath(cli), WithInputFormat(InputFormatText))
+	for range msgChan {
+	}
+	if err := <-errChan; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got, err := os.ReadFile(promptFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "Summarize goroutines\n" {
+		t.Errorf("expected rendered prompt on stdin, got %q", got)
+	}
+
+	msgChan, errChan = QueryTemplate(context.Background(), "{{.Missing}}", map[string]string{}, WithCLIPath(cli))
+	for range msgChan {
+	}
+	if err := <-errChan; err == nil {
+		t.Error("expected render error on the error channel")
+	}
+}
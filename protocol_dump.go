@@ -0,0 +1,83 @@
+package claude
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// Protocol dump directions.
+const (
+	dumpOutbound = "outbound" // SDK to CLI (stdin)
+	dumpInbound  = "inbound"  // CLI to SDK (stdout)
+)
+
+// protocolDump appends one timestamped JSONL record per protocol message.
+// A nil *protocolDump records nothing.
+type protocolDump struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+type protocolDumpRecord struct {
+	Time      string          `json:"time"`
+	Direction string          `json:"direction"`
+	Type      string          `json:"type,omitempty"`
+	Subtype   string          `json:"subtype,omitempty"`
+	Message   json.RawMessage `json:"message,omitempty"`
+	Text      string          `json:"text,omitempty"` // non-JSON input, e.g. text input format
+}
+
+func openProtocolDump(path string) (*protocolDump, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, &SDKError{Message: "failed to open protocol dump " + path, Cause: err}
+	}
+	return &protocolDump{f: f}, nil
+}
+
+// record writes raw, one JSON message or a line of text, with its direction.
+func (d *protocolDump) record(direction string, raw []byte) {
+	if d == nil {
+		return
+	}
+	rec := protocolDumpRecord{Time: time.Now().UTC().Format(time.RFC3339Nano), Direction: direction}
+	var msg map[string]any
+	if err := json.Unmarshal(raw, &msg); err == nil {
+		rec.Message = raw
+		rec.Type, _ = msg["type"].(string)
+		rec.Subtype, _ = msg["subtype"].(string)
+		for _, key := range []string{"request", "response"} {
+			if inner, ok := msg[key].(map[string]any); ok {
+				rec.Subtype, _ = inner["subtype"].(string)
+			}
+		}
+	} else {
+		rec.Text = string(raw)
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.f != nil {
+		_, _ = d.f.Write(append(line, '\n'))
+	}
+}
+
+func (d *protocolDump) close() error {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.f == nil {
+		return nil
+	}
+	err := d.f.Close()
+	d.f = nil
+	return err
+}
@@ -0,0 +1,87 @@
+package claude
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestProtocolDumpRecordsControlExchange(t *testing.T) {
+	cli := writeFakeCLI(t, fakeCLIScript)
+	dumpPath := filepath.Join(t.TempDir(), "protocol.jsonl")
+
+	client := NewClient(WithCLIPath(cli), WithProtocolDump(dumpPath))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Connect(ctx); err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+	_ = client.Close()
+
+	f, err := os.Open(dumpPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var records []protocolDumpRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec protocolDumpRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("invalid dump line %q: %v", scanner.Text(), err)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, rec.Time); err != nil {
+			t.Errorf("invalid timestamp %q", rec.Time)
+		}
+		records = append(records, rec)
+	}
+
+	var sawRequest, sawResponse bool
+	for _, rec := range records {
+		switch {
+		case rec.Direction == dumpOutbound && rec.Type == "control_request" && rec.Subtype == "initialize":
+			sawRequest = true
+		case rec.Direction == dumpInbound && rec.Type == "control_response" && rec.Subtype == "success":
+			sawResponse = true
+		}
+	}
+	if !sawRequest || !sawResponse {
+		t.Errorf("expected initialize request and its response in dump, got %+v", records)
+	}
+}
+
+func TestProtocolDumpRecordsEndInputSentinel(t *testing.T) {
+	dumpPath := filepath.Join(t.TempDir(), "protocol.jsonl")
+	dump, err := openProtocolDump(dumpPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := &subprocessTransport{
+		options: applyOptions([]Option{WithEndInputSentinel(map[string]any{"type": "end"})}),
+		ready:   true,
+		stdin:   &recordingStdin{},
+		dump:    dump,
+	}
+	if err := tr.EndInput(); err != nil {
+		t.Fatalf("EndInput failed: %v", err)
+	}
+	_ = dump.close()
+
+	data, err := os.ReadFile(dumpPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rec protocolDumpRecord
+	if err := json.Unmarshal(bytes.TrimSpace(data), &rec); err != nil {
+		t.Fatalf("expected one dump record, got %q: %v", data, err)
+	}
+	if rec.Direction != dumpOutbound || rec.Type != "end" {
+		t.Errorf("expected the outbound sentinel, got %+v", rec)
+	}
+}
@@ -5,9 +5,10 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"os"
+	"regexp"
 	"strconv"
 	"sync"
 	"sync/atomic"
@@ -21,6 +22,11 @@ type queryOptions struct {
 	SdkMcpServers     map[string]*McpServer
 	InitializeTimeout float64
 	Agents            map[string]map[string]any
+	RequireVersion    bool
+	SkipVersionCheck  bool
+	CallbackTimeout   time.Duration
+	MaxCallbacks      int
+	Logger            Logger
 }
 
 // hookMatcherConfig is the internal representation of hook matchers.
@@ -32,65 +38,93 @@ type hookMatcherConfig struct {
 
 // pendingRequest represents a pending control request waiting for response.
 type pendingRequest struct {
+	once   sync.Once
 	done   chan struct{}
 	result map[string]any
 	err    error
 }
 
+// resolve completes the request. Only the first call has any effect, so a
+// response racing with close cannot overwrite the delivered outcome.
+func (p *pendingRequest) resolve(result map[string]any, err error) {
+	p.once.Do(func() {
+		p.result = result
+		p.err = err
+		close(p.done)
+	})
+}
+
 // queryHandler handles bidirectional control protocol on top of the transport.
 type queryHandler struct {
-	transport interface {
-		Write(data string) error
-		Messages() <-chan map[string]any
-		Errors() <-chan error
-		LastError() error
-		Close() error
-		EndInput() error
-		IsReady() bool
-	}
+	transport Transport
 
 	canUseTool    CanUseToolFunc
 	hooks         map[string][]hookMatcherConfig
 	sdkMcpServers map[string]*McpServer
 	agents        map[string]map[string]any
+	logger        Logger
 
 	// Control protocol state
 	pendingRequests sync.Map // map[string]*pendingRequest
+	pendingCount    atomic.Int64
 	hookCallbacks   map[string]HookCallback
+	hookTimeouts    map[string]time.Duration  // per-callback overrides of callbackTimeout
+	hookMatchers    map[string]*regexp.Regexp // compiled HookMatcher patterns by callback ID
+	callbackTimeout time.Duration
+	maxCallbacks    int            // workers draining callbackQueue; 0 means a goroutine per request
+	callbackQueue   *callbackQueue // control requests waiting for a worker when maxCallbacks > 0
 	nextCallbackID  int
 	requestCounter  atomic.Int64
 
 	// Message stream
-	msgChan chan map[string]any
-	cancel  context.CancelFunc
-	wg      sync.WaitGroup
-	closed  atomic.Bool
+	msgChan   chan map[string]any
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	closed    atomic.Bool
+	closeOnce sync.Once
+	closeChan chan struct{}
 
 	writeMu sync.Mutex
 
+	// Cancel funcs of control requests being handled, by request ID
+	inflight sync.Map
+
 	// Track first result for proper stream closure
 	firstResultOnce sync.Once
 	firstResultChan chan struct{}
 
 	streamCloseTimeout float64
 	initializeTimeout  float64
+	requireVersion     bool
+	skipVersionCheck   bool
 
 	// Initialize result
 	initResult map[string]any
 
+	// Closed once the initialize handshake succeeds
+	readyOnce sync.Once
+	readyChan chan struct{}
+
 	readErr   error
 	readErrMu sync.Mutex
+
+	// High-water marks reported by metrics
+	msgHighWater     atomic.Int64
+	pendingHighWater atomic.Int64
+
+	// Requested model, updated by set_model requests
+	modelPin modelPin
+
+	// Message parse errors tolerated so far under MaxParseErrors
+	parseErrors atomic.Int64
 }
 
-func newQueryHandler(transport interface {
-	Write(data string) error
-	Messages() <-chan map[string]any
-	Errors() <-chan error
-	LastError() error
-	Close() error
-	EndInput() error
-	IsReady() bool
-}, opts queryOptions) *queryHandler {
+func newQueryHandler(transport Transport, opts queryOptions) *queryHandler {
+	var queue *callbackQueue
+	if opts.MaxCallbacks > 0 {
+		queue = &callbackQueue{wake: make(chan struct{}, 1)}
+	}
+
 	timeout := opts.InitializeTimeout
 	if timeout <= 0 {
 		timeout = 60.0
@@ -109,11 +143,21 @@ func newQueryHandler(transport interface {
 		hooks:              opts.Hooks,
 		sdkMcpServers:      opts.SdkMcpServers,
 		agents:             opts.Agents,
+		logger:             loggerOr(opts.Logger),
 		hookCallbacks:      make(map[string]HookCallback),
+		hookTimeouts:       make(map[string]time.Duration),
+		hookMatchers:       make(map[string]*regexp.Regexp),
+		callbackTimeout:    opts.CallbackTimeout,
+		maxCallbacks:       opts.MaxCallbacks,
+		callbackQueue:      queue,
 		msgChan:            make(chan map[string]any, 100),
 		firstResultChan:    make(chan struct{}),
+		readyChan:          make(chan struct{}),
+		closeChan:          make(chan struct{}),
 		streamCloseTimeout: streamCloseTimeout,
 		initializeTimeout:  timeout,
+		requireVersion:     opts.RequireVersion,
+		skipVersionCheck:   opts.SkipVersionCheck,
 	}
 }
 
@@ -123,6 +167,9 @@ func (q *queryHandler) start(ctx context.Context) error {
 
 	q.wg.Add(1)
 	go q.readMessages(readCtx)
+	for range q.maxCallbacks {
+		go q.callbackWorker(readCtx)
+	}
 	return nil
 }
 
@@ -186,19 +233,20 @@ func (q *queryHandler) readMessages(ctx context.Context) {
 					subtype, _ := response["subtype"].(string)
 					if subtype == "error" {
 						errMsg, _ := response["error"].(string)
-						pending.err = fmt.Errorf("%s", errMsg)
+						pending.resolve(nil, fmt.Errorf("%s", errMsg))
 					} else {
-						pending.result = response
+						pending.resolve(response, nil)
 					}
-					safeClose(pending.done)
 				}
 
 			case "control_request":
-				go q.handleControlRequest(ctx, msg)
+				q.dispatchControlRequest(ctx, msg)
 
 			case "control_cancel_request":
-				// TODO: implement cancellation
-				continue
+				requestID, _ := msg["request_id"].(string)
+				if cancel, ok := q.inflight.Load(requestID); ok {
+					cancel.(context.CancelFunc)()
+				}
 
 			default:
 				// Track result for stream closure
@@ -210,6 +258,7 @@ func (q *queryHandler) readMessages(ctx context.Context) {
 				// Regular SDK message
 				select {
 				case q.msgChan <- msg:
+					storeMax(&q.msgHighWater, int64(len(q.msgChan)))
 				case <-ctx.Done():
 					return
 				}
@@ -218,28 +267,160 @@ func (q *queryHandler) readMessages(ctx context.Context) {
 	}
 }
 
-func (q *queryHandler) handleControlRequest(ctx context.Context, msg map[string]any) {
+// controlCall is a control request from the CLI on its way to a handler.
+type controlCall struct {
+	ctx       context.Context // cancelled when the CLI withdraws the request
+	cancel    context.CancelFunc
+	requestID string
+	request   map[string]any
+	received  time.Time // the callback deadline runs from here
+}
+
+// callbackQueue hands control requests from the read loop to a fixed set of
+// workers. push never blocks, so the read loop keeps delivering control
+// responses and cancellations while every worker is busy.
+type callbackQueue struct {
+	mu    sync.Mutex
+	calls []controlCall
+	wake  chan struct{} // signalled when calls may be non-empty
+}
+
+func (cq *callbackQueue) push(call controlCall) {
+	cq.mu.Lock()
+	cq.calls = append(cq.calls, call)
+	cq.mu.Unlock()
+	cq.signal()
+}
+
+// pop removes the oldest call, passing the wake-up on when more remain.
+func (cq *callbackQueue) pop() (controlCall, bool) {
+	cq.mu.Lock()
+	if len(cq.calls) == 0 {
+		cq.mu.Unlock()
+		return controlCall{}, false
+	}
+	call := cq.calls[0]
+	cq.calls[0] = controlCall{}
+	cq.calls = cq.calls[1:]
+	more := len(cq.calls) > 0
+	cq.mu.Unlock()
+	if more {
+		cq.signal()
+	}
+	return call, true
+}
+
+func (cq *callbackQueue) signal() {
+	select {
+	case cq.wake <- struct{}{}:
+	default:
+	}
+}
+
+// dispatchControlRequest registers a control request so that the CLI can
+// withdraw it, then hands it to a callback worker, or to a goroutine of its
+// own when callbacks are not capped. It never blocks the read loop.
+func (q *queryHandler) dispatchControlRequest(ctx context.Context, msg map[string]any) {
 	requestID, _ := msg["request_id"].(string)
 	request, _ := msg["request"].(map[string]any)
 	if request == nil || requestID == "" {
 		return
 	}
 
+	// The CLI withdraws a request with control_cancel_request, which cancels
+	// its context; it expects no response then.
+	callCtx, cancel := context.WithCancel(ctx)
+	q.inflight.Store(requestID, cancel)
+	call := controlCall{
+		ctx:       callCtx,
+		cancel:    cancel,
+		requestID: requestID,
+		request:   request,
+		received:  time.Now(),
+	}
+	if q.callbackQueue == nil {
+		go q.handleControlRequest(call)
+		return
+	}
+	q.callbackQueue.push(call)
+}
+
+// callbackWorker handles queued control requests until ctx is done.
+func (q *queryHandler) callbackWorker(ctx context.Context) {
+	for {
+		if call, ok := q.callbackQueue.pop(); ok {
+			q.handleControlRequest(call)
+			continue
+		}
+		select {
+		case <-q.callbackQueue.wake:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// handleControlRequest runs the callback for call and writes its response.
+func (q *queryHandler) handleControlRequest(call controlCall) {
+	ctx, requestID, request, received := call.ctx, call.requestID, call.request, call.received
+	finish := func() {
+		q.inflight.Delete(requestID)
+		call.cancel()
+	}
+	var asyncHook *HookJSONOutput
+	defer func() {
+		if asyncHook == nil {
+			finish()
+		}
+	}()
+	if ctx.Err() != nil {
+		return // withdrawn while queued
+	}
+
 	subtype, _ := request["subtype"].(string)
 	var responseData map[string]any
 	var err error
 
 	switch subtype {
 	case "can_use_tool":
-		responseData, err = q.handleCanUseTool(ctx, request)
+		responseData, err = runCallback(ctx, received, q.callbackTimeout, "permission", request, q.handleCanUseTool)
 	case "hook_callback":
-		responseData, err = q.handleHookCallback(ctx, request)
+		timeout := q.callbackTimeout
+		callbackID, _ := request["callback_id"].(string)
+		if override, ok := q.hookTimeouts[callbackID]; ok {
+			timeout = override
+		}
+		var output *HookJSONOutput
+		output, err = runCallback(ctx, received, timeout, "hook", request, q.callHook)
+		responseData = hookResponse(output)
+		if err == nil && output != nil && output.Async != nil && *output.Async && output.AsyncWork != nil {
+			asyncHook = output
+		}
 	case "mcp_message":
-		responseData, err = q.handleMcpMessage(ctx, request)
+		responseData, err = runCallback(ctx, received, q.callbackTimeout, "MCP", request, q.handleMcpMessage)
 	default:
 		err = fmt.Errorf("unsupported control request subtype: %s", subtype)
 	}
 
+	if ctx.Err() != nil {
+		asyncHook = nil
+		return
+	}
+	q.writeControlResponse(requestID, responseData, err)
+
+	// The request stays in inflight until the async outcome is written, so
+	// that control_cancel_request can still stop its AsyncWork.
+	if asyncHook != nil {
+		go func() {
+			defer finish()
+			q.completeAsyncHook(ctx, requestID, asyncHook)
+		}()
+	}
+}
+
+// writeControlResponse answers the control request requestID with data, or
+// with err when it is non-nil.
+func (q *queryHandler) writeControlResponse(requestID string, data map[string]any, err error) {
 	var response map[string]any
 	if err != nil {
 		response = map[string]any{
@@ -256,17 +437,88 @@ func (q *queryHandler) handleControlRequest(ctx context.Context, msg map[string]
 			"response": map[string]any{
 				"subtype":    "success",
 				"request_id": requestID,
-				"response":   responseData,
+				"response":   data,
 			},
 		}
 	}
 
-	data, _ := json.Marshal(response)
+	line, _ := json.Marshal(response)
 	q.writeMu.Lock()
-	_ = q.transport.Write(string(data) + "\n")
+	_ = q.transport.Write(string(line) + "\n")
 	q.writeMu.Unlock()
 }
 
+// completeAsyncHook runs the AsyncWork of a hook that answered with Async,
+// bounded by its AsyncTimeout, and sends the outcome as a second control
+// response to requestID unless the CLI withdrew the request meanwhile.
+func (q *queryHandler) completeAsyncHook(ctx context.Context, requestID string, output *HookJSONOutput) {
+	var timeout time.Duration
+	if output.AsyncTimeout != nil {
+		timeout = time.Duration(*output.AsyncTimeout) * time.Millisecond
+	}
+	result, err := runCallback(ctx, time.Now(), timeout, "async hook", nil, func(ctx context.Context, _ map[string]any) (*HookJSONOutput, error) {
+		return output.AsyncWork(ctx)
+	})
+	if ctx.Err() != nil || q.closed.Load() {
+		return
+	}
+	q.writeControlResponse(requestID, hookResponse(result), err)
+}
+
+// runCallback runs handle with a deadline of timeout after start, or none when
+// timeout is zero. Once the deadline passes it returns an error, even if the
+// callback ignores its context and keeps running. A panic in handle is
+// returned as an error rather than crashing the process.
+func runCallback[T any](
+	ctx context.Context,
+	start time.Time,
+	timeout time.Duration,
+	kind string,
+	request map[string]any,
+	handle func(context.Context, map[string]any) (T, error),
+) (T, error) {
+	if timeout <= 0 {
+		return callRecovered(ctx, kind, request, handle)
+	}
+	ctx, cancel := context.WithDeadline(ctx, start.Add(timeout))
+	defer cancel()
+
+	type outcome struct {
+		data T
+		err  error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		data, err := callRecovered(ctx, kind, request, handle)
+		done <- outcome{data, err}
+	}()
+	var zero T
+	select {
+	case o := <-done:
+		return o.data, o.err
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return zero, fmt.Errorf("%s callback timed out after %s", kind, timeout)
+		}
+		return zero, ctx.Err()
+	}
+}
+
+// callRecovered calls handle, converting a panic into an error.
+func callRecovered[T any](
+	ctx context.Context,
+	kind string,
+	request map[string]any,
+	handle func(context.Context, map[string]any) (T, error),
+) (data T, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%s callback panicked: %v", kind, r)
+		}
+	}()
+	return handle(ctx, request)
+}
+
 func (q *queryHandler) handleCanUseTool(ctx context.Context, request map[string]any) (map[string]any, error) {
 	if q.canUseTool == nil {
 		return nil, fmt.Errorf("canUseTool callback is not provided")
@@ -288,6 +540,7 @@ func (q *queryHandler) handleCanUseTool(ctx context.Context, request map[string]
 	}
 
 	permCtx := ToolPermissionContext{
+		Signal:      ctx,
 		Suggestions: suggestions,
 	}
 
@@ -331,6 +584,16 @@ func (q *queryHandler) handleCanUseTool(ctx context.Context, request map[string]
 }
 
 func (q *queryHandler) handleHookCallback(ctx context.Context, request map[string]any) (map[string]any, error) {
+	output, err := q.callHook(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	return hookResponse(output), nil
+}
+
+// callHook runs the hook callback named by request. It returns a nil output
+// when the callback does or when the matcher filters the call out.
+func (q *queryHandler) callHook(ctx context.Context, request map[string]any) (*HookJSONOutput, error) {
 	callbackID, _ := request["callback_id"].(string)
 	callback, ok := q.hookCallbacks[callbackID]
 	if !ok {
@@ -341,19 +604,23 @@ func (q *queryHandler) handleHookCallback(ctx context.Context, request map[strin
 	if rawInput, ok := request["input"].(map[string]any); ok {
 		hookInput = parseHookInput(rawInput)
 	}
+	// Events without a tool, such as Notification, are not filtered.
+	if pattern, ok := q.hookMatchers[callbackID]; ok && hookInput.ToolName != "" && !pattern.MatchString(hookInput.ToolName) {
+		return nil, nil
+	}
 
 	toolUseID, _ := request["tool_use_id"].(string)
-	hookCtx := HookContext{}
+	hookCtx := HookContext{Signal: ctx}
 
-	output, err := callback(ctx, hookInput, toolUseID, hookCtx)
-	if err != nil {
-		return nil, err
-	}
+	return callback(ctx, hookInput, toolUseID, hookCtx)
+}
+
+// hookResponse converts a hook output to its control response payload.
+func hookResponse(output *HookJSONOutput) map[string]any {
 	if output == nil {
-		return map[string]any{}, nil
+		return map[string]any{}
 	}
-
-	return convertHookOutputForCLI(output), nil
+	return convertHookOutputForCLI(output)
 }
 
 func (q *queryHandler) handleMcpMessage(ctx context.Context, request map[string]any) (map[string]any, error) {
@@ -396,7 +663,11 @@ func (q *queryHandler) sendControlRequest(ctx context.Context, request map[strin
 	// Create pending request
 	pending := &pendingRequest{done: make(chan struct{})}
 	q.pendingRequests.Store(requestID, pending)
-	defer q.pendingRequests.Delete(requestID)
+	storeMax(&q.pendingHighWater, q.pendingCount.Add(1))
+	defer func() {
+		q.pendingRequests.Delete(requestID)
+		q.pendingCount.Add(-1)
+	}()
 
 	// Build and send control request
 	controlRequest := map[string]any{
@@ -429,7 +700,7 @@ func (q *queryHandler) sendControlRequest(ctx context.Context, request map[strin
 		return resp, nil
 	case <-timer.C:
 		subtype, _ := request["subtype"].(string)
-		return nil, fmt.Errorf("control request timeout: %s", subtype)
+		return nil, fmt.Errorf("%w: %s", errControlRequestTimeout, subtype)
 	case <-ctx.Done():
 		return nil, ctx.Err()
 	}
@@ -445,11 +716,21 @@ func (q *queryHandler) initialize(ctx context.Context) (map[string]any, error) {
 			}
 			var matcherConfigs []map[string]any
 			for _, matcher := range matchers {
+				pattern, err := compileHookMatcher(matcher.Matcher)
+				if err != nil {
+					return nil, &SDKError{Message: fmt.Sprintf("invalid %s hook matcher %q", event, matcher.Matcher), Cause: err}
+				}
 				callbackIDs := make([]string, len(matcher.Hooks))
 				for i, callback := range matcher.Hooks {
 					callbackID := fmt.Sprintf("hook_%d", q.nextCallbackID)
 					q.nextCallbackID++
 					q.hookCallbacks[callbackID] = callback
+					if matcher.Timeout != nil {
+						q.hookTimeouts[callbackID] = time.Duration(*matcher.Timeout * float64(time.Second))
+					}
+					if pattern != nil {
+						q.hookMatchers[callbackID] = pattern
+					}
 					callbackIDs[i] = callbackID
 				}
 				mc := map[string]any{
@@ -477,10 +758,57 @@ func (q *queryHandler) initialize(ctx context.Context) (map[string]any, error) {
 	if err != nil {
 		return nil, err
 	}
+	// Older CLIs do not report a version; it is then treated as unknown.
+	version, ok := resp["version"].(string)
+	if !ok && q.requireVersion {
+		return nil, &CLIConnectionError{SDKError: SDKError{Message: "initialize response did not include the Claude Code version"}}
+	}
+	if ok && !q.skipVersionCheck {
+		if err := checkCLIVersion(version); err != nil {
+			return nil, err
+		}
+	}
 	q.initResult = resp
+	q.markReady()
 	return resp, nil
 }
 
+// cliVersion returns the version reported in the initialize response, or ""
+// before initialize completes or when the CLI did not report one.
+func (q *queryHandler) cliVersion() string {
+	if !q.isReady() {
+		return ""
+	}
+	version, _ := q.initResult["version"].(string)
+	return version
+}
+
+func (q *queryHandler) markReady() {
+	q.readyOnce.Do(func() {
+		close(q.readyChan)
+	})
+}
+
+func (q *queryHandler) isReady() bool {
+	select {
+	case <-q.readyChan:
+		return true
+	default:
+		return false
+	}
+}
+
+func (q *queryHandler) waitReady(ctx context.Context) error {
+	select {
+	case <-q.readyChan:
+		return nil
+	case <-q.closeChan:
+		return &CLIConnectionError{SDKError: SDKError{Message: "Connection closed before the initialize handshake completed", Cause: q.err()}}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (q *queryHandler) interrupt(ctx context.Context) error {
 	_, err := q.sendControlRequest(ctx, map[string]any{"subtype": "interrupt"}, 60.0)
 	return err
@@ -504,7 +832,12 @@ func (q *queryHandler) setModelOptional(ctx context.Context, model any) error {
 		"subtype": "set_model",
 		"model":   model,
 	}, 60.0)
-	return err
+	if err != nil {
+		return err
+	}
+	name, _ := model.(string)
+	q.modelPin.set(name)
+	return nil
 }
 
 func (q *queryHandler) rewindFiles(ctx context.Context, userMessageID string) error {
@@ -515,14 +848,72 @@ func (q *queryHandler) rewindFiles(ctx context.Context, userMessageID string) er
 	return err
 }
 
-func (q *queryHandler) getMcpStatus(ctx context.Context) (map[string]any, error) {
-	return q.sendControlRequest(ctx, map[string]any{"subtype": "mcp_status"}, 60.0)
+func (q *queryHandler) getMcpStatus(ctx context.Context) (*MCPStatus, error) {
+	resp, err := q.sendControlRequest(ctx, map[string]any{"subtype": "mcp_status"}, 60.0)
+	if err != nil {
+		return nil, err
+	}
+	return parseMCPStatus(resp), nil
+}
+
+// Override keys recognized on streaming input messages. They are removed from
+// the message and applied with control requests before the message is sent,
+// so the overrides take effect for that turn and every turn after it.
+const (
+	InputOverrideModel          = "_model"           // string, or nil for the CLI default model
+	InputOverridePermissionMode = "_permission_mode" // PermissionMode value
+
+	// InputOverrideCwd is rejected: the working directory belongs to the CLI
+	// process and the stream-json protocol has no per-message or per-session
+	// cwd. Use one client per working directory (WithCwd) instead.
+	InputOverrideCwd = "_cwd"
+)
+
+// applyInputOverrides strips override keys from msg and issues the matching
+// control requests.
+func (q *queryHandler) applyInputOverrides(ctx context.Context, msg map[string]any) error {
+	if _, ok := msg[InputOverrideCwd]; ok {
+		delete(msg, InputOverrideCwd)
+		return ErrPerSessionCwdUnsupported
+	}
+	if raw, ok := msg[InputOverridePermissionMode]; ok {
+		delete(msg, InputOverridePermissionMode)
+		mode, _ := raw.(string)
+		if mode == "" {
+			return &SDKError{Message: fmt.Sprintf("invalid %s override: %v", InputOverridePermissionMode, raw)}
+		}
+		if err := q.setPermissionMode(ctx, mode); err != nil {
+			return err
+		}
+	}
+	if raw, ok := msg[InputOverrideModel]; ok {
+		delete(msg, InputOverrideModel)
+		switch model := raw.(type) {
+		case nil:
+			if err := q.setModelOptional(ctx, nil); err != nil {
+				return err
+			}
+		case string:
+			if err := q.setModelOptional(ctx, model); err != nil {
+				return err
+			}
+		default:
+			return &SDKError{Message: fmt.Sprintf("invalid %s override: %v", InputOverrideModel, raw)}
+		}
+	}
+	return nil
 }
 
 func (q *queryHandler) receiveMessages() <-chan map[string]any {
 	return q.msgChan
 }
 
+// needsOpenInput reports whether the CLI may send control requests that the
+// SDK answers over stdin, so stdin must stay open until the first result.
+func (q *queryHandler) needsOpenInput() bool {
+	return q.canUseTool != nil || len(q.hooks) > 0 || len(q.sdkMcpServers) > 0
+}
+
 func (q *queryHandler) streamInput(ctx context.Context, messages <-chan map[string]any) {
 	for {
 		select {
@@ -531,10 +922,9 @@ func (q *queryHandler) streamInput(ctx context.Context, messages <-chan map[stri
 		case msg, ok := <-messages:
 			if !ok {
 				// Input stream ended
-				hasHooks := len(q.hooks) > 0
-				if len(q.sdkMcpServers) > 0 || hasHooks {
-					log.Printf("Waiting for first result before closing stdin (sdk_mcp_servers=%d, has_hooks=%v)",
-						len(q.sdkMcpServers), hasHooks)
+				if q.needsOpenInput() {
+					q.logger.Debugf("Waiting for first result before closing stdin (sdk_mcp_servers=%d, has_hooks=%v, has_can_use_tool=%v)",
+						len(q.sdkMcpServers), len(q.hooks) > 0, q.canUseTool != nil)
 					select {
 					case <-q.firstResultChan:
 					case <-time.After(time.Duration(q.streamCloseTimeout * float64(time.Second))):
@@ -547,6 +937,10 @@ func (q *queryHandler) streamInput(ctx context.Context, messages <-chan map[stri
 			if q.closed.Load() {
 				return
 			}
+			if err := q.applyInputOverrides(ctx, msg); err != nil {
+				q.pushErrorMessage(ctx, err)
+				return
+			}
 			data, _ := json.Marshal(msg)
 			q.writeMu.Lock()
 			_ = q.transport.Write(string(data) + "\n")
@@ -670,6 +1064,16 @@ func parseHookInput(m map[string]any) HookInput {
 	return input
 }
 
+// compileHookMatcher compiles a HookMatcher pattern, anchored so that "Bash"
+// matches only the Bash tool, as the CLI does. It returns nil for "" and "*",
+// which match every tool.
+func compileHookMatcher(matcher string) (*regexp.Regexp, error) {
+	if matcher == "" || matcher == "*" {
+		return nil, nil
+	}
+	return regexp.Compile("^(?:" + matcher + ")$")
+}
+
 // convertHookOutputForCLI converts a HookJSONOutput to a map for the CLI.
 func convertHookOutputForCLI(output *HookJSONOutput) map[string]any {
 	result := map[string]any{}
@@ -724,14 +1128,59 @@ func convertHookOutputForCLI(output *HookJSONOutput) map[string]any {
 	return result
 }
 
+// close shuts the handler down. It is safe to call concurrently and more than
+// once; every caller returns only after shutdown has finished. Ordering:
+//  1. mark closed and release anyone blocked delivering to msgChan,
+//  2. fail pending control requests,
+//  3. cancel the read loop and wait for it to exit (msgChan is closed there),
+//  4. close the transport.
 func (q *queryHandler) close() {
-	q.closed.Store(true)
-	q.failPendingRequests(fmt.Errorf("query handler closed"))
-	if q.cancel != nil {
-		q.cancel()
+	q.closeOnce.Do(func() {
+		q.closed.Store(true)
+		close(q.closeChan)
+		q.failPendingRequests(fmt.Errorf("query handler closed"))
+		if q.cancel != nil {
+			q.cancel()
+		}
+		q.wg.Wait()
+		_ = q.transport.Close()
+	})
+}
+
+// metrics reports current and high-water queue depths.
+func (q *queryHandler) metrics() ChannelMetrics {
+	return ChannelMetrics{
+		MessageQueueDepth:         len(q.msgChan),
+		MessageQueueHighWater:     int(q.msgHighWater.Load()),
+		MessageQueueCapacity:      cap(q.msgChan),
+		PendingControlRequests:    int(q.pendingCount.Load()),
+		PendingControlRequestsMax: int(q.pendingHighWater.Load()),
+	}
+}
+
+// tolerateParseError reports whether err is a *MessageParseError that still
+// fits in the maxErrors budget for this connection, logging it if so.
+func (q *queryHandler) tolerateParseError(maxErrors int, err error) bool {
+	var parseErr *MessageParseError
+	if maxErrors <= 0 || !errors.As(err, &parseErr) {
+		return false
+	}
+	n := q.parseErrors.Add(1)
+	if n > int64(maxErrors) {
+		return false
+	}
+	q.logger.Warnf("Skipping unparseable message (%d of %d tolerated): %v", n, maxErrors, err)
+	return true
+}
+
+// storeMax raises v to n if n is larger.
+func storeMax(v *atomic.Int64, n int64) {
+	for {
+		cur := v.Load()
+		if n <= cur || v.CompareAndSwap(cur, n) {
+			return
+		}
 	}
-	q.wg.Wait()
-	_ = q.transport.Close()
 }
 
 func (q *queryHandler) pushErrorMessage(ctx context.Context, err error) {
@@ -742,8 +1191,10 @@ func (q *queryHandler) pushErrorMessage(ctx context.Context, err error) {
 	case q.msgChan <- map[string]any{
 		"type":  "error",
 		"error": err.Error(),
+		"cause": err,
 	}:
 	case <-ctx.Done():
+	case <-q.closeChan:
 	}
 }
 
@@ -769,19 +1220,9 @@ func (q *queryHandler) failPendingRequests(err error) {
 		return
 	}
 	q.pendingRequests.Range(func(_, value any) bool {
-		pending, ok := value.(*pendingRequest)
-		if !ok {
-			return true
-		}
-		if pending.err == nil {
-			pending.err = err
+		if pending, ok := value.(*pendingRequest); ok {
+			pending.resolve(nil, err)
 		}
-		safeClose(pending.done)
 		return true
 	})
 }
-
-func safeClose(ch chan struct{}) {
-	defer func() { _ = recover() }()
-	close(ch)
-}
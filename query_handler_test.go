@@ -5,7 +5,10 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"reflect"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -144,6 +147,20 @@ func TestConvertHookOutputForCLI(t *testing.T) {
 	}
 }
 
+func TestNewStopHookContinue(t *testing.T) {
+	result := convertHookOutputForCLI(NewStopHookContinue("tests have not been run"))
+
+	if result["decision"] != "block" {
+		t.Errorf("expected decision='block', got %v", result["decision"])
+	}
+	if result["reason"] != "tests have not been run" {
+		t.Errorf("expected reason to be forwarded, got %v", result["reason"])
+	}
+	if _, ok := result["continue"]; ok {
+		t.Errorf("expected continue to be unset, got %v", result["continue"])
+	}
+}
+
 func TestConvertHookOutputForCLINil(t *testing.T) {
 	output := &HookJSONOutput{}
 	result := convertHookOutputForCLI(output)
@@ -179,10 +196,16 @@ func (m *mockTransport) Write(data string) error {
 func (m *mockTransport) Messages() <-chan map[string]any { return m.msgChan }
 func (m *mockTransport) Errors() <-chan error            { return m.errChan }
 func (m *mockTransport) LastError() error                { return m.lastErr }
-func (m *mockTransport) Close() error                    { m.closed = true; return nil }
 func (m *mockTransport) EndInput() error                 { return nil }
 func (m *mockTransport) IsReady() bool                   { return true }
 
+func (m *mockTransport) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	return nil
+}
+
 func (m *mockTransport) getWritten() []string {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -242,6 +265,49 @@ func TestQueryHandlerCanUseTool(t *testing.T) {
 	}
 }
 
+func TestQueryHandlerCanUseToolCancelled(t *testing.T) {
+	mt := newMockTransport()
+	entered := make(chan struct{})
+	signalled := make(chan struct{})
+	handler := newQueryHandler(mt, queryOptions{
+		CanUseTool: func(ctx context.Context, toolName string, input map[string]any, permCtx ToolPermissionContext) (PermissionResult, error) {
+			close(entered)
+			select {
+			case <-permCtx.Signal.Done():
+				close(signalled)
+				return nil, permCtx.Signal.Err()
+			case <-time.After(2 * time.Second):
+				return &PermissionResultAllow{}, nil
+			}
+		},
+	})
+	_ = handler.start(context.Background())
+	defer handler.close()
+
+	mt.msgChan <- map[string]any{
+		"type":       "control_request",
+		"request_id": "req_ask",
+		"request":    map[string]any{"subtype": "can_use_tool", "tool_name": "Bash", "input": map[string]any{}},
+	}
+	<-entered
+	mt.msgChan <- map[string]any{"type": "control_cancel_request", "request_id": "req_ask"}
+
+	select {
+	case <-signalled:
+	case <-time.After(time.Second):
+		t.Fatal("expected the permission Signal to be cancelled")
+	}
+	time.Sleep(20 * time.Millisecond)
+	for _, line := range mt.getWritten() {
+		if strings.Contains(line, "req_ask") {
+			t.Errorf("expected no response to a cancelled request, got %s", line)
+		}
+	}
+	if _, ok := handler.inflight.Load("req_ask"); ok {
+		t.Error("expected the cancelled request to be forgotten")
+	}
+}
+
 func TestQueryHandlerMcpMessage(t *testing.T) {
 	addTool := NewMCPTool("add", "Add two numbers",
 		map[string]any{
@@ -402,3 +468,809 @@ func TestQueryHandlerPropagatesContextCancellationAsError(t *testing.T) {
 		t.Fatalf("expected read error context canceled, got %v", handler.err())
 	}
 }
+
+func TestQueryHandlerConcurrentCloseDuringReads(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		mt := newMockTransport()
+		handler := newQueryHandler(mt, queryOptions{})
+		_ = handler.start(context.Background())
+
+		stop := make(chan struct{})
+		var producers sync.WaitGroup
+		producers.Add(1)
+		go func() {
+			defer producers.Done()
+			for n := 0; ; n++ {
+				msg := map[string]any{"type": "assistant", "n": n}
+				if n%3 == 0 {
+					msg = map[string]any{
+						"type":     "control_response",
+						"response": map[string]any{"subtype": "success", "request_id": "req_1"},
+					}
+				}
+				select {
+				case mt.msgChan <- msg:
+				case <-stop:
+					return
+				}
+			}
+		}()
+
+		// A pending control request racing with close.
+		go func() {
+			_, _ = handler.sendControlRequest(context.Background(), map[string]any{"subtype": "interrupt"}, 5)
+		}()
+
+		// Slow reader that stops early so the handler can block on a full channel.
+		go func() {
+			for n := 0; n < 5; n++ {
+				if _, ok := <-handler.receiveMessages(); !ok {
+					return
+				}
+			}
+		}()
+
+		time.Sleep(time.Millisecond)
+		var closers sync.WaitGroup
+		for c := 0; c < 3; c++ {
+			closers.Add(1)
+			go func() {
+				defer closers.Done()
+				handler.close()
+			}()
+		}
+
+		done := make(chan struct{})
+		go func() {
+			closers.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatal("concurrent close did not return")
+		}
+		close(stop)
+		producers.Wait()
+	}
+}
+
+func TestQueryHandlerCloseAfterCancelWithFullChannel(t *testing.T) {
+	mt := newMockTransport()
+	handler := newQueryHandler(mt, queryOptions{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	_ = handler.start(ctx)
+
+	// Fill the handler's output channel with nobody reading.
+	for i := 0; i < cap(handler.msgChan); i++ {
+		mt.msgChan <- map[string]any{"type": "assistant"}
+	}
+	deadline := time.After(2 * time.Second)
+	for len(handler.msgChan) < cap(handler.msgChan) {
+		select {
+		case <-deadline:
+			t.Fatal("timeout filling handler channel")
+		default:
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// The read loop now blocks trying to report the cancellation.
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		handler.close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("close deadlocked while the read loop reported cancellation")
+	}
+}
+
+// ackControlRequests answers every control request written to mt with success
+// until stop is closed.
+func ackControlRequests(mt *mockTransport, stop <-chan struct{}) {
+	acked := 0
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(time.Millisecond):
+		}
+		written := mt.getWritten()
+		for ; acked < len(written); acked++ {
+			var req map[string]any
+			if json.Unmarshal([]byte(written[acked]), &req) != nil || req["type"] != "control_request" {
+				continue
+			}
+			mt.msgChan <- map[string]any{
+				"type":     "control_response",
+				"response": map[string]any{"subtype": "success", "request_id": req["request_id"]},
+			}
+		}
+	}
+}
+
+func TestQueryHandlerStreamInputOverrides(t *testing.T) {
+	mt := newMockTransport()
+	handler := newQueryHandler(mt, queryOptions{})
+	ctx := context.Background()
+	_ = handler.start(ctx)
+	defer handler.close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go ackControlRequests(mt, stop)
+
+	input := make(chan map[string]any, 1)
+	input <- map[string]any{
+		"type":                      "user",
+		"message":                   map[string]any{"role": "user", "content": "hi"},
+		InputOverrideModel:          "claude-haiku-4-5",
+		InputOverridePermissionMode: "plan",
+	}
+	close(input)
+	handler.streamInput(ctx, input)
+
+	written := mt.getWritten()
+	if len(written) != 3 {
+		t.Fatalf("expected 2 control requests and 1 user message, got %d writes: %v", len(written), written)
+	}
+	var subtypes []string
+	for _, line := range written[:2] {
+		var req map[string]any
+		_ = json.Unmarshal([]byte(line), &req)
+		request, _ := req["request"].(map[string]any)
+		subtype, _ := request["subtype"].(string)
+		subtypes = append(subtypes, subtype)
+	}
+	if subtypes[0] != "set_permission_mode" || subtypes[1] != "set_model" {
+		t.Errorf("expected set_permission_mode then set_model, got %v", subtypes)
+	}
+	var user map[string]any
+	_ = json.Unmarshal([]byte(written[2]), &user)
+	if user["type"] != "user" {
+		t.Errorf("expected user message last, got %v", user["type"])
+	}
+	if _, ok := user[InputOverrideModel]; ok {
+		t.Error("expected override keys to be stripped from the user message")
+	}
+}
+
+func TestQueryHandlerStreamInputRejectsOverride(t *testing.T) {
+	tests := []struct {
+		name     string
+		key      string
+		value    any
+		sentinel error
+	}{
+		{name: "per-session cwd", key: InputOverrideCwd, value: "/tmp/other", sentinel: ErrPerSessionCwdUnsupported},
+		{name: "non-string model", key: InputOverrideModel, value: 5},
+		{name: "empty permission mode", key: InputOverridePermissionMode, value: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mt := newMockTransport()
+			handler := newQueryHandler(mt, queryOptions{})
+			ctx := context.Background()
+			_ = handler.start(ctx)
+			defer handler.close()
+
+			input := make(chan map[string]any, 2)
+			input <- map[string]any{
+				"type":    "user",
+				"message": map[string]any{"role": "user", "content": "hi"},
+				tt.key:    tt.value,
+			}
+			input <- map[string]any{
+				"type":    "user",
+				"message": map[string]any{"role": "user", "content": "after"},
+			}
+			close(input)
+			handler.streamInput(ctx, input)
+
+			if written := mt.getWritten(); len(written) != 0 {
+				t.Fatalf("expected nothing written, got %v", written)
+			}
+			select {
+			case raw := <-handler.receiveMessages():
+				_, err := parseMessage(raw)
+				if err == nil {
+					t.Fatal("expected the error message to parse into an error")
+				}
+				if tt.sentinel != nil && !errors.Is(err, tt.sentinel) {
+					t.Errorf("expected %v, got %v", tt.sentinel, err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("expected an error message")
+			}
+		})
+	}
+}
+
+func TestQueryHandlerInitializeVersion(t *testing.T) {
+	tests := []struct {
+		name        string
+		require     bool
+		skip        bool
+		response    map[string]any
+		wantErr     bool
+		wantVersion string
+	}{
+		{name: "missing version is unknown", response: map[string]any{}},
+		{name: "missing version required", require: true, response: map[string]any{}, wantErr: true},
+		{name: "non-string version required", require: true, response: map[string]any{"version": 2.0}, wantErr: true},
+		{name: "reported version", require: true, response: map[string]any{"version": "2.1.0"}, wantVersion: "2.1.0"},
+		{name: "above minimum", response: map[string]any{"version": "2.0.14 (Claude Code)"}, wantVersion: "2.0.14 (Claude Code)"},
+		{name: "equal to minimum", response: map[string]any{"version": MinimumClaudeCodeVersion}, wantVersion: MinimumClaudeCodeVersion},
+		{name: "below minimum", response: map[string]any{"version": "1.0.128"}, wantErr: true},
+		{name: "malformed", response: map[string]any{"version": "two.oh"}, wantErr: true},
+		{name: "below minimum skipped", skip: true, response: map[string]any{"version": "1.0.128"}, wantVersion: "1.0.128"},
+		{name: "malformed skipped", skip: true, response: map[string]any{"version": "two.oh"}, wantVersion: "two.oh"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mt := newMockTransport()
+			handler := newQueryHandler(mt, queryOptions{RequireVersion: tt.require, SkipVersionCheck: tt.skip})
+			_ = handler.start(context.Background())
+			defer handler.close()
+
+			go respondToInitialize(mt, tt.response)
+
+			_, err := handler.initialize(context.Background())
+			if tt.wantErr {
+				var connErr *CLIConnectionError
+				if !errors.As(err, &connErr) || !strings.Contains(err.Error(), "version") {
+					t.Fatalf("expected CLIConnectionError about the version, got %v", err)
+				}
+				if handler.isReady() {
+					t.Error("expected handler not to be ready after a failed initialize")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("initialize failed: %v", err)
+			}
+			if got := handler.cliVersion(); got != tt.wantVersion {
+				t.Errorf("expected version %q, got %q", tt.wantVersion, got)
+			}
+		})
+	}
+}
+
+func TestQueryHandlerWaitReadyReturnsOnClose(t *testing.T) {
+	handler := newQueryHandler(newMockTransport(), queryOptions{})
+	_ = handler.start(context.Background())
+
+	done := make(chan error, 1)
+	go func() { done <- handler.waitReady(context.Background()) }()
+	handler.close()
+
+	select {
+	case err := <-done:
+		var connErr *CLIConnectionError
+		if !errors.As(err, &connErr) {
+			t.Errorf("expected CLIConnectionError, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("waitReady did not return after close")
+	}
+}
+
+// respondToInitialize answers the first control request written to mt with a
+// success carrying response.
+func respondToInitialize(mt *mockTransport, response map[string]any) {
+	for {
+		for _, w := range mt.getWritten() {
+			var req map[string]any
+			if json.Unmarshal([]byte(w), &req) == nil && req["type"] == "control_request" {
+				mt.msgChan <- map[string]any{
+					"type": "control_response",
+					"response": map[string]any{
+						"subtype":    "success",
+						"request_id": req["request_id"],
+						"response":   response,
+					},
+				}
+				return
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestQueryHandlerGlobalTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	blockingHook := func(ctx context.Context, input HookInput, toolUseID string, hookCtx HookContext) (*HookJSONOutput, error) {
+		<-release // ignores ctx on purpose
+		return &HookJSONOutput{}, nil
+	}
+	slowHook := func(ctx context.Context, input HookInput, toolUseID string, hookCtx HookContext) (*HookJSONOutput, error) {
+		time.Sleep(100 * time.Millisecond)
+		return &HookJSONOutput{}, nil
+	}
+	override := 5.0
+
+	mt := newMockTransport()
+	handler := newQueryHandler(mt, queryOptions{
+		CallbackTimeout: 20 * time.Millisecond,
+		CanUseTool: func(ctx context.Context, toolName string, input map[string]any, permCtx ToolPermissionContext) (PermissionResult, error) {
+			<-release
+			return &PermissionResultAllow{}, nil
+		},
+		Hooks: map[string][]hookMatcherConfig{
+			"PreToolUse":  {{Matcher: "Bash", Hooks: []HookCallback{blockingHook}}},
+			"PostToolUse": {{Matcher: "Bash", Hooks: []HookCallback{slowHook}, Timeout: &override}},
+		},
+	})
+	ctx := context.Background()
+	_ = handler.start(ctx)
+	defer handler.close()
+	go respondToInitialize(mt, map[string]any{})
+	if _, err := handler.initialize(ctx); err != nil {
+		t.Fatalf("initialize failed: %v", err)
+	}
+	// Map IDs are assigned in map order; find the blocking hook's.
+	blockingID, slowID := "hook_0", "hook_1"
+	if _, ok := handler.hookTimeouts["hook_0"]; ok {
+		blockingID, slowID = slowID, blockingID
+	}
+
+	tests := []struct {
+		name    string
+		request map[string]any
+		wantErr string
+	}{
+		{"blocking permission", map[string]any{"subtype": "can_use_tool", "tool_name": "Bash", "input": map[string]any{}}, "permission callback timed out after 20ms"},
+		{"blocking hook", map[string]any{"subtype": "hook_callback", "callback_id": blockingID}, "hook callback timed out after 20ms"},
+		{"hook with its own timeout", map[string]any{"subtype": "hook_callback", "callback_id": slowID}, ""},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requestID := fmt.Sprintf("timeout_%d", i)
+			mt.msgChan <- map[string]any{"type": "control_request", "request_id": requestID, "request": tt.request}
+
+			deadline := time.After(2 * time.Second)
+			for {
+				select {
+				case <-deadline:
+					t.Fatalf("no response to %s", requestID)
+				case <-time.After(time.Millisecond):
+				}
+				for _, line := range mt.getWritten() {
+					var msg map[string]any
+					_ = json.Unmarshal([]byte(line), &msg)
+					response, _ := msg["response"].(map[string]any)
+					if msg["type"] != "control_response" || response["request_id"] != requestID {
+						continue
+					}
+					if tt.wantErr == "" {
+						if response["subtype"] != "success" {
+							t.Errorf("expected success, got %v", response)
+						}
+					} else if response["subtype"] != "error" || response["error"] != tt.wantErr {
+						t.Errorf("expected error %q, got %v", tt.wantErr, response)
+					}
+					return
+				}
+			}
+		})
+	}
+}
+
+func TestQueryHandlerHookSignalTimeout(t *testing.T) {
+	signalErr := make(chan error, 1)
+	hook := func(ctx context.Context, input HookInput, toolUseID string, hookCtx HookContext) (*HookJSONOutput, error) {
+		select {
+		case <-hookCtx.Signal.Done():
+			signalErr <- hookCtx.Signal.Err()
+			return nil, hookCtx.Signal.Err()
+		case <-time.After(2 * time.Second):
+			signalErr <- nil
+			return &HookJSONOutput{}, nil
+		}
+	}
+	timeout := 0.03
+
+	mt := newMockTransport()
+	handler := newQueryHandler(mt, queryOptions{
+		Hooks: map[string][]hookMatcherConfig{
+			"PreToolUse": {{Matcher: "Bash", Hooks: []HookCallback{hook}, Timeout: &timeout}},
+		},
+	})
+	ctx := context.Background()
+	_ = handler.start(ctx)
+	defer handler.close()
+	go respondToInitialize(mt, map[string]any{})
+	if _, err := handler.initialize(ctx); err != nil {
+		t.Fatalf("initialize failed: %v", err)
+	}
+
+	start := time.Now()
+	mt.msgChan <- map[string]any{
+		"type":       "control_request",
+		"request_id": "hook_req",
+		"request":    map[string]any{"subtype": "hook_callback", "callback_id": "hook_0"},
+	}
+	if err := <-signalErr; !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the hook Signal to hit its deadline, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Signal fired after %s, want about 30ms", elapsed)
+	}
+}
+
+func TestQueryHandlerHookMatcher(t *testing.T) {
+	var mu sync.Mutex
+	called := map[string][]string{}
+	record := func(name string) HookCallback {
+		return func(ctx context.Context, input HookInput, toolUseID string, hookCtx HookContext) (*HookJSONOutput, error) {
+			mu.Lock()
+			called[name] = append(called[name], input.ToolName)
+			mu.Unlock()
+			return &HookJSONOutput{}, nil
+		}
+	}
+
+	mt := newMockTransport()
+	handler := newQueryHandler(mt, queryOptions{
+		Hooks: map[string][]hookMatcherConfig{
+			"PreToolUse": {
+				{Matcher: "Write|Edit", Hooks: []HookCallback{record("edits")}},
+				{Matcher: "Bash", Hooks: []HookCallback{record("bash")}},
+				{Matcher: "mcp__.*", Hooks: []HookCallback{record("mcp")}},
+				{Matcher: "", Hooks: []HookCallback{record("all")}},
+			},
+		},
+	})
+	ctx := context.Background()
+	_ = handler.start(ctx)
+	defer handler.close()
+	go respondToInitialize(mt, map[string]any{})
+	if _, err := handler.initialize(ctx); err != nil {
+		t.Fatalf("initialize failed: %v", err)
+	}
+
+	for _, tool := range []string{"Write", "Edit", "Bash", "BashOutput", "mcp__kv__get", "Read"} {
+		for id := range 4 {
+			request := map[string]any{
+				"subtype":     "hook_callback",
+				"callback_id": fmt.Sprintf("hook_%d", id),
+				"input":       map[string]any{"hook_event_name": "PreToolUse", "tool_name": tool},
+			}
+			if _, err := handler.handleHookCallback(ctx, request); err != nil {
+				t.Fatalf("hook callback for %s: %v", tool, err)
+			}
+		}
+	}
+
+	want := map[string][]string{
+		"edits": {"Write", "Edit"},
+		"bash":  {"Bash"},
+		"mcp":   {"mcp__kv__get"},
+		"all":   {"Write", "Edit", "Bash", "BashOutput", "mcp__kv__get", "Read"},
+	}
+	if !reflect.DeepEqual(called, want) {
+		t.Errorf("callbacks ran for %v, want %v", called, want)
+	}
+}
+
+func TestQueryHandlerInvalidHookMatcher(t *testing.T) {
+	mt := newMockTransport()
+	handler := newQueryHandler(mt, queryOptions{
+		Hooks: map[string][]hookMatcherConfig{
+			"PreToolUse": {{Matcher: "Bash(", Hooks: []HookCallback{func(ctx context.Context, input HookInput, toolUseID string, hookCtx HookContext) (*HookJSONOutput, error) {
+				return nil, nil
+			}}}},
+		},
+	})
+	_ = handler.start(context.Background())
+	defer handler.close()
+	if _, err := handler.initialize(context.Background()); err == nil || !strings.Contains(err.Error(), "invalid PreToolUse hook matcher") {
+		t.Errorf("expected an invalid matcher error, got %v", err)
+	}
+}
+
+func TestQueryHandlerAsyncHook(t *testing.T) {
+	release := make(chan struct{})
+	cancelled := make(chan struct{})
+	hooks := []HookCallback{
+		func(ctx context.Context, input HookInput, toolUseID string, hookCtx HookContext) (*HookJSONOutput, error) {
+			return NewAsyncHookOutput(time.Second, func(ctx context.Context) (*HookJSONOutput, error) {
+				<-release
+				return &HookJSONOutput{SystemMessage: "audit logged"}, nil
+			}), nil
+		},
+		func(ctx context.Context, input HookInput, toolUseID string, hookCtx HookContext) (*HookJSONOutput, error) {
+			return NewAsyncHookOutput(30*time.Millisecond, func(ctx context.Context) (*HookJSONOutput, error) {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}), nil
+		},
+		func(ctx context.Context, input HookInput, toolUseID string, hookCtx HookContext) (*HookJSONOutput, error) {
+			return NewAsyncHookOutput(time.Minute, func(ctx context.Context) (*HookJSONOutput, error) {
+				<-ctx.Done()
+				close(cancelled)
+				return nil, ctx.Err()
+			}), nil
+		},
+	}
+
+	mt := newMockTransport()
+	handler := newQueryHandler(mt, queryOptions{
+		Hooks: map[string][]hookMatcherConfig{"PostToolUse": {{Hooks: hooks}}},
+	})
+	ctx := context.Background()
+	_ = handler.start(ctx)
+	defer handler.close()
+	go respondToInitialize(mt, map[string]any{})
+	if _, err := handler.initialize(ctx); err != nil {
+		t.Fatalf("initialize failed: %v", err)
+	}
+
+	// responses returns the control responses written for requestID so far.
+	responses := func(requestID string) []map[string]any {
+		var out []map[string]any
+		for _, line := range mt.getWritten() {
+			var msg map[string]any
+			_ = json.Unmarshal([]byte(line), &msg)
+			if response, _ := msg["response"].(map[string]any); msg["type"] == "control_response" && response["request_id"] == requestID {
+				out = append(out, response)
+			}
+		}
+		return out
+	}
+	waitFor := func(requestID string, n int) []map[string]any {
+		t.Helper()
+		deadline := time.After(2 * time.Second)
+		for {
+			if got := responses(requestID); len(got) >= n {
+				return got
+			}
+			select {
+			case <-deadline:
+				t.Fatalf("expected %d responses to %s, got %v", n, requestID, responses(requestID))
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}
+
+	mt.msgChan <- map[string]any{"type": "control_request", "request_id": "async_ok", "request": map[string]any{"subtype": "hook_callback", "callback_id": "hook_0"}}
+	ack := waitFor("async_ok", 1)[0]
+	ackData, _ := ack["response"].(map[string]any)
+	if ack["subtype"] != "success" || ackData["async"] != true || ackData["asyncTimeout"] != float64(1000) {
+		t.Fatalf("expected an async acknowledgement, got %v", ack)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if got := responses("async_ok"); len(got) != 1 {
+		t.Fatalf("expected completion to wait for the work, got %v", got)
+	}
+	close(release)
+	done := waitFor("async_ok", 2)[1]
+	doneData, _ := done["response"].(map[string]any)
+	if done["subtype"] != "success" || doneData["systemMessage"] != "audit logged" {
+		t.Errorf("expected the completion output, got %v", done)
+	}
+
+	mt.msgChan <- map[string]any{"type": "control_request", "request_id": "async_slow", "request": map[string]any{"subtype": "hook_callback", "callback_id": "hook_1"}}
+	timedOut := waitFor("async_slow", 2)[1]
+	if timedOut["subtype"] != "error" || timedOut["error"] != "async hook callback timed out after 30ms" {
+		t.Errorf("expected a timeout completion, got %v", timedOut)
+	}
+
+	// Withdrawing the request after the acknowledgement stops its AsyncWork.
+	mt.msgChan <- map[string]any{"type": "control_request", "request_id": "async_cancel", "request": map[string]any{"subtype": "hook_callback", "callback_id": "hook_2"}}
+	waitFor("async_cancel", 1)
+	mt.msgChan <- map[string]any{"type": "control_cancel_request", "request_id": "async_cancel"}
+	select {
+	case <-cancelled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected control_cancel_request to cancel the async work")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if got := responses("async_cancel"); len(got) != 1 {
+		t.Errorf("expected no completion for a withdrawn request, got %v", got)
+	}
+}
+
+func TestQueryHandlerCallbackPanic(t *testing.T) {
+	panicking := func(ctx context.Context, input HookInput, toolUseID string, hookCtx HookContext) (*HookJSONOutput, error) {
+		panic("boom")
+	}
+	for _, timeout := range []time.Duration{0, time.Second} {
+		t.Run(fmt.Sprintf("timeout %s", timeout), func(t *testing.T) {
+			mt := newMockTransport()
+			handler := newQueryHandler(mt, queryOptions{
+				CallbackTimeout: timeout,
+				Hooks:           map[string][]hookMatcherConfig{"PreToolUse": {{Hooks: []HookCallback{panicking}}}},
+			})
+			_ = handler.start(context.Background())
+			defer handler.close()
+			go respondToInitialize(mt, map[string]any{})
+			if _, err := handler.initialize(context.Background()); err != nil {
+				t.Fatalf("initialize failed: %v", err)
+			}
+
+			mt.msgChan <- map[string]any{"type": "control_request", "request_id": "panic_req", "request": map[string]any{"subtype": "hook_callback", "callback_id": "hook_0"}}
+			deadline := time.After(2 * time.Second)
+			for {
+				for _, line := range mt.getWritten() {
+					var msg map[string]any
+					_ = json.Unmarshal([]byte(line), &msg)
+					if response, _ := msg["response"].(map[string]any); response["request_id"] == "panic_req" {
+						if response["subtype"] != "error" || response["error"] != "hook callback panicked: boom" {
+							t.Errorf("expected a panic error response, got %v", response)
+						}
+						return
+					}
+				}
+				select {
+				case <-deadline:
+					t.Fatal("no response to the panicking hook")
+				case <-time.After(time.Millisecond):
+				}
+			}
+		})
+	}
+}
+
+func TestQueryHandlerMaxConcurrentCallbacks(t *testing.T) {
+	var active, peak atomic.Int64
+	hook := func(ctx context.Context, input HookInput, toolUseID string, hookCtx HookContext) (*HookJSONOutput, error) {
+		n := active.Add(1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		active.Add(-1)
+		return &HookJSONOutput{}, nil
+	}
+
+	mt := newMockTransport()
+	handler := newQueryHandler(mt, queryOptions{
+		MaxCallbacks: 2,
+		Hooks:        map[string][]hookMatcherConfig{"PreToolUse": {{Hooks: []HookCallback{hook}}}},
+	})
+	_ = handler.start(context.Background())
+	defer handler.close()
+	go respondToInitialize(mt, map[string]any{})
+	if _, err := handler.initialize(context.Background()); err != nil {
+		t.Fatalf("initialize failed: %v", err)
+	}
+	initWrites := len(mt.getWritten())
+
+	const requests = 6
+	for i := range requests {
+		mt.msgChan <- map[string]any{"type": "control_request", "request_id": fmt.Sprintf("cap_%d", i), "request": map[string]any{"subtype": "hook_callback", "callback_id": "hook_0"}}
+	}
+	deadline := time.After(2 * time.Second)
+	for len(mt.getWritten()) < initWrites+requests {
+		select {
+		case <-deadline:
+			t.Fatalf("expected %d responses, got %d", requests, len(mt.getWritten())-initWrites)
+		case <-time.After(time.Millisecond):
+		}
+	}
+	if got := peak.Load(); got != 2 {
+		t.Errorf("expected at most 2 concurrent callbacks, peak was %d", got)
+	}
+}
+
+func TestQueryHandlerCallbackDeadlineIncludesSlotWait(t *testing.T) {
+	hook := func(ctx context.Context, input HookInput, toolUseID string, hookCtx HookContext) (*HookJSONOutput, error) {
+		time.Sleep(100 * time.Millisecond) // ignores ctx on purpose
+		return &HookJSONOutput{}, nil
+	}
+	mt := newMockTransport()
+	handler := newQueryHandler(mt, queryOptions{
+		MaxCallbacks:    1,
+		CallbackTimeout: 150 * time.Millisecond,
+		Hooks:           map[string][]hookMatcherConfig{"PreToolUse": {{Hooks: []HookCallback{hook}}}},
+	})
+	_ = handler.start(context.Background())
+	defer handler.close()
+	go respondToInitialize(mt, map[string]any{})
+	if _, err := handler.initialize(context.Background()); err != nil {
+		t.Fatalf("initialize failed: %v", err)
+	}
+
+	// The second request waits 100ms for the slot and then overruns its
+	// 150ms budget, although its callback alone would fit.
+	for i := range 2 {
+		mt.msgChan <- map[string]any{"type": "control_request", "request_id": fmt.Sprintf("slot_%d", i), "request": map[string]any{"subtype": "hook_callback", "callback_id": "hook_0"}}
+	}
+	responses := map[any]map[string]any{}
+	deadline := time.After(2 * time.Second)
+	for len(responses) < 2 {
+		select {
+		case <-deadline:
+			t.Fatalf("expected 2 responses, got %v", responses)
+		case <-time.After(time.Millisecond):
+		}
+		for _, line := range mt.getWritten() {
+			var msg map[string]any
+			_ = json.Unmarshal([]byte(line), &msg)
+			if response, _ := msg["response"].(map[string]any); msg["type"] == "control_response" {
+				responses[response["request_id"]] = response
+			}
+		}
+	}
+	if got := responses["slot_0"]["subtype"]; got != "success" {
+		t.Errorf("expected the first request to succeed, got %v", responses["slot_0"])
+	}
+	if got := responses["slot_1"]; got["subtype"] != "error" || !strings.Contains(fmt.Sprint(got["error"]), "timed out") {
+		t.Errorf("expected the second request to time out, got %v", got)
+	}
+}
+
+func TestQueryHandlerCappedCallbackSendsControlRequest(t *testing.T) {
+	var handler *queryHandler
+	mt := newMockTransport()
+	handler = newQueryHandler(mt, queryOptions{
+		MaxCallbacks:    1,
+		CallbackTimeout: 5 * time.Second,
+		CanUseTool: func(ctx context.Context, toolName string, input map[string]any, permCtx ToolPermissionContext) (PermissionResult, error) {
+			if err := handler.setPermissionMode(ctx, "plan"); err != nil {
+				return nil, err
+			}
+			return &PermissionResultAllow{}, nil
+		},
+	})
+	_ = handler.start(context.Background())
+	defer handler.close()
+	stop := make(chan struct{})
+	defer close(stop)
+	go ackControlRequests(mt, stop)
+
+	// The second request waits for the only slot while the first callback
+	// needs the read loop to deliver its set_permission_mode response.
+	for i := range 2 {
+		mt.msgChan <- map[string]any{"type": "control_request", "request_id": fmt.Sprintf("perm_%d", i), "request": map[string]any{"subtype": "can_use_tool", "tool_name": "Bash", "input": map[string]any{}}}
+	}
+	deadline := time.After(2 * time.Second)
+	for {
+		responses := map[any]any{}
+		for _, line := range mt.getWritten() {
+			var msg map[string]any
+			_ = json.Unmarshal([]byte(line), &msg)
+			if response, _ := msg["response"].(map[string]any); msg["type"] == "control_response" {
+				responses[response["request_id"]] = response["subtype"]
+			}
+		}
+		if responses["perm_0"] == "success" && responses["perm_1"] == "success" {
+			return
+		}
+		select {
+		case <-deadline:
+			t.Fatalf("expected both permission requests to succeed, got %v", responses)
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func TestQueryHandlerInitializeTimeout(t *testing.T) {
+	mt := newMockTransport()
+	handler := newQueryHandler(mt, queryOptions{
+		InitializeTimeout: resolveInitializeTimeout(applyOptions([]Option{WithInitializeTimeout(50 * time.Millisecond)})),
+	})
+	_ = handler.start(context.Background())
+	defer handler.close()
+
+	start := time.Now()
+	_, err := handler.initialize(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("expected a timeout error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("initialize took %s, want about 50ms", elapsed)
+	}
+}
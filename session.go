@@ -0,0 +1,51 @@
+package claude
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// claudeConfigDir returns the directory where the CLI started with env keeps
+// its state: env's CLAUDE_CONFIG_DIR, then the SDK process's, then ~/.claude.
+func claudeConfigDir(env map[string]string) string {
+	if dir := env["CLAUDE_CONFIG_DIR"]; dir != "" {
+		return dir
+	}
+	if dir := os.Getenv("CLAUDE_CONFIG_DIR"); dir != "" {
+		return dir
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".claude")
+}
+
+// validateResumeSession checks that the session passed to WithResume has a
+// transcript in the CLI's session store (<config dir>/projects/*/<id>.jsonl).
+// A WithTransport CLI may not share this machine's disk, so it is not checked.
+func validateResumeSession(o *AgentOptions) error {
+	if !o.ValidateResume || o.Resume == "" || o.Transport != nil {
+		return nil
+	}
+	notFound := &SessionNotFoundError{
+		SDKError:  SDKError{Message: "Session not found: " + o.Resume},
+		SessionID: o.Resume,
+	}
+	if filepath.Base(o.Resume) != o.Resume {
+		return notFound
+	}
+	// The ID is looked up literally in each project, never used as a pattern.
+	projects := filepath.Join(claudeConfigDir(o.Env), "projects")
+	entries, err := os.ReadDir(projects)
+	if err != nil {
+		return notFound
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(projects, entry.Name(), o.Resume+".jsonl"))
+		if err == nil && info.Mode().IsRegular() {
+			return nil
+		}
+	}
+	return notFound
+}
@@ -0,0 +1,33 @@
+package claude
+
+import "time"
+
+// SessionEventType identifies a ClaudeClient lifecycle transition.
+type SessionEventType string
+
+const (
+	SessionEventConnected            SessionEventType = "connected"   // CLI process started
+	SessionEventInitialized          SessionEventType = "initialized" // initialize handshake completed
+	SessionEventQuery                SessionEventType = "query"
+	SessionEventResult               SessionEventType = "result"
+	SessionEventInterrupt            SessionEventType = "interrupt"
+	SessionEventModelChange          SessionEventType = "model_change"
+	SessionEventPermissionModeChange SessionEventType = "permission_mode_change"
+	SessionEventClosed               SessionEventType = "closed"
+)
+
+// SessionEvent is one entry of a client's lifecycle timeline.
+type SessionEvent struct {
+	Type      SessionEventType
+	Time      time.Time
+	SessionID string // set for query and result events
+	Detail    string // result subtype, new model or new permission mode
+}
+
+// emitSessionEvent reports a lifecycle transition to the SessionEventLog.
+func (c *ClaudeClient) emitSessionEvent(typ SessionEventType, sessionID, detail string) {
+	if c.options == nil || c.options.SessionEventLog == nil {
+		return
+	}
+	c.options.SessionEventLog(SessionEvent{Type: typ, Time: time.Now(), SessionID: sessionID, Detail: detail})
+}
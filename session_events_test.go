@@ -0,0 +1,64 @@
+package claude
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSessionEventLog(t *testing.T) {
+	cli := writeFakeCLI(t, fakeCLIScript)
+
+	var mu sync.Mutex
+	var events []SessionEvent
+	client := NewClient(WithCLIPath(cli), WithSessionEventLog(func(e SessionEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, e)
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Connect(ctx); err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+	if err := client.SetModel(ctx, "claude-haiku-4-5"); err != nil {
+		t.Fatalf("set model failed: %v", err)
+	}
+	if err := client.QueryWithSession(ctx, "hello", "sess-1"); err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	msgChan, errChan := client.ReceiveResponseWithErrors(ctx)
+	for range msgChan {
+	}
+	if err := <-errChan; err != nil {
+		t.Fatalf("receive failed: %v", err)
+	}
+	if err := client.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	want := []SessionEvent{
+		{Type: SessionEventConnected},
+		{Type: SessionEventInitialized},
+		{Type: SessionEventModelChange, Detail: "claude-haiku-4-5"},
+		{Type: SessionEventQuery, SessionID: "sess-1"},
+		{Type: SessionEventResult, SessionID: "sess-1", Detail: ResultSubtypeSuccess},
+		{Type: SessionEventClosed},
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != len(want) {
+		t.Fatalf("expected %d events, got %+v", len(want), events)
+	}
+	for i, w := range want {
+		got := events[i]
+		if got.Type != w.Type || got.SessionID != w.SessionID || got.Detail != w.Detail {
+			t.Errorf("event %d: got %+v, want %+v", i, got, w)
+		}
+		if got.Time.IsZero() || (i > 0 && got.Time.Before(events[i-1].Time)) {
+			t.Errorf("event %d: timestamps out of order", i)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package claude
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+// ClientState is the part of a ClaudeClient's state needed to resume its
+// session in a new process. SaveState writes it and LoadState reads it back.
+type ClientState struct {
+	SessionID      string         `json:"session_id"`
+	Cwd            string         `json:"cwd,omitempty"`
+	Model          string         `json:"model,omitempty"`
+	PermissionMode PermissionMode `json:"permission_mode,omitempty"`
+	// PermissionUpdates are the session-scoped updates granted through
+	// CanUseTool. Updates with other destinations are written to settings
+	// files by the CLI and need no restoring.
+	PermissionUpdates []PermissionUpdate `json:"permission_updates,omitempty"`
+}
+
+// clientState tracks the ClientState of a connected client.
+type clientState struct {
+	mu    sync.Mutex
+	state ClientState
+}
+
+// observe records the session ID carried by msg.
+func (s *clientState) observe(msg Message) {
+	var sessionID string
+	switch m := msg.(type) {
+	case *AssistantMessage:
+		sessionID = m.SessionID
+	case *ResultMessage:
+		sessionID = m.SessionID
+	case *SystemMessage:
+		sessionID, _ = m.Data["session_id"].(string)
+	}
+	if sessionID == "" {
+		return
+	}
+	s.mu.Lock()
+	s.state.SessionID = sessionID
+	s.mu.Unlock()
+}
+
+func (s *clientState) update(fn func(*ClientState)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(&s.state)
+}
+
+func (s *clientState) snapshot() ClientState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := s.state
+	state.PermissionUpdates = append([]PermissionUpdate(nil), s.state.PermissionUpdates...)
+	return state
+}
+
+// recordPermissionUpdates wraps canUseTool to record the session-scoped
+// permission updates it grants.
+func (c *ClaudeClient) recordPermissionUpdates(canUseTool CanUseToolFunc) CanUseToolFunc {
+	if canUseTool == nil {
+		return nil
+	}
+	return func(ctx context.Context, toolName string, input map[string]any, permCtx ToolPermissionContext) (PermissionResult, error) {
+		result, err := canUseTool(ctx, toolName, input, permCtx)
+		if allow, ok := result.(*PermissionResultAllow); ok && err == nil {
+			for _, update := range allow.UpdatedPermissions {
+				if update.Destination == PermissionDestSession {
+					c.state.update(func(s *ClientState) {
+						s.PermissionUpdates = append(s.PermissionUpdates, update)
+					})
+				}
+			}
+		}
+		return result, err
+	}
+}
+
+// SaveState writes the client's resumable state to w as JSON. It fails if no
+// session ID has been received yet.
+func (c *ClaudeClient) SaveState(w io.Writer) error {
+	state := c.state.snapshot()
+	if state.SessionID == "" {
+		return &SDKError{Message: "no session to save: no session ID received yet"}
+	}
+	if state.Cwd == "" {
+		state.Cwd = c.options.Cwd
+	}
+	if state.Model == "" {
+		state.Model = c.options.Model
+	}
+	if state.PermissionMode == "" {
+		state.PermissionMode = c.options.PermissionMode
+	}
+	if err := json.NewEncoder(w).Encode(state); err != nil {
+		return &SDKError{Message: "failed to save client state", Cause: err}
+	}
+	return nil
+}
+
+// LoadState reads a ClientState written by SaveState.
+func LoadState(r io.Reader) (*ClientState, error) {
+	var state ClientState
+	if err := json.NewDecoder(r).Decode(&state); err != nil {
+		return nil, &SDKError{Message: "failed to load client state", Cause: err}
+	}
+	if state.SessionID == "" {
+		return nil, &SDKError{Message: "saved client state has no session ID"}
+	}
+	return &state, nil
+}
+
+// NewClientFromState creates a client that resumes the session in state with
+// its saved cwd, model and permission mode. Session permission updates are
+// restored as options: allow and deny rules become allowed and disallowed
+// tools, setMode sets the permission mode and addDirectories adds
+// directories; other updates are dropped. Explicit opts win over the state.
+func NewClientFromState(state *ClientState, opts ...Option) *ClaudeClient {
+	restored := []Option{WithResume(state.SessionID)}
+	if state.Cwd != "" {
+		restored = append(restored, WithCwd(state.Cwd))
+	}
+	if state.Model != "" {
+		restored = append(restored, WithModel(state.Model))
+	}
+	if state.PermissionMode != "" {
+		restored = append(restored, WithPermissionMode(state.PermissionMode))
+	}
+
+	var allowed, disallowed, dirs []string
+	for _, update := range state.PermissionUpdates {
+		switch update.Type {
+		case PermissionUpdateAddRules:
+			switch update.Behavior {
+			case PermissionBehaviorAllow:
+				allowed = append(allowed, permissionRuleStrings(update.Rules)...)
+			case PermissionBehaviorDeny:
+				disallowed = append(disallowed, permissionRuleStrings(update.Rules)...)
+			}
+		case PermissionUpdateSetMode:
+			if update.Mode != "" {
+				restored = append(restored, WithPermissionMode(update.Mode))
+			}
+		case PermissionUpdateAddDirectories:
+			dirs = append(dirs, update.Directories...)
+		}
+	}
+	if len(allowed) > 0 {
+		restored = append(restored, WithAllowedTools(allowed...))
+	}
+	if len(disallowed) > 0 {
+		restored = append(restored, WithDisallowedTools(disallowed...))
+	}
+	if len(dirs) > 0 {
+		restored = append(restored, WithAddDirs(dirs...))
+	}
+	return NewClient(append(restored, opts...)...)
+}
+
+// permissionRuleStrings formats rules the way --allowedTools takes them, e.g.
+// "Bash(npm test:*)".
+func permissionRuleStrings(rules []PermissionRuleValue) []string {
+	out := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		if rule.RuleContent == "" {
+			out = append(out, rule.ToolName)
+		} else {
+			out = append(out, rule.ToolName+"("+rule.RuleContent+")")
+		}
+	}
+	return out
+}
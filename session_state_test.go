@@ -0,0 +1,84 @@
+package claude
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestSaveStateRoundTrip(t *testing.T) {
+	client := NewClient(
+		WithCwd("/srv/project"),
+		WithModel("claude-sonnet-4-5"),
+		WithPermissionMode(PermissionAcceptEdits),
+	)
+
+	var buf bytes.Buffer
+	if err := client.SaveState(&buf); err == nil {
+		t.Fatal("expected SaveState to fail before a session ID is received")
+	}
+
+	if err := client.observeMessage(client.query, &ResultMessage{Subtype: ResultSubtypeSuccess, SessionID: "sess-123"}); err != nil {
+		t.Fatalf("observeMessage: %v", err)
+	}
+	canUseTool := client.recordPermissionUpdates(func(ctx context.Context, toolName string, input map[string]any, permCtx ToolPermissionContext) (PermissionResult, error) {
+		allow := AllowForSession(toolName, "npm test:*")
+		allow.UpdatedPermissions = append(allow.UpdatedPermissions,
+			PermissionUpdate{Type: PermissionUpdateAddDirectories, Directories: []string{"/srv/shared"}, Destination: PermissionDestSession},
+			PermissionUpdate{Type: PermissionUpdateAddRules, Rules: []PermissionRuleValue{{ToolName: "Write"}}, Behavior: PermissionBehaviorAllow, Destination: PermissionDestUserSettings},
+		)
+		return allow, nil
+	})
+	if _, err := canUseTool(context.Background(), "Bash", nil, ToolPermissionContext{}); err != nil {
+		t.Fatalf("canUseTool: %v", err)
+	}
+
+	if err := client.SaveState(&buf); err != nil {
+		t.Fatalf("SaveState: %v", err)
+	}
+	state, err := LoadState(&buf)
+	if err != nil {
+		t.Fatalf("LoadState: %v", err)
+	}
+	want := &ClientState{
+		SessionID:      "sess-123",
+		Cwd:            "/srv/project",
+		Model:          "claude-sonnet-4-5",
+		PermissionMode: PermissionAcceptEdits,
+		PermissionUpdates: []PermissionUpdate{
+			{Type: PermissionUpdateAddRules, Rules: []PermissionRuleValue{{ToolName: "Bash", RuleContent: "npm test:*"}}, Behavior: PermissionBehaviorAllow, Destination: PermissionDestSession},
+			{Type: PermissionUpdateAddDirectories, Directories: []string{"/srv/shared"}, Destination: PermissionDestSession},
+		},
+	}
+	if !reflect.DeepEqual(state, want) {
+		t.Fatalf("LoadState = %+v, want %+v", state, want)
+	}
+
+	restored := NewClientFromState(state, WithMaxTurns(3))
+	opts := restored.options
+	if opts.Resume != "sess-123" || opts.Cwd != "/srv/project" || opts.Model != "claude-sonnet-4-5" || opts.MaxTurns != 3 {
+		t.Errorf("restored options = resume %q cwd %q model %q max turns %d", opts.Resume, opts.Cwd, opts.Model, opts.MaxTurns)
+	}
+	if !reflect.DeepEqual(opts.AllowedTools, []string{"Bash(npm test:*)"}) {
+		t.Errorf("AllowedTools = %v", opts.AllowedTools)
+	}
+	if !reflect.DeepEqual(opts.AddDirs, []string{"/srv/shared"}) {
+		t.Errorf("AddDirs = %v", opts.AddDirs)
+	}
+
+	cmd := newSubprocessTransport(opts).buildCommand()
+	i := slices.Index(cmd, "--resume")
+	if i < 0 || i+1 >= len(cmd) || cmd[i+1] != "sess-123" {
+		t.Errorf("expected --resume sess-123 in %v", cmd)
+	}
+}
+
+func TestLoadStateRejectsMissingSession(t *testing.T) {
+	for _, input := range []string{`{"cwd":"/tmp"}`, `not json`} {
+		if _, err := LoadState(bytes.NewBufferString(input)); err == nil {
+			t.Errorf("LoadState(%q): expected error", input)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package claude
+
+import "sync"
+
+// SessionStats is the running total of the results a ClaudeClient has
+// received since it was created.
+type SessionStats struct {
+	Results                  int // ResultMessages counted
+	InputTokens              int
+	OutputTokens             int
+	CacheCreationInputTokens int
+	CacheReadInputTokens     int
+	TotalCostUSD             float64
+}
+
+// sessionStats accumulates SessionStats from result messages.
+type sessionStats struct {
+	mu    sync.Mutex
+	stats SessionStats
+}
+
+// add counts the usage and cost of one result.
+func (s *sessionStats) add(rm *ResultMessage) {
+	usage := rm.ParsedUsage()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.Results++
+	s.stats.InputTokens += usage.InputTokens
+	s.stats.OutputTokens += usage.OutputTokens
+	s.stats.CacheCreationInputTokens += usage.CacheCreationInputTokens
+	s.stats.CacheReadInputTokens += usage.CacheReadInputTokens
+	if rm.TotalCostUSD != nil {
+		s.stats.TotalCostUSD += *rm.TotalCostUSD
+	}
+}
+
+func (s *sessionStats) snapshot() SessionStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+// SessionStats returns the token usage and cost summed over every
+// ResultMessage received so far, across turns and reconnects. Each result
+// reports only its own turn, so this is the cost of the conversation.
+func (c *ClaudeClient) SessionStats() SessionStats {
+	return c.stats.snapshot()
+}
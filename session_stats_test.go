@@ -0,0 +1,76 @@
+package claude
+
+import (
+	"context"
+	"math"
+	"testing"
+)
+
+func resultWithUsage(cost float64, usage map[string]any) map[string]any {
+	return map[string]any{
+		"type":            "result",
+		"subtype":         "success",
+		"is_error":        false,
+		"duration_ms":     float64(100),
+		"duration_api_ms": float64(90),
+		"num_turns":       float64(1),
+		"session_id":      "sess-1",
+		"total_cost_usd":  cost,
+		"usage":           usage,
+	}
+}
+
+func TestClientSessionStats(t *testing.T) {
+	client, mt := testableClient(t, queryOptions{})
+	defer client.Close()
+
+	if got := client.SessionStats(); got != (SessionStats{}) {
+		t.Fatalf("expected zero stats before any result, got %+v", got)
+	}
+
+	mt.msgChan <- resultWithUsage(0.01, map[string]any{
+		"input_tokens":                float64(100),
+		"output_tokens":               float64(20),
+		"cache_creation_input_tokens": float64(500),
+		"cache_read_input_tokens":     float64(0),
+	})
+	mt.msgChan <- resultWithUsage(0.02, map[string]any{
+		"input_tokens":            float64(30),
+		"output_tokens":           float64(40),
+		"cache_read_input_tokens": float64(500),
+	})
+	close(mt.msgChan)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range client.ReceiveMessages(context.Background()) {
+		}
+	}()
+	// Reads race with the receive goroutine; -race checks the locking.
+	for {
+		client.SessionStats()
+		select {
+		case <-done:
+		default:
+			continue
+		}
+		break
+	}
+
+	got := client.SessionStats()
+	want := SessionStats{
+		Results:                  2,
+		InputTokens:              130,
+		OutputTokens:             60,
+		CacheCreationInputTokens: 500,
+		CacheReadInputTokens:     500,
+	}
+	if math.Abs(got.TotalCostUSD-0.03) > 1e-9 {
+		t.Errorf("TotalCostUSD = %v, want 0.03", got.TotalCostUSD)
+	}
+	got.TotalCostUSD = 0
+	if got != want {
+		t.Errorf("SessionStats = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,76 @@
+package claude
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidateResumeSession(t *testing.T) {
+	configDir := t.TempDir()
+	t.Setenv("CLAUDE_CONFIG_DIR", configDir)
+	projectDir := filepath.Join(configDir, "projects", "-tmp-project")
+	if err := os.MkdirAll(projectDir, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(projectDir, "sess-exists.jsonl"), []byte("{}\n"), 0o644); err != nil {
+		t.Fatalf("write transcript: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		opts     []Option
+		notFound bool
+	}{
+		{name: "validation disabled", opts: []Option{WithResume("sess-missing")}},
+		{name: "no resume", opts: []Option{WithResumeValidation()}},
+		{name: "existing session", opts: []Option{WithResume("sess-exists"), WithResumeValidation()}},
+		{name: "missing session", opts: []Option{WithResume("sess-missing"), WithResumeValidation()}, notFound: true},
+		{name: "path traversal", opts: []Option{WithResume("../sess-exists"), WithResumeValidation()}, notFound: true},
+		{name: "glob pattern", opts: []Option{WithResume("sess-*"), WithResumeValidation()}, notFound: true},
+		{name: "glob character class", opts: []Option{WithResume("sess-exist[s]"), WithResumeValidation()}, notFound: true},
+		{name: "config dir from WithEnv", opts: []Option{WithResume("sess-exists"), WithResumeValidation(), WithEnv(map[string]string{"CLAUDE_CONFIG_DIR": t.TempDir()})}, notFound: true},
+		{name: "custom transport is not checked", opts: []Option{WithResume("sess-missing"), WithResumeValidation(), WithTransport(newMemoryTransport())}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateResumeSession(applyOptions(tt.opts))
+			var notFoundErr *SessionNotFoundError
+			if got := errors.As(err, &notFoundErr); got != tt.notFound {
+				t.Fatalf("expected SessionNotFoundError=%v, got %v", tt.notFound, err)
+			}
+		})
+	}
+}
+
+func TestConnectResumeNonexistentSession(t *testing.T) {
+	t.Setenv("CLAUDE_CONFIG_DIR", t.TempDir())
+
+	client := NewClient(
+		WithCLIPath("/nonexistent/claude"),
+		WithResume("sess-missing"),
+		WithResumeValidation(),
+	)
+	err := client.Connect(context.Background())
+
+	var notFoundErr *SessionNotFoundError
+	if !errors.As(err, &notFoundErr) {
+		t.Fatalf("expected SessionNotFoundError before spawning the CLI, got %T (%v)", err, err)
+	}
+	if notFoundErr.SessionID != "sess-missing" {
+		t.Errorf("expected session ID 'sess-missing', got %q", notFoundErr.SessionID)
+	}
+
+	msgs, errs := Query(context.Background(), "hi",
+		WithCLIPath("/nonexistent/claude"),
+		WithResume("sess-missing"),
+		WithResumeValidation(),
+	)
+	for range msgs {
+	}
+	if err := <-errs; !errors.As(err, &notFoundErr) {
+		t.Fatalf("expected SessionNotFoundError from Query, got %T (%v)", err, err)
+	}
+}
@@ -0,0 +1,102 @@
+package claude
+
+import (
+	"fmt"
+	"sync"
+)
+
+// sessionTurns tracks the turns sent to the CLI that have not produced a
+// ResultMessage yet. Each ResultMessage completes the oldest turn of its
+// session, since sessions may finish out of order.
+type sessionTurns struct {
+	mu      sync.Mutex
+	pending []sessionTurn
+}
+
+// sessionTurn is one in-flight turn and the QueryStream call that sent it;
+// stream is 0 for the single-message methods such as Query.
+type sessionTurn struct {
+	sessionID string
+	stream    int64
+}
+
+// claim records a turn for sessionID sent by stream. It reports whether
+// another sender already has a turn in flight for the session; under strict
+// the turn is then not recorded.
+func (s *sessionTurns) claim(sessionID string, stream int64, strict bool) (busy bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, turn := range s.pending {
+		if turn.sessionID == sessionID && turn.stream != stream {
+			busy = true
+			break
+		}
+	}
+	if !busy || !strict {
+		s.pending = append(s.pending, sessionTurn{sessionID: sessionID, stream: stream})
+	}
+	return busy
+}
+
+// release drops the latest turn claimed for sessionID by stream, for a turn
+// that could not be sent.
+func (s *sessionTurns) release(sessionID string, stream int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := len(s.pending) - 1; i >= 0; i-- {
+		if s.pending[i].sessionID == sessionID && s.pending[i].stream == stream {
+			s.pending = append(s.pending[:i], s.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// finish completes the oldest in-flight turn for sessionID. A result whose
+// session matches no turn, such as one for a turn sent under "default",
+// completes the oldest turn of any session.
+func (s *sessionTurns) finish(sessionID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pending) == 0 {
+		return
+	}
+	i := 0
+	for j, turn := range s.pending {
+		if turn.sessionID == sessionID {
+			i = j
+			break
+		}
+	}
+	s.pending = append(s.pending[:i], s.pending[i+1:]...)
+}
+
+// pendingCount returns the number of turns in flight.
+func (s *sessionTurns) pendingCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.pending)
+}
+
+func (s *sessionTurns) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = nil
+}
+
+// beginTurn records a turn about to be sent for sessionID. When another
+// sender has a turn in flight for the same session it fails with a
+// *SessionBusyError under WithStrictSessions and logs a warning otherwise.
+// A caller whose send then fails must undo the claim with c.turns.release.
+func (c *ClaudeClient) beginTurn(sessionID string, stream int64) error {
+	if !c.turns.claim(sessionID, stream, c.options.StrictSessions) {
+		return nil
+	}
+	if c.options.StrictSessions {
+		return &SessionBusyError{
+			SDKError:  SDKError{Message: fmt.Sprintf("session %q already has a turn in flight from another sender", sessionID)},
+			SessionID: sessionID,
+		}
+	}
+	loggerOr(c.options.Logger).Warnf("Session %q already has a turn in flight from another sender; responses may interleave", sessionID)
+	return nil
+}
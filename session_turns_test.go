@@ -0,0 +1,147 @@
+package claude
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestClientQueryStreamBusySession(t *testing.T) {
+	userMessage := func(text string) map[string]any {
+		return map[string]any{"type": "user", "message": map[string]any{"role": "user", "content": text}}
+	}
+	stream := func(client *ClaudeClient, sessionID string, msgs ...map[string]any) error {
+		ch := make(chan map[string]any, len(msgs))
+		for _, msg := range msgs {
+			ch <- msg
+		}
+		close(ch)
+		return client.QueryStream(context.Background(), ch, sessionID)
+	}
+
+	for _, strict := range []bool{false, true} {
+		t.Run(map[bool]string{false: "warn", true: "strict"}[strict], func(t *testing.T) {
+			client, stdin := writableClient(t)
+			defer client.Close()
+			logger := &recordingLogger{}
+			client.options.Logger = logger
+			client.options.StrictSessions = strict
+
+			// One stream may queue several turns for its own session.
+			if err := stream(client, "s1", userMessage("first"), userMessage("second")); err != nil {
+				t.Fatalf("first stream failed: %v", err)
+			}
+			if err := stream(client, "s2", userMessage("other session")); err != nil {
+				t.Fatalf("stream for another session failed: %v", err)
+			}
+			if len(logger.get()) != 0 {
+				t.Fatalf("expected no warnings yet, got %q", logger.get())
+			}
+
+			written := stdin.Len()
+			err := stream(client, "s1", userMessage("overlapping"))
+			var busy *SessionBusyError
+			if strict {
+				if !errors.As(err, &busy) || busy.SessionID != "s1" {
+					t.Fatalf("expected a SessionBusyError for s1, got %v", err)
+				}
+				if stdin.Len() != written {
+					t.Errorf("expected nothing written for the busy session")
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("expected the overlapping stream to be sent, got %v", err)
+				}
+				if lines := logger.get(); len(lines) != 1 || !strings.Contains(lines[0], `Session "s1" already has a turn in flight`) {
+					t.Errorf("expected one busy-session warning, got %q", lines)
+				}
+			}
+
+			// Results for the three queued turns free the session.
+			for range 3 {
+				if err := client.observeMessage(client.query, &ResultMessage{Subtype: ResultSubtypeSuccess}); err != nil {
+					t.Fatalf("observe failed: %v", err)
+				}
+			}
+			if !strict {
+				_ = client.observeMessage(client.query, &ResultMessage{Subtype: ResultSubtypeSuccess})
+			}
+			if err := stream(client, "s1", userMessage("after results")); err != nil {
+				t.Errorf("expected the idle session to accept a new stream, got %v", err)
+			}
+		})
+	}
+}
+
+func TestClientInterleavedSessionResults(t *testing.T) {
+	client, _ := writableClient(t)
+	defer client.Close()
+	client.options.StrictSessions = true
+
+	if err := client.QueryWithSession(context.Background(), "slow", "s1"); err != nil {
+		t.Fatalf("send for s1 failed: %v", err)
+	}
+	if err := client.QueryWithSession(context.Background(), "fast", "s2"); err != nil {
+		t.Fatalf("send for s2 failed: %v", err)
+	}
+
+	// s2 finishes first; its result must not complete the turn of s1.
+	if err := client.observeMessage(client.query, &ResultMessage{Subtype: ResultSubtypeSuccess, SessionID: "s2"}); err != nil {
+		t.Fatalf("observe failed: %v", err)
+	}
+	input := make(chan map[string]any, 1)
+	input <- map[string]any{"type": "user", "message": map[string]any{"role": "user", "content": "overlap"}}
+	close(input)
+	var busy *SessionBusyError
+	if err := client.QueryStream(context.Background(), input, "s1"); !errors.As(err, &busy) {
+		t.Errorf("expected s1 to still be busy, got %v", err)
+	}
+	if n := client.turns.pendingCount(); n != 1 {
+		t.Errorf("expected only the s1 turn in flight, got %d", n)
+	}
+
+	if err := client.observeMessage(client.query, &ResultMessage{Subtype: ResultSubtypeSuccess, SessionID: "s1"}); err != nil {
+		t.Fatalf("observe failed: %v", err)
+	}
+	if n := client.turns.pendingCount(); n != 0 {
+		t.Errorf("expected no turns in flight, got %d", n)
+	}
+}
+
+// failingStdin rejects every write.
+type failingStdin struct{}
+
+func (failingStdin) Write([]byte) (int, error) { return 0, errors.New("broken pipe") }
+func (failingStdin) Close() error              { return nil }
+
+func TestClientFailedSendReleasesTurn(t *testing.T) {
+	client, stdin := writableClient(t)
+	defer client.Close()
+	client.options.StrictSessions = true
+	transport := client.transport.(*subprocessTransport)
+
+	transport.stdin = failingStdin{}
+	input := make(chan map[string]any, 1)
+	input <- map[string]any{"type": "user", "message": map[string]any{"role": "user", "content": "lost"}}
+	close(input)
+	if err := client.QueryStream(context.Background(), input, "s1"); err == nil {
+		t.Fatal("expected the write to fail")
+	}
+	if err := client.QueryWithSession(context.Background(), "lost too", "s2"); err == nil {
+		t.Fatal("expected the write to fail")
+	}
+
+	// Only the turn claims are under test; revive the transport.
+	transport.stdin = stdin
+	transport.ready = true
+	input = make(chan map[string]any, 1)
+	input <- map[string]any{"type": "user", "message": map[string]any{"role": "user", "content": "retry"}}
+	close(input)
+	if err := client.QueryStream(context.Background(), input, "s2"); err != nil {
+		t.Errorf("expected a send from another stream to succeed, got %v", err)
+	}
+	if err := client.QueryWithSession(context.Background(), "retry", "s1"); err != nil {
+		t.Errorf("expected a send from another stream to succeed, got %v", err)
+	}
+}
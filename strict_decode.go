@@ -0,0 +1,53 @@
+package claude
+
+import (
+	"slices"
+	"strings"
+)
+
+// knownMessageFields lists the top-level fields the CLI is known to send for
+// each message type the SDK decodes into a fixed struct. System and rate
+// limit messages keep their raw payload, so they are not checked.
+var knownMessageFields = map[string][]string{
+	"user": {
+		"type", "message", "uuid", "session_id", "parent_tool_use_id",
+		"tool_use_result", "isSynthetic", "isReplay",
+	},
+	"assistant": {
+		"type", "message", "uuid", "session_id", "parent_tool_use_id", "error",
+	},
+	"result": {
+		"type", "subtype", "uuid", "session_id", "duration_ms", "duration_api_ms",
+		"is_error", "num_turns", "result", "total_cost_usd", "usage", "modelUsage",
+		"permission_denials", "structured_output", "errors",
+	},
+	"stream_event": {
+		"type", "uuid", "session_id", "event", "parent_tool_use_id",
+	},
+}
+
+// unknownMessageFields returns the sorted top-level fields of data that are
+// not known for its message type.
+func unknownMessageFields(data map[string]any) []string {
+	msgType, _ := data["type"].(string)
+	known, ok := knownMessageFields[msgType]
+	if !ok {
+		return nil
+	}
+	var unknown []string
+	for field := range data {
+		if !slices.Contains(known, field) {
+			unknown = append(unknown, field)
+		}
+	}
+	slices.Sort(unknown)
+	return unknown
+}
+
+// warnUnknownFields logs the fields of a decoded message that the SDK does not
+// know, for WithStrictJSONDecoding.
+func warnUnknownFields(logger Logger, data map[string]any) {
+	if unknown := unknownMessageFields(data); len(unknown) > 0 {
+		logger.Warnf("Unexpected fields in %v message: %s", data["type"], strings.Join(unknown, ", "))
+	}
+}
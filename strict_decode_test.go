@@ -0,0 +1,60 @@
+package claude
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUnknownMessageFields(t *testing.T) {
+	tests := []struct {
+		name string
+		data map[string]any
+		want []string
+	}{
+		{"known fields", map[string]any{"type": "assistant", "message": map[string]any{}, "uuid": "a", "session_id": "s"}, nil},
+		{"extra fields sorted", map[string]any{"type": "assistant", "message": map[string]any{}, "zeta": 1, "alpha": true}, []string{"alpha", "zeta"}},
+		{"result", map[string]any{"type": "result", "subtype": "success", "fast_mode": true}, []string{"fast_mode"}},
+		{"system unchecked", map[string]any{"type": "system", "subtype": "init", "anything": 1}, nil},
+		{"unknown type unchecked", map[string]any{"type": "future", "anything": 1}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := unknownMessageFields(tt.data); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("unknownMessageFields = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientStrictJSONDecoding(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		logger := &recordingLogger{}
+		client, mt := testableClient(t, queryOptions{})
+		client.options.StrictJSONDecoding = strict
+		client.options.Logger = logger
+		raw := assistantWithUUID("a", "hi")
+		raw["cache_hint"] = "warm"
+		mt.msgChan <- raw
+		close(mt.msgChan)
+
+		var received int
+		for _, err := range client.Messages2(context.Background()) {
+			if err != nil {
+				t.Fatalf("strict=%v: unexpected error: %v", strict, err)
+			}
+			received++
+		}
+		client.Close()
+
+		if received != 1 {
+			t.Errorf("strict=%v: expected the message to be delivered, got %d", strict, received)
+		}
+		logs := strings.Join(logger.get(), "\n")
+		warned := strings.Contains(logs, "Unexpected fields in assistant message: cache_hint")
+		if warned != strict {
+			t.Errorf("strict=%v: warned=%v, logs: %q", strict, warned, logs)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package claude
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// textReader adapts a message channel to an io.Reader over assistant text.
+type textReader struct {
+	ctx  context.Context
+	msgs <-chan Message
+
+	buf  []byte
+	done bool
+
+	closeOnce sync.Once
+	closeChan chan struct{}
+}
+
+// NewTextReader returns a reader yielding the text blocks of assistant messages
+// from msgs as they arrive. It returns io.EOF after the ResultMessage or when
+// msgs is closed, and ctx.Err() if ctx is done first. Other message types are
+// skipped. Close stops reading but does not drain msgs.
+func NewTextReader(ctx context.Context, msgs <-chan Message) io.ReadCloser {
+	return &textReader{ctx: ctx, msgs: msgs, closeChan: make(chan struct{})}
+}
+
+func (r *textReader) Read(p []byte) (int, error) {
+	select {
+	case <-r.closeChan:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		select {
+		case msg, ok := <-r.msgs:
+			if !ok {
+				r.done = true
+				continue
+			}
+			switch m := msg.(type) {
+			case *AssistantMessage:
+				for _, block := range m.Content {
+					if tb, ok := block.(*TextBlock); ok {
+						r.buf = append(r.buf, tb.Text...)
+					}
+				}
+			case *ResultMessage:
+				r.done = true
+			}
+		case <-r.ctx.Done():
+			return 0, r.ctx.Err()
+		case <-r.closeChan:
+			return 0, io.ErrClosedPipe
+		}
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// Close unblocks any pending Read; it is safe to call from another goroutine.
+func (r *textReader) Close() error {
+	r.closeOnce.Do(func() { close(r.closeChan) })
+	return nil
+}
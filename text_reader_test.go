@@ -0,0 +1,106 @@
+package claude
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestTextReaderReadAll(t *testing.T) {
+	msgs := make(chan Message, 10)
+	msgs <- &SystemMessage{Subtype: "init"}
+	msgs <- &AssistantMessage{Content: []ContentBlock{
+		&TextBlock{Text: "Hello, "},
+		&ToolUseBlock{ID: "tu-1", Name: "Bash"},
+	}}
+	msgs <- &UserMessage{Content: "tool output"}
+	msgs <- &AssistantMessage{Content: []ContentBlock{
+		&ThinkingBlock{Thinking: "hmm"},
+		&TextBlock{Text: "world!"},
+	}}
+	msgs <- &ResultMessage{Subtype: "success"}
+	msgs <- &AssistantMessage{Content: []ContentBlock{&TextBlock{Text: " after result"}}}
+
+	data, err := io.ReadAll(NewTextReader(context.Background(), msgs))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(data) != "Hello, world!" {
+		t.Errorf("expected %q, got %q", "Hello, world!", string(data))
+	}
+}
+
+func TestTextReaderEOFOnChannelClose(t *testing.T) {
+	msgs := make(chan Message, 1)
+	msgs <- &AssistantMessage{Content: []ContentBlock{&TextBlock{Text: "partial"}}}
+	close(msgs)
+
+	data, err := io.ReadAll(NewTextReader(context.Background(), msgs))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(data) != "partial" {
+		t.Errorf("expected %q, got %q", "partial", string(data))
+	}
+}
+
+func TestTextReaderSmallBuffer(t *testing.T) {
+	msgs := make(chan Message, 2)
+	msgs <- &AssistantMessage{Content: []ContentBlock{&TextBlock{Text: "abcdef"}}}
+	msgs <- &ResultMessage{Subtype: "success"}
+
+	r := NewTextReader(context.Background(), msgs)
+	buf := make([]byte, 4)
+	n, err := r.Read(buf)
+	if err != nil || string(buf[:n]) != "abcd" {
+		t.Fatalf("first read: got %q, %v", buf[:n], err)
+	}
+	n, err = r.Read(buf)
+	if err != nil || string(buf[:n]) != "ef" {
+		t.Fatalf("second read: got %q, %v", buf[:n], err)
+	}
+	if _, err := r.Read(buf); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
+
+func TestTextReaderContextCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := io.ReadAll(NewTextReader(ctx, make(chan Message)))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestTextReaderClose(t *testing.T) {
+	r := NewTextReader(context.Background(), make(chan Message))
+	if err := r.Close(); err != nil {
+		t.Fatalf("unexpected close error: %v", err)
+	}
+	if _, err := r.Read(make([]byte, 1)); !errors.Is(err, io.ErrClosedPipe) {
+		t.Fatalf("expected ErrClosedPipe after close, got %v", err)
+	}
+}
+
+func TestTextReaderCloseUnblocksRead(t *testing.T) {
+	r := NewTextReader(context.Background(), make(chan Message))
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := r.Read(make([]byte, 1))
+		errCh <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	_ = r.Close()
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, io.ErrClosedPipe) {
+			t.Fatalf("expected ErrClosedPipe, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("close did not unblock pending read")
+	}
+}
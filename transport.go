@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -13,14 +14,41 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 )
 
 const defaultMaxBufferSize = 1024 * 1024 // 1MB buffer limit
 
+const defaultLargeInputWarning = 1024 * 1024 // 1MB per input message
+
+const defaultShutdownGrace = 2 * time.Second
+
+// Transport carries the stream-json protocol between the SDK and Claude Code.
+// The default transport runs the CLI as a subprocess; WithTransport swaps in
+// another, such as an in-memory fake for tests or a remote gateway.
+type Transport interface {
+	// Write sends one newline-terminated JSON message.
+	Write(data string) error
+	// Messages delivers decoded messages and is closed when the stream ends.
+	Messages() <-chan map[string]any
+	// Errors delivers stream failures.
+	Errors() <-chan error
+	// LastError returns the error that ended the stream, if any.
+	LastError() error
+	// Close releases the transport; further calls must be harmless.
+	Close() error
+	// EndInput signals that no more messages will be written.
+	EndInput() error
+	// IsReady reports whether the transport can be written to.
+	IsReady() bool
+}
+
 // subprocessTransport implements Transport using the Claude Code CLI subprocess.
 type subprocessTransport struct {
 	options       *AgentOptions
 	cliPath       string
+	cliErr        error // why cliPath could not be resolved, returned by Connect
 	cwd           string
 	process       *exec.Cmd
 	stdin         io.WriteCloser
@@ -32,15 +60,41 @@ type subprocessTransport struct {
 	maxBufferSize int
 	writeMu       sync.Mutex
 	cancel        context.CancelFunc
+	lifetime      context.Context // parent of the process lifecycle; Background when nil
 
 	exitErr error
 	errMu   sync.Mutex
+
+	stderrTail stderrTail
+	stderrDone chan struct{} // closed when readStderr returns
+
+	dump *protocolDump
+
+	stopOnce sync.Once
+}
+
+// connectTransport returns the WithTransport transport, or starts the CLI
+// subprocess when there is none. When ownsLifetime is set the subprocess is
+// stopped once ctx is done; otherwise ctx bounds the startup only.
+func connectTransport(ctx context.Context, options *AgentOptions, ownsLifetime bool) (Transport, error) {
+	if options.Transport != nil {
+		return options.Transport, nil
+	}
+	t := newSubprocessTransport(options)
+	if ownsLifetime {
+		t.lifetime = ctx
+	}
+	if err := t.Connect(ctx); err != nil {
+		return nil, err
+	}
+	return t, nil
 }
 
 func newSubprocessTransport(options *AgentOptions) *subprocessTransport {
 	cliPath := options.CLIPath
+	var cliErr error
 	if cliPath == "" {
-		cliPath = findCLI()
+		cliPath, cliErr = findCLI()
 	}
 
 	maxBuf := options.MaxBufferSize
@@ -51,6 +105,7 @@ func newSubprocessTransport(options *AgentOptions) *subprocessTransport {
 	return &subprocessTransport{
 		options:       options,
 		cliPath:       cliPath,
+		cliErr:        cliErr,
 		cwd:           options.Cwd,
 		maxBufferSize: maxBuf,
 		msgChan:       make(chan map[string]any, 100),
@@ -58,15 +113,108 @@ func newSubprocessTransport(options *AgentOptions) *subprocessTransport {
 	}
 }
 
-func findCLI() string {
+// cliPathEnvVars name executables that override the CLI search, in order.
+var cliPathEnvVars = []string{"CLAUDE_CODE_CLI", "CLAUDE_CLI_PATH"}
+
+func findCLI() (string, error) {
+	home, _ := os.UserHomeDir()
+	return cliLookup{
+		goos:     runtime.GOOS,
+		home:     home,
+		getenv:   os.Getenv,
+		lookPath: exec.LookPath,
+		isFile: func(path string) bool {
+			info, err := os.Stat(path)
+			return err == nil && !info.IsDir()
+		},
+	}.find()
+}
+
+// cliLookup locates the Claude Code CLI. Its environment is injected so the
+// per-platform search can be tested anywhere.
+type cliLookup struct {
+	goos     string
+	home     string
+	getenv   func(key string) string
+	lookPath func(file string) (string, error)
+	isFile   func(path string) bool
+}
+
+// find returns the CLI to run. A path set in one of cliPathEnvVars wins, and
+// is an error rather than a fallback when it does not exist.
+func (l cliLookup) find() (string, error) {
+	for _, name := range cliPathEnvVars {
+		path := l.getenv(name)
+		if path == "" {
+			continue
+		}
+		if !l.isFile(path) {
+			return path, &CLINotFoundError{
+				CLIConnectionError: CLIConnectionError{SDKError: SDKError{Message: fmt.Sprintf("Claude Code not found at %s=%s", name, path)}},
+				CLIPath:            path,
+				EnvVar:             name,
+			}
+		}
+		return path, nil
+	}
+
 	// Try which/where
-	if path, err := exec.LookPath("claude"); err == nil {
-		return path
+	for _, name := range l.names() {
+		if path, err := l.lookPath(name); err == nil {
+			return path, nil
+		}
 	}
 
 	// Common locations
-	home, _ := os.UserHomeDir()
-	locations := []string{
+	for _, loc := range l.locations() {
+		if l.isFile(loc) {
+			return loc, nil
+		}
+	}
+
+	return "claude", nil // Will fail at connect time with clear error
+}
+
+// names returns the executable names to look up on PATH. On Windows npm
+// installs a claude.cmd shim and the native installer a claude.exe, so every
+// PATHEXT extension is tried explicitly.
+func (l cliLookup) names() []string {
+	if l.goos != "windows" {
+		return []string{"claude"}
+	}
+	pathext := l.getenv("PATHEXT")
+	if pathext == "" {
+		pathext = ".com;.exe;.bat;.cmd"
+	}
+	var names []string
+	seen := map[string]bool{}
+	for _, ext := range append(strings.Split(strings.ToLower(pathext), ";"), ".cmd", ".exe") {
+		if ext == "" || seen[ext] {
+			continue
+		}
+		seen[ext] = true
+		names = append(names, "claude"+ext)
+	}
+	return names
+}
+
+func (l cliLookup) locations() []string {
+	home := l.home
+	if l.goos == "windows" {
+		var locations []string
+		npmDirs := []string{filepath.Join(home, "AppData", "Roaming", "npm")}
+		if appData := l.getenv("APPDATA"); appData != "" {
+			npmDirs = append([]string{filepath.Join(appData, "npm")}, npmDirs...)
+		}
+		for _, dir := range npmDirs {
+			locations = append(locations, filepath.Join(dir, "claude.cmd"), filepath.Join(dir, "claude.exe"))
+		}
+		return append(locations,
+			filepath.Join(home, ".local", "bin", "claude.exe"),
+			filepath.Join(home, ".claude", "local", "claude.exe"),
+		)
+	}
+	return []string{
 		filepath.Join(home, ".npm-global/bin/claude"),
 		"/usr/local/bin/claude",
 		filepath.Join(home, ".local/bin/claude"),
@@ -74,14 +222,24 @@ func findCLI() string {
 		filepath.Join(home, ".yarn/bin/claude"),
 		filepath.Join(home, ".claude/local/claude"),
 	}
+}
 
-	for _, loc := range locations {
-		if info, err := os.Stat(loc); err == nil && !info.IsDir() {
-			return loc
-		}
+// BuildCLIArgs returns the Claude Code CLI argv (including the CLI path) that
+// the SDK would spawn for the given options, for running the CLI externally.
+// The spawned process must still speak the stream-json control protocol.
+func BuildCLIArgs(opts ...Option) ([]string, error) {
+	options := applyOptions(opts)
+	if err := validateInputFormat(options); err != nil {
+		return nil, err
 	}
-
-	return "claude" // Will fail at connect time with clear error
+	if err := validateAddDirs(options); err != nil {
+		return nil, err
+	}
+	if err := configurePermissionPromptTool(options); err != nil {
+		return nil, err
+	}
+	expandSDKToolAllowlist(options)
+	return newSubprocessTransport(options).buildCommand(), nil
 }
 
 func (t *subprocessTransport) buildCommand() []string {
@@ -165,7 +323,13 @@ func (t *subprocessTransport) buildCommand() []string {
 		cmd = append(cmd, "--settings", settingsValue)
 	}
 
+	seenDirs := make(map[string]bool, len(opts.AddDirs))
 	for _, dir := range opts.AddDirs {
+		key := filepath.Clean(dir)
+		if seenDirs[key] {
+			continue
+		}
+		seenDirs[key] = true
 		cmd = append(cmd, "--add-dir", dir)
 	}
 
@@ -235,16 +399,17 @@ func (t *subprocessTransport) buildCommand() []string {
 		}
 	}
 
-	// Thinking config
+	// Thinking config. An explicit budget always wins and is sent alongside
+	// --effort; only adaptive thinking's default cap gives way to EffortMax.
 	var maxThinkingTokens *int
 	if opts.Thinking != nil {
 		switch tc := opts.Thinking.(type) {
 		case *ThinkingConfigAdaptive:
-			if opts.MaxThinkingTokens == nil {
+			if opts.MaxThinkingTokens != nil {
+				maxThinkingTokens = opts.MaxThinkingTokens
+			} else if opts.Effort != EffortMax {
 				v := 32000
 				maxThinkingTokens = &v
-			} else {
-				maxThinkingTokens = opts.MaxThinkingTokens
 			}
 		case *ThinkingConfigEnabled:
 			maxThinkingTokens = &tc.BudgetTokens
@@ -273,8 +438,11 @@ func (t *subprocessTransport) buildCommand() []string {
 		}
 	}
 
-	// Always use streaming mode
-	cmd = append(cmd, "--input-format", "stream-json")
+	inputFormat := opts.InputFormat
+	if inputFormat == "" {
+		inputFormat = InputFormatStreamJSON
+	}
+	cmd = append(cmd, "--input-format", inputFormat)
 
 	return cmd
 }
@@ -315,6 +483,10 @@ func (t *subprocessTransport) buildSettingsValue() string {
 	return string(data)
 }
 
+// Connect starts the CLI. ctx bounds the startup only: the process runs until
+// Close, or until the lifetime context is done when one is set, so a
+// ClaudeClient outlives the context it connected with while Query and
+// QueryStream stop with theirs.
 func (t *subprocessTransport) Connect(ctx context.Context) error {
 	if t.process != nil {
 		return nil
@@ -322,10 +494,18 @@ func (t *subprocessTransport) Connect(ctx context.Context) error {
 	if err := ctx.Err(); err != nil {
 		return err
 	}
+	if t.cliErr != nil {
+		return t.cliErr
+	}
 
-	lifecycleCtx, lifecycleCancel := context.WithCancel(context.Background())
+	lifetime := t.lifetime
+	if lifetime == nil {
+		lifetime = context.Background()
+	}
+	lifecycleCtx, lifecycleCancel := context.WithCancel(lifetime)
 	cmd := t.buildCommand()
 	t.process = exec.CommandContext(lifecycleCtx, cmd[0], cmd[1:]...)
+	t.process.Cancel = t.terminate
 	t.cancel = lifecycleCancel
 	if err := setProcessUser(t.process, t.options.User); err != nil {
 		lifecycleCancel()
@@ -337,19 +517,7 @@ func (t *subprocessTransport) Connect(ctx context.Context) error {
 		}
 	}
 
-	// Set environment
-	env := os.Environ()
-	for k, v := range t.options.Env {
-		env = append(env, k+"="+v)
-	}
-	env = append(env,
-		"CLAUDE_CODE_ENTRYPOINT=sdk-go",
-		"CLAUDE_AGENT_SDK_VERSION="+Version,
-	)
-	if t.options.EnableFileCheckpointing {
-		env = append(env, "CLAUDE_CODE_ENABLE_SDK_FILE_CHECKPOINTING=true")
-	}
-	t.process.Env = env
+	t.process.Env = t.buildEnv(os.Environ(), runtime.GOOS)
 
 	if t.cwd != "" {
 		t.process.Dir = t.cwd
@@ -370,41 +538,42 @@ func (t *subprocessTransport) Connect(ctx context.Context) error {
 		return &CLIConnectionError{SDKError: SDKError{Message: "Failed to create stdout pipe", Cause: err}}
 	}
 
-	// Pipe stderr if callback is set or debug mode is enabled
-	shouldPipeStderr := t.options.Stderr != nil || t.hasExtraArg("debug-to-stderr")
-	if shouldPipeStderr {
-		t.stderr, err = t.process.StderrPipe()
-		if err != nil {
+	// Always pipe stderr: its tail goes into the ProcessError if the CLI fails.
+	t.stderr, err = t.process.StderrPipe()
+	if err != nil {
+		lifecycleCancel()
+		return &CLIConnectionError{SDKError: SDKError{Message: "Failed to create stderr pipe", Cause: err}}
+	}
+
+	if t.options.ProtocolDump != "" {
+		if t.dump, err = openProtocolDump(t.options.ProtocolDump); err != nil {
 			lifecycleCancel()
-			return &CLIConnectionError{SDKError: SDKError{Message: "Failed to create stderr pipe", Cause: err}}
-		}
-	} else {
-		if runtime.GOOS != "windows" {
-			devNull, _ := os.Open(os.DevNull)
-			t.process.Stderr = devNull
+			return err
 		}
 	}
 
 	if err := t.process.Start(); err != nil {
 		lifecycleCancel()
+		_ = t.dump.close()
 		if os.IsNotExist(err) {
 			return &CLINotFoundError{
 				CLIConnectionError: CLIConnectionError{SDKError: SDKError{Message: "Claude Code not found at: " + t.cliPath, Cause: err}},
 				CLIPath:            t.cliPath,
 			}
 		}
-		return &CLIConnectionError{SDKError: SDKError{Message: "Failed to start Claude Code", Cause: err}}
+		return &CLIConnectionError{SDKError: SDKError{Message: "Failed to start Claude Code", Cause: &spawnError{err}}}
 	}
 
 	// Start stderr reader
-	if t.stderr != nil {
-		go t.readStderr()
-	}
+	t.stderrDone = make(chan struct{})
+	go t.readStderr()
+
+	// Mark ready before the reader starts: it clears the flag when the process
+	// exits, which may be immediate.
+	t.ready = true
 
 	// Start stdout reader
 	go t.readMessages(lifecycleCtx)
-
-	t.ready = true
 	if err := ctx.Err(); err != nil {
 		_ = t.Close()
 		return err
@@ -413,9 +582,7 @@ func (t *subprocessTransport) Connect(ctx context.Context) error {
 }
 
 func (t *subprocessTransport) readStderr() {
-	if t.stderr == nil {
-		return
-	}
+	defer close(t.stderrDone)
 	scanner := bufio.NewScanner(t.stderr)
 	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
 	for scanner.Scan() {
@@ -423,6 +590,7 @@ func (t *subprocessTransport) readStderr() {
 		if line == "" {
 			continue
 		}
+		t.stderrTail.add(line)
 		if t.options.Stderr != nil {
 			t.options.Stderr(line)
 		} else if t.hasExtraArg("debug-to-stderr") && t.options.DebugStderr != nil {
@@ -435,6 +603,12 @@ func (t *subprocessTransport) readStderr() {
 			}
 		}
 	}
+	if err := scanner.Err(); err != nil {
+		// A line over the limit stops the scanner; keep draining so the CLI
+		// never blocks writing to a full stderr pipe.
+		loggerOr(t.options.Logger).Warnf("Stopped reading CLI stderr: %v", err)
+		_, _ = io.Copy(io.Discard, t.stderr)
+	}
 }
 
 func (t *subprocessTransport) readMessages(ctx context.Context) {
@@ -446,10 +620,14 @@ func (t *subprocessTransport) readMessages(ctx context.Context) {
 		t.writeMu.Unlock()
 	}()
 
+	// Splitting on '\n' is UTF-8 safe: the byte never occurs inside a multibyte
+	// sequence. TrimSpace only strips outside the JSON value, and encoding/json
+	// replaces invalid UTF-8 inside strings with U+FFFD instead of failing.
 	scanner := bufio.NewScanner(t.stdout)
 	scanner.Buffer(make([]byte, 256*1024), t.maxBufferSize)
 
 	jsonBuffer := ""
+	sawJSON := false
 
 	for scanner.Scan() {
 		select {
@@ -476,6 +654,17 @@ func (t *subprocessTransport) readMessages(ctx context.Context) {
 			if jsonBuffer == "" {
 				firstBrace := strings.Index(jsonLine, "{")
 				if firstBrace < 0 {
+					// An interactive auth prompt waits for input that never comes;
+					// fail instead of skipping it and hanging.
+					if !sawJSON && isAuthPrompt(jsonLine) {
+						err := &AuthenticationRequiredError{
+							SDKError: SDKError{Message: "Claude Code requires authentication: " + jsonLine},
+							Prompt:   jsonLine,
+						}
+						t.setExitError(err)
+						t.signalError(err)
+						return
+					}
 					continue
 				}
 				if firstBrace > 0 {
@@ -506,7 +695,9 @@ func (t *subprocessTransport) readMessages(ctx context.Context) {
 				// Accumulate more data
 				continue
 			}
+			t.dump.record(dumpInbound, []byte(jsonBuffer))
 			jsonBuffer = ""
+			sawJSON = true
 
 			select {
 			case t.msgChan <- data:
@@ -529,14 +720,22 @@ func (t *subprocessTransport) readMessages(ctx context.Context) {
 		return
 	}
 
-	// Wait for process to finish
+	// Wait for process to finish. Wait closes the stderr pipe, so let the
+	// stderr reader drain first; a grandchild holding stderr open must not
+	// stall shutdown, hence the bound.
 	if t.process != nil {
+		if t.stderrDone != nil {
+			select {
+			case <-t.stderrDone:
+			case <-time.After(stderrDrainTimeout):
+			}
+		}
 		if err := t.process.Wait(); err != nil {
 			if exitErr, ok := err.(*exec.ExitError); ok {
 				t.setExitError(NewProcessError(
 					fmt.Sprintf("Command failed with exit code %d", exitErr.ExitCode()),
 					exitErr.ExitCode(),
-					"Check stderr output for details",
+					t.stderrTail.String(),
 				))
 			} else {
 				t.setExitError(&ProcessError{
@@ -550,6 +749,62 @@ func (t *subprocessTransport) readMessages(ctx context.Context) {
 	}
 }
 
+// stderrTailSize bounds the stderr kept for ProcessError.
+const stderrTailSize = 64 * 1024
+
+// stderrDrainTimeout bounds the wait for stderr to reach EOF once stdout has.
+const stderrDrainTimeout = time.Second
+
+// stderrTail keeps the most recent stderr lines, up to stderrTailSize bytes.
+type stderrTail struct {
+	mu    sync.Mutex
+	lines []string
+	size  int
+}
+
+func (b *stderrTail) add(line string) {
+	if len(line) > stderrTailSize {
+		line = line[len(line)-stderrTailSize:]
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lines = append(b.lines, line)
+	b.size += len(line) + 1
+	for b.size > stderrTailSize && len(b.lines) > 1 {
+		b.size -= len(b.lines[0]) + 1
+		b.lines = b.lines[1:]
+	}
+}
+
+func (b *stderrTail) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return strings.Join(b.lines, "\n")
+}
+
+// authPromptPatterns are lowercase fragments of the CLI's login and API key
+// prompts.
+var authPromptPatterns = []string{
+	"please log in",
+	"please login",
+	"please run /login",
+	"claude login",
+	"not logged in",
+	"invalid api key",
+	"authentication required",
+}
+
+// isAuthPrompt reports whether a non-JSON stdout line looks like an auth prompt.
+func isAuthPrompt(line string) bool {
+	lower := strings.ToLower(line)
+	for _, pattern := range authPromptPatterns {
+		if strings.Contains(lower, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
 func (t *subprocessTransport) Write(data string) error {
 	t.writeMu.Lock()
 	defer t.writeMu.Unlock()
@@ -561,19 +816,109 @@ func (t *subprocessTransport) Write(data string) error {
 		return &CLIConnectionError{
 			SDKError: SDKError{
 				Message: "Cannot write to process that exited with error",
-				Cause:   exitErr,
+				Cause:   &ProcessExitedError{SDKError: SDKError{Message: "CLI process has exited", Cause: exitErr}},
 			},
 		}
 	}
 
-	_, err := io.WriteString(t.stdin, data)
+	t.warnLargeInput(len(data))
+	t.dump.record(dumpOutbound, []byte(strings.TrimSuffix(data, "\n")))
+	err := t.writeStdin(data)
 	if err != nil {
 		t.ready = false
+		if isClosedPipe(err) {
+			err = &ProcessExitedError{SDKError: SDKError{Message: "CLI process has exited", Cause: err}}
+		}
 		return &CLIConnectionError{SDKError: SDKError{Message: "Failed to write to process stdin", Cause: err}}
 	}
 	return nil
 }
 
+// requiredEnv names the parent variables copied under WithCleanEnv whatever
+// the allowlist, by GOOS; "" applies everywhere.
+var requiredEnv = map[string][]string{
+	"":        {"PATH", "HOME"},
+	"windows": {"SYSTEMROOT", "USERPROFILE"},
+}
+
+// buildEnv returns the CLI's environment given the parent's.
+func (t *subprocessTransport) buildEnv(environ []string, goos string) []string {
+	env := environ
+	if t.options.CleanEnv {
+		allowed := append(append(append([]string(nil), requiredEnv[""]...), requiredEnv[goos]...), t.options.EnvAllowlist...)
+		env = nil
+		for _, kv := range environ {
+			name, _, _ := strings.Cut(kv, "=")
+			for _, a := range allowed {
+				// Windows variable names are case-insensitive, e.g. Path.
+				if name == a || (goos == "windows" && strings.EqualFold(name, a)) {
+					env = append(env, kv)
+					break
+				}
+			}
+		}
+	}
+	for k, v := range t.options.Env {
+		env = append(env, k+"="+v)
+	}
+	env = append(env,
+		"CLAUDE_CODE_ENTRYPOINT=sdk-go",
+		"CLAUDE_AGENT_SDK_VERSION="+Version,
+	)
+	if t.options.EnableFileCheckpointing {
+		env = append(env, "CLAUDE_CODE_ENABLE_SDK_FILE_CHECKPOINTING=true")
+	}
+	return env
+}
+
+// writeStdin writes data to stdin, giving up after WithWriteTimeout. A write
+// that times out may have been partly written, so stdin is closed to end it.
+func (t *subprocessTransport) writeStdin(data string) error {
+	var timeout time.Duration
+	if t.options != nil {
+		timeout = t.options.WriteTimeout
+	}
+	if timeout <= 0 {
+		_, err := io.WriteString(t.stdin, data)
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.WriteString(t.stdin, data)
+		done <- err
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		_ = t.stdin.Close()
+		return fmt.Errorf("CLI did not read %d bytes of input within %s", len(data), timeout)
+	}
+}
+
+// warnLargeInput logs when a single input message exceeds the configured size.
+func (t *subprocessTransport) warnLargeInput(size int) {
+	threshold := defaultLargeInputWarning
+	var logger Logger
+	if t.options != nil {
+		if t.options.LargeInputWarning != 0 {
+			threshold = t.options.LargeInputWarning
+		}
+		logger = t.options.Logger
+	}
+	if threshold > 0 && size > threshold {
+		loggerOr(logger).Warnf("Input message of %d bytes exceeds %d bytes; the CLI has no compressed input encoding, consider splitting it", size, threshold)
+	}
+}
+
+// isClosedPipe reports whether a stdin write failed because the other end is gone.
+func isClosedPipe(err error) bool {
+	return errors.Is(err, syscall.EPIPE) || errors.Is(err, io.ErrClosedPipe)
+}
+
 func (t *subprocessTransport) Messages() <-chan map[string]any {
 	return t.msgChan
 }
@@ -593,13 +938,34 @@ func (t *subprocessTransport) EndInput() error {
 	defer t.writeMu.Unlock()
 
 	if t.stdin != nil {
+		sentinelErr := t.writeEndInputSentinelLocked()
 		err := t.stdin.Close()
 		t.stdin = nil
+		if sentinelErr != nil {
+			return sentinelErr
+		}
 		return err
 	}
 	return nil
 }
 
+// writeEndInputSentinelLocked writes the configured end-of-input sentinel, if
+// any. The caller must hold writeMu and closes stdin regardless of the result.
+func (t *subprocessTransport) writeEndInputSentinelLocked() error {
+	if t.options == nil || t.options.EndInputSentinel == nil || t.options.InputFormat == InputFormatText {
+		return nil
+	}
+	data, err := json.Marshal(t.options.EndInputSentinel)
+	if err != nil {
+		return &SDKError{Message: "failed to marshal end-of-input sentinel", Cause: err}
+	}
+	t.dump.record(dumpOutbound, data)
+	if _, err := io.WriteString(t.stdin, string(data)+"\n"); err != nil {
+		return &CLIConnectionError{SDKError: SDKError{Message: "Failed to write end-of-input sentinel", Cause: err}}
+	}
+	return nil
+}
+
 func (t *subprocessTransport) IsReady() bool {
 	return t.ready
 }
@@ -618,13 +984,47 @@ func (t *subprocessTransport) Close() error {
 	}
 
 	if t.process != nil && t.process.Process != nil {
-		_ = t.process.Process.Kill()
-		_, _ = t.process.Process.Wait()
+		t.stopOnce.Do(t.awaitExit)
 	}
 
+	return t.dump.close()
+}
+
+// terminate asks the CLI to exit so it can flush transcripts and clean up,
+// falling back to a kill where the signal is unsupported (Windows).
+func (t *subprocessTransport) terminate() error {
+	sig := os.Signal(syscall.SIGTERM)
+	if runtime.GOOS == "windows" {
+		sig = os.Interrupt
+	}
+	if err := t.process.Process.Signal(sig); err != nil {
+		return t.process.Process.Kill()
+	}
 	return nil
 }
 
+// awaitExit waits up to the shutdown grace period for the process to exit
+// after terminate, then kills it.
+func (t *subprocessTransport) awaitExit() {
+	grace := defaultShutdownGrace
+	if t.options != nil && t.options.ShutdownGrace > 0 {
+		grace = t.options.ShutdownGrace
+	}
+	exited := make(chan struct{})
+	go func() {
+		_, _ = t.process.Process.Wait()
+		close(exited)
+	}()
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case <-exited:
+	case <-timer.C:
+		_ = t.process.Process.Kill()
+		<-exited
+	}
+}
+
 func (t *subprocessTransport) hasExtraArg(flag string) bool {
 	if t.options == nil || t.options.ExtraArgs == nil {
 		return false
@@ -2,12 +2,18 @@ package claude
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -133,6 +139,43 @@ func TestBuildCommandWithEffort(t *testing.T) {
 	}
 }
 
+func TestBuildCommandEffortMaxWithThinkingBudget(t *testing.T) {
+	budget := 4000
+	tests := []struct {
+		name       string
+		opts       *AgentOptions
+		wantBudget string // empty means no --max-thinking-tokens
+	}{
+		{name: "enabled budget wins", opts: &AgentOptions{Effort: EffortMax, Thinking: &ThinkingConfigEnabled{BudgetTokens: 16000}}, wantBudget: "16000"},
+		{name: "max thinking tokens wins", opts: &AgentOptions{Effort: EffortMax, MaxThinkingTokens: &budget}, wantBudget: "4000"},
+		{name: "adaptive with explicit cap", opts: &AgentOptions{Effort: EffortMax, Thinking: &ThinkingConfigAdaptive{}, MaxThinkingTokens: &budget}, wantBudget: "4000"},
+		{name: "adaptive drops default cap", opts: &AgentOptions{Effort: EffortMax, Thinking: &ThinkingConfigAdaptive{}}},
+		{name: "adaptive keeps default cap below max", opts: &AgentOptions{Effort: EffortHigh, Thinking: &ThinkingConfigAdaptive{}}, wantBudget: "32000"},
+		{name: "disabled wins", opts: &AgentOptions{Effort: EffortMax, Thinking: &ThinkingConfigDisabled{}}, wantBudget: "0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := newSubprocessTransport(tt.opts).buildCommand()
+			if got := flagValue(cmd, "--max-thinking-tokens"); got != tt.wantBudget {
+				t.Errorf("expected --max-thinking-tokens %q, got %q in %v", tt.wantBudget, got, cmd)
+			}
+			if got := flagValue(cmd, "--effort"); got != string(tt.opts.Effort) {
+				t.Errorf("expected --effort %q, got %q", tt.opts.Effort, got)
+			}
+		})
+	}
+}
+
+// flagValue returns the argument following flag in cmd, or "" if absent.
+func flagValue(cmd []string, flag string) string {
+	for i, arg := range cmd {
+		if arg == flag && i+1 < len(cmd) {
+			return cmd[i+1]
+		}
+	}
+	return ""
+}
+
 func TestBuildCommandWithContinue(t *testing.T) {
 	opts := &AgentOptions{ContinueConversation: true}
 	tr := newSubprocessTransport(opts)
@@ -170,6 +213,80 @@ func TestBuildCommandWithExtraArgs(t *testing.T) {
 	}
 }
 
+func TestBuildCommandInputFormat(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		want   string
+	}{
+		{name: "default", format: "", want: "--input-format stream-json"},
+		{name: "stream-json", format: InputFormatStreamJSON, want: "--input-format stream-json"},
+		{name: "text", format: InputFormatText, want: "--input-format text"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := newSubprocessTransport(&AgentOptions{InputFormat: tt.format})
+			cmdStr := strings.Join(tr.buildCommand(), " ")
+			if !strings.Contains(cmdStr, tt.want) {
+				t.Errorf("expected %q in command: %s", tt.want, cmdStr)
+			}
+			if strings.Count(cmdStr, "--input-format") != 1 {
+				t.Errorf("expected exactly one --input-format flag: %s", cmdStr)
+			}
+		})
+	}
+}
+
+func TestBuildCLIArgsMatchesInternalBuilder(t *testing.T) {
+	val := "1"
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{name: "defaults", opts: nil},
+		{name: "model and turns", opts: []Option{WithModel("claude-sonnet-4-5"), WithMaxTurns(3)}},
+		{name: "tools", opts: []Option{WithAllowedTools("Read", "Bash"), WithDisallowedTools("Write")}},
+		{name: "extra args", opts: []Option{WithExtraArgs(map[string]*string{"custom": &val})}},
+		{name: "thinking", opts: []Option{WithThinking(&ThinkingConfigEnabled{BudgetTokens: 8000}), WithEffort(EffortLow)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := append([]Option{WithCLIPath("/opt/claude")}, tt.opts...)
+			got, err := BuildCLIArgs(opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			want := newSubprocessTransport(applyOptions(opts)).buildCommand()
+			if strings.Join(got, "\x00") != strings.Join(want, "\x00") {
+				t.Errorf("BuildCLIArgs mismatch:\n got: %v\nwant: %v", got, want)
+			}
+			if got[0] != "/opt/claude" {
+				t.Errorf("expected CLI path as argv[0], got %q", got[0])
+			}
+		})
+	}
+}
+
+func TestBuildCLIArgsConfiguresPermissionPromptTool(t *testing.T) {
+	canUseTool := func(ctx context.Context, toolName string, input map[string]any, permCtx ToolPermissionContext) (PermissionResult, error) {
+		return &PermissionResultAllow{}, nil
+	}
+	args, err := BuildCLIArgs(WithCanUseTool(canUseTool))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(strings.Join(args, " "), "--permission-prompt-tool stdio") {
+		t.Errorf("expected stdio permission prompt tool: %v", args)
+	}
+
+	if _, err := BuildCLIArgs(WithCanUseTool(canUseTool), WithPermissionPromptToolName("mcp__x")); err == nil {
+		t.Error("expected error combining CanUseTool with a permission prompt tool")
+	}
+	if _, err := BuildCLIArgs(WithInputFormat("xml")); err == nil {
+		t.Error("expected error for unsupported input format")
+	}
+}
+
 func TestBuildSettingsValueEmpty(t *testing.T) {
 	tr := &subprocessTransport{options: &AgentOptions{}}
 	val := tr.buildSettingsValue()
@@ -238,6 +355,45 @@ func TestReadMessagesBufferOverflowReturnsError(t *testing.T) {
 	}
 }
 
+func TestReadMessagesAuthPromptPrelude(t *testing.T) {
+	tests := []struct {
+		name    string
+		prelude string
+	}{
+		{name: "login prompt", prelude: "Please log in to continue: run `claude login`"},
+		{name: "invalid api key", prelude: "Invalid API key · Please run /login"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The writer stays open, as with a CLI blocked waiting for input.
+			r, w := io.Pipe()
+			defer w.Close()
+			tr := newSubprocessTransport(&AgentOptions{})
+			tr.stdout = r
+			go func() { _, _ = io.WriteString(w, tt.prelude+"\n") }()
+
+			done := make(chan struct{})
+			go func() {
+				tr.readMessages(context.Background())
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(2 * time.Second):
+				t.Fatal("readMessages hung on an auth prompt")
+			}
+
+			var authErr *AuthenticationRequiredError
+			if err := <-tr.Errors(); !errors.As(err, &authErr) {
+				t.Fatalf("expected AuthenticationRequiredError, got %T (%v)", err, err)
+			}
+			if authErr.Prompt != tt.prelude {
+				t.Errorf("expected prompt %q, got %q", tt.prelude, authErr.Prompt)
+			}
+		})
+	}
+}
+
 func TestReadMessagesSkipsNonJSONPrelude(t *testing.T) {
 	opts := &AgentOptions{}
 	tr := newSubprocessTransport(opts)
@@ -264,6 +420,39 @@ func TestReadMessagesSkipsNonJSONPrelude(t *testing.T) {
 	}
 }
 
+func TestReadMessagesPreservesUnicode(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want string
+	}{
+		{name: "escaped unicode", line: `{"type":"text","text":"caf\u00e9 \ud83d\ude00 \u65e5\u672c"}`, want: "café 😀 日本"},
+		{name: "raw multibyte", line: `{"type":"text","text":"naïve 日本語 😀 — done"}`, want: "naïve 日本語 😀 — done"},
+		{name: "crlf line ending", line: "{\"type\":\"text\",\"text\":\"línea\"}\r", want: "línea"},
+		{name: "surrounding whitespace kept", line: `{"type":"text","text":"  \u00a0padded\u3000 "}`, want: "  \u00a0padded\u3000 "},
+		{name: "invalid byte replaced", line: "{\"type\":\"text\",\"text\":\"bad\xffbyte\"}", want: "bad\ufffdbyte"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := newSubprocessTransport(&AgentOptions{})
+			tr.stdout = io.NopCloser(strings.NewReader(tt.line + "\n"))
+
+			tr.readMessages(context.Background())
+
+			var got []map[string]any
+			for msg := range tr.Messages() {
+				got = append(got, msg)
+			}
+			if len(got) != 1 {
+				t.Fatalf("expected 1 parsed message, got %d (lastErr=%v)", len(got), tr.LastError())
+			}
+			if text, _ := got[0]["text"].(string); text != tt.want {
+				t.Errorf("text mismatch: got %q, want %q", text, tt.want)
+			}
+		})
+	}
+}
+
 func TestConnectContextDoesNotOwnTransportLifecycle(t *testing.T) {
 	if runtime.GOOS == "windows" {
 		t.Skip("shell script test")
@@ -296,3 +485,889 @@ func TestConnectContextDoesNotOwnTransportLifecycle(t *testing.T) {
 		t.Fatalf("close failed: %v", err)
 	}
 }
+
+// recordingStdin logs writes and the close call in order.
+type recordingStdin struct {
+	events []string
+}
+
+func (r *recordingStdin) Write(p []byte) (int, error) {
+	r.events = append(r.events, "write:"+string(p))
+	return len(p), nil
+}
+
+func (r *recordingStdin) Close() error {
+	r.events = append(r.events, "close")
+	return nil
+}
+
+func TestEndInputSentinel(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		want []string
+	}{
+		{name: "default closes only", want: []string{"close"}},
+		{
+			name: "sentinel before close",
+			opts: []Option{WithEndInputSentinel(map[string]any{"type": "end"})},
+			want: []string{"write:{\"type\":\"end\"}\n", "close"},
+		},
+		{
+			name: "text format skips sentinel",
+			opts: []Option{WithEndInputSentinel(map[string]any{"type": "end"}), WithInputFormat(InputFormatText)},
+			want: []string{"close"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdin := &recordingStdin{}
+			tr := &subprocessTransport{options: applyOptions(tt.opts), ready: true, stdin: stdin}
+			if err := tr.EndInput(); err != nil {
+				t.Fatalf("EndInput failed: %v", err)
+			}
+			if strings.Join(stdin.events, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("got events %q, want %q", stdin.events, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteBrokenPipeReturnsProcessExitedError(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("pipe semantics differ on windows")
+	}
+	tests := []struct {
+		name       string
+		close      func(r, w *os.File)
+		wantExited bool
+	}{
+		{name: "reader closed", close: func(r, w *os.File) { r.Close() }, wantExited: true},
+		// Our own end being closed says nothing about the process.
+		{name: "writer closed", close: func(r, w *os.File) { w.Close() }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, w, err := os.Pipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			defer w.Close()
+			tt.close(r, w)
+
+			tr := &subprocessTransport{ready: true, stdin: w}
+			err = tr.Write("{\"type\":\"user\"}\n")
+			var exited *ProcessExitedError
+			if got := errors.As(err, &exited); got != tt.wantExited {
+				t.Fatalf("expected ProcessExitedError=%v, got %v", tt.wantExited, err)
+			}
+			var connErr *CLIConnectionError
+			if !errors.As(err, &connErr) {
+				t.Errorf("expected error to remain a CLIConnectionError, got %T", err)
+			}
+			if tr.IsReady() {
+				t.Error("expected transport to be marked not ready")
+			}
+		})
+	}
+}
+
+func TestProcessErrorIncludesStderrTail(t *testing.T) {
+	// Over 64KB of noise, then the diagnostic that matters.
+	cli := writeFakeCLI(t, `#!/bin/sh
+i=0
+while [ $i -lt 1200 ]; do
+  echo "noise line $i padded to be long enough to overflow the tail buffer" >&2
+  i=$((i+1))
+done
+echo "fatal: model not available" >&2
+exit 3
+`)
+	tr := newSubprocessTransport(applyOptions([]Option{WithCLIPath(cli)}))
+	if err := tr.Connect(context.Background()); err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+	defer tr.Close()
+	for range tr.Messages() {
+	}
+
+	var procErr *ProcessError
+	if !errors.As(tr.LastError(), &procErr) {
+		t.Fatalf("expected ProcessError, got %v", tr.LastError())
+	}
+	if procErr.ExitCode != 3 {
+		t.Errorf("expected exit code 3, got %d", procErr.ExitCode)
+	}
+	if !strings.HasSuffix(procErr.Stderr, "fatal: model not available") {
+		t.Errorf("expected stderr to end with the diagnostic, got ...%q", procErr.Stderr[max(0, len(procErr.Stderr)-80):])
+	}
+	if strings.Contains(procErr.Stderr, "noise line 0 ") || len(procErr.Stderr) > stderrTailSize {
+		t.Errorf("expected stderr to be bounded to the tail, got %d bytes", len(procErr.Stderr))
+	}
+	if !strings.Contains(procErr.Error(), "fatal: model not available") {
+		t.Errorf("expected the diagnostic in the error message, got %q", procErr.Error())
+	}
+}
+
+func TestStderrTailKeepsOverlongLine(t *testing.T) {
+	var tail stderrTail
+	tail.add("first")
+	tail.add(strings.Repeat("x", stderrTailSize+10) + "end")
+	if got := tail.String(); len(got) != stderrTailSize || !strings.HasSuffix(got, "end") {
+		t.Errorf("expected the last %d bytes of the overlong line, got %d bytes", stderrTailSize, len(got))
+	}
+}
+
+func TestReadStderrDrainsAfterOverlongLine(t *testing.T) {
+	r, w := io.Pipe()
+	logger := &recordingLogger{}
+	tr := &subprocessTransport{
+		options:    &AgentOptions{Logger: logger},
+		stderr:     r,
+		stderrDone: make(chan struct{}),
+	}
+	go tr.readStderr()
+
+	written := make(chan error, 1)
+	go func() {
+		_, err := io.WriteString(w, strings.Repeat("x", 2*1024*1024)+"\nstill writing\n")
+		_ = w.Close()
+		written <- err
+	}()
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("stderr was not drained after an overlong line")
+	}
+	<-tr.stderrDone
+	if lines := logger.get(); len(lines) != 1 || !strings.Contains(lines[0], "Stopped reading CLI stderr") {
+		t.Errorf("expected one warning about stderr, got %q", lines)
+	}
+}
+
+func TestBuildCLIArgsAllowAllSDKTools(t *testing.T) {
+	noop := func(ctx context.Context, args map[string]any) (MCPToolResult, error) { return MCPToolResult{}, nil }
+	calc := CreateSdkMcpServer("calc", "1.0.0", NewMCPTool("add", "", nil, noop), NewMCPTool("sqrt", "", nil, noop))
+	kv := CreateSdkMcpServer("kv", "1.0.0", NewMCPTool("get", "", nil, noop))
+
+	args, err := BuildCLIArgs(
+		WithAllowedTools("Read", "mcp__calc__add"),
+		WithMcpServers(map[string]McpServerConfig{
+			"kv":     kv,
+			"calc":   calc,
+			"remote": &McpStdioServerConfig{Command: "remote-mcp"},
+		}),
+		WithAllowAllSDKTools(),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var allowed string
+	for i, arg := range args {
+		if arg == "--allowedTools" && i+1 < len(args) {
+			allowed = args[i+1]
+		}
+	}
+	want := "Read,mcp__calc__add,mcp__calc__sqrt,mcp__kv__get"
+	if allowed != want {
+		t.Errorf("expected --allowedTools %q, got %q", want, allowed)
+	}
+}
+
+func TestWriteWarnsOnLargeInput(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     []Option
+		size     int
+		wantWarn bool
+	}{
+		{name: "under default", size: 1024},
+		{name: "over default", size: defaultLargeInputWarning + 1, wantWarn: true},
+		{name: "over custom", opts: []Option{WithLargeInputWarning(100)}, size: 101, wantWarn: true},
+		{name: "disabled", opts: []Option{WithLargeInputWarning(-1)}, size: defaultLargeInputWarning + 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := &recordingLogger{}
+			tr := &subprocessTransport{options: applyOptions(append(tt.opts, WithLogger(logger))), ready: true, stdin: &recordingStdin{}}
+			if err := tr.Write(strings.Repeat("x", tt.size)); err != nil {
+				t.Fatalf("write failed: %v", err)
+			}
+			logs := strings.Join(logger.get(), "\n")
+			if got := strings.Contains(logs, "consider splitting it"); got != tt.wantWarn {
+				t.Errorf("expected warning=%v, got log %q", tt.wantWarn, logs)
+			}
+		})
+	}
+}
+
+func TestBuildEnv(t *testing.T) {
+	parent := []string{"PATH=/usr/bin", "HOME=/home/dev", "AWS_SECRET_ACCESS_KEY=hunter2", "HTTPS_PROXY=http://proxy:3128", "Path=C:\\bin"}
+	tests := []struct {
+		name    string
+		opts    []Option
+		goos    string
+		want    []string
+		notWant []string
+	}{
+		{
+			name: "inherits everything by default",
+			goos: "linux",
+			want: []string{"AWS_SECRET_ACCESS_KEY=hunter2", "HTTPS_PROXY=http://proxy:3128", "CLAUDE_CODE_ENTRYPOINT=sdk-go"},
+		},
+		{
+			name:    "clean env keeps the allowlist and required variables",
+			opts:    []Option{WithCleanEnv("HTTPS_PROXY"), WithEnv(map[string]string{"ANTHROPIC_API_KEY": "sk-test"})},
+			goos:    "linux",
+			want:    []string{"PATH=/usr/bin", "HOME=/home/dev", "HTTPS_PROXY=http://proxy:3128", "ANTHROPIC_API_KEY=sk-test", "CLAUDE_CODE_ENTRYPOINT=sdk-go", "CLAUDE_AGENT_SDK_VERSION=" + Version},
+			notWant: []string{"AWS_SECRET_ACCESS_KEY=hunter2", "Path=C:\\bin"},
+		},
+		{
+			name:    "clean env matches Windows names case-insensitively",
+			opts:    []Option{WithCleanEnv()},
+			goos:    "windows",
+			want:    []string{"Path=C:\\bin"},
+			notWant: []string{"AWS_SECRET_ACCESS_KEY=hunter2", "HTTPS_PROXY=http://proxy:3128"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newSubprocessTransport(applyOptions(tt.opts)).buildEnv(parent, tt.goos)
+			for _, kv := range tt.want {
+				if !slices.Contains(env, kv) {
+					t.Errorf("expected %q in env %v", kv, env)
+				}
+			}
+			for _, kv := range tt.notWant {
+				if slices.Contains(env, kv) {
+					t.Errorf("expected %q to be absent from env %v", kv, env)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	// Nothing reads the pipe, so the first write blocks like a stalled CLI.
+	_, stdin := io.Pipe()
+	tr := &subprocessTransport{options: applyOptions([]Option{WithWriteTimeout(20 * time.Millisecond)}), ready: true, stdin: stdin}
+
+	start := time.Now()
+	err := tr.Write(`{"type":"user"}` + "\n")
+	var connErr *CLIConnectionError
+	if !errors.As(err, &connErr) || !strings.Contains(err.Error(), "did not read") {
+		t.Fatalf("expected a CLIConnectionError for the stalled write, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("write took %s, expected it to give up after the timeout", elapsed)
+	}
+	if tr.IsReady() {
+		t.Error("expected the transport to be not ready after a timed-out write")
+	}
+	if err := tr.Write(`{"type":"user"}` + "\n"); err == nil || !strings.Contains(err.Error(), "not ready") {
+		t.Errorf("expected later writes to be refused, got %v", err)
+	}
+}
+
+func TestBuildCommandAddDirs(t *testing.T) {
+	existing := t.TempDir()
+	file := filepath.Join(existing, "file.txt")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(existing, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		opts     []Option
+		wantDirs []string
+		wantErr  bool
+	}{
+		{
+			name:     "duplicates collapsed",
+			opts:     []Option{WithAddDirs("/tmp/a", "/tmp/b", "/tmp/a/", "/tmp/./b")},
+			wantDirs: []string{"/tmp/a", "/tmp/b"},
+		},
+		{
+			name:     "missing dir passes without strict mode",
+			opts:     []Option{WithAddDirs("/nonexistent/dir")},
+			wantDirs: []string{"/nonexistent/dir"},
+		},
+		{
+			name:     "strict mode accepts existing dir",
+			opts:     []Option{WithAddDirs(existing), WithStrictAddDirs()},
+			wantDirs: []string{existing},
+		},
+		{name: "strict mode rejects missing dir", opts: []Option{WithAddDirs(existing, "/nonexistent/dir"), WithStrictAddDirs()}, wantErr: true},
+		{name: "strict mode rejects file", opts: []Option{WithAddDirs(file), WithStrictAddDirs()}, wantErr: true},
+		{
+			name:     "strict mode resolves relative dir against cwd",
+			opts:     []Option{WithAddDirs("sub"), WithCwd(existing), WithStrictAddDirs()},
+			wantDirs: []string{"sub"},
+		},
+		{name: "strict mode rejects relative dir missing from cwd", opts: []Option{WithAddDirs("examples"), WithCwd(existing), WithStrictAddDirs()}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args, err := BuildCLIArgs(tt.opts...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var dirs []string
+			for i, arg := range args {
+				if arg == "--add-dir" {
+					dirs = append(dirs, args[i+1])
+				}
+			}
+			if strings.Join(dirs, ",") != strings.Join(tt.wantDirs, ",") {
+				t.Errorf("expected --add-dir %v, got %v", tt.wantDirs, dirs)
+			}
+		})
+	}
+}
+
+// fakeCLIScript acknowledges every control request with an empty success
+// response and answers every other input line with a success result.
+const fakeCLIScript = `#!/bin/sh
+while IFS= read -r line; do
+  id=$(printf '%s' "$line" | sed -n 's/.*"request_id":"\([^"]*\)".*/\1/p')
+  if [ -n "$id" ]; then
+    echo "{\"type\":\"control_response\",\"response\":{\"subtype\":\"success\",\"request_id\":\"$id\",\"response\":{}}}"
+  else
+    echo '{"type":"result","subtype":"success","duration_ms":1,"duration_api_ms":1,"is_error":false,"num_turns":1,"session_id":"sess-1"}'
+  fi
+done
+`
+
+// writeFakeCLI writes an executable script to a temp dir and returns its path.
+func writeFakeCLI(t *testing.T, script string) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("shell script test")
+	}
+	cli := filepath.Join(t.TempDir(), "claude")
+	if err := os.WriteFile(cli, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return cli
+}
+
+func TestFindCLIWindowsExtensions(t *testing.T) {
+	if runtime.GOOS != "windows" {
+		t.Skip("Windows executable resolution")
+	}
+	tests := []struct {
+		name    string
+		pathext string
+		onPath  string
+		want    string
+	}{
+		{name: "npm shim", pathext: ".COM;.EXE;.BAT;.CMD", onPath: "claude.cmd", want: `C:\npm\claude.cmd`},
+		{name: "native exe", pathext: ".COM;.EXE;.BAT;.CMD", onPath: "claude.exe", want: `C:\npm\claude.exe`},
+		{name: "cmd missing from PATHEXT", pathext: ".COM;.EXE", onPath: "claude.cmd", want: `C:\npm\claude.cmd`},
+		{name: "default PATHEXT", onPath: "claude.cmd", want: `C:\npm\claude.cmd`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var looked []string
+			got, _ := cliLookup{
+				goos: "windows",
+				home: `C:\Users\dev`,
+				getenv: func(key string) string {
+					if key == "PATHEXT" {
+						return tt.pathext
+					}
+					return ""
+				},
+				lookPath: func(file string) (string, error) {
+					looked = append(looked, file)
+					if file == tt.onPath {
+						return `C:\npm\` + file, nil
+					}
+					return "", errors.New("not found")
+				},
+				isFile: func(string) bool { return false },
+			}.find()
+			if got != tt.want {
+				t.Errorf("expected %q, got %q (looked up %v)", tt.want, got, looked)
+			}
+			for _, name := range looked {
+				if name == "claude" {
+					t.Errorf("expected only names with an extension, looked up %v", looked)
+				}
+			}
+		})
+	}
+}
+
+func TestFindCLIWindowsNpmLocation(t *testing.T) {
+	if runtime.GOOS != "windows" {
+		t.Skip("Windows install locations")
+	}
+	appData := t.TempDir()
+	shim := filepath.Join(appData, "npm", "claude.cmd")
+	got, _ := cliLookup{
+		goos: "windows",
+		home: t.TempDir(),
+		getenv: func(key string) string {
+			if key == "APPDATA" {
+				return appData
+			}
+			return ""
+		},
+		lookPath: func(string) (string, error) { return "", errors.New("not found") },
+		isFile:   func(path string) bool { return path == shim },
+	}.find()
+	if got != shim {
+		t.Errorf("expected %q, got %q", shim, got)
+	}
+}
+
+func TestFindCLIUnixLocations(t *testing.T) {
+	home := "/home/dev"
+	want := filepath.Join(home, ".local/bin/claude")
+	var looked []string
+	got, _ := cliLookup{
+		goos:   "linux",
+		home:   home,
+		getenv: func(string) string { return "" },
+		lookPath: func(file string) (string, error) {
+			looked = append(looked, file)
+			return "", errors.New("not found")
+		},
+		isFile: func(path string) bool { return path == want },
+	}.find()
+	if got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+	if len(looked) != 1 || looked[0] != "claude" {
+		t.Errorf("expected a single PATH lookup of claude, got %v", looked)
+	}
+}
+
+func TestFindCLIEnvOverride(t *testing.T) {
+	const pinned = "/opt/claude/bin/claude"
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    string
+		wantErr bool
+	}{
+		{name: "unset", want: "/usr/bin/claude"},
+		{name: "valid override", env: map[string]string{"CLAUDE_CODE_CLI": pinned}, want: pinned},
+		{name: "legacy variable", env: map[string]string{"CLAUDE_CLI_PATH": pinned}, want: pinned},
+		{name: "first variable wins", env: map[string]string{"CLAUDE_CODE_CLI": pinned, "CLAUDE_CLI_PATH": "/elsewhere/claude"}, want: pinned},
+		{name: "missing override", env: map[string]string{"CLAUDE_CODE_CLI": "/opt/missing/claude"}, want: "/opt/missing/claude", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := cliLookup{
+				goos:     "linux",
+				home:     "/home/dev",
+				getenv:   func(key string) string { return tt.env[key] },
+				lookPath: func(file string) (string, error) { return "/usr/bin/" + file, nil },
+				isFile:   func(path string) bool { return path == pinned },
+			}.find()
+			if got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+			var notFound *CLINotFoundError
+			if tt.wantErr {
+				if !errors.As(err, &notFound) || notFound.CLIPath != tt.want || notFound.EnvVar != "CLAUDE_CODE_CLI" || !strings.Contains(err.Error(), "CLAUDE_CODE_CLI="+tt.want) {
+					t.Errorf("expected a CLINotFoundError naming %s, got %v", tt.want, err)
+				}
+			} else if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestConnectReportsMissingCLIOverride(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "claude")
+	t.Setenv("CLAUDE_CODE_CLI", missing)
+	err := newSubprocessTransport(&AgentOptions{}).Connect(context.Background())
+	var notFound *CLINotFoundError
+	if !errors.As(err, &notFound) || notFound.CLIPath != missing {
+		t.Errorf("expected a CLINotFoundError for %s, got %v", missing, err)
+	}
+}
+
+func TestCloseTerminatesGracefully(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "terminated")
+	cli := writeFakeCLI(t, `#!/bin/sh
+trap 'echo flushed > "`+marker+`"; exit 0' TERM
+echo '{"type":"system","subtype":"trap_installed"}'
+while :; do sleep 0.01; done
+`)
+	tr := newSubprocessTransport(&AgentOptions{CLIPath: cli, ShutdownGrace: 5 * time.Second})
+	if err := tr.Connect(context.Background()); err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+	waitForMessage(t, tr)
+
+	start := time.Now()
+	if err := tr.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected Close to return once the CLI exited, took %v", elapsed)
+	}
+	if data, err := os.ReadFile(marker); err != nil || strings.TrimSpace(string(data)) != "flushed" {
+		t.Errorf("expected the CLI to handle SIGTERM, marker: %q, %v", data, err)
+	}
+	if err := tr.Close(); err != nil {
+		t.Errorf("second close failed: %v", err)
+	}
+}
+
+func TestCloseKillsAfterShutdownGrace(t *testing.T) {
+	cli := writeFakeCLI(t, `#!/bin/sh
+trap '' TERM
+echo '{"type":"system","subtype":"trap_installed"}'
+while :; do sleep 0.01; done
+`)
+	grace := 100 * time.Millisecond
+	tr := newSubprocessTransport(&AgentOptions{CLIPath: cli, ShutdownGrace: grace})
+	if err := tr.Connect(context.Background()); err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+	waitForMessage(t, tr)
+
+	done := make(chan struct{})
+	start := time.Now()
+	go func() {
+		_ = tr.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close blocked on a process ignoring SIGTERM")
+	}
+	if elapsed := time.Since(start); elapsed < grace {
+		t.Errorf("expected Close to wait the grace period, returned after %v", elapsed)
+	}
+	if err := tr.process.Process.Signal(syscall.Signal(0)); err == nil {
+		t.Error("expected the process to be killed after the grace period")
+	}
+}
+
+func TestQueryCancelStopsSubprocess(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	// Answers control requests and starts a turn on the prompt, then keeps
+	// working after stdin closes without ever finishing the turn.
+	cli := writeFakeCLI(t, `#!/bin/sh
+echo $$ > "`+pidFile+`"
+while IFS= read -r line; do
+  id=$(printf '%s' "$line" | sed -n 's/.*"request_id":"\([^"]*\)".*/\1/p')
+  if [ -n "$id" ]; then
+    echo "{\"type\":\"control_response\",\"response\":{\"subtype\":\"success\",\"request_id\":\"$id\",\"response\":{}}}"
+  else
+    echo '{"type":"assistant","message":{"model":"claude-sonnet-4-5","content":[{"type":"text","text":"thinking"}]}}'
+  fi
+done
+while :; do sleep 0.01; done
+`)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	msgs, errs := Query(ctx, "hello", WithCLIPath(cli), WithShutdownGrace(time.Second))
+	select {
+	case <-msgs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the first message")
+	}
+
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		for range msgs {
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Query kept reading after its context was cancelled")
+	}
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatalf("fake CLI wrote no pid: %v", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatalf("bad pid %q: %v", data, err)
+	}
+	proc, _ := os.FindProcess(pid)
+	if err := proc.Signal(syscall.Signal(0)); err == nil {
+		t.Errorf("expected the CLI process %d to be gone after cancellation", pid)
+	}
+}
+
+func TestTransportLifetimeCancelStopsReader(t *testing.T) {
+	cli := writeFakeCLI(t, `#!/bin/sh
+echo '{"type":"assistant","message":{"model":"claude-sonnet-4-5","content":[{"type":"text","text":"thinking"}]}}'
+while :; do sleep 0.01; done
+`)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tr := newSubprocessTransport(applyOptions([]Option{WithCLIPath(cli), WithShutdownGrace(time.Second)}))
+	tr.lifetime = ctx
+	if err := tr.Connect(context.Background()); err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+	defer tr.Close()
+	waitForMessage(t, tr)
+
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		for range tr.Messages() {
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("readMessages kept running after the lifetime context was cancelled")
+	}
+}
+
+// waitForMessage blocks until the fake CLI behind tr writes its first message.
+func waitForMessage(t *testing.T, tr *subprocessTransport) {
+	t.Helper()
+	select {
+	case <-tr.Messages():
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the fake CLI")
+	}
+}
+
+// memoryTransport is an in-process stand-in for the CLI: it acknowledges
+// control requests and answers each user message with an echo and a result.
+type memoryTransport struct {
+	mu      sync.Mutex
+	msgChan chan map[string]any
+	errChan chan error
+	done    bool
+	prompts []any
+}
+
+func newMemoryTransport() *memoryTransport {
+	return &memoryTransport{msgChan: make(chan map[string]any, 16), errChan: make(chan error, 1)}
+}
+
+func (m *memoryTransport) Write(data string) error {
+	var msg map[string]any
+	if err := json.Unmarshal([]byte(data), &msg); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.done {
+		return errors.New("transport closed")
+	}
+	switch msg["type"] {
+	case "control_request":
+		m.msgChan <- map[string]any{
+			"type":     "control_response",
+			"response": map[string]any{"subtype": "success", "request_id": msg["request_id"], "response": map[string]any{}},
+		}
+	case "user":
+		content := msg["message"].(map[string]any)["content"]
+		m.prompts = append(m.prompts, content)
+		m.msgChan <- map[string]any{
+			"type":       "assistant",
+			"session_id": "mem-1",
+			"message": map[string]any{
+				"model":   "claude-sonnet-4-5",
+				"content": []any{map[string]any{"type": "text", "text": fmt.Sprint("echo: ", content)}},
+			},
+		}
+		m.msgChan <- map[string]any{
+			"type": "result", "subtype": "success", "is_error": false, "session_id": "mem-1",
+			"duration_ms": float64(1), "duration_api_ms": float64(1), "num_turns": float64(1),
+		}
+	}
+	return nil
+}
+
+func (m *memoryTransport) finish() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.done {
+		m.done = true
+		close(m.msgChan)
+	}
+	return nil
+}
+
+func (m *memoryTransport) Messages() <-chan map[string]any { return m.msgChan }
+func (m *memoryTransport) Errors() <-chan error            { return m.errChan }
+func (m *memoryTransport) LastError() error                { return nil }
+func (m *memoryTransport) EndInput() error                 { return m.finish() }
+func (m *memoryTransport) Close() error                    { return m.finish() }
+func (m *memoryTransport) IsReady() bool                   { return true }
+
+func TestClientWithTransport(t *testing.T) {
+	mem := newMemoryTransport()
+	client := NewClient(WithTransport(mem), WithCLIPath("/nonexistent/claude"))
+	ctx := context.Background()
+	if err := client.Connect(ctx); err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+	defer client.Close()
+
+	if err := client.Query(ctx, "hello"); err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	msgs, errs := client.ReceiveResponseWithErrors(ctx)
+	var text string
+	var result *ResultMessage
+	for msg := range msgs {
+		switch m := msg.(type) {
+		case *AssistantMessage:
+			text = m.Content[0].(*TextBlock).Text
+		case *ResultMessage:
+			result = m
+		}
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if text != "echo: hello" || result == nil || result.SessionID != "mem-1" {
+		t.Errorf("unexpected response: text %q, result %+v", text, result)
+	}
+}
+
+func TestWithTransportRejectsReuse(t *testing.T) {
+	ctx := context.Background()
+	client := NewClient(WithTransport(newMemoryTransport()), WithCLIPath("/nonexistent/claude"))
+	if err := client.Connect(ctx); err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+	_ = client.Close()
+	if err := client.Connect(ctx); !errors.Is(err, ErrTransportReused) {
+		client.Close()
+		t.Errorf("expected ErrTransportReused on reconnect, got %v", err)
+	}
+
+	pool := NewClientPool(2, 0, WithTransport(newMemoryTransport()), WithCLIPath("/nonexistent/claude"))
+	defer pool.Close()
+	_, release, err := pool.Acquire(ctx)
+	if err != nil {
+		t.Fatalf("acquire failed: %v", err)
+	}
+	defer release()
+	if _, _, err := pool.Acquire(ctx); !errors.Is(err, ErrTransportReused) {
+		t.Errorf("expected ErrTransportReused for a second pooled client, got %v", err)
+	}
+}
+
+func TestQueryWithTransport(t *testing.T) {
+	mem := newMemoryTransport()
+	msgs, errs := Query(context.Background(), "ping", WithTransport(mem), WithCLIPath("/nonexistent/claude"))
+	var got []Message
+	for msg := range msgs {
+		got = append(got, msg)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected assistant and result messages, got %d", len(got))
+	}
+	if len(mem.prompts) != 1 || mem.prompts[0] != "ping" {
+		t.Errorf("expected the prompt to reach the transport, got %v", mem.prompts)
+	}
+}
+
+// permissionTransport asks for permission to run a tool before answering the
+// prompt, and fails the exchange if stdin is closed before the answer arrives.
+type permissionTransport struct {
+	*memoryTransport
+	prompt   string
+	answered bool
+	decision any
+}
+
+func (p *permissionTransport) Write(data string) error {
+	var msg map[string]any
+	if err := json.Unmarshal([]byte(data), &msg); err != nil {
+		return err
+	}
+	switch msg["type"] {
+	case "user":
+		p.mu.Lock()
+		p.prompt = data
+		p.mu.Unlock()
+		p.msgChan <- map[string]any{
+			"type":       "control_request",
+			"request_id": "perm_1",
+			"request":    map[string]any{"subtype": "can_use_tool", "tool_name": "Bash", "input": map[string]any{"command": "ls"}},
+		}
+		return nil
+	case "control_response":
+		response, _ := msg["response"].(map[string]any)
+		if response["request_id"] != "perm_1" {
+			return nil
+		}
+		p.mu.Lock()
+		p.answered = true
+		p.decision = response["response"]
+		prompt := p.prompt
+		p.mu.Unlock()
+		return p.memoryTransport.Write(prompt)
+	}
+	return p.memoryTransport.Write(data)
+}
+
+func (p *permissionTransport) EndInput() error {
+	p.mu.Lock()
+	answered := p.answered
+	p.mu.Unlock()
+	if !answered {
+		p.errChan <- errors.New("stdin closed before the permission request was answered")
+	}
+	return p.finish()
+}
+
+func TestQueryWithCanUseTool(t *testing.T) {
+	tr := &permissionTransport{memoryTransport: newMemoryTransport()}
+	var asked string
+	canUseTool := func(ctx context.Context, toolName string, input map[string]any, permCtx ToolPermissionContext) (PermissionResult, error) {
+		asked = toolName
+		return &PermissionResultAllow{}, nil
+	}
+	msgs, errs := Query(context.Background(), "list files", WithTransport(tr), WithCLIPath("/nonexistent/claude"), WithCanUseTool(canUseTool))
+	var result *ResultMessage
+	for msg := range msgs {
+		if r, ok := msg.(*ResultMessage); ok {
+			result = r
+		}
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if asked != "Bash" {
+		t.Errorf("expected the callback to be asked about Bash, got %q", asked)
+	}
+	decision, _ := tr.decision.(map[string]any)
+	if decision["behavior"] != "allow" {
+		t.Errorf("expected an allow decision, got %v", tr.decision)
+	}
+	if result == nil || len(tr.prompts) != 1 || tr.prompts[0] != "list files" {
+		t.Errorf("expected the prompt to be answered, got result %v and prompts %v", result, tr.prompts)
+	}
+}
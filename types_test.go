@@ -324,6 +324,35 @@ func TestPermissionResultAllow(t *testing.T) {
 	}
 }
 
+func TestAllowForSession(t *testing.T) {
+	allow := AllowForSession("Bash", "npm test:*")
+	if allow.UpdatedInput != nil {
+		t.Errorf("expected no updated input, got %v", allow.UpdatedInput)
+	}
+	if len(allow.UpdatedPermissions) != 1 {
+		t.Fatalf("expected 1 updated permission, got %d", len(allow.UpdatedPermissions))
+	}
+
+	d := allow.UpdatedPermissions[0].ToDict()
+	want := map[string]any{
+		"type":        "addRules",
+		"behavior":    "allow",
+		"destination": "session",
+	}
+	for key, value := range want {
+		if d[key] != value {
+			t.Errorf("expected %s %q, got %v", key, value, d[key])
+		}
+	}
+	rules, ok := d["rules"].([]map[string]any)
+	if !ok || len(rules) != 1 {
+		t.Fatalf("unexpected rules: %v", d["rules"])
+	}
+	if rules[0]["toolName"] != "Bash" || rules[0]["ruleContent"] != "npm test:*" {
+		t.Errorf("unexpected rule: %v", rules[0])
+	}
+}
+
 func TestPermissionResultDeny(t *testing.T) {
 	deny := &PermissionResultDeny{
 		Message:   "not allowed",
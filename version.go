@@ -0,0 +1,78 @@
+package claude
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseVersion parses a dotted numeric version such as "2.0.14". A leading
+// "v", pre-release or build suffixes ("-beta.1", "+abc") and trailing text
+// after a space ("2.0.14 (Claude Code)") are ignored.
+func parseVersion(version string) ([]int, error) {
+	s := strings.TrimSpace(version)
+	if i := strings.IndexByte(s, ' '); i >= 0 {
+		s = s[:i]
+	}
+	s = strings.TrimPrefix(s, "v")
+	if i := strings.IndexAny(s, "-+"); i >= 0 {
+		s = s[:i]
+	}
+	parts := strings.Split(s, ".")
+	nums := make([]int, len(parts))
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("malformed version %q", version)
+		}
+		nums[i] = n
+	}
+	return nums, nil
+}
+
+// compareVersions returns -1, 0 or 1 as a is lower than, equal to or higher
+// than b. Missing components count as zero, so "2.0" equals "2.0.0".
+func compareVersions(a, b string) (int, error) {
+	va, err := parseVersion(a)
+	if err != nil {
+		return 0, err
+	}
+	vb, err := parseVersion(b)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < len(va) || i < len(vb); i++ {
+		var x, y int
+		if i < len(va) {
+			x = va[i]
+		}
+		if i < len(vb) {
+			y = vb[i]
+		}
+		if x != y {
+			if x < y {
+				return -1, nil
+			}
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+// checkCLIVersion reports an error when version is below
+// MinimumClaudeCodeVersion or cannot be parsed.
+func checkCLIVersion(version string) error {
+	cmp, err := compareVersions(version, MinimumClaudeCodeVersion)
+	if err != nil {
+		return &CLIConnectionError{SDKError: SDKError{
+			Message: fmt.Sprintf("cannot check Claude Code version %q against minimum %s; use WithSkipVersionCheck to connect anyway", version, MinimumClaudeCodeVersion),
+			Cause:   err,
+		}}
+	}
+	if cmp < 0 {
+		return &CLIConnectionError{SDKError: SDKError{
+			Message: fmt.Sprintf("Claude Code %s is older than the minimum supported version %s; upgrade with: npm install -g @anthropic-ai/claude-code", version, MinimumClaudeCodeVersion),
+		}}
+	}
+	return nil
+}
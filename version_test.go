@@ -0,0 +1,31 @@
+package claude
+
+import "testing"
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b    string
+		want    int
+		wantErr bool
+	}{
+		{a: "2.0.0", b: "2.0.0", want: 0},
+		{a: "2.0", b: "2.0.0", want: 0},
+		{a: "2.0.14", b: "2.0.9", want: 1},
+		{a: "1.9.99", b: "2.0.0", want: -1},
+		{a: "v2.1.0", b: "2.0.0", want: 1},
+		{a: "2.0.1 (Claude Code)", b: "2.0.0", want: 1},
+		{a: "2.0.0-beta.1", b: "2.0.0", want: 0},
+		{a: "", b: "2.0.0", wantErr: true},
+		{a: "2.x", b: "2.0.0", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := compareVersions(tt.a, tt.b)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("compareVersions(%q, %q) error = %v, wantErr %v", tt.a, tt.b, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}